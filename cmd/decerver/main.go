@@ -35,5 +35,9 @@ func main() {
 		os.Exit(1)
 	}
 	
-	dc.Shutdown()
+	errShutdown := dc.Shutdown()
+	if errShutdown != nil {
+		fmt.Printf("Shutdown was not clean: %s\n", errShutdown.Error())
+		os.Exit(1)
+	}
 }
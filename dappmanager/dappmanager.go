@@ -7,8 +7,10 @@ import (
 	// "encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/dapps"
 	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/events"
 	"github.com/eris-ltd/decerver/interfaces/files"
 	"github.com/eris-ltd/decerver/interfaces/logging"
 	"github.com/eris-ltd/decerver/interfaces/modules"
@@ -18,7 +20,6 @@ import (
 	"github.com/eris-ltd/epm-go/utils"
 	// "github.com/syndtr/goleveldb/leveldb"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strconv"
@@ -28,7 +29,7 @@ import (
 	"github.com/robertkrimen/otto/parser"
 )
 
-var logger *log.Logger = logging.NewLogger("Dapp Manager")
+var logger *logging.Logger = logging.NewLogger("Dapp Manager")
 
 // const REG_URL = "http://localhost:9999"
 
@@ -56,14 +57,21 @@ func newDapp() *Dapp {
 }
 
 type DappManager struct {
-	mutex       *sync.Mutex
-	keys        map[string]string
+	mutex *sync.Mutex
+	keys  map[string]string
+	// Guarded by the dapps mutex, since it is read from api requests while
+	// dapps are removed. The mutex above is held (first) when it is written.
+	dappsMutex  *sync.RWMutex
 	dapps       map[string]dapps.Dapp
 	rm          scripting.RuntimeManager
 	server      network.Server
 	runningDapp dapps.Dapp
 	mm          modules.ModuleManager
 	fio         files.FileIO
+	ep          events.EventProcessor
+	perms       *permissionStore
+	quotas      *scripting.Quotas
+	rateLimits  *dapps.RateLimits
 	//	hashDB *leveldb.DB
 }
 
@@ -72,10 +80,15 @@ func NewDappManager(dc decerver.Decerver) dapps.DappManager {
 	dm.keys = make(map[string]string)
 	dm.dapps = make(map[string]dapps.Dapp)
 	dm.mutex = &sync.Mutex{}
+	dm.dappsMutex = &sync.RWMutex{}
 	dm.rm = dc.RuntimeManager()
 	dm.mm = dc.ModuleManager()
 	dm.server = dc.Server()
 	dm.fio = dc.FileIO()
+	dm.ep = dc.EventProcessor()
+	dm.perms = newPermissionStore(dm.fio, dc.Config().RequirePermissionApproval)
+	dm.quotas = dc.Config().Quotas
+	dm.rateLimits = dc.Config().RateLimits
 	return dm
 }
 
@@ -132,7 +145,14 @@ func (dm *DappManager) RegisterDapp(dir string) {
 		return
 	}
 
-	idxDir := path.Join(dir, dapps.INDEX_FILE_NAME)
+	// The id is used in the routes, so it is checked before anything else.
+	if errId := checkDappId(packageFile.Id); errId != nil {
+		logger.Printf("Bad id for dapp '%s'. Skipping...\n", dir)
+		logger.Println(errId.Error())
+		return
+	}
+
+	idxDir := path.Join(dapps.StaticDir(dir, packageFile), dapps.INDEX_FILE_NAME)
 	_, errIf := os.Stat(idxDir)
 
 	if errIf != nil {
@@ -278,34 +298,88 @@ func (dm *DappManager) RegisterDapp(dir string) {
 		}
 	*/
 
-	dm.dapps[packageFile.Id] = dapp
+	errS := dm.server.SetStaticFiles(packageFile.Id, dir, packageFile.Static)
+	if errS != nil {
+		logger.Printf("Cannot serve the web files of dapp '%s'. Skipping...\n", dir)
+		logger.Println(errS.Error())
+		return
+	}
 
 	// Register the handlers right away.
-	dm.server.RegisterDapp(dapp.packageFile.Id)
+	errR := dm.server.RegisterDapp(packageFile.Id)
+	if errR != nil {
+		logger.Printf("Cannot add the routes of dapp '%s'. Skipping...\n", dir)
+		logger.Println(errR.Error())
+		return
+	}
+
+	dm.mutex.Lock()
+	dm.dappsMutex.Lock()
+	dm.dapps[packageFile.Id] = dapp
+	dm.dappsMutex.Unlock()
+	dm.mutex.Unlock()
 
 	return
 }
 
+// Dapps are served from /<dappId>/ (and from under the http, ws and sse
+// bases), so the id must be a single path segment. Otherwise a dapp could
+// take over the routes of the api, or of other dapps.
+func checkDappId(dappId string) error {
+	if dappId == "" || dappId == "." || dappId == ".." || strings.ContainsAny(dappId, "/\\") {
+		return fmt.Errorf("Dapp id must be a single path segment: '%s'", dappId)
+	}
+	return nil
+}
+
+// Get a registered dapp.
+func (dm *DappManager) dapp(dappId string) (dapps.Dapp, bool) {
+	dm.dappsMutex.RLock()
+	defer dm.dappsMutex.RUnlock()
+	dapp, ok := dm.dapps[dappId]
+	return dapp, ok
+}
+
 // TODO check dependencies.
 func (dm *DappManager) LoadDapp(dappId string) error {
 
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
-	dapp, ok := dm.dapps[dappId]
+	dapp, ok := dm.dapp(dappId)
 	if !ok {
-		return errors.New("Error loading dapp: " + dappId + ". No dapp with that name has been registered.")
+		return fmt.Errorf("Error loading dapp: %s. %w.", dappId, dapps.ErrDappNotFound)
 	}
 
 	if dm.runningDapp != nil {
 		if dm.runningDapp.PackageFile().Id == dappId {
-			return errors.New("Error loading dapp - already running: " + dappId)
+			return fmt.Errorf("Error loading dapp: %s. %w.", dappId, dapps.ErrDappRunning)
 		}
 		dm.UnloadDapp()
 	}
 
 	logger.Println("Loading dapp: " + dappId)
 
-	rt := dm.rm.CreateRuntime(dappId)
+	err := dm.server.SetWsProtocol(dappId, dapp.PackageFile().WsProtocol)
+	if err != nil {
+		return errors.New("Error loading dapp: " + dappId + ". " + err.Error())
+	}
+	err = dm.server.SetOriginPolicy(dappId, dapp.PackageFile().Origins)
+	if err != nil {
+		return errors.New("Error loading dapp: " + dappId + ". " + err.Error())
+	}
+	err = dm.server.SetRateLimits(dappId, dapps.StrictestRateLimits(dm.rateLimits, dapp.PackageFile().RateLimits))
+	if err != nil {
+		return errors.New("Error loading dapp: " + dappId + ". " + err.Error())
+	}
+
+	caps := dm.perms.capabilities(dappId, dapp.PackageFile())
+	rt := dm.rm.CreateRuntime(dappId, caps)
+
+	quotas := scripting.StrictestQuotas(dm.quotas, dapp.PackageFile().Quotas)
+	rt.SetQuotas(quotas)
+	rt.SetAllowedHosts(dapps.AllowedHosts(dapp.PackageFile()))
+	dm.fio.SetDappTempQuota(dappId, quotas.MaxTempFileBytes)
+	dm.ep.SetSubscriptionLimit(dappId, quotas.MaxSubscriptions)
 
 	for _, js := range dapp.Models() {
 		rt.AddScript(js)
@@ -368,6 +442,47 @@ func (dm *DappManager) LoadDapp(dappId string) error {
 	return nil
 }
 
+func (dm *DappManager) StopDapp(dappId string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if _, ok := dm.dapp(dappId); !ok {
+		return fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	if dm.runningDapp == nil || dm.runningDapp.PackageFile().Id != dappId {
+		return fmt.Errorf("%w: %s", dapps.ErrDappNotRunning, dappId)
+	}
+	dm.UnloadDapp()
+	return nil
+}
+
+// Remove a dapp. It is stopped if it is running, and its routes are
+// removed. The files are left as they are.
+func (dm *DappManager) RemoveDapp(dappId string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if _, ok := dm.dapp(dappId); !ok {
+		return fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	if dm.runningDapp != nil && dm.runningDapp.PackageFile().Id == dappId {
+		dm.UnloadDapp()
+	}
+	dm.server.UnregisterDapp(dappId)
+	dm.dappsMutex.Lock()
+	delete(dm.dapps, dappId)
+	dm.dappsMutex.Unlock()
+	logger.Println("Removed dapp: " + dappId)
+	return nil
+}
+
+func (dm *DappManager) RunningDapp() string {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.runningDapp == nil {
+		return ""
+	}
+	return dm.runningDapp.PackageFile().Id
+}
+
 func (dm *DappManager) UnloadDapp() {
 	// TODO cleanup
 	dappId := dm.runningDapp.PackageFile().Id
@@ -426,6 +541,8 @@ func (dc *DappRegistry) HashDir(directory string) []byte {
 */
 
 func (dm *DappManager) DappList() []*dapps.DappInfo {
+	dm.dappsMutex.RLock()
+	defer dm.dappsMutex.RUnlock()
 	arr := make([]*dapps.DappInfo, len(dm.dapps))
 	ctr := 0
 	for _, dapp := range dm.dapps {
@@ -435,6 +552,39 @@ func (dm *DappManager) DappList() []*dapps.DappInfo {
 	return arr
 }
 
+func (dm *DappManager) Permissions(dappId string) (*dapps.PermissionInfo, error) {
+	dapp, ok := dm.dapp(dappId)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	return dm.perms.info(dappId, dapp.PackageFile()), nil
+}
+
+func (dm *DappManager) UpdatePermissions(dappId string, update *dapps.PermissionUpdate) error {
+	_, ok := dm.dapp(dappId)
+	if !ok {
+		return fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	logger.Printf("Updating permissions for '%s'. Granted: %v, Denied: %v\n", dappId, update.Grant, update.Deny)
+	return dm.perms.update(dappId, update)
+}
+
+func (dm *DappManager) Quotas(dappId string) (*scripting.Quotas, error) {
+	dapp, ok := dm.dapp(dappId)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	return scripting.StrictestQuotas(dm.quotas, dapp.PackageFile().Quotas), nil
+}
+
+func (dm *DappManager) RateLimits(dappId string) (*dapps.RateLimits, error) {
+	dapp, ok := dm.dapp(dappId)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+	}
+	return dapps.StrictestRateLimits(dm.rateLimits, dapp.PackageFile().RateLimits), nil
+}
+
 /*
 func getVerification(string dappName) bool {
 
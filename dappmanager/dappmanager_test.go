@@ -0,0 +1,86 @@
+package dappmanager
+
+import (
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/network"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// Records the dapps that routes are added for.
+type fakeServer struct {
+	network.Server
+	static []string
+	routes []string
+}
+
+func (fs *fakeServer) SetStaticFiles(dappId, dir string, config *dapps.StaticConfig) error {
+	fs.static = append(fs.static, dappId)
+	return nil
+}
+
+func (fs *fakeServer) RegisterDapp(dappId string) error {
+	fs.routes = append(fs.routes, dappId)
+	return nil
+}
+
+// Write a dapp with the given id to a new directory.
+func writeTestDapp(t *testing.T, id string) string {
+	dir := t.TempDir()
+	pf, _ := json.Marshal(&dapps.PackageFile{Id: id, Name: "test"})
+	lo, _ := json.Marshal(&dapps.LoadOrderConfig{LoadingOrder: []string{"main.js"}})
+	files := map[string][]byte{
+		dapps.PACKAGE_FILE_NAME: pf,
+		dapps.INDEX_FILE_NAME:   []byte("<html></html>"),
+		path.Join(dapps.MODELS_FOLDER_NAME, dapps.LOADING_ORDER_FILE_NAME): lo,
+		path.Join(dapps.MODELS_FOLDER_NAME, "main.js"):                     []byte("var x = 1;"),
+	}
+	os.Mkdir(path.Join(dir, dapps.MODELS_FOLDER_NAME), 0755)
+	for name, bts := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), bts, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return dir
+}
+
+func TestRegisterDappId(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"mydapp", true},
+		{"my.dapp", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"api/v2", false},
+		{"admin/ui", false},
+		{"metrics/x", false},
+		{"/mydapp", false},
+		{"mydapp/", false},
+		{"..\\admin", false},
+	}
+	for _, test := range tests {
+		fs := &fakeServer{}
+		dm := &DappManager{}
+		dm.server = fs
+		dm.mutex = &sync.Mutex{}
+		dm.dappsMutex = &sync.RWMutex{}
+		dm.dapps = make(map[string]dapps.Dapp)
+		dm.RegisterDapp(writeTestDapp(t, test.id))
+
+		_, registered := dm.dapp(test.id)
+		if registered != test.ok {
+			t.Errorf("'%s': Expected registered to be %v.\n", test.id, test.ok)
+		}
+		// Bad ids must not get any routes.
+		if !test.ok && (len(fs.static) != 0 || len(fs.routes) != 0) {
+			t.Errorf("'%s': Routes were added: %v, %v\n", test.id, fs.static, fs.routes)
+		}
+	}
+}
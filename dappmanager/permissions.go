@@ -0,0 +1,109 @@
+package dappmanager
+
+import (
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/files"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"sort"
+	"sync"
+)
+
+const PERMISSIONS_FILE_NAME = "permissions"
+
+// The permission store keeps the operators decisions on what dapps are
+// allowed to do. It maps dapp ids to capability names, and the value is
+// true if the capability is granted, and false if it is denied. It is
+// persisted in the system directory.
+type permissionStore struct {
+	mutex           *sync.Mutex
+	fio             files.FileIO
+	decisions       map[string]map[string]bool
+	requireApproval bool
+}
+
+func newPermissionStore(fio files.FileIO, requireApproval bool) *permissionStore {
+	ps := &permissionStore{}
+	ps.mutex = &sync.Mutex{}
+	ps.fio = fio
+	ps.requireApproval = requireApproval
+	ps.decisions = make(map[string]map[string]bool)
+	err := fio.UnmarshalJsonFromFile(fio.System(), PERMISSIONS_FILE_NAME, &ps.decisions)
+	if err != nil {
+		logger.Println("No stored permissions: " + err.Error())
+	}
+	return ps
+}
+
+// Not thread safe.
+func (ps *permissionStore) save() error {
+	return ps.fio.MarshalJsonToFile(ps.fio.System(), PERMISSIONS_FILE_NAME, ps.decisions)
+}
+
+// Get the capabilities that a dapp should run with. Requested capabilities
+// are granted unless they have been denied. If approval is required, they
+// must also have been explicitly granted.
+func (ps *permissionStore) capabilities(dappId string, pf *dapps.PackageFile) scripting.Capabilities {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	caps := make(scripting.Capabilities)
+	decided := ps.decisions[dappId]
+	for _, c := range dapps.RequestedCapabilities(pf) {
+		granted, ok := decided[c]
+		if ok && !granted {
+			continue
+		}
+		if !ok && ps.requireApproval {
+			continue
+		}
+		caps[c] = true
+	}
+	return caps
+}
+
+func (ps *permissionStore) info(dappId string, pf *dapps.PackageFile) *dapps.PermissionInfo {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	pi := &dapps.PermissionInfo{}
+	pi.DappId = dappId
+	pi.Requested = dapps.RequestedCapabilities(pf)
+	pi.Granted = make([]string, 0)
+	pi.Denied = make([]string, 0)
+	pi.Pending = make([]string, 0)
+	decided := ps.decisions[dappId]
+	for _, c := range pi.Requested {
+		granted, ok := decided[c]
+		if !ok {
+			granted = !ps.requireApproval
+		}
+		if !ok && ps.requireApproval {
+			pi.Pending = append(pi.Pending, c)
+		} else if granted {
+			pi.Granted = append(pi.Granted, c)
+		} else {
+			pi.Denied = append(pi.Denied, c)
+		}
+	}
+	sort.Strings(pi.Requested)
+	sort.Strings(pi.Granted)
+	sort.Strings(pi.Denied)
+	sort.Strings(pi.Pending)
+	return pi
+}
+
+func (ps *permissionStore) update(dappId string, update *dapps.PermissionUpdate) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	decided, ok := ps.decisions[dappId]
+	if !ok {
+		decided = make(map[string]bool)
+		ps.decisions[dappId] = decided
+	}
+	for _, c := range update.Grant {
+		decided[c] = true
+	}
+	// Deny wins if a capability is in both lists.
+	for _, c := range update.Deny {
+		decided[c] = false
+	}
+	return ps.save()
+}
@@ -15,26 +15,68 @@ import (
 	"github.com/eris-ltd/decerver/modulemanager"
 	"github.com/eris-ltd/decerver/runtimemanager"
 	"github.com/eris-ltd/decerver/server"
-	"log"
+	"github.com/eris-ltd/decerver/tracing"
+	"fmt"
 	"os"
 	"os/signal"
 	"os/user"
 	"path"
+	"strings"
+	"time"
 )
 
 const version = "1.0.0"
 
-var logger *log.Logger = logging.NewLogger("Decerver Core")
+var logger *logging.Logger = logging.NewLogger("Decerver Core")
 
 // default config object
 var DefaultConfig = &decerver.DCConfig{
-	LogFile:       "",
+	LogFile:       "decerver.log",
+	Logging: &logging.Config{
+		Format:     logging.FORMAT_LOGFMT,
+		Level:      "info",
+		MaxSize:    10 * 1024 * 1024,
+		MaxAge:     24,
+		MaxBackups: 7,
+	},
+	Tracing: &tracing.Config{
+		SampleRate: 1,
+	},
 	MaxClients:    10,
 	Hostname:      "localhost",
 	Port:          3000,
 	DebugMode:     true,
+	Quotas: &scripting.Quotas{
+		MaxTempFileBytes: 64 * 1024 * 1024,
+		MaxSubscriptions: 256,
+		MaxWsSessions:    10,
+		MaxCallTime:      10000,
+		MaxHttpResponseBytes: 4 * 1024 * 1024,
+		MaxHttpRequestBytes: 32 * 1024 * 1024,
+	},
+	RateLimits: &dapps.RateLimits{
+		HttpRate:       20,
+		HttpBurst:      50,
+		WsMessageRate:  20,
+		WsMessageBurst: 50,
+	},
+	Websocket: &decerver.WsConfig{
+		PingPeriod:     54000,
+		PongWait:       60000,
+		WriteWait:      10000,
+		MaxMessageSize: 8192,
+	},
+	EventQueue: &decerver.EventQueueConfig{
+		Size:         256,
+		Overflow:     events.OVERFLOW_DROP_OLDEST,
+		BlockTimeout: 1000,
+	},
+	ShutdownTimeout: 10000,
 }
 
+// Used if the config does not have a shutdown timeout.
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
 type DeCerver struct {
 	config        *decerver.DCConfig
 	modApi        modules.DecerverModuleApi
@@ -82,6 +124,12 @@ func (dc *DeCerver) loadConfig(){
 		fio.MarshalJsonToFile(fio.Root(),"config",config)
 	}
 	dc.config = config
+	if err := logging.Configure(config.Logging, fio.Log(), config.LogFile); err != nil {
+		logger.Error("Failed to configure logging.", "error", err.Error())
+	}
+	if err := tracing.Configure(config.Tracing, fio.Log()); err != nil {
+		logger.Error("Failed to configure tracing.", "error", err.Error())
+	}
 }
 
 func (dc *DeCerver) Init() error {
@@ -94,10 +142,13 @@ func (dc *DeCerver) Init() error {
 }
 
 func (dc *DeCerver) Start() error {
-	dc.webServer.Start()
+	err := dc.webServer.Start()
+	if err != nil {
+		return err
+	}
 	logger.Println("Server started.")
 
-	err := dc.moduleManager.Start()
+	err = dc.moduleManager.Start()
 	if err != nil {
 		return err
 	}
@@ -113,13 +164,67 @@ func (dc *DeCerver) Start() error {
 	return nil
 }
 
-// TODO stuff
+// Shut everything down, in order: the webserver (which stops accepting
+// connections, closes websocket sessions and drains http requests), the
+// runtimes, the modules and last the event processor. Each component gets
+// the shutdown timeout to stop. Those that fail, or do not stop in time,
+// are reported in the error.
 func (dc *DeCerver) Shutdown() error {
-	dc.moduleManager.Shutdown()
+	defer logging.Close()
+	timeout := DEFAULT_SHUTDOWN_TIMEOUT
+	if dc.config.ShutdownTimeout > 0 {
+		timeout = time.Duration(dc.config.ShutdownTimeout) * time.Millisecond
+	}
+	failed := make([]string, 0)
+	stop := func(name string, fn func() error) {
+		logger.Println("Stopping " + name + ".")
+		if err := stopWithin(timeout, fn); err != nil {
+			logger.Printf("Failed to stop %s: %s\n", name, err.Error())
+			failed = append(failed, name)
+		}
+	}
+
+	// The webserver enforces the timeout itself, since it has to close the
+	// remaining connections when it runs out.
+	logger.Println("Stopping webserver.")
+	if err := dc.webServer.Shutdown(timeout); err != nil {
+		logger.Println(err.Error())
+		failed = append(failed, "webserver")
+	}
+	stop("runtimes", func() error {
+		dc.rm.ShutdownRuntimes()
+		return nil
+	})
+	stop("modules", dc.moduleManager.Shutdown)
+	stop("event processor", func() error {
+		dc.ep.Shutdown()
+		return nil
+	})
+	// Export the remaining spans.
+	stop("tracing", tracing.Shutdown)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to stop: %s", strings.Join(failed, ", "))
+	}
 	logger.Println("Bye.")
 	return nil
 }
 
+// Run fn, but stop waiting for it after the timeout. If it times out,
+// it is left running.
+func stopWithin(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out after %v.", timeout)
+	}
+}
+
 func block() string {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
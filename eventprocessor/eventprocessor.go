@@ -5,15 +5,35 @@ package eventprocessor
 import (
 	"fmt"
 	"encoding/json"
+	"sync"
 	"github.com/eris-ltd/modules/types"
 	"github.com/eris-ltd/decerver/interfaces/decerver"
 	"github.com/eris-ltd/decerver/interfaces/events"
 	"github.com/eris-ltd/decerver/interfaces/logging"
 	"github.com/eris-ltd/decerver/interfaces/modules"
-	"log"
+	"github.com/eris-ltd/decerver/metrics"
 )
 
-var logger *log.Logger = logging.NewLogger("Event Processor")
+var logger *logging.Logger = logging.NewLogger("Event Processor")
+
+// Unlike the traffic data, these are kept in normal mode too.
+var (
+	eventsPosted    = metrics.NewCounterVec("decerver_events_posted_total", "Events posted by modules, by source.", "source")
+	eventsDelivered = metrics.NewCounterVec("decerver_events_delivered_total", "Events posted to subscribers (once per subscriber), by source.", "source")
+	eventsDropped   = metrics.NewCounterVec("decerver_events_dropped_total", "Events that were not passed on, by source and reason.", "source", "reason")
+)
+
+// Reasons for dropping events.
+const (
+	DROP_NO_SUBSCRIBERS = "no_subscribers"
+	// The queue of a subscriber was full.
+	DROP_QUEUE_FULL = "queue_full"
+	// The subscriber was removed before the event was posted to it.
+	DROP_UNSUBSCRIBED = "unsubscribed"
+)
+
+// The number of events from modules that can wait for the event loop.
+const MAIN_QUEUE_SIZE = 1024
 
 // Typedef for map of subscriptions
 type SubMap map[string]*subscriptions
@@ -56,6 +76,7 @@ func newSubscriptions() *subscriptions {
 }
 
 type trafficData struct {
+	mutex *sync.Mutex
 	// The total amount of events that are posted.
 	EventsPosted uint64 `json:"events_posted"`
 	// The number of events received sorted by source (module)
@@ -69,18 +90,37 @@ type trafficData struct {
 	// This happens when there are subs to the source, but not
 	// to the event type that's posted.
 	EventsNoEvtSubs map[string]map[string]uint64 `json:"events_no_event_type_subs"`
+	// The total amount of events that were dropped because a subscriber
+	// queue was full, or the subscriber was removed.
+	EventsDropped uint64 `json:"events_dropped"`
+	// Dropped events by source (module) and reason.
+	EventsDroppedBySource map[string]map[string]uint64 `json:"events_dropped_by_source"`
+	// The queues of the current subscribers, by subscriber id. It is
+	// filled in when the traffic data is read.
+	Queues map[string]*queueStats `json:"queues"`
+}
+
+type queueStats struct {
+	// The number of events waiting to be posted.
+	Length int `json:"length"`
+	// The number of events that were dropped because the queue was full.
+	Dropped uint64 `json:"dropped"`
 }
 
 func newTrafficData() *trafficData {
 	td := &trafficData{}
+	td.mutex = &sync.Mutex{}
 	td.EventsPostedBySource = make(map[string]uint64)
 	td.EventsSubReceivedBySource = make(map[string]uint64)
 	td.EventsNoSourceSubsBySource = make(map[string]uint64)
 	td.EventsNoEvtSubs = make(map[string]map[string]uint64)
+	td.EventsDroppedBySource = make(map[string]map[string]uint64)
 	return td
 }
 
 func (td *trafficData) incPosted(src string) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
 	td.EventsPosted++
 	if _, ok := td.EventsPostedBySource[src]; !ok {
 		td.EventsPostedBySource[src] = uint64(1)
@@ -90,6 +130,8 @@ func (td *trafficData) incPosted(src string) {
 }
 
 func (td *trafficData) incNoSubBySource(src string) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
 	if _, ok := td.EventsNoSourceSubsBySource[src]; !ok {
 		td.EventsNoSourceSubsBySource[src] = uint64(1)
 	} else {
@@ -98,6 +140,8 @@ func (td *trafficData) incNoSubBySource(src string) {
 }
 
 func (td *trafficData) incNoEvtSub(src, evt string) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
 	if _, ok := td.EventsNoEvtSubs[src]; !ok {
 		newMap := make(map[string]uint64)
 		newMap[evt] = uint64(1)
@@ -107,7 +151,19 @@ func (td *trafficData) incNoEvtSub(src, evt string) {
 	}
 }
 
+func (td *trafficData) incDropped(src, reason string, n int) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
+	td.EventsDropped += uint64(n)
+	if _, ok := td.EventsDroppedBySource[src]; !ok {
+		td.EventsDroppedBySource[src] = make(map[string]uint64)
+	}
+	td.EventsDroppedBySource[src][reason] += uint64(n)
+}
+
 func (td *trafficData) incrementReceived(src string) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
 	if _, ok := td.EventsSubReceivedBySource[src]; !ok {
 		td.EventsSubReceivedBySource[src] = uint64(1)
 	} else {
@@ -132,10 +188,21 @@ type EventProcessor struct {
 	// Main event channel
 	mainEvts chan types.Event
 	mainClose chan interface{}
-	subChan chan events.Subscriber
+	subChan chan *subRequest
 	unsubChan chan string
 	incomingChans map[string]chan types.Event
 	closeChan chan interface{}
+	closeOnce *sync.Once
+	// Subscription counts and limits by owner. Guarded by the quota mutex
+	// since they are checked before the subscriber is passed to the loop.
+	quotaMutex *sync.Mutex
+	subCounts map[string]int
+	subLimits map[string]int
+	// Subscriber queues by subscriber id. Guarded by the queue mutex, since
+	// they are closed from outside the loop when subscribers are removed.
+	queueMutex *sync.Mutex
+	queues map[string]*subQueue
+	queueSettings *queueSettings
 }
 
 func NewEventProcessor(dc decerver.Decerver) events.EventProcessor {
@@ -148,11 +215,18 @@ func NewEventProcessor(dc decerver.Decerver) events.EventProcessor {
 	if ep.debug {
 		ep.td = newTrafficData()
 	}
-	ep.mainEvts = make(chan types.Event)
-	ep.subChan = make(chan events.Subscriber)
+	ep.mainEvts = make(chan types.Event, MAIN_QUEUE_SIZE)
+	ep.subChan = make(chan *subRequest)
 	ep.unsubChan = make(chan string)
 	ep.incomingChans = make(map[string]chan types.Event)
 	ep.closeChan = make(chan interface{})
+	ep.closeOnce = &sync.Once{}
+	ep.quotaMutex = &sync.Mutex{}
+	ep.subCounts = make(map[string]int)
+	ep.subLimits = make(map[string]int)
+	ep.queueMutex = &sync.Mutex{}
+	ep.queues = make(map[string]*subQueue)
+	ep.queueSettings = newQueueSettings(dc.Config().EventQueue)
 	
 	go func(ep *EventProcessor){
 		for {
@@ -160,8 +234,8 @@ func NewEventProcessor(dc decerver.Decerver) events.EventProcessor {
 				case evt := <- ep.mainEvts:
 					fmt.Printf("Event: %v\n", evt)
 					ep.post(evt)
-				case sub := <- ep.subChan:
-					ep.subscribe(sub)
+				case req := <- ep.subChan:
+					req.done <- ep.subscribe(req.sub)
 				case id := <- ep.unsubChan:
 					ep.unsubscribe(id)
 				case _ = <- ep.closeChan:
@@ -178,6 +252,7 @@ func NewEventProcessor(dc decerver.Decerver) events.EventProcessor {
 func (ep *EventProcessor) post(e types.Event) error {
 	src := e.Source
 	ee := e.Event
+	eventsPosted.With(src).Inc()
 	if ep.debug {
 		ep.td.incPosted(src)
 		logger.Println("Receiving event '" + ee + "' from '" + src + "'.")
@@ -185,6 +260,7 @@ func (ep *EventProcessor) post(e types.Event) error {
 	
 	sourceSubs := ep.subs[src]
 	if sourceSubs == nil || len(sourceSubs) == 0 {
+		eventsDropped.With(src, DROP_NO_SUBSCRIBERS).Inc()
 		if ep.debug {
 			logger.Println("No subscribers to events published by: " + src + ". Skipping.")
 			ep.td.incNoEvtSub(src,ee)
@@ -194,6 +270,7 @@ func (ep *EventProcessor) post(e types.Event) error {
 
 	eeSubs := sourceSubs[ee]
 	if eeSubs == nil || len(eeSubs.srs) == 0 {
+		eventsDropped.With(src, DROP_NO_SUBSCRIBERS).Inc()
 		if ep.debug {
 			logger.Println("No subscribers to events of type '" + ee + "' published by '" + src + "'. Skipping.")
 			ep.td.incNoEvtSub(src, ee)
@@ -201,26 +278,145 @@ func (ep *EventProcessor) post(e types.Event) error {
 		return nil
 	}
 
+	matched := 0
 	for _, sub := range eeSubs.srs {
 		if sub.Target() == e.Target {
+			matched++
 			if ep.debug {
 				logger.Println("Found subscriber")
 				logger.Printf("Chan: %v\n", sub)
-				ep.td.incrementReceived(src)
 			}
-			sub.Post(e)
+			ep.enqueue(sub, e)
 		}
 	}
+	if matched == 0 {
+		eventsDropped.With(src, DROP_NO_SUBSCRIBERS).Inc()
+	}
 	return nil
 }
 
+// Add an event to the queue of a subscriber. It is posted to the
+// subscriber from the delivery goroutine of the queue.
+func (ep *EventProcessor) enqueue(sub events.Subscriber, e types.Event) {
+	ep.queueMutex.Lock()
+	q := ep.queues[sub.Id()]
+	ep.queueMutex.Unlock()
+	reason := DROP_UNSUBSCRIBED
+	if q != nil {
+		reason = q.push(e)
+	}
+	if reason != "" {
+		ep.dropped(e.Source, reason, 1)
+	}
+}
+
+func (ep *EventProcessor) dropped(src, reason string, n int) {
+	if n == 0 {
+		return
+	}
+	eventsDropped.With(src, reason).Add(float64(n))
+	if ep.debug {
+		ep.td.incDropped(src, reason, n)
+	}
+}
+
+// Called from the delivery goroutine of the subscriber.
+func (ep *EventProcessor) deliver(sub events.Subscriber, e types.Event) {
+	sub.Post(e)
+	eventsDelivered.With(e.Source).Inc()
+	if ep.debug {
+		ep.td.incrementReceived(e.Source)
+	}
+}
+
+// Stop delivery to a subscriber. Events that are still in its queue are
+// dropped.
+func (ep *EventProcessor) closeQueue(id string) {
+	ep.queueMutex.Lock()
+	q := ep.queues[id]
+	delete(ep.queues, id)
+	ep.queueMutex.Unlock()
+	if q != nil {
+		ep.dropped(q.source, DROP_UNSUBSCRIBED, q.close())
+	}
+}
+
+// A subscriber that is passed to the loop. The loop sends the result of
+// the subscription on done.
+type subRequest struct {
+	sub  events.Subscriber
+	done chan error
+}
+
 func (ep *EventProcessor) Subscribe(sub events.Subscriber) error {
-	ep.subChan <- sub
-	return nil
+	if osub, ok := sub.(events.OwnedSubscriber); ok {
+		owner := osub.Owner()
+		ep.quotaMutex.Lock()
+		max := ep.subLimits[owner]
+		if max > 0 && ep.subCounts[owner] >= max {
+			ep.quotaMutex.Unlock()
+			return fmt.Errorf("Subscription limit reached for '%s' (%d).", owner, max)
+		}
+		ep.subCounts[owner]++
+		ep.quotaMutex.Unlock()
+	}
+	// The modules are only looked up in the loop, which checks that the
+	// source exists.
+	req := &subRequest{sub, make(chan error, 1)}
+	var err error
+	select {
+	case ep.subChan <- req:
+		err = <-req.done
+	case <-ep.closeChan:
+		err = fmt.Errorf("The event processor has been shut down.")
+	}
+	if err != nil {
+		if osub, ok := sub.(events.OwnedSubscriber); ok {
+			ep.quotaMutex.Lock()
+			ep.subCounts[osub.Owner()]--
+			ep.quotaMutex.Unlock()
+		}
+	}
+	return err
+}
+
+// Stop the event loop and the delivery to subscribers. It is safe to
+// call more then once.
+func (ep *EventProcessor) Shutdown() {
+	ep.closeOnce.Do(func() {
+		close(ep.closeChan)
+		ep.queueMutex.Lock()
+		for _, q := range ep.queues {
+			q.close()
+		}
+		ep.queues = make(map[string]*subQueue)
+		ep.queueMutex.Unlock()
+		logger.Println("Event processor shut down.")
+	})
+}
+
+func (ep *EventProcessor) SetSubscriptionLimit(owner string, max int) {
+	ep.quotaMutex.Lock()
+	defer ep.quotaMutex.Unlock()
+	ep.subLimits[owner] = max
+}
+
+func (ep *EventProcessor) SubscriptionCount(owner string) int {
+	ep.quotaMutex.Lock()
+	defer ep.quotaMutex.Unlock()
+	return ep.subCounts[owner]
 }
 
 func (ep *EventProcessor) subscribe(sub events.Subscriber) error {
 	src := sub.Source()
+	mod, ok := ep.moduleManager.Modules()[src]
+	if !ok || mod == nil {
+		return fmt.Errorf("No module with name: %s", src)
+	}
+	// The id is used to find the queue, and to unsubscribe.
+	if _, ok := ep.byId[sub.Id()]; ok {
+		return fmt.Errorf("There is already a subscriber with id: %s", sub.Id())
+	}
 	if ep.debug {
 		logger.Println("New subscription registering: " + src)
 	}
@@ -241,16 +437,29 @@ func (ep *EventProcessor) subscribe(sub events.Subscriber) error {
 	evts.add(sub)
 	ep.byId[sub.Id()] = sub
 
+	// Events are posted to the subscriber from a goroutine of its own, so
+	// that a slow subscriber does not hold up the loop.
+	q := newSubQueue(src, ep.queueSettings)
+	ep.queueMutex.Lock()
+	ep.queues[sub.Id()] = q
+	ep.queueMutex.Unlock()
+	go q.run(func(e types.Event){
+		ep.deliver(sub, e)
+	})
+
 	// Call subscribe on module.
-	eChan := ep.moduleManager.Modules()[src].Subscribe(sub.Id(), sub.Event(), sub.Target())
+	eChan := mod.Subscribe(sub.Id(), sub.Event(), sub.Target())
 	ep.incomingChans[sub.Id()] = eChan
 	go func(ch chan types.Event){
 		for {
 			evt, ok := <- ch
 			if !ok {
 				return
-			} else {
-				ep.mainEvts <- evt
+			}
+			select {
+				case ep.mainEvts <- evt:
+				case <- ep.closeChan:
+					return
 			}
 		}
 	}(eChan)
@@ -260,8 +469,16 @@ func (ep *EventProcessor) subscribe(sub events.Subscriber) error {
 
 // TODO not sure what the error is supposed to do yet
 func (ep *EventProcessor) Unsubscribe(id string) error {
-	ep.unsubChan <- id
-	return nil
+	// The queue is closed right away, rather then by the loop, since the
+	// loop may be waiting for room in it (with the block overflow policy),
+	// and the subscriber may be the one calling.
+	ep.closeQueue(id)
+	select {
+	case ep.unsubChan <- id:
+		return nil
+	case <-ep.closeChan:
+		return fmt.Errorf("The event processor has been shut down.")
+	}
 }
 
 // TODO not sure what the error is supposed to do yet
@@ -271,26 +488,46 @@ func (ep *EventProcessor) unsubscribe(id string) error {
 		logger.Println("No subscriber with id: " + id)
 		return nil
 	}
-	ep.moduleManager.Modules()[sub.Source()].UnSubscribe(sub.Id())
+	// The module may be gone.
+	if mod, ok := ep.moduleManager.Modules()[sub.Source()]; ok && mod != nil {
+		mod.UnSubscribe(sub.Id())
+	}
 	// This is the crux. If module closes automatically, then it's wrong. No good way of checking.
 	// close(ep.incomingChans[id])
 	delete(ep.incomingChans,id)
+	ep.closeQueue(id)
 	// Clean out the sub (both from subs and from the map that stores by id)
 	// TODO this is temporary but otherwise store the channel in the subById? Make a struct?
 	ep.subs[sub.Source()][sub.Event()].remove(id)
 	delete(ep.byId, id)
+	if osub, ok := sub.(events.OwnedSubscriber); ok {
+		ep.quotaMutex.Lock()
+		ep.subCounts[osub.Owner()]--
+		ep.quotaMutex.Unlock()
+	}
 	return nil
 }
 
 func (ep *EventProcessor) TrafficData() string {
 	if ep.debug {
+		// It is read while the event loop updates it.
+		ep.td.mutex.Lock()
+		ep.td.Queues = ep.queueStats()
 		bts, _ := json.MarshalIndent(ep.td, "", "\t")
-		str := string(bts)
-		// TODO remove
-		logger.Println(str)
-		return str
+		ep.td.mutex.Unlock()
+		return string(bts)
 	} else {
 		logger.Println("Event Traffic Data not available (debug mode must be enabled).")
 		return "N/A"
 	}
 }
+
+func (ep *EventProcessor) queueStats() map[string]*queueStats {
+	ep.queueMutex.Lock()
+	defer ep.queueMutex.Unlock()
+	stats := make(map[string]*queueStats)
+	for id, q := range ep.queues {
+		stats[id] = &queueStats{q.length(), q.droppedCount()}
+	}
+	return stats
+}
@@ -0,0 +1,328 @@
+package eventprocessor
+
+import (
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/events"
+	"github.com/eris-ltd/decerver/interfaces/modules"
+	"github.com/eris-ltd/modules/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDecerver struct {
+	decerver.Decerver
+	config *decerver.DCConfig
+	mm     modules.ModuleManager
+}
+
+func (fd *fakeDecerver) Config() *decerver.DCConfig {
+	return fd.config
+}
+
+func (fd *fakeDecerver) ModuleManager() modules.ModuleManager {
+	return fd.mm
+}
+
+// The module is removed when gone is set.
+type fakeModuleManager struct {
+	modules.ModuleManager
+	mod   *fakeModule
+	mutex *sync.Mutex
+	gone  bool
+}
+
+func (fmm *fakeModuleManager) Modules() map[string]modules.Module {
+	fmm.mutex.Lock()
+	defer fmm.mutex.Unlock()
+	if fmm.gone {
+		return map[string]modules.Module{}
+	}
+	return map[string]modules.Module{"mod": fmm.mod}
+}
+
+func (fmm *fakeModuleManager) remove() {
+	fmm.mutex.Lock()
+	defer fmm.mutex.Unlock()
+	fmm.gone = true
+}
+
+// A module that gives each subscription a channel of its own.
+type fakeModule struct {
+	modules.Module
+	mutex *sync.Mutex
+	chans map[string]chan types.Event
+}
+
+func (fm *fakeModule) Subscribe(name, event, target string) chan types.Event {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	ch := make(chan types.Event)
+	fm.chans[name] = ch
+	return ch
+}
+
+func (fm *fakeModule) UnSubscribe(name string) {}
+
+func (fm *fakeModule) channel(name string) chan types.Event {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return fm.chans[name]
+}
+
+// Passes the events it gets on to a channel. If entered is set, it is
+// signalled when an event is posted, and the post waits for release.
+type testSub struct {
+	id       string
+	source   string
+	owner    string
+	received chan types.Event
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func newTestSub(id string) *testSub {
+	return &testSub{id: id, source: "mod", received: make(chan types.Event, 100)}
+}
+
+func (ts *testSub) Post(e types.Event) {
+	if ts.entered != nil {
+		ts.entered <- struct{}{}
+		<-ts.release
+	}
+	ts.received <- e
+}
+
+func (ts *testSub) Source() string { return ts.source }
+func (ts *testSub) Owner() string  { return ts.owner }
+func (ts *testSub) Id() string     { return ts.id }
+func (ts *testSub) Event() string  { return "evt" }
+func (ts *testSub) Target() string { return "" }
+
+func newTestProcessor(cfg *decerver.EventQueueConfig) (*EventProcessor, *fakeModule) {
+	ep, mod, _ := newTestProcessorMM(cfg)
+	return ep, mod
+}
+
+func newTestProcessorMM(cfg *decerver.EventQueueConfig) (*EventProcessor, *fakeModule, *fakeModuleManager) {
+	mod := &fakeModule{mutex: &sync.Mutex{}, chans: make(map[string]chan types.Event)}
+	fmm := &fakeModuleManager{mod: mod, mutex: &sync.Mutex{}}
+	fd := &fakeDecerver{}
+	fd.config = &decerver.DCConfig{DebugMode: true, EventQueue: cfg}
+	fd.mm = fmm
+	return NewEventProcessor(fd).(*EventProcessor), mod, fmm
+}
+
+func receive(t *testing.T, ts *testSub, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-ts.received:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Got %d events, expected %d.\n", ts.id, i, n)
+		}
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	ep, mod := newTestProcessor(&decerver.EventQueueConfig{Size: 4, Overflow: events.OVERFLOW_DROP_NEWEST})
+	defer ep.Shutdown()
+	slow := newTestSub("slow")
+	slow.entered = make(chan struct{}, 1)
+	slow.release = make(chan struct{})
+	fast := newTestSub("fast")
+	for _, sub := range []*testSub{slow, fast} {
+		if err := ep.Subscribe(sub); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	ch := mod.channel("slow")
+	evt := types.Event{Source: "mod", Event: "evt"}
+	ch <- evt
+	<-slow.entered
+	receive(t, fast, 1)
+	// The slow subscriber is stuck on the first event. Four more fit in
+	// its queue, and the rest are dropped. The fast one gets them all.
+	for i := 0; i < 9; i++ {
+		ch <- evt
+		receive(t, fast, 1)
+	}
+
+	td := &trafficData{}
+	if err := json.Unmarshal([]byte(ep.TrafficData()), td); err != nil {
+		t.Fatal(err.Error())
+	}
+	if td.EventsDropped != 5 || td.EventsDroppedBySource["mod"][DROP_QUEUE_FULL] != 5 {
+		t.Errorf("Wrong dropped counts: %d, %v\n", td.EventsDropped, td.EventsDroppedBySource)
+	}
+	if qs := td.Queues["slow"]; qs == nil || qs.Length != 4 || qs.Dropped != 5 {
+		t.Errorf("Wrong queue stats for the slow subscriber: %+v\n", qs)
+	}
+	if qs := td.Queues["fast"]; qs == nil || qs.Length != 0 || qs.Dropped != 0 {
+		t.Errorf("Wrong queue stats for the fast subscriber: %+v\n", qs)
+	}
+
+	// The events in the queue are dropped when the subscriber is removed.
+	if err := ep.Unsubscribe("slow"); err != nil {
+		t.Fatal(err.Error())
+	}
+	close(slow.release)
+	receive(t, slow, 1)
+	select {
+	case <-slow.received:
+		t.Error("Events were posted after the subscriber was removed.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	td = &trafficData{}
+	json.Unmarshal([]byte(ep.TrafficData()), td)
+	if td.EventsDroppedBySource["mod"][DROP_UNSUBSCRIBED] != 4 || td.Queues["slow"] != nil {
+		t.Errorf("Wrong traffic data after unsubscribe: %v, %v\n", td.EventsDroppedBySource, td.Queues)
+	}
+}
+
+func TestModuleGone(t *testing.T) {
+	ep, _, fmm := newTestProcessorMM(nil)
+	defer ep.Shutdown()
+	ep.SetSubscriptionLimit("dapp", 1)
+
+	// Unknown modules are refused, and do not count towards the quota.
+	bad := newTestSub("bad")
+	bad.source = "nomod"
+	bad.owner = "dapp"
+	if err := ep.Subscribe(bad); err == nil {
+		t.Error("Subscribed to a module that does not exist.")
+	}
+	if n := ep.SubscriptionCount("dapp"); n != 0 {
+		t.Errorf("Failed subscription was counted: %d\n", n)
+	}
+	sub := newTestSub("sub")
+	sub.owner = "dapp"
+	if err := ep.Subscribe(sub); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Removing a subscription to a module that is gone must not take down
+	// the event loop.
+	fmm.remove()
+	if err := ep.Unsubscribe("sub"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ep.Subscribe(newTestSub("other")); err == nil {
+		t.Error("Subscribed to a module that is gone.")
+	}
+	if n := ep.SubscriptionCount("dapp"); n != 0 {
+		t.Errorf("Wrong subscription count after unsubscribe: %d\n", n)
+	}
+}
+
+func TestDuplicateId(t *testing.T) {
+	ep, mod := newTestProcessor(nil)
+	defer ep.Shutdown()
+	first := newTestSub("sub")
+	first.owner = "dapp"
+	if err := ep.Subscribe(first); err != nil {
+		t.Fatal(err.Error())
+	}
+	second := newTestSub("sub")
+	second.owner = "dapp"
+	if err := ep.Subscribe(second); err == nil {
+		t.Error("Subscribed twice with the same id.")
+	}
+	if n := ep.SubscriptionCount("dapp"); n != 1 {
+		t.Errorf("Wrong subscription count: %d\n", n)
+	}
+
+	// The first subscriber still gets the events, and the second does not.
+	mod.channel("sub") <- types.Event{Source: "mod", Event: "evt"}
+	receive(t, first, 1)
+	select {
+	case <-second.received:
+		t.Error("The duplicate subscriber got an event.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// One unsubscribe removes it, and then the id can be used again. The
+	// loop handles the unsubscribe before the new subscription.
+	if err := ep.Unsubscribe("sub"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ep.Subscribe(second); err != nil {
+		t.Errorf("Could not reuse the id: %s\n", err.Error())
+	}
+	if n := ep.SubscriptionCount("dapp"); n != 1 {
+		t.Errorf("Wrong subscription count after subscribing again: %d\n", n)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	e1 := types.Event{Event: "1"}
+	e2 := types.Event{Event: "2"}
+	e3 := types.Event{Event: "3"}
+	tests := []struct {
+		overflow string
+		want     []string
+	}{
+		{events.OVERFLOW_DROP_OLDEST, []string{"2", "3"}},
+		{events.OVERFLOW_DROP_NEWEST, []string{"1", "2"}},
+		{events.OVERFLOW_BLOCK, []string{"1", "2"}},
+	}
+	for _, test := range tests {
+		q := newSubQueue("mod", &queueSettings{2, test.overflow, 10 * time.Millisecond})
+		if q.push(e1) != "" || q.push(e2) != "" {
+			t.Fatalf("%s: Events were dropped from a queue with room.\n", test.overflow)
+		}
+		if reason := q.push(e3); reason != DROP_QUEUE_FULL {
+			t.Errorf("%s: Wrong drop reason: %s\n", test.overflow, reason)
+		}
+		if q.length() != 2 || q.droppedCount() != 1 {
+			t.Errorf("%s: Wrong length (%d) or dropped count (%d).\n", test.overflow, q.length(), q.droppedCount())
+		}
+		for _, w := range test.want {
+			if e := <-q.events; e.Event != w {
+				t.Errorf("%s: Expected event %s, Got: %s\n", test.overflow, w, e.Event)
+			}
+		}
+		q.close()
+		if reason := q.push(e1); reason != DROP_UNSUBSCRIBED {
+			t.Errorf("%s: Wrong drop reason after close: %s\n", test.overflow, reason)
+		}
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	q := newSubQueue("mod", &queueSettings{1, events.OVERFLOW_BLOCK, time.Second})
+	q.push(types.Event{Event: "1"})
+	// Waits until there is room.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-q.events
+	}()
+	if reason := q.push(types.Event{Event: "2"}); reason != "" {
+		t.Errorf("Event was dropped: %s\n", reason)
+	}
+	// Or the queue is closed.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.close()
+	}()
+	if reason := q.push(types.Event{Event: "3"}); reason != DROP_UNSUBSCRIBED {
+		t.Errorf("Wrong drop reason: %s\n", reason)
+	}
+}
+
+func TestQueueSettings(t *testing.T) {
+	tests := []struct {
+		cfg  *decerver.EventQueueConfig
+		want queueSettings
+	}{
+		{nil, queueSettings{DEFAULT_QUEUE_SIZE, DEFAULT_OVERFLOW, DEFAULT_BLOCK_TIMEOUT}},
+		{&decerver.EventQueueConfig{Size: 8, Overflow: events.OVERFLOW_BLOCK, BlockTimeout: 5},
+			queueSettings{8, events.OVERFLOW_BLOCK, 5 * time.Millisecond}},
+		{&decerver.EventQueueConfig{Overflow: "drop_all"}, queueSettings{DEFAULT_QUEUE_SIZE, DEFAULT_OVERFLOW, DEFAULT_BLOCK_TIMEOUT}},
+	}
+	for i, test := range tests {
+		if qs := newQueueSettings(test.cfg); *qs != test.want {
+			t.Errorf("%d: Expected: %+v, Got: %+v\n", i, test.want, *qs)
+		}
+	}
+}
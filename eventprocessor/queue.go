@@ -0,0 +1,153 @@
+package eventprocessor
+
+import (
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/events"
+	"github.com/eris-ltd/modules/types"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the event queue settings in the decerver config.
+const (
+	DEFAULT_QUEUE_SIZE    = 256
+	DEFAULT_OVERFLOW      = events.OVERFLOW_DROP_OLDEST
+	DEFAULT_BLOCK_TIMEOUT = time.Second
+)
+
+// The queue settings that are used by the event processor.
+type queueSettings struct {
+	size         int
+	overflow     string
+	blockTimeout time.Duration
+}
+
+// Get the settings from the config. Missing values gets the defaults, as
+// does an unknown overflow policy.
+func newQueueSettings(cfg *decerver.EventQueueConfig) *queueSettings {
+	qs := &queueSettings{DEFAULT_QUEUE_SIZE, DEFAULT_OVERFLOW, DEFAULT_BLOCK_TIMEOUT}
+	if cfg == nil {
+		return qs
+	}
+	if cfg.Size > 0 {
+		qs.size = cfg.Size
+	}
+	switch cfg.Overflow {
+	case "":
+	case events.OVERFLOW_DROP_OLDEST, events.OVERFLOW_DROP_NEWEST, events.OVERFLOW_BLOCK:
+		qs.overflow = cfg.Overflow
+	default:
+		logger.Warn("Unknown event queue overflow policy. Using the default.", "overflow", cfg.Overflow, "default", DEFAULT_OVERFLOW)
+	}
+	if cfg.BlockTimeout > 0 {
+		qs.blockTimeout = time.Duration(cfg.BlockTimeout) * time.Millisecond
+	}
+	return qs
+}
+
+// A bounded queue of events for a subscriber. The event loop is the only
+// one that pushes to it, and the delivery goroutine (run) is the only one
+// that takes from it, except when the oldest event is dropped.
+type subQueue struct {
+	// The source of the events.
+	source   string
+	settings *queueSettings
+	events   chan types.Event
+	// Closed when the subscriber is removed.
+	done      chan struct{}
+	closeOnce *sync.Once
+	// The number of events that were dropped because the queue was full.
+	dropped uint64
+}
+
+func newSubQueue(source string, settings *queueSettings) *subQueue {
+	q := &subQueue{}
+	q.source = source
+	q.settings = settings
+	q.events = make(chan types.Event, settings.size)
+	q.done = make(chan struct{})
+	q.closeOnce = &sync.Once{}
+	return q
+}
+
+// Add an event to the queue. Returns the reason if an event (the new one,
+// or the oldest one in the queue) was dropped, otherwise "".
+func (q *subQueue) push(e types.Event) string {
+	select {
+	case <-q.done:
+		return DROP_UNSUBSCRIBED
+	default:
+	}
+	select {
+	case q.events <- e:
+		return ""
+	default:
+	}
+	switch q.settings.overflow {
+	case events.OVERFLOW_DROP_NEWEST:
+	case events.OVERFLOW_BLOCK:
+		timer := time.NewTimer(q.settings.blockTimeout)
+		defer timer.Stop()
+		select {
+		case q.events <- e:
+			return ""
+		case <-timer.C:
+		case <-q.done:
+			return DROP_UNSUBSCRIBED
+		}
+	default:
+		// The delivery goroutine may have taken the oldest event since, in
+		// which case there is room now. Either way the send does not block,
+		// since nobody else adds to the queue.
+		dropped := false
+		select {
+		case <-q.events:
+			dropped = true
+		default:
+		}
+		q.events <- e
+		if !dropped {
+			return ""
+		}
+	}
+	atomic.AddUint64(&q.dropped, 1)
+	return DROP_QUEUE_FULL
+}
+
+// Post the events in the queue until it is closed. Events that are left
+// in the queue when it is closed are not posted.
+func (q *subQueue) run(post func(types.Event)) {
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		select {
+		case e := <-q.events:
+			post(e)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Stop delivery. Returns the number of events that were left in the
+// queue, the first time it is called.
+func (q *subQueue) close() int {
+	left := 0
+	q.closeOnce.Do(func() {
+		close(q.done)
+		left = len(q.events)
+	})
+	return left
+}
+
+func (q *subQueue) length() int {
+	return len(q.events)
+}
+
+func (q *subQueue) droppedCount() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"fmt"
 	"path"
+	"path/filepath"
 	"sync"
 )
 
@@ -19,12 +20,14 @@ type FileIO struct {
 	dapps       string
 	system      string
 	tempfiles	string
+	tempQuotas  map[string]int64
 }
 
 func NewFileIO(rootDir string) *FileIO {
 	fio := &FileIO{}
 	fio.mutex = &sync.Mutex{}
 	fio.root = rootDir
+	fio.tempQuotas = make(map[string]int64)
 	return fio
 }
 
@@ -107,13 +110,46 @@ func (fio *FileIO) CreateModuleDirectory(moduleName string) error {
 	return initDir(dir)
 }
 
-// Creates a new directory for a module, and returns the path.
+// Writes a tempfile for a dapp. Fails if this would make the total size
+// of the dapps tempfiles exceed its quota.
 func (fio *FileIO) WriteDappTempFile(dappName, fileName string, data []byte) error {
 	fio.mutex.Lock()
 	defer fio.mutex.Unlock()
 	dir := path.Join(fio.tempfiles,dappName)
 	initDir(dir)
-	return ioutil.WriteFile((path.Join(dir, fileName)), data, 0600)
+	fp := path.Join(dir, fileName)
+	if max := fio.tempQuotas[dappName]; max > 0 {
+		used, err := dirSize(dir)
+		if err != nil {
+			return err
+		}
+		// The file is replaced, so its old size does not count.
+		if fi, err := os.Stat(fp); err == nil {
+			used -= fi.Size()
+		}
+		if used + int64(len(data)) > max {
+			return fmt.Errorf("Tempfile quota exceeded for '%s' (%d bytes).", dappName, max)
+		}
+	}
+	return ioutil.WriteFile(fp, data, 0600)
+}
+
+// Set the maximum total size of a dapps tempfiles. 0 means no limit.
+func (fio *FileIO) SetDappTempQuota(dappName string, maxBytes int64) {
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+	fio.tempQuotas[dappName] = maxBytes
+}
+
+// Get the total size of a dapps tempfiles.
+func (fio *FileIO) DappTempUsage(dappName string) (int64, error) {
+	fio.mutex.Lock()
+	defer fio.mutex.Unlock()
+	dir := path.Join(fio.tempfiles,dappName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+	return dirSize(dir)
 }
 
 // Creates a new directory for a module, and returns the path.
@@ -211,6 +247,21 @@ func (fio *FileIO) InitPaths() error {
 	return nil
 }
 
+// Get the total size of all files in a directory (recursively).
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func initDir(Datadir string) error {
 	_, err := os.Stat(Datadir)
 	if err != nil {
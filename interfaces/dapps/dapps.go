@@ -2,6 +2,9 @@ package dapps
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"path"
 )
 
 const (
@@ -11,6 +14,23 @@ const (
 	LOADING_ORDER_FILE_NAME = "config.json"
 )
 
+// The websocket protocols a dapp can use.
+const (
+	// The ESRPC protocol. Messages are passed to the dapps javascript as-is.
+	WS_PROTOCOL_ESRPC = "esrpc"
+	// JSON-RPC 2.0. The server handles the protocol, and calls the methods
+	// that the dapp has registered.
+	WS_PROTOCOL_JSONRPC = "jsonrpc2"
+)
+
+// Errors returned by the dapp manager. They are wrapped with more
+// information, so use errors.Is.
+var (
+	ErrDappNotFound   = errors.New("No dapp with that name has been registered")
+	ErrDappRunning    = errors.New("The dapp is already running")
+	ErrDappNotRunning = errors.New("The dapp is not running")
+)
+
 type Dapp interface {
 	Models() []string
 	Path() string
@@ -30,6 +50,75 @@ type (
 		Bugs               *Bugs               `json:"bugs"`
 		Licence            *Licence            `json:"licence"`
 		ModuleDependencies []*ModuleDependency `json:"module_dependencies"`
+		Permissions        *Permissions        `json:"permissions"`
+		// Quotas can be used to lower the limits set in the decerver config,
+		// but never to raise them.
+		Quotas *scripting.Quotas `json:"quotas"`
+		// The websocket protocol ("esrpc" or "jsonrpc2"). Defaults to "esrpc".
+		WsProtocol string `json:"ws_protocol"`
+		// Other web sites that may use the dapps http, websocket and event
+		// stream endpoints. By default only pages served by the decerver can.
+		Origins *OriginPolicy `json:"origins"`
+		// How the web files (the UI) are served.
+		Static *StaticConfig `json:"static"`
+		// How often each client may call the dapp. Like quotas, they can only
+		// lower the limits set in the decerver config.
+		RateLimits *RateLimits `json:"rate_limits"`
+	}
+
+	// Token bucket rate limits, per client (ip address). Rates are per
+	// second, and the burst is how many requests (or messages) can be made
+	// at once. A rate of 0 means no limit. The burst defaults to the rate.
+	RateLimits struct {
+		// Requests to the dapps http handler, and event stream connections.
+		HttpRate  float64 `json:"http_rate"`
+		HttpBurst int     `json:"http_burst"`
+		// Messages from websocket clients.
+		WsMessageRate  float64 `json:"ws_message_rate"`
+		WsMessageBurst int     `json:"ws_message_burst"`
+	}
+
+	StaticConfig struct {
+		// The directory with the web files, relative to the dapp directory.
+		// Defaults to the dapp directory. The package file, the models
+		// folder and dot-files are never served.
+		Dir string `json:"dir"`
+		// Serve index.html for paths that has no file extension and no
+		// file, so that single-page apps can use their own routes.
+		SpaFallback bool `json:"spa_fallback"`
+		// How long browsers may cache files other than html, in seconds. 0
+		// means the default (one hour), and a negative value means that
+		// they must always revalidate.
+		MaxAge int `json:"max_age"`
+	}
+
+	OriginPolicy struct {
+		// Origins such as "https://example.com", "http://localhost:8080", or
+		// "https://*.example.com" for all sub-domains. "*" allows any origin.
+		Allowed []string `json:"allowed"`
+		// Whether cross-origin http requests may include cookies. Can not be
+		// used together with "*".
+		Credentials bool `json:"credentials"`
+		// Request headers (besides the simple ones) that cross-origin http
+		// requests may use.
+		Headers []string `json:"headers"`
+		// How long browsers may cache preflight responses, in seconds.
+		MaxAge int `json:"max_age"`
+	}
+
+	// The permissions a dapp requires. Modules are given by the name of
+	// their javascript api object (e.g. "ipfs").
+	Permissions struct {
+		Modules   []string            `json:"modules"`
+		Tempfiles bool                `json:"tempfiles"`
+		Network   *NetworkPermissions `json:"network"`
+	}
+
+	NetworkPermissions struct {
+		Outbound bool `json:"outbound"`
+		// The hosts that outbound requests may be sent to, such as "example.com",
+		// "localhost:8080", or "*.example.com" for all sub-domains.
+		AllowedHosts []string `json:"allowed_hosts"`
 	}
 
 	Author struct {
@@ -76,6 +165,70 @@ type DappInfo struct {
 	Licence    *Licence    `json:"licence"`
 }
 
+// The permission status of a dapp. Requested permissions that has
+// neither been granted nor denied by the operator are pending.
+type PermissionInfo struct {
+	DappId    string   `json:"dapp_id"`
+	Requested []string `json:"requested"`
+	Granted   []string `json:"granted"`
+	Denied    []string `json:"denied"`
+	Pending   []string `json:"pending"`
+}
+
+// Used by the operator to grant or deny permissions.
+type PermissionUpdate struct {
+	Grant []string `json:"grant"`
+	Deny  []string `json:"deny"`
+}
+
+// The resource limits of a dapp, and how much it is currently using.
+type QuotaInfo struct {
+	DappId     string            `json:"dapp_id"`
+	Limits     *scripting.Quotas `json:"limits"`
+	RateLimits *RateLimits       `json:"rate_limits"`
+	Usage      *QuotaUsage       `json:"usage"`
+}
+
+type QuotaUsage struct {
+	TempFileBytes int64 `json:"tempfile_bytes"`
+	Subscriptions int   `json:"subscriptions"`
+	WsSessions    int   `json:"ws_sessions"`
+	// Requests and messages that were refused by the rate limits.
+	Throttled *ThrottleStats `json:"throttled"`
+}
+
+// The number of requests and messages that the rate limits has refused
+// since the decerver started.
+type ThrottleStats struct {
+	HttpRequests uint64 `json:"http_requests"`
+	WsMessages   uint64 `json:"ws_messages"`
+}
+
+// Combine two sets of rate limits, keeping the strictest limit for each
+// one. Either argument may be nil.
+func StrictestRateLimits(a, b *RateLimits) *RateLimits {
+	rl := &RateLimits{}
+	if a != nil {
+		*rl = *a
+	}
+	if b == nil {
+		return rl
+	}
+	if b.HttpRate > 0 && (rl.HttpRate == 0 || b.HttpRate < rl.HttpRate) {
+		rl.HttpRate = b.HttpRate
+	}
+	if b.HttpBurst > 0 && (rl.HttpBurst == 0 || b.HttpBurst < rl.HttpBurst) {
+		rl.HttpBurst = b.HttpBurst
+	}
+	if b.WsMessageRate > 0 && (rl.WsMessageRate == 0 || b.WsMessageRate < rl.WsMessageRate) {
+		rl.WsMessageRate = b.WsMessageRate
+	}
+	if b.WsMessageBurst > 0 && (rl.WsMessageBurst == 0 || b.WsMessageBurst < rl.WsMessageBurst) {
+		rl.WsMessageBurst = b.WsMessageBurst
+	}
+	return rl
+}
+
 type LoadOrderConfig struct {
 	LoadingOrder []string `json:"loading_order"`
 }
@@ -94,6 +247,47 @@ func DappInfoFromPackageFile(pf *PackageFile) *DappInfo {
 	return di
 }
 
+// Get the names of the capabilities that a dapp requests. Package files
+// without a permissions section are given access to the modules in their
+// module dependencies, and to tempfiles, which is what dapps had before
+// permissions were added.
+func RequestedCapabilities(pf *PackageFile) []string {
+	caps := make([]string, 0)
+	perms := pf.Permissions
+	if perms == nil {
+		for _, md := range pf.ModuleDependencies {
+			caps = append(caps, scripting.ModuleCapability(md.Name))
+		}
+		return append(caps, scripting.CAP_TEMPFILES)
+	}
+	for _, mod := range perms.Modules {
+		caps = append(caps, scripting.ModuleCapability(mod))
+	}
+	if perms.Tempfiles {
+		caps = append(caps, scripting.CAP_TEMPFILES)
+	}
+	if perms.Network != nil && perms.Network.Outbound {
+		caps = append(caps, scripting.CAP_NETWORK_OUTBOUND)
+	}
+	return caps
+}
+
+// Get the hosts a dapp is allowed to send requests to.
+func AllowedHosts(pf *PackageFile) []string {
+	if pf.Permissions == nil || pf.Permissions.Network == nil {
+		return []string{}
+	}
+	return pf.Permissions.Network.AllowedHosts
+}
+
+// Get the directory that a dapps web files are served from.
+func StaticDir(dir string, pf *PackageFile) string {
+	if pf.Static == nil || pf.Static.Dir == "" {
+		return dir
+	}
+	return path.Join(dir, pf.Static.Dir)
+}
+
 func NewPackageFileFromJson(pfJson []byte) (*PackageFile, error) {
 	pf := &PackageFile{}
 	err := json.Unmarshal(pfJson, pf)
@@ -106,5 +300,19 @@ func NewPackageFileFromJson(pfJson []byte) (*PackageFile, error) {
 type DappManager interface {
 	DappList() []*DappInfo
 	LoadDapp(dappId string) error
+	// Stop a running dapp.
+	StopDapp(dappId string) error
+	// The id of the running dapp, or the empty string if none is.
+	RunningDapp() string
+	// Remove a dapp, and its routes. It is stopped first if it is running.
+	RemoveDapp(dappId string) error
 	RegisterDapps(string, string) error
+	// Get the permission status of a dapp.
+	Permissions(dappId string) (*PermissionInfo, error)
+	// Grant and/or deny permissions. Takes effect the next time the dapp is loaded.
+	UpdatePermissions(dappId string, update *PermissionUpdate) error
+	// Get the quotas that applies to a dapp.
+	Quotas(dappId string) (*scripting.Quotas, error)
+	// Get the rate limits that applies to a dapp.
+	RateLimits(dappId string) (*RateLimits, error)
 }
@@ -5,17 +5,98 @@ import (
 	"github.com/eris-ltd/decerver/interfaces/dapps"
 	"github.com/eris-ltd/decerver/interfaces/events"
 	"github.com/eris-ltd/decerver/interfaces/files"
+	"github.com/eris-ltd/decerver/interfaces/logging"
 	"github.com/eris-ltd/decerver/interfaces/modules"
 	"github.com/eris-ltd/decerver/interfaces/network"
+	"github.com/eris-ltd/decerver/tracing"
 )
 
 // The decerver configuration file.
 type DCConfig struct {
+	// The decerver log file, in the log directory (empty means stdout
+	// only). Dapp logs are written to the 'dapps' sub directory.
 	LogFile    string `json:"logfile"`
+	// Log format, levels and rotation.
+	Logging    *logging.Config `json:"logging"`
+	// Request tracing. It is off unless a trace file or collector is set.
+	Tracing    *tracing.Config `json:"tracing"`
 	MaxClients int    `json:"max_clients"`
+	// The maximum number of websocket (and event stream) connections from
+	// a single ip address. 0 means no limit.
+	MaxClientsPerIp int `json:"max_clients_per_ip"`
 	Hostname   string `json:"hostname"`
 	Port       int    `json:"port"`
+	// Other names that the decerver is reached by (host or host:port),
+	// e.g. through a proxy. Requests for hosts other then these and the
+	// hostname are refused. If the hostname is a loopback address,
+	// 'localhost' and the loopback addresses are allowed as well.
+	ServerNames []string `json:"server_names"`
 	DebugMode  bool   `json:"debug_mode"`
+	// If set, the permissions that dapps request must be granted through
+	// the admin api before they are given to the dapp.
+	RequirePermissionApproval bool `json:"require_permission_approval"`
+	// Default resource limits for dapps.
+	Quotas     *scripting.Quotas `json:"quotas"`
+	// Default rate limits for the endpoints of dapps (per client).
+	RateLimits *dapps.RateLimits `json:"rate_limits"`
+	// Websocket settings.
+	Websocket  *WsConfig `json:"websocket"`
+	// The queues that events wait in before they are posted to subscribers.
+	EventQueue *EventQueueConfig `json:"event_queue"`
+	// The time (in milliseconds) each component gets to stop when the
+	// decerver shuts down.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// If set, the web server uses https instead of http.
+	Tls *TlsConfig `json:"tls"`
+	// A unix domain socket to serve on as well, for local tools (empty
+	// means none). The socket is only accessible to the user that runs
+	// the decerver.
+	UnixSocket string `json:"unix_socket"`
+}
+
+// Event queue settings. Each subscriber has a queue of its own, and its
+// events are posted from a goroutine of its own, so that a slow subscriber
+// does not hold up the others. Fields that are left out (or 0) gets the
+// default value.
+type EventQueueConfig struct {
+	// The number of events that can wait for a subscriber.
+	Size int `json:"size"`
+	// What to do with new events when a queue is full: "drop_oldest" (the
+	// default), "drop_newest" or "block".
+	Overflow string `json:"overflow"`
+	// With "block", the time (in milliseconds) to wait for room in the
+	// queue. The event is dropped if there is still no room after that.
+	BlockTimeout int `json:"block_timeout"`
+}
+
+// TLS settings for the web server.
+type TlsConfig struct {
+	// The certificate and key (PEM files). If both are left out, a
+	// self-signed certificate is generated and stored in the system
+	// directory.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CA certificates (PEM file) that client certificates are verified
+	// against. If set, requests to the /admin routes must present a valid
+	// client certificate (except over the unix socket).
+	ClientCaFile string `json:"client_ca_file"`
+}
+
+// Websocket settings. Times are in milliseconds. Fields that are left
+// out (or 0) gets the default value.
+type WsConfig struct {
+	// How often the server pings clients.
+	PingPeriod int `json:"ping_period"`
+	// How long the server waits for a pong (or any other message) before
+	// it considers the connection dead. Must be longer then the ping period.
+	PongWait int `json:"pong_wait"`
+	// The time allowed to write a message to a client.
+	WriteWait int `json:"write_wait"`
+	// The largest message (in bytes) a client may send. Dapps can lower it
+	// with the 'max_ws_message_bytes' quota.
+	MaxMessageSize int64 `json:"max_message_size"`
+	// Use permessage-deflate compression with clients that support it.
+	Compression bool `json:"compression"`
 }
 
 
@@ -13,8 +13,24 @@ type EventProcessor interface {
 	Subscribe(sub Subscriber) error
 	Unsubscribe(id string) error
 	TrafficData() string
+	// Limit the number of subscriptions an owner can have at once (0 means no limit).
+	SetSubscriptionLimit(owner string, max int)
+	// The number of subscriptions an owner currently has.
+	SubscriptionCount(owner string) int
+	// Stop processing events. Subscribe and Unsubscribe fails after this.
+	Shutdown()
 }
 
+// What to do with new events when the queue of a subscriber is full.
+const (
+	// Drop the oldest event in the queue to make room.
+	OVERFLOW_DROP_OLDEST = "drop_oldest"
+	// Drop the new event.
+	OVERFLOW_DROP_NEWEST = "drop_newest"
+	// Wait for room (for a limited time). This holds up all events.
+	OVERFLOW_BLOCK = "block"
+)
+
 // A default object that implements 'Event'
 type Event struct {
 	Event     string
@@ -37,3 +53,10 @@ type Subscriber interface {
 	// The target (if any).
 	Target() string
 }
+
+// Subscribers that belongs to someone, such as a dapp, should implement
+// this, so that subscription limits can be enforced.
+type OwnedSubscriber interface {
+	Subscriber
+	Owner() string
+}
@@ -29,6 +29,10 @@ type FileIO interface {
 	// Convenience method for writing dapp and module tempfiles
 	WriteDappTempFile(string, string, []byte) error
 	ReadDappTempFile(string, string) ([]byte,error)
+	// Set the maximum number of bytes a dapp may store in tempfiles (0 means no limit).
+	SetDappTempQuota(string, int64)
+	// The number of bytes a dapp currently stores in tempfiles.
+	DappTempUsage(string) (int64, error)
 	WriteModuleTempFile(string, string, []byte) error
 	ReadModuleTempFile(string, string) ([]byte,error)
 }
@@ -1,10 +1,484 @@
+// Package logging contains the leveled, structured logger that all parts
+// of the decerver use. Each component (webserver, runtime manager, etc.)
+// has its own logger, and its own level, which can be changed while the
+// decerver runs. Entries are written as logfmt or json, to stdout and
+// (if configured) to a log file that is rotated when it gets too large or
+// too old.
+//
+// Dapps log through their own loggers (see DappLogger). Their entries also
+// go to a separate file for each dapp.
 package logging
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func NewLogger(name string) *log.Logger {
-	return log.New(os.Stdout, "["+name+"] ", log.LstdFlags)
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+// Marks a component that has no level of its own.
+const levelUnset = -1
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DEBUG || l > ERROR {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return INFO, fmt.Errorf("Unknown log level: %s", s)
+}
+
+// Output formats.
+const (
+	FORMAT_LOGFMT = "logfmt"
+	FORMAT_JSON   = "json"
+)
+
+// The sub directory of the log directory that dapp logs are written to.
+const DAPP_LOG_DIR = "dapps"
+
+// Logging settings.
+type Config struct {
+	// "logfmt" (the default) or "json".
+	Format string `json:"format"`
+	// The level of components that have no level of their own. The default
+	// is "info".
+	Level string `json:"level"`
+	// Levels by component name.
+	Levels map[string]string `json:"levels"`
+	// Log files are rotated when they reach this size (in bytes), or when
+	// they have been written to for this long (in hours). Only the newest
+	// rotated files are kept. 0 means no limit.
+	MaxSize    int64 `json:"max_size"`
+	MaxAge     int   `json:"max_age"`
+	MaxBackups int   `json:"max_backups"`
+}
+
+// The current levels.
+type LevelInfo struct {
+	Default string `json:"default"`
+	// The level of each component. Components without a level of their
+	// own have the default level.
+	Components map[string]string `json:"components"`
+}
+
+// A change of levels. The empty string as a component level means that
+// the component uses the default level.
+type LevelUpdate struct {
+	Default    string            `json:"default,omitempty"`
+	Components map[string]string `json:"components"`
+}
+
+type component struct {
+	level int32
+}
+
+type output struct {
+	mutex  *sync.Mutex
+	format string
+	// Stdout, and the log file if there is one.
+	writers []io.Writer
+	file    *RotatingFile
+	// Where dapp logs are written. Empty means they are not.
+	dappDir   string
+	dappFiles map[string]*RotatingFile
+	// Rotation settings for the files.
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+}
+
+var (
+	componentMutex = &sync.Mutex{}
+	components     = make(map[string]*component)
+	defaultLevel   = int32(INFO)
+	out            = &output{
+		mutex:     &sync.Mutex{},
+		format:    FORMAT_LOGFMT,
+		writers:   []io.Writer{os.Stdout},
+		dappFiles: make(map[string]*RotatingFile),
+	}
+	// Replaced in tests.
+	now  = time.Now
+	exit = os.Exit
+)
+
+type Logger struct {
+	name string
+	comp *component
+	// Key/value pairs that are added to every entry.
+	fields []interface{}
+	// Set for dapp loggers.
+	dappId string
+}
+
+// Get the logger of a component. Loggers with the same name share a
+// level.
+func NewLogger(name string) *Logger {
+	componentMutex.Lock()
+	defer componentMutex.Unlock()
+	comp, ok := components[name]
+	if !ok {
+		comp = &component{levelUnset}
+		components[name] = comp
+	}
+	return &Logger{name: name, comp: comp}
+}
+
+var dappComponent = NewLogger("Dapp")
+
+// Get the logger of a dapp. Its entries are written to the dapp's own log
+// file as well. All dapps share the "Dapp" level.
+func DappLogger(dappId string) *Logger {
+	l := dappComponent.With("dapp", dappId)
+	l.dappId = dappId
+	return l
+}
+
+// Close the log file of a dapp. It is opened again if the dapp logs
+// something after this.
+func CloseDappLog(dappId string) {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if rf, ok := out.dappFiles[dappId]; ok {
+		rf.Close()
+		delete(out.dappFiles, dappId)
+	}
+}
+
+// Get a logger that adds key/value pairs to each entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	nl := *l
+	nl.fields = append(append([]interface{}(nil), l.fields...), kv...)
+	return &nl
+}
+
+func (l *Logger) Level() Level {
+	if level := atomic.LoadInt32(&l.comp.level); level != levelUnset {
+		return Level(level)
+	}
+	return Level(atomic.LoadInt32(&defaultLevel))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DEBUG, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(INFO, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WARN, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ERROR, msg, kv)
+}
+
+// The Print functions work like those of log.Logger, and log at the info
+// level.
+func (l *Logger) Print(v ...interface{}) {
+	l.log(INFO, fmt.Sprint(v...), nil)
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.log(INFO, fmt.Sprintln(v...), nil)
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.log(INFO, fmt.Sprintf(format, v...), nil)
+}
+
+// Log at the error level and exit.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.log(ERROR, fmt.Sprint(v...), nil)
+	exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append([]interface{}(nil), fields...), kv...)
+	}
+	out.write(l, now(), level, msg, fields)
+}
+
+func (o *output) write(l *Logger, t time.Time, level Level, msg string, fields []interface{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entry := formatEntry(o.format, t, level, l.name, msg, fields)
+	for _, w := range o.writers {
+		w.Write(entry)
+	}
+	if l.dappId != "" && o.dappDir != "" {
+		if rf := o.dappFile(l.dappId); rf != nil {
+			rf.Write(entry)
+		}
+	}
+}
+
+// Not thread safe.
+func (o *output) dappFile(dappId string) *RotatingFile {
+	if rf, ok := o.dappFiles[dappId]; ok {
+		return rf
+	}
+	// Dapp ids are directory names, but make sure.
+	name := filepath.Base(filepath.Clean("/" + dappId))
+	if name == "/" || name == "." {
+		return nil
+	}
+	rf, err := OpenRotatingFile(filepath.Join(o.dappDir, name+".log"), o.maxSize, o.maxAge, o.maxBackups)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open dapp log: %s\n", err.Error())
+		return nil
+	}
+	o.dappFiles[dappId] = rf
+	return rf
+}
+
+func formatEntry(format string, t time.Time, level Level, name, msg string, fields []interface{}) []byte {
+	buf := &bytes.Buffer{}
+	ts := t.UTC().Format(time.RFC3339Nano)
+	if format == FORMAT_JSON {
+		// Fields are written in order, so a map can not be used.
+		buf.WriteString(`{"time":` + jsonString(ts) + `,"level":` + jsonString(level.String()) +
+			`,"component":` + jsonString(name) + `,"msg":` + jsonString(msg))
+		for i := 0; i < len(fields); i += 2 {
+			key, val := fieldAt(fields, i)
+			bts, err := json.Marshal(val)
+			if err != nil {
+				bts = []byte(jsonString(fmt.Sprint(val)))
+			}
+			buf.WriteString("," + jsonString(key) + ":")
+			buf.Write(bts)
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+	buf.WriteString("time=" + ts + " level=" + level.String() + " component=" + logfmtValue(name) + " msg=" + logfmtValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		key, val := fieldAt(fields, i)
+		buf.WriteString(" " + logfmtKey(key) + "=" + logfmtValue(fmt.Sprint(val)))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Get the key/value pair at i. A key without a value gets nil.
+func fieldAt(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 < len(fields) {
+		return key, fields[i+1]
+	}
+	return key, nil
+}
+
+func jsonString(s string) string {
+	bts, _ := json.Marshal(s)
+	return string(bts)
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+func logfmtValue(val string) string {
+	if val == "" {
+		return `""`
+	}
+	if strings.IndexFunc(val, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' || r == '\\' }) < 0 {
+		return val
+	}
+	return strconv.Quote(val)
+}
+
+// Apply the config. Dir is the log directory, and file the name of the
+// decerver log file in it (an absolute path is used as-is). If file is
+// empty, the log is only written to stdout. Dapp logs are written to the
+// 'dapps' sub directory. Either cfg or dir may be nil/empty.
+func Configure(cfg *Config, dir, file string) error {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	format := cfg.Format
+	if format == "" {
+		format = FORMAT_LOGFMT
+	}
+	if format != FORMAT_LOGFMT && format != FORMAT_JSON {
+		return fmt.Errorf("Unknown log format: %s", cfg.Format)
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.MaxBackups < 0 {
+		return fmt.Errorf("Log rotation settings can not be negative.")
+	}
+	update := &LevelUpdate{Default: cfg.Level, Components: cfg.Levels}
+	if update.Default == "" {
+		update.Default = INFO.String()
+	}
+	if err := checkLevels(update); err != nil {
+		return err
+	}
+	maxAge := time.Duration(cfg.MaxAge) * time.Hour
+
+	var rf *RotatingFile
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			if dir == "" {
+				return fmt.Errorf("Log file '%s' is relative, but there is no log directory.", file)
+			}
+			file = filepath.Join(dir, file)
+		}
+		var err error
+		rf, err = OpenRotatingFile(file, cfg.MaxSize, maxAge, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	dappDir := ""
+	if dir != "" {
+		dappDir = filepath.Join(dir, DAPP_LOG_DIR)
+		if err := os.MkdirAll(dappDir, 0755); err != nil {
+			if rf != nil {
+				rf.Close()
+			}
+			return err
+		}
+	}
+
+	out.mutex.Lock()
+	if out.file != nil {
+		out.file.Close()
+	}
+	for id, drf := range out.dappFiles {
+		drf.Close()
+		delete(out.dappFiles, id)
+	}
+	out.format = format
+	out.writers = []io.Writer{os.Stdout}
+	out.file = rf
+	if rf != nil {
+		out.writers = append(out.writers, rf)
+	}
+	out.dappDir = dappDir
+	out.maxSize, out.maxAge, out.maxBackups = cfg.MaxSize, maxAge, cfg.MaxBackups
+	out.mutex.Unlock()
+
+	return SetLevels(update)
+}
+
+// Close the log files. Logging goes on, to stdout only.
+func Close() {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if out.file != nil {
+		out.file.Close()
+		out.file = nil
+	}
+	for id, rf := range out.dappFiles {
+		rf.Close()
+		delete(out.dappFiles, id)
+	}
+	out.writers = []io.Writer{os.Stdout}
+	out.dappDir = ""
+}
+
+func checkLevels(update *LevelUpdate) error {
+	if update.Default != "" {
+		if _, err := ParseLevel(update.Default); err != nil {
+			return err
+		}
+	}
+	for name, level := range update.Components {
+		if level == "" {
+			continue
+		}
+		if _, err := ParseLevel(level); err != nil {
+			return fmt.Errorf("%s (component: %s)", err.Error(), name)
+		}
+	}
+	return nil
+}
+
+// Change levels. Nothing is changed if a level is invalid. Components that
+// do not exist yet get their level when they are created.
+func SetLevels(update *LevelUpdate) error {
+	if err := checkLevels(update); err != nil {
+		return err
+	}
+	if update.Default != "" {
+		level, _ := ParseLevel(update.Default)
+		atomic.StoreInt32(&defaultLevel, int32(level))
+	}
+	componentMutex.Lock()
+	defer componentMutex.Unlock()
+	for name, levelStr := range update.Components {
+		comp, ok := components[name]
+		if !ok {
+			comp = &component{levelUnset}
+			components[name] = comp
+		}
+		level := int32(levelUnset)
+		if levelStr != "" {
+			l, _ := ParseLevel(levelStr)
+			level = int32(l)
+		}
+		atomic.StoreInt32(&comp.level, level)
+	}
+	return nil
+}
+
+// Get the levels of all components.
+func Levels() *LevelInfo {
+	li := &LevelInfo{}
+	def := Level(atomic.LoadInt32(&defaultLevel))
+	li.Default = def.String()
+	li.Components = make(map[string]string)
+	componentMutex.Lock()
+	defer componentMutex.Unlock()
+	for name, comp := range components {
+		level := Level(atomic.LoadInt32(&comp.level))
+		if level == levelUnset {
+			level = def
+		}
+		li.Components[name] = level.String()
+	}
+	return li
 }
@@ -0,0 +1,240 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// Write entries to a buffer, at a fixed time. Everything is restored when
+// the test ends.
+func captureLog(t *testing.T, format string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	out.mutex.Lock()
+	oldFormat, oldWriters := out.format, out.writers
+	out.format = format
+	out.writers = []io.Writer{buf}
+	out.mutex.Unlock()
+	oldDefault := Levels().Default
+	now = func() time.Time { return testTime }
+	t.Cleanup(func() {
+		Close()
+		out.mutex.Lock()
+		out.format, out.writers = oldFormat, oldWriters
+		out.mutex.Unlock()
+		SetLevels(&LevelUpdate{Default: oldDefault})
+		now = time.Now
+	})
+	return buf
+}
+
+func TestFormats(t *testing.T) {
+	buf := captureLog(t, FORMAT_LOGFMT)
+	l := NewLogger("Test Formats").With("dapp", "a b")
+	l.Info("Started.\n", "port", 3000, "err", nil, "odd")
+	want := `time=2015-03-01T12:00:00Z level=info component="Test Formats" msg=Started. dapp="a b" port=3000 err=<nil> odd=<nil>` + "\n"
+	if buf.String() != want {
+		t.Errorf("Wrong logfmt entry.\nExpected: %sGot: %s", want, buf.String())
+	}
+
+	buf.Reset()
+	out.format = FORMAT_JSON
+	l.Warn("Say \"hi\"", "port", 3000, "tags", []string{"x"})
+	want = `{"time":"2015-03-01T12:00:00Z","level":"warn","component":"Test Formats","msg":"Say \"hi\"","dapp":"a b","port":3000,"tags":["x"]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("Wrong json entry.\nExpected: %sGot: %s", want, buf.String())
+	}
+}
+
+func TestLevels(t *testing.T) {
+	buf := captureLog(t, FORMAT_LOGFMT)
+	a, b := NewLogger("Test A"), NewLogger("Test B")
+	if err := SetLevels(&LevelUpdate{Default: "warn", Components: map[string]string{"Test A": "debug"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Debug("a")
+	b.Info("b")
+	b.Error("c")
+	if got := buf.String(); !strings.Contains(got, "msg=a") || strings.Contains(got, "msg=b") || !strings.Contains(got, "msg=c") {
+		t.Errorf("Wrong entries were written:\n%s", got)
+	}
+	// Loggers with the same name share the level.
+	if !NewLogger("Test A").Enabled(DEBUG) {
+		t.Error("The level is not shared.")
+	}
+
+	li := Levels()
+	if li.Default != "warn" || li.Components["Test A"] != "debug" || li.Components["Test B"] != "warn" {
+		t.Errorf("Wrong levels: %v\n", li)
+	}
+
+	// Invalid updates change nothing.
+	if err := SetLevels(&LevelUpdate{Default: "error", Components: map[string]string{"Test B": "loud"}}); err == nil {
+		t.Error("Invalid level was accepted.")
+	}
+	if Levels().Default != "warn" {
+		t.Error("Default level was changed by an invalid update.")
+	}
+
+	// Reset to the default, and set the level of a component that does
+	// not exist yet.
+	SetLevels(&LevelUpdate{Components: map[string]string{"Test A": "", "Test C": "error"}})
+	if a.Enabled(DEBUG) || !a.Enabled(WARN) {
+		t.Error("Level was not reset.")
+	}
+	if NewLogger("Test C").Level() != ERROR {
+		t.Error("New component did not get its level.")
+	}
+}
+
+func TestFatal(t *testing.T) {
+	buf := captureLog(t, FORMAT_LOGFMT)
+	code := 0
+	exit = func(c int) { code = c }
+	defer func() { exit = os.Exit }()
+	NewLogger("Test").Fatal("Bad", "thing")
+	if code != 1 || !strings.Contains(buf.String(), "level=error") {
+		t.Errorf("Wrong exit code (%d) or entry: %s", code, buf.String())
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	captureLog(t, FORMAT_LOGFMT)
+	dir := t.TempDir()
+	tests := []struct {
+		cfg  *Config
+		dir  string
+		file string
+		ok   bool
+	}{
+		{nil, "", "", true},
+		{&Config{Format: "xml"}, dir, "", false},
+		{&Config{Level: "loud"}, dir, "", false},
+		{&Config{Levels: map[string]string{"Test": "loud"}}, dir, "", false},
+		{&Config{MaxSize: -1}, dir, "", false},
+		{&Config{}, "", "decerver.log", false},
+		{&Config{Format: FORMAT_JSON}, dir, "decerver.log", true},
+	}
+	for i, test := range tests {
+		if err := Configure(test.cfg, test.dir, test.file); (err == nil) != test.ok {
+			t.Errorf("%d: Expected ok: %v, Got: %v\n", i, test.ok, err)
+		}
+	}
+
+	NewLogger("Test").Info("To file.")
+	bts, err := os.ReadFile(filepath.Join(dir, "decerver.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(string(bts), `{"time":`) || !strings.Contains(string(bts), "To file.") {
+		t.Errorf("Wrong log file contents: %s\n", bts)
+	}
+}
+
+func TestDappLogger(t *testing.T) {
+	buf := captureLog(t, FORMAT_LOGFMT)
+	dir := t.TempDir()
+	if err := Configure(nil, dir, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	out.writers = []io.Writer{buf}
+	DappLogger("mydapp").Println("hello", 1)
+	DappLogger("../other").Println("hi")
+	NewLogger("Test").Info("Not a dapp.")
+
+	bts, err := os.ReadFile(filepath.Join(dir, DAPP_LOG_DIR, "mydapp.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "time=2015-03-01T12:00:00Z level=info component=Dapp msg=\"hello 1\" dapp=mydapp\n"
+	if string(bts) != want {
+		t.Errorf("Wrong dapp log.\nExpected: %sGot: %s", want, bts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DAPP_LOG_DIR, "other.log")); err != nil {
+		t.Error("Dapp id was not cleaned.")
+	}
+	// Dapp entries go to the main log as well.
+	if strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("Wrong main log:\n%s", buf.String())
+	}
+
+	// The file is opened again after it is closed.
+	CloseDappLog("mydapp")
+	DappLogger("mydapp").Print("again")
+	bts, _ = os.ReadFile(filepath.Join(dir, DAPP_LOG_DIR, "mydapp.log"))
+	if !strings.Contains(string(bts), "msg=again") {
+		t.Errorf("Nothing was written after closing: %s", bts)
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	defer func() { now = time.Now }()
+	tm := testTime
+	now = func() time.Time {
+		tm = tm.Add(time.Second)
+		return tm
+	}
+	p := filepath.Join(t.TempDir(), "test.log")
+	rf, err := OpenRotatingFile(p, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rf.Close()
+	for _, entry := range []string{"aaaaaa\n", "bbbbbb\n", "cc\n", "dddddddddddddddd\n", "eeeeee\n"} {
+		if _, err := rf.Write([]byte(entry)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	bts, _ := os.ReadFile(p)
+	if string(bts) != "eeeeee\n" {
+		t.Errorf("Wrong current file: %q\n", bts)
+	}
+	backups := rf.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Wrong number of backups: %v\n", backups)
+	}
+	// Entries are never split, even if they are too large.
+	for i, want := range []string{"bbbbbb\ncc\n", "dddddddddddddddd\n"} {
+		bts, _ := os.ReadFile(backups[i])
+		if string(bts) != want {
+			t.Errorf("Backup %d: Expected: %q, Got: %q\n", i, want, bts)
+		}
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	defer func() { now = time.Now }()
+	tm := testTime
+	now = func() time.Time { return tm }
+	p := filepath.Join(t.TempDir(), "test.log")
+	rf, err := OpenRotatingFile(p, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rf.Close()
+	rf.Write([]byte("a\n"))
+	tm = tm.Add(59 * time.Minute)
+	rf.Write([]byte("b\n"))
+	tm = tm.Add(time.Minute)
+	rf.Write([]byte("c\n"))
+
+	backups := rf.backups()
+	if len(backups) != 1 || filepath.Base(backups[0]) != "test-20150301T130000.000.log" {
+		t.Fatalf("Wrong backups: %v\n", backups)
+	}
+	bts, _ := os.ReadFile(backups[0])
+	if string(bts) != "a\nb\n" {
+		t.Errorf("Wrong backup: %q\n", bts)
+	}
+	rf.Close()
+	if _, err := rf.Write([]byte("d\n")); err == nil {
+		t.Error("Wrote to a closed file.")
+	}
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time format in the names of rotated files. It sorts in time order.
+const rotateTimeFormat = "20060102T150405.000"
+
+// A file that is rotated when it reaches a size, or has been written to for
+// some time. The rotated file is renamed to 'name-<time>.ext', and only
+// the newest rotated files are kept.
+type RotatingFile struct {
+	mutex *sync.Mutex
+	path  string
+	// 0 means no limit.
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	// When the current file was opened.
+	opened time.Time
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{}
+	rf.mutex = &sync.Mutex{}
+	rf.path = path
+	rf.maxSize = maxSize
+	rf.maxAge = maxAge
+	rf.maxBackups = maxBackups
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Not thread safe.
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = fi.Size()
+	rf.opened = now()
+	return nil
+}
+
+// Write to the file, rotating it first if needed. An entry is never split
+// between files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return 0, fmt.Errorf("Log file is closed: %s", rf.path)
+	}
+	if rf.size > 0 && ((rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize) || (rf.maxAge > 0 && now().Sub(rf.opened) >= rf.maxAge)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Not thread safe.
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	ext := filepath.Ext(rf.path)
+	base := strings.TrimSuffix(rf.path, ext)
+	rotated := base + "-" + now().UTC().Format(rotateTimeFormat) + ext
+	// Rotations within the same millisecond get a counter.
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s-%s.%d%s", base, now().UTC().Format(rotateTimeFormat), i, ext)
+	}
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.removeOld()
+	return nil
+}
+
+// Remove the oldest rotated files, so that no more then maxBackups are
+// kept. Not thread safe.
+func (rf *RotatingFile) removeOld() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups := rf.backups()
+	for len(backups) > rf.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// The rotated files, oldest first.
+func (rf *RotatingFile) backups() []string {
+	ext := filepath.Ext(rf.path)
+	base := strings.TrimSuffix(rf.path, ext)
+	matches, _ := filepath.Glob(globEscape(base) + "-*" + globEscape(ext))
+	backups := make([]string, 0, len(matches))
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, base+"-"), ext)
+		if len(stamp) >= len(rotateTimeFormat) {
+			if _, err := time.Parse(rotateTimeFormat, stamp[:len(rotateTimeFormat)]); err == nil {
+				backups = append(backups, m)
+			}
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func fileExists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func globEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	return r.Replace(s)
+}
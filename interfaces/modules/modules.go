@@ -18,6 +18,24 @@ type (
 		Name  string `json:"name"`
 		EMail string `json:"e-mail"`
 	}
+
+	// The state of a module, as tracked by the module manager.
+	ModuleStatus struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+		// Set if the module failed to init, start or shut down.
+		Error string `json:"error"`
+	}
+)
+
+// Module states.
+const (
+	MODULE_REGISTERED  = "registered"
+	MODULE_INITIALIZED = "initialized"
+	MODULE_STARTING    = "starting"
+	MODULE_RUNNING     = "running"
+	MODULE_STOPPED     = "stopped"
+	MODULE_FAILED      = "failed"
 )
 
 type (
@@ -44,6 +62,8 @@ type (
 		Init() error
 		Start() error
 		Shutdown() error
+		// The state of each module, sorted by name.
+		Status() []*ModuleStatus
 	}
 	
 	// This is the functionality that decerver exports to modules
@@ -1,7 +1,8 @@
 package network
 
 import (
-	"github.com/eris-ltd/decerver/interfaces/dapps"		
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"time"
 )
 
 // Websocket session
@@ -11,9 +12,49 @@ type WsSession interface {
 	WriteCloseMsg()
 }
 
+// Information about a live websocket session.
+type SessionInfo struct {
+	Id         uint32    `json:"id"`
+	DappId     string    `json:"dapp_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	State      string    `json:"state"`
+	Opened     time.Time `json:"opened"`
+	Protocol   string    `json:"protocol"`
+	MsgsIn     uint64    `json:"msgs_in"`
+	MsgsOut    uint64    `json:"msgs_out"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+}
+
 // Webserver
 type Server interface {
 	AddDappManager(dapps.DappManager)
-	RegisterDapp(dappId string)
+	// Add the routes of a dapp. If it already has routes, they are
+	// replaced.
+	RegisterDapp(dappId string) error
+	// Remove the routes and settings of a dapp.
+	UnregisterDapp(dappId string)
 	Start() error
+	// The number of open websocket sessions for a dapp.
+	SessionCount(dappId string) int
+	// The live websocket sessions, sorted by id.
+	Sessions() []*SessionInfo
+	// Set the websocket protocol for a dapp (see dapps.WS_PROTOCOL_*). It
+	// applies to sessions that are opened after the call.
+	SetWsProtocol(dappId, protocol string) error
+	// Set which other origins may use a dapps endpoints. nil means only
+	// pages served by the decerver. It applies to requests and sessions
+	// that are made after the call.
+	SetOriginPolicy(dappId string, policy *dapps.OriginPolicy) error
+	// Set where a dapps web files are, and how they are served. Dir is the
+	// dapp directory.
+	SetStaticFiles(dappId, dir string, config *dapps.StaticConfig) error
+	// Set the rate limits of a dapp. nil means no limits.
+	SetRateLimits(dappId string, limits *dapps.RateLimits) error
+	// The requests and messages to a dapp that were refused by its rate
+	// limits.
+	Throttled(dappId string) *dapps.ThrottleStats
+	// Stop accepting connections, close websocket sessions and event
+	// streams, and wait for in-flight requests until the timeout.
+	Shutdown(timeout time.Duration) error
 }
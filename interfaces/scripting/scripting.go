@@ -1,7 +1,9 @@
 package scripting
 
 import (
+	"context"
 	"github.com/eris-ltd/decerver/interfaces/types"	
+	"time"
 )
 
 const (
@@ -11,23 +13,110 @@ const (
 	STATUS_CRITICAL
 )
 
+// Capabilities that can be granted to a runtime. Module api objects are
+// granted by their object name, prefixed by CAP_MODULE_PREFIX (e.g. "modules.ipfs").
+const (
+	CAP_MODULE_PREFIX    = "modules."
+	CAP_TEMPFILES        = "tempfiles"
+	CAP_NETWORK_OUTBOUND = "network.outbound"
+)
+
 // typedef for javascript objects.
 type SObject map[string]interface{}
 
+// Resource limits for a dapp. A value of 0 means no limit.
+type Quotas struct {
+	// The total size of all tempfiles written by the dapp.
+	MaxTempFileBytes int64 `json:"max_tempfile_bytes"`
+	// The number of event subscriptions the dapp may have at once.
+	MaxSubscriptions int `json:"max_subscriptions"`
+	// The number of websocket sessions the dapp may have at once.
+	MaxWsSessions int `json:"max_ws_sessions"`
+	// The time (in milliseconds) a single call into the runtime, or a
+	// script (such as a model), may take before it is interrupted.
+	MaxCallTime int `json:"max_call_time"`
+	// The size of response bodies from outbound http requests.
+	MaxHttpResponseBytes int64 `json:"max_http_response_bytes"`
+	// The size of messages that websocket clients may send to the dapp.
+	// It can not be raised above the servers limit.
+	MaxWsMessageBytes int64 `json:"max_ws_message_bytes"`
+	// The size of request bodies that clients may send to the dapps http
+	// handler.
+	MaxHttpRequestBytes int64 `json:"max_http_request_bytes"`
+}
+
+// Combine two sets of quotas, keeping the strictest limit for each one.
+// Either argument may be nil.
+func StrictestQuotas(a, b *Quotas) *Quotas {
+	q := &Quotas{}
+	if a != nil {
+		*q = *a
+	}
+	if b == nil {
+		return q
+	}
+	if b.MaxTempFileBytes > 0 && (q.MaxTempFileBytes == 0 || b.MaxTempFileBytes < q.MaxTempFileBytes) {
+		q.MaxTempFileBytes = b.MaxTempFileBytes
+	}
+	if b.MaxSubscriptions > 0 && (q.MaxSubscriptions == 0 || b.MaxSubscriptions < q.MaxSubscriptions) {
+		q.MaxSubscriptions = b.MaxSubscriptions
+	}
+	if b.MaxWsSessions > 0 && (q.MaxWsSessions == 0 || b.MaxWsSessions < q.MaxWsSessions) {
+		q.MaxWsSessions = b.MaxWsSessions
+	}
+	if b.MaxCallTime > 0 && (q.MaxCallTime == 0 || b.MaxCallTime < q.MaxCallTime) {
+		q.MaxCallTime = b.MaxCallTime
+	}
+	if b.MaxHttpResponseBytes > 0 && (q.MaxHttpResponseBytes == 0 || b.MaxHttpResponseBytes < q.MaxHttpResponseBytes) {
+		q.MaxHttpResponseBytes = b.MaxHttpResponseBytes
+	}
+	if b.MaxWsMessageBytes > 0 && (q.MaxWsMessageBytes == 0 || b.MaxWsMessageBytes < q.MaxWsMessageBytes) {
+		q.MaxWsMessageBytes = b.MaxWsMessageBytes
+	}
+	if b.MaxHttpRequestBytes > 0 && (q.MaxHttpRequestBytes == 0 || b.MaxHttpRequestBytes < q.MaxHttpRequestBytes) {
+		q.MaxHttpRequestBytes = b.MaxHttpRequestBytes
+	}
+	return q
+}
+
+// The set of capabilities that has been granted to a runtime.
+type Capabilities map[string]bool
+
+func (c Capabilities) Has(name string) bool {
+	return c[name]
+}
+
+// Get the capability name for the module api object with the given name.
+func ModuleCapability(objectName string) string {
+	return CAP_MODULE_PREFIX + objectName
+}
+
 type(
 	// This is the interface for the javascript runtime manager, or 'Atë'.
 	RuntimeManager interface {
 		GetRuntime(string) Runtime
-		CreateRuntime(string) Runtime
+		// The ids of the runtimes, sorted.
+		RuntimeIds() []string
+		// Create a runtime. Only the api objects and functions that are
+		// covered by the given capabilities are made available.
+		CreateRuntime(string, Capabilities) Runtime
 		RemoveRuntime(string)
 		RegisterApiObject(string, interface{})
+		// Register a function that creates an api object for each new runtime. It
+		// is used for objects that must know which runtime they are bound to. No
+		// capability is needed to use these objects.
+		RegisterApiObjectFactory(string, func(Runtime) interface{})
 		RegisterApiScript(string)
 		ShutdownRuntimes()
+		// Write the profile of a runtime to the log directory. Returns the file path.
+		DumpProfile(string) (string, error)
 	}
 
 	// This is the interface for a javascript runtime.
 	Runtime interface {
 		Init(string)
+		// The capabilities that has been granted to this runtime.
+		Capabilities() Capabilities
 		Shutdown()
 		// This is normally the same as the dapp id when running decerver.
 		Id() string
@@ -37,6 +126,51 @@ type(
 		AddScript(script string) error
 		CallFunc(funcName string, param ...interface{}) (interface{}, error)
 		CallFuncOnObj(objName, funcName string, param ...interface{}) (interface{}, error)
+		// Like CallFuncOnObj. The call is traced as part of the span in
+		// the context (if any).
+		CallFuncOnObjContext(ctx context.Context, objName, funcName string, param ...interface{}) (interface{}, error)
+		// Get the profiling data (call stats and breaks) for this runtime.
+		Profile() *Profile
+		// Clear all profiling data.
+		ResetProfile()
+		// Turn 'debugger' statements on or off.
+		SetBreakpointsEnabled(enabled bool)
+		// Set the resource limits. Only MaxCallTime is enforced by the runtime.
+		SetQuotas(*Quotas)
+		Quotas() *Quotas
+		// Set the hosts that outbound http requests may be sent to.
+		SetAllowedHosts([]string)
+	}
+	
+	// Call statistics for a function that has been called from go. Times
+	// are in nanoseconds.
+	CallStats struct {
+		Calls     uint64        `json:"calls"`
+		Errors    uint64        `json:"errors"`
+		TotalTime time.Duration `json:"total_time"`
+		MaxTime   time.Duration `json:"max_time"`
+		// Time spent waiting for the runtime to become available.
+		LockWait  time.Duration `json:"lock_wait"`
+	}
+	
+	// The state of the runtime when a 'debugger' statement was hit.
+	BreakData struct {
+		Time       time.Time         `json:"time"`
+		Callee     string            `json:"callee"`
+		Filename   string            `json:"filename"`
+		Line       int               `json:"line"`
+		Column     int               `json:"column"`
+		Stacktrace []string          `json:"stacktrace"`
+		Symbols    map[string]string `json:"symbols"`
+	}
+	
+	// Profiling data for a runtime. Functions are keyed by their full
+	// name, e.g. "network.handleIncomingHttp".
+	Profile struct {
+		RuntimeId string                `json:"runtime_id"`
+		Started   time.Time             `json:"started"`
+		Functions map[string]*CallStats `json:"functions"`
+		Breaks    []*BreakData          `json:"breaks"`
 	}
 )
 
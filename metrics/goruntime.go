@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Memory stats are read at most this often, since reading them stops the
+// world for a moment, and several metrics use them in the same scrape.
+const memStatsMaxAge = time.Second
+
+type memStatsCache struct {
+	mutex *sync.Mutex
+	stats runtime.MemStats
+	read  time.Time
+}
+
+func (mc *memStatsCache) get() *runtime.MemStats {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if time.Since(mc.read) > memStatsMaxAge {
+		runtime.ReadMemStats(&mc.stats)
+		mc.read = time.Now()
+	}
+	stats := mc.stats
+	return &stats
+}
+
+var processStart = time.Now()
+
+// Add metrics about the go runtime and the process.
+func (r *Registry) AddGoCollectors() {
+	mc := &memStatsCache{mutex: &sync.Mutex{}}
+	memStat := func(fn func(ms *runtime.MemStats) float64) CollectFunc {
+		return func() []*Sample {
+			return []*Sample{{nil, fn(mc.get())}}
+		}
+	}
+	r.NewCollector("go_info", "Information about the go runtime.", GAUGE, func() []*Sample {
+		return []*Sample{{[]string{runtime.Version()}, 1}}
+	}, "version")
+	r.NewCollector("go_goroutines", "The number of goroutines.", GAUGE, func() []*Sample {
+		return []*Sample{{nil, float64(runtime.NumGoroutine())}}
+	})
+	r.NewCollector("go_memstats_alloc_bytes", "Bytes allocated and still in use.", GAUGE, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.Alloc)
+	}))
+	r.NewCollector("go_memstats_alloc_bytes_total", "Bytes allocated, including freed ones.", COUNTER, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.TotalAlloc)
+	}))
+	r.NewCollector("go_memstats_heap_objects", "The number of allocated objects.", GAUGE, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.HeapObjects)
+	}))
+	r.NewCollector("go_memstats_sys_bytes", "Bytes obtained from the system.", GAUGE, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.Sys)
+	}))
+	r.NewCollector("go_gc_cycles_total", "The number of completed gc cycles.", COUNTER, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.NumGC)
+	}))
+	r.NewCollector("go_gc_pause_seconds_total", "The total time the world was stopped for gc.", COUNTER, memStat(func(ms *runtime.MemStats) float64 {
+		return float64(ms.PauseTotalNs) / 1e9
+	}))
+	r.NewCollector("process_start_time_seconds", "The start time of the process, in seconds since the epoch.", GAUGE, func() []*Sample {
+		return []*Sample{{nil, float64(processStart.UnixNano()) / 1e9}}
+	})
+}
+
+func init() {
+	Default.AddGoCollectors()
+}
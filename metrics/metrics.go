@@ -0,0 +1,533 @@
+// Package metrics keeps counters, gauges and histograms, and writes them in
+// the Prometheus text format. It is cheap enough to be used all the time,
+// not just in debug mode.
+//
+// Metrics are normally package level variables, made with the functions in
+// this package, which register them in the Default registry:
+//
+//	var requests = metrics.NewCounterVec("decerver_requests_total", "Requests.", "dapp")
+//	...
+//	requests.With(dappId).Inc()
+//
+// Values that are already kept somewhere else (such as the number of open
+// sessions) are read when the metrics are scraped, using collectors.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types.
+const (
+	COUNTER   = "counter"
+	GAUGE     = "gauge"
+	HISTOGRAM = "histogram"
+)
+
+// The content type of the text format.
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Histogram buckets (in seconds) that fit request and call durations.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Separates label values in series keys. It can not appear in valid
+// utf-8.
+const keySep = "\xff"
+
+// A sample of a metric.
+type Sample struct {
+	// The label values, in the order of the label names.
+	LabelValues []string
+	Value       float64
+}
+
+// Something that writes the samples of a metric.
+type metric interface {
+	desc() *desc
+	write(w *bufio.Writer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.mutex = &sync.Mutex{}
+	r.metrics = make(map[string]metric)
+	return r
+}
+
+// The registry that the package level functions use.
+var Default = NewRegistry()
+
+// Metric names are fixed in the code, so a bad or duplicate name is a
+// programming error.
+func (r *Registry) register(m metric) {
+	d := m.desc()
+	if !validName(d.name) {
+		panic("metrics: invalid name: " + d.name)
+	}
+	for _, l := range d.labels {
+		if !validName(l) || strings.HasPrefix(l, "__") || l == "le" {
+			panic("metrics: invalid label name: " + l)
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.metrics[d.name]; ok {
+		panic("metrics: already registered: " + d.name)
+	}
+	r.metrics[d.name] = m
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Write all metrics in the text format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.write(bw)
+	return bw.Flush()
+}
+
+func (r *Registry) write(bw *bufio.Writer) {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mutex.Unlock()
+
+	for _, m := range metrics {
+		d := m.desc()
+		fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.typ)
+		m.write(bw)
+	}
+}
+
+// Serve the metrics of one or more registries over http. Metric names must
+// be unique across the registries.
+func Handler(registries ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		w.Header().Set("Cache-Control", "no-store")
+		bw := bufio.NewWriter(w)
+		for _, r := range registries {
+			r.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+func escapeHelp(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write a sample line. Extra is an extra label (like 'le'), written last.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func checkValues(d *desc, values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+}
+
+// The series of a metric, by label values. Series are created the first
+// time they are used.
+type seriesMap struct {
+	mutex  *sync.RWMutex
+	series map[string]interface{}
+	values map[string][]string
+	create func() interface{}
+}
+
+func newSeriesMap(create func() interface{}) *seriesMap {
+	sm := &seriesMap{}
+	sm.mutex = &sync.RWMutex{}
+	sm.series = make(map[string]interface{})
+	sm.values = make(map[string][]string)
+	sm.create = create
+	return sm
+}
+
+func (sm *seriesMap) get(values []string) interface{} {
+	key := strings.Join(values, keySep)
+	sm.mutex.RLock()
+	s, ok := sm.series[key]
+	sm.mutex.RUnlock()
+	if ok {
+		return s
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if s, ok := sm.series[key]; ok {
+		return s
+	}
+	s = sm.create()
+	sm.series[key] = s
+	sm.values[key] = append([]string(nil), values...)
+	return s
+}
+
+// Remove the series that have the given value for a label.
+func (sm *seriesMap) deleteMatching(index int, value string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	for key, values := range sm.values {
+		if values[index] == value {
+			delete(sm.series, key)
+			delete(sm.values, key)
+		}
+	}
+}
+
+// Call fn for each series, sorted by label values.
+func (sm *seriesMap) each(fn func(values []string, s interface{})) {
+	sm.mutex.RLock()
+	keys := make([]string, 0, len(sm.series))
+	for key := range sm.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		series[i], values[i] = sm.series[key], sm.values[key]
+	}
+	sm.mutex.RUnlock()
+	for i := range keys {
+		fn(values[i], series[i])
+	}
+}
+
+func labelIndex(d *desc, label string) int {
+	for i, l := range d.labels {
+		if l == label {
+			return i
+		}
+	}
+	panic("metrics: " + d.name + " has no label " + label)
+}
+
+// A float64 that is updated atomically.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (af *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&af.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&af.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (af *atomicFloat) set(v float64) {
+	atomic.StoreUint64(&af.bits, math.Float64bits(v))
+}
+
+func (af *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&af.bits))
+}
+
+// A value that only goes up.
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+// Add to the counter. Negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if v > 0 {
+		c.value.add(v)
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return c.value.load()
+}
+
+type CounterVec struct {
+	d      *desc
+	series *seriesMap
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{&desc{name, help, COUNTER, labels}, newSeriesMap(func() interface{} { return &Counter{} })}
+	r.register(cv)
+	return cv
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// Get the counter with the given label values.
+func (cv *CounterVec) With(values ...string) *Counter {
+	checkValues(cv.d, values)
+	return cv.series.get(values).(*Counter)
+}
+
+// Remove the counters that have the given value for a label, e.g. those of
+// a dapp that has been removed.
+func (cv *CounterVec) DeleteMatching(label, value string) {
+	cv.series.deleteMatching(labelIndex(cv.d, label), value)
+}
+
+func (cv *CounterVec) desc() *desc {
+	return cv.d
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.series.each(func(values []string, s interface{}) {
+		writeSample(w, cv.d.name, cv.d.labels, values, "", "", s.(*Counter).Value())
+	})
+}
+
+// A value that can go up and down.
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.value.add(v)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.load()
+}
+
+type GaugeVec struct {
+	d      *desc
+	series *seriesMap
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{&desc{name, help, GAUGE, labels}, newSeriesMap(func() interface{} { return &Gauge{} })}
+	r.register(gv)
+	return gv
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	checkValues(gv.d, values)
+	return gv.series.get(values).(*Gauge)
+}
+
+func (gv *GaugeVec) DeleteMatching(label, value string) {
+	gv.series.deleteMatching(labelIndex(gv.d, label), value)
+}
+
+func (gv *GaugeVec) desc() *desc {
+	return gv.d
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.series.each(func(values []string, s interface{}) {
+		writeSample(w, gv.d.name, gv.d.labels, values, "", "", s.(*Gauge).Value())
+	})
+}
+
+// Counts observations (such as call durations) in buckets.
+type Histogram struct {
+	// Upper bounds, sorted. The +Inf bucket is implicit.
+	bounds []float64
+	// Counts per bucket (not cumulative). The last one is +Inf.
+	counts []uint64
+	sum    atomicFloat
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	h.sum.add(v)
+}
+
+// The number of observations.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return n
+}
+
+func (h *Histogram) Sum() float64 {
+	return h.sum.load()
+}
+
+type HistogramVec struct {
+	d      *desc
+	series *seriesMap
+}
+
+// Buckets are the upper bounds. nil means DefaultBuckets.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	hv := &HistogramVec{d: &desc{name, help, HISTOGRAM, labels}}
+	hv.series = newSeriesMap(func() interface{} {
+		return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	})
+	r.register(hv)
+	return hv
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	checkValues(hv.d, values)
+	return hv.series.get(values).(*Histogram)
+}
+
+func (hv *HistogramVec) DeleteMatching(label, value string) {
+	hv.series.deleteMatching(labelIndex(hv.d, label), value)
+}
+
+func (hv *HistogramVec) desc() *desc {
+	return hv.d
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.series.each(func(values []string, s interface{}) {
+		h := s.(*Histogram)
+		// The counts are read one by one, so they may be slightly off
+		// from each other while observations come in. The total is the
+		// sum of the buckets, so that _count and +Inf agree.
+		var cum uint64
+		for i, bound := range h.bounds {
+			cum += atomic.LoadUint64(&h.counts[i])
+			writeSample(w, hv.d.name+"_bucket", hv.d.labels, values, "le", formatFloat(bound), float64(cum))
+		}
+		cum += atomic.LoadUint64(&h.counts[len(h.bounds)])
+		writeSample(w, hv.d.name+"_bucket", hv.d.labels, values, "le", "+Inf", float64(cum))
+		writeSample(w, hv.d.name+"_sum", hv.d.labels, values, "", "", h.Sum())
+		writeSample(w, hv.d.name+"_count", hv.d.labels, values, "", "", float64(cum))
+	})
+}
+
+// Reads the samples of a metric when it is scraped. The samples are
+// written in the order they are returned.
+type CollectFunc func() []*Sample
+
+type collector struct {
+	d       *desc
+	collect CollectFunc
+}
+
+// Add a metric whose samples are read by fn when it is scraped. Typ is
+// COUNTER or GAUGE.
+func (r *Registry) NewCollector(name, help, typ string, fn CollectFunc, labels ...string) {
+	if typ != COUNTER && typ != GAUGE {
+		panic("metrics: collectors must be counters or gauges: " + name)
+	}
+	r.register(&collector{&desc{name, help, typ, labels}, fn})
+}
+
+func NewCollector(name, help, typ string, fn CollectFunc, labels ...string) {
+	Default.NewCollector(name, help, typ, fn, labels...)
+}
+
+func (c *collector) desc() *desc {
+	return c.d
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	for _, s := range c.collect() {
+		if len(s.LabelValues) != len(c.d.labels) {
+			continue
+		}
+		writeSample(w, c.d.name, c.d.labels, s.LabelValues, "", "", s.Value)
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeText(t *testing.T, r *Registry) string {
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.String()
+}
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests.\nBy path.", "path", "code")
+	requests.With("/a", "200").Inc()
+	requests.With("/a", "200").Add(2)
+	requests.With("/a", "200").Add(-1)
+	requests.With("/b\"\\\n", "404").Inc()
+	r.NewGaugeVec("test_temperature", "Temperature.").With().Set(-1.5)
+	r.NewCollector("test_collected", "Collected.", GAUGE, func() []*Sample {
+		return []*Sample{{[]string{"x"}, 1}, {[]string{"too", "many"}, 2}}
+	}, "name")
+
+	want := `# HELP test_collected Collected.
+# TYPE test_collected gauge
+test_collected{name="x"} 1
+# HELP test_requests_total Requests.\nBy path.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="200"} 3
+test_requests_total{path="/b\"\\\n",code="404"} 1
+# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature -1.5
+`
+	if got := writeText(t, r); got != want {
+		t.Errorf("Expected:\n%s\nGot:\n%s\n", want, got)
+	}
+
+	requests.DeleteMatching("code", "404")
+	if strings.Contains(writeText(t, r), "404") {
+		t.Error("Series was not deleted.")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("test_duration_seconds", "Durations.", []float64{1, 0.1}, "op").With("get")
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+	if h.Count() != 4 || h.Sum() != 3.65 {
+		t.Errorf("Wrong count or sum: %d %v\n", h.Count(), h.Sum())
+	}
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="get",le="0.1"} 2
+test_duration_seconds_bucket{op="get",le="1"} 3
+test_duration_seconds_bucket{op="get",le="+Inf"} 4
+test_duration_seconds_sum{op="get"} 3.65
+test_duration_seconds_count{op="get"} 4
+`
+	if got := writeText(t, r); got != want {
+		t.Errorf("Expected:\n%s\nGot:\n%s\n", want, got)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	cv := r.NewCounterVec("test_total", "Test.", "worker")
+	hv := r.NewHistogramVec("test_seconds", "Test.", nil, "worker")
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cv.With("w").Inc()
+				hv.With("w").Observe(0.5)
+			}
+		}()
+	}
+	// Scraping while the values change.
+	writeText(t, r)
+	wg.Wait()
+	if v := cv.With("w").Value(); v != 8000 {
+		t.Errorf("Wrong counter value: %v\n", v)
+	}
+	if h := hv.With("w"); h.Count() != 8000 || h.Sum() != 4000 {
+		t.Errorf("Wrong histogram: %d %v\n", h.Count(), h.Sum())
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: Did not panic.\n", name)
+			}
+		}()
+		fn()
+	}
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.", "a")
+	expectPanic("duplicate", func() { r.NewGaugeVec("test_total", "Test.") })
+	expectPanic("bad name", func() { r.NewGaugeVec("1test", "Test.") })
+	expectPanic("bad label", func() { r.NewGaugeVec("test2", "Test.", "le") })
+	expectPanic("wrong values", func() { r.metrics["test_total"].(*CounterVec).With("a", "b") })
+	expectPanic("histogram collector", func() { r.NewCollector("test3", "Test.", HISTOGRAM, nil) })
+}
+
+func TestHandler(t *testing.T) {
+	a, b := NewRegistry(), NewRegistry()
+	a.NewGaugeVec("test_a", "A.").With().Set(1)
+	b.NewGaugeVec("test_b", "B.").With().Set(2)
+	w := httptest.NewRecorder()
+	Handler(a, b).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != CONTENT_TYPE {
+		t.Errorf("Wrong content type: %s\n", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "test_a 1\n") || !strings.Contains(body, "test_b 2\n") {
+		t.Errorf("Missing metrics:\n%s\n", body)
+	}
+
+	// The go runtime metrics are in the default registry.
+	if !strings.Contains(writeText(t, Default), "\ngo_goroutines ") {
+		t.Error("No go runtime metrics.")
+	}
+}
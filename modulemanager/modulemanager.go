@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/modules"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // The modulemanager is where the different modules are kept. Currently, modules has
@@ -11,12 +14,18 @@ import (
 type ModuleManager struct {
 	modules     map[string]modules.Module
 	moduleNames []string
+	// The state of each module. Modules are started in their own goroutines,
+	// so this is guarded by the mutex.
+	status map[string]*modules.ModuleStatus
+	mutex  *sync.Mutex
 }
 
 func NewModuleManager() modules.ModuleManager {
 	mm := &ModuleManager{}
 	mm.modules = make(map[string]modules.Module, 1)
-	mm.moduleNames = make([]string, 1)
+	mm.moduleNames = make([]string, 0, 1)
+	mm.status = make(map[string]*modules.ModuleStatus)
+	mm.mutex = &sync.Mutex{}
 	return mm
 }
 
@@ -37,6 +46,7 @@ func (mm *ModuleManager) Add(m modules.Module) error {
 	}
 	mm.moduleNames = append(mm.moduleNames, m.Name())
 	mm.modules[m.Name()] = m
+	mm.setStatus(m.Name(), modules.MODULE_REGISTERED, nil)
 	return nil
 }
 
@@ -44,25 +54,74 @@ func (mm *ModuleManager) Init() error {
 	for _, md := range mm.modules {
 		err := md.Init()
 		if err != nil {
+			mm.setStatus(md.Name(), modules.MODULE_FAILED, err)
 			return err
 		}
+		mm.setStatus(md.Name(), modules.MODULE_INITIALIZED, nil)
 	}
 	return nil
 }
 
 func (mm *ModuleManager) Start() error {
 	for _, mod := range mm.modules {
+		mm.setStatus(mod.Name(), modules.MODULE_STARTING, nil)
 		go func(module modules.Module) {
 			fmt.Println("Loading module: " + module.Name())
-			module.Start()
+			err := module.Start()
+			mm.mutex.Lock()
+			defer mm.mutex.Unlock()
+			// It may have been shut down while starting.
+			if ms := mm.status[module.Name()]; ms.State != modules.MODULE_STARTING {
+				return
+			}
+			if err != nil {
+				mm.status[module.Name()] = &modules.ModuleStatus{Name: module.Name(), State: modules.MODULE_FAILED, Error: err.Error()}
+			} else {
+				mm.status[module.Name()] = &modules.ModuleStatus{Name: module.Name(), State: modules.MODULE_RUNNING}
+			}
 		}(mod)
 	}
 	return nil
 }
 
+// Shut down all modules, in the order they were added. A module that fails
+// does not stop the others from being shut down. The errors are returned
+// together.
 func (mm *ModuleManager) Shutdown() error {
-	for _, mod := range mm.modules {
-		mod.Shutdown()
+	failed := make([]string, 0)
+	for _, name := range mm.moduleNames {
+		mod := mm.modules[name]
+		if err := mod.Shutdown(); err != nil {
+			mm.setStatus(name, modules.MODULE_FAILED, err)
+			failed = append(failed, name+": "+err.Error())
+		} else {
+			mm.setStatus(name, modules.MODULE_STOPPED, nil)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to shut down modules: %s", strings.Join(failed, "; "))
 	}
 	return nil
 }
+
+func (mm *ModuleManager) Status() []*modules.ModuleStatus {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	ret := make([]*modules.ModuleStatus, 0, len(mm.status))
+	for _, ms := range mm.status {
+		cp := *ms
+		ret = append(ret, &cp)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (mm *ModuleManager) setStatus(name, state string, err error) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	ms := &modules.ModuleStatus{Name: name, State: state}
+	if err != nil {
+		ms.Error = err.Error()
+	}
+	mm.status[name] = ms
+}
@@ -0,0 +1,63 @@
+package modulemanager
+
+import (
+	"errors"
+	"github.com/eris-ltd/decerver/interfaces/modules"
+	"strings"
+	"testing"
+)
+
+type fakeModule struct {
+	modules.Module
+	name        string
+	shutdownErr error
+	stopped     bool
+}
+
+func (fm *fakeModule) Name() string {
+	return fm.name
+}
+
+func (fm *fakeModule) Shutdown() error {
+	fm.stopped = true
+	return fm.shutdownErr
+}
+
+func TestShutdownErrors(t *testing.T) {
+	mm := NewModuleManager()
+	mods := []*fakeModule{
+		{name: "a", shutdownErr: errors.New("a broke")},
+		{name: "b"},
+		{name: "c", shutdownErr: errors.New("c broke")},
+	}
+	for _, mod := range mods {
+		if err := mm.Add(mod); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := mm.Shutdown()
+	if err == nil {
+		t.Fatal("Shutdown errors were dropped.")
+	}
+	if !strings.Contains(err.Error(), "a: a broke") || !strings.Contains(err.Error(), "c: c broke") {
+		t.Errorf("Errors are missing from: %s\n", err.Error())
+	}
+	// All modules are shut down, even when one fails.
+	for _, mod := range mods {
+		if !mod.stopped {
+			t.Errorf("Module '%s' was not shut down.\n", mod.name)
+		}
+	}
+	want := map[string]string{"a": modules.MODULE_FAILED, "b": modules.MODULE_STOPPED, "c": modules.MODULE_FAILED}
+	for _, ms := range mm.Status() {
+		if ms.State != want[ms.Name] {
+			t.Errorf("%s: Expected state %s, Got: %s\n", ms.Name, want[ms.Name], ms.State)
+		}
+	}
+
+	mm = NewModuleManager()
+	mm.Add(&fakeModule{name: "ok"})
+	if err := mm.Shutdown(); err != nil {
+		t.Errorf("Unexpected error: %s\n", err.Error())
+	}
+}
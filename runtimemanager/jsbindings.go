@@ -1,13 +1,22 @@
 package runtimemanager
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/obscuren/sha3"
 	"github.com/robertkrimen/otto"
 	"github.com/eris-ltd/decerver/interfaces/logging"
-	"log"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,13 +26,12 @@ func isZero(i *big.Int) bool {
 	return i.Cmp(BZERO) == 0
 }
 
-var ottoLog *log.Logger = logging.NewLogger("Runtime")
-
 // TODO clean up the scripts. Make proper function objects.
 func BindDefaults(runtime *Runtime) {
 	vm := runtime.vm
 	
-	bindGo(vm)
+	bindGo(vm, runtime.log)
+	bindHttpClient(runtime)
 	
 	bindCore(vm)
 	bindNetworking(vm)
@@ -32,7 +40,8 @@ func BindDefaults(runtime *Runtime) {
 
 }
 
-func bindGo(vm *otto.Otto) {
+// Print, Println and Printf write to the log of the dapp.
+func bindGo(vm *otto.Otto, log *logging.Logger) {
 
 	vm.Set("Add", func(call otto.FunctionCall) otto.Value {
 		p0, p1, errP := parseBin(call)
@@ -198,6 +207,25 @@ func bindGo(vm *otto.Otto) {
 		return result
 	})
 
+	// Http
+	// Params: the Accept header, and an array of content types.
+	// Returns: the content type to use, or the empty string if none is acceptable.
+	vm.Set("NegotiateType", func(call otto.FunctionCall) otto.Value {
+		accept, _ := call.Argument(0).ToString()
+		offers := make([]string, 0)
+		if exp, err := call.Argument(1).Export(); err == nil {
+			if arr, ok := exp.([]interface{}); ok {
+				for _, offer := range arr {
+					offers = append(offers, fmt.Sprint(offer))
+				}
+			} else if arr, ok := exp.([]string); ok {
+				offers = arr
+			}
+		}
+		result, _ := vm.ToValue(negotiateType(accept, offers))
+		return result
+	})
+
 	vm.Set("Print", func(call otto.FunctionCall) otto.Value {
 		output := make([]interface{}, 0)
 		// TODO error
@@ -205,7 +233,7 @@ func bindGo(vm *otto.Otto) {
 			arg, _ := argument.Export()
 			output = append(output, arg)
 		}
-		ottoLog.Print(output...)
+		log.Print(output...)
 		return otto.Value{}
 	})
 
@@ -216,25 +244,25 @@ func bindGo(vm *otto.Otto) {
 			arg, _ := argument.Export()
 			output = append(output, arg)
 		}
-		ottoLog.Println(output...)
+		log.Println(output...)
 		return otto.Value{}
 	})
 
 	vm.Set("Printf", func(call otto.FunctionCall) otto.Value {
 		args := call.ArgumentList
 		if args == nil || len(args) == 0 {
-			ottoLog.Println("")
+			log.Println("")
 			return otto.Value{}
 		}
 		fmtStr, _ := args[0].Export()
 		fs, ok := fmtStr.(string)
 		if !ok {
-			ottoLog.Println("")
+			log.Println("")
 			return otto.Value{}
 		}
 
 		if len(args) == 1 {
-			ottoLog.Printf(fs)
+			log.Printf(fs)
 		} else {
 			output := make([]interface{}, 0)
 			// TODO error
@@ -242,12 +270,261 @@ func bindGo(vm *otto.Otto) {
 				arg, _ := argument.Export()
 				output = append(output, arg)
 			}
-			ottoLog.Printf(fs, output...)
+			log.Printf(fs, output...)
 		}
 		return otto.Value{}
 	})
 }
 
+// A media range from an Accept header.
+type mediaRange struct {
+	tpe string
+	sub string
+	q   float64
+}
+
+// Pick the offered content type that the Accept header prefers. Ties goes
+// to the earliest offer. Returns the empty string if none is acceptable.
+func negotiateType(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	ranges := make([]*mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		tpe := strings.Split(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if len(tpe) != 2 {
+			continue
+		}
+		mr := &mediaRange{tpe[0], tpe[1], 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, offer := range offers {
+		ot := strings.Split(strings.ToLower(offer), "/")
+		if len(ot) != 2 {
+			continue
+		}
+		// The most specific range that matches decides the quality.
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			s := -1
+			if mr.tpe == ot[0] && mr.sub == ot[1] {
+				s = 2
+			} else if mr.tpe == ot[0] && mr.sub == "*" {
+				s = 1
+			} else if mr.tpe == "*" && mr.sub == "*" {
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// The timeout used for outbound http requests if none is given (in milliseconds).
+const DEFAULT_HTTP_TIMEOUT = 30000
+
+// An outbound http request from javascript.
+type httpClientReq struct {
+	Method  string
+	URL     *url.URL
+	Header  http.Header
+	Body    string
+	Timeout time.Duration
+}
+
+// The response to an outbound http request. It has the same format as the
+// responses that dapps returns from their incoming http callback.
+type httpClientResp struct {
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// Binds the functions used by network.httpRequest and network.httpRequestAsync.
+// Dapps must have the 'network.outbound' capability, and the host must be in
+// their list of allowed hosts.
+func bindHttpClient(runtime *Runtime) {
+	vm := runtime.vm
+
+	// Params: method, url, headers, body, timeoutMs
+	// Returns: the response as a json string.
+	vm.Set("HttpRequest", func(call otto.FunctionCall) otto.Value {
+		req := runtime.parseHttpClientReq(call.ArgumentList)
+		runtime.limitHttpTimeout(req)
+		span := runtime.startHttpClientSpan(req)
+		resp, err := doHttpRequest(req, runtime.allowedHosts, runtime.quotas.MaxHttpResponseBytes)
+		endHttpClientSpan(span, resp, err)
+		if err != nil {
+			panic(vm.MakeCustomError("HttpError", err.Error()))
+		}
+		bts, _ := json.Marshal(resp)
+		result, _ := vm.ToValue(string(bts))
+		return result
+	})
+
+	// Params: callbackId, method, url, headers, body, timeoutMs
+	// The response is passed to network.httpResponse when it arrives.
+	vm.Set("HttpRequestAsync", func(call otto.FunctionCall) otto.Value {
+		id, _ := call.Argument(0).ToString()
+		req := runtime.parseHttpClientReq(call.ArgumentList[1:])
+		// Copy these, since the request is made without holding the runtime lock.
+		allowed := runtime.allowedHosts
+		maxBytes := runtime.quotas.MaxHttpResponseBytes
+		span := runtime.startHttpClientSpan(req)
+		go func() {
+			respJson := ""
+			errMsg := ""
+			resp, err := doHttpRequest(req, allowed, maxBytes)
+			endHttpClientSpan(span, resp, err)
+			if err != nil {
+				errMsg = err.Error()
+			} else {
+				bts, _ := json.Marshal(resp)
+				respJson = string(bts)
+			}
+			// The callback is part of the same trace.
+			ctx := tracing.ContextWithSpan(context.Background(), span)
+			_, err = runtime.CallFuncOnObjContext(ctx, "network", "httpResponse", id, respJson, errMsg)
+			if err != nil {
+				logger.Println("Failed to pass http response to runtime: " + err.Error())
+			}
+		}()
+		return otto.Value{}
+	})
+}
+
+// Parse the request arguments (method, url, headers, body, timeoutMs). Panics
+// with a javascript error if they are bad, or if the request is not allowed.
+// Must be called from a function that is bound to the vm.
+func (rt *Runtime) parseHttpClientReq(args []otto.Value) *httpClientReq {
+	rt.requireCapability(scripting.CAP_NETWORK_OUTBOUND)
+	arg := func(i int) otto.Value {
+		if i < len(args) {
+			return args[i]
+		}
+		return otto.UndefinedValue()
+	}
+	req := &httpClientReq{}
+	req.Method = "GET"
+	if arg(0).IsDefined() {
+		req.Method = strings.ToUpper(arg(0).String())
+	}
+	u, err := url.Parse(arg(1).String())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		panic(rt.vm.MakeTypeError("Invalid url: " + arg(1).String()))
+	}
+	if !hostAllowed(u, rt.allowedHosts) {
+		panic(rt.vm.MakeCustomError("PermissionError", "Host not in the list of allowed hosts: " + u.Host))
+	}
+	req.URL = u
+	req.Header = make(http.Header)
+	if arg(2).IsObject() {
+		hdr, _ := arg(2).Export()
+		if hm, ok := hdr.(map[string]interface{}); ok {
+			for k, v := range hm {
+				if vs, isArr := v.([]interface{}); isArr {
+					for _, val := range vs {
+						req.Header.Add(k, fmt.Sprint(val))
+					}
+				} else {
+					req.Header.Set(k, fmt.Sprint(v))
+				}
+			}
+		}
+	}
+	if arg(3).IsDefined() && !arg(3).IsNull() {
+		req.Body = arg(3).String()
+	}
+	timeout, _ := arg(4).ToInteger()
+	if timeout <= 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	req.Timeout = time.Duration(timeout) * time.Millisecond
+	return req
+}
+
+// The call can not be interrupted while it waits for a response, so blocking
+// requests must not take longer then the call time that is left. Panics with
+// a javascript error if there is none left. Must be called from a function
+// that is bound to the vm.
+func (rt *Runtime) limitHttpTimeout(req *httpClientReq) {
+	if rt.callDeadline.IsZero() {
+		return
+	}
+	left := time.Until(rt.callDeadline)
+	if left <= 0 {
+		panic(rt.vm.MakeCustomError("HttpError", "No call time left for the request."))
+	}
+	if req.Timeout > left {
+		req.Timeout = left
+	}
+}
+
+// Sends the request. Redirects are only followed to allowed hosts. If maxBytes
+// is larger then 0, responses with larger bodies are rejected.
+func doHttpRequest(req *httpClientReq, allowed []string, maxBytes int64) (*httpClientResp, error) {
+	client := &http.Client{
+		Timeout: req.Timeout,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("Stopped after 10 redirects.")
+			}
+			if !hostAllowed(r.URL, allowed) {
+				return fmt.Errorf("Redirect to host that is not allowed: %s", r.URL.Host)
+			}
+			return nil
+		},
+	}
+	hr, err := http.NewRequest(req.Method, req.URL.String(), strings.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header = req.Header
+	r, err := client.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	var bts []byte
+	if maxBytes > 0 {
+		bts, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		if err == nil && int64(len(bts)) > maxBytes {
+			err = fmt.Errorf("Response body exceeds the maximum size (%d bytes).", maxBytes)
+		}
+	} else {
+		bts, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := &httpClientResp{}
+	resp.Status = r.StatusCode
+	resp.Header = r.Header
+	resp.Body = string(bts)
+	return resp, nil
+}
+
 func bindCore(vm *otto.Otto){
 	_, err := vm.Run(`
 		
@@ -424,19 +701,149 @@ func bindNetworking(vm *otto.Otto){
 		}
 		
 		// Used internally. Do not call this from javascript.
-		network.handleIncomingHttp = function(httpReqAsJson){
+		network.handleIncomingHttp = function(httpReqAsJson, body, writer){
 			var httpReq = JSON.parse(httpReqAsJson);
-			var ret = this.incomingHttpCallback(httpReq);
+			var resp;
+			if(body){
+				httpReq.body = network.newHttpBody(body);
+				httpReq.openFile = function(field, index){
+					return network.newHttpBody(network.bodyResult(body.OpenFile(field, index || 0)));
+				};
+			}
+			if(writer){
+				resp = network.newHttpResponse(writer);
+			}
+			var ret = this.incomingHttpCallback(httpReq, resp);
 			var rets;
 			try {
 				rets = JSON.stringify(ret);
 				Println("Json string of resp obj:\n" + rets);
 				return rets;
 			} catch(err) {
-				return network.getHttpResponse500();
+				return JSON.stringify(network.getHttpResponse500());
 			}
 		};
 		
+		// Returns a response that redirects the client to url. Status is optional
+		// (default 302).
+		network.getHttpRedirect = function(url, status){
+			return {
+				"Status" : status || 302,
+				"Header" : {},
+				"Body" : "",
+				"Redirect" : url
+			};
+		}
+
+		// Adds a cookie to a response object. Options is optional, and can have the
+		// fields: path, domain, expires (a Date or milliseconds), maxAge (seconds),
+		// secure, httpOnly and sameSite ("strict", "lax" or "none").
+		network.setCookie = function(resp, name, value, options){
+			var opts = options || {};
+			var expires = opts.expires || 0;
+			if(expires instanceof Date){
+				expires = expires.getTime();
+			}
+			if(!resp.Cookies){
+				resp.Cookies = [];
+			}
+			resp.Cookies.push({
+				"name" : name,
+				"value" : value,
+				"path" : opts.path || "",
+				"domain" : opts.domain || "",
+				"expires" : expires,
+				"maxAge" : opts.maxAge || 0,
+				"secure" : !!opts.secure,
+				"httpOnly" : !!opts.httpOnly,
+				"sameSite" : opts.sameSite || ""
+			});
+		}
+
+		// Adds a cookie to a response object that deletes the cookie in the client.
+		// Path and domain must be the same as when the cookie was set.
+		network.clearCookie = function(resp, name, options){
+			var opts = options || {};
+			network.setCookie(resp, name, "", {"path" : opts.path, "domain" : opts.domain, "maxAge" : -1});
+		}
+
+		// Picks the content type from offers (an array, such as ["application/json", "text/html"])
+		// that the request prefers, using its Accept header. Returns the first offer if there
+		// is no Accept header, and null if none of them are acceptable.
+		network.negotiateType = function(httpReq, offers){
+			var accept = "";
+			if(httpReq.Header && httpReq.Header.Accept){
+				accept = httpReq.Header.Accept.join(",");
+			}
+			var type = NegotiateType(accept, offers);
+			return type === "" ? null : type;
+		}
+
+		// Used internally. Throws the error of a body reader call, or returns the data.
+		network.bodyResult = function(ret){
+			if(ret.error !== ""){
+				throw new Error(ret.error);
+			}
+			return ret.data;
+		}
+
+		// Used internally. Wraps a request body, or an uploaded file.
+		network.newHttpBody = function(reader){
+			var body = {};
+			// Reads up to maxBytes (default 1 MB) as an array of byte values. Returns an
+			// empty array at the end of the body.
+			body.read = function(maxBytes){
+				var data = network.bodyResult(reader.Read(maxBytes || 0));
+				var bts = [];
+				for(var i = 0; i < data.length; i++){
+					bts.push(data[i]);
+				}
+				return bts;
+			};
+			// Same as read, but returns a string. Multi-byte characters may be split
+			// between reads.
+			body.readString = function(maxBytes){
+				return network.bodyResult(reader.ReadString(maxBytes || 0));
+			};
+			// Same as read, but returns the bytes base64 encoded.
+			body.readBase64 = function(maxBytes){
+				return network.bodyResult(reader.ReadBase64(maxBytes || 0));
+			};
+			return body;
+		}
+
+		// Used internally. Wraps the response writer.
+		network.newHttpResponse = function(writer){
+			var resp = {};
+			function check(err){
+				if(err !== ""){
+					throw new Error(err);
+				}
+			}
+			resp.writeHeader = function(status, header){
+				check(writer.WriteHeader(status, header ? JSON.stringify(header) : ""));
+			};
+			resp.write = function(data){
+				check(writer.Write(data));
+			};
+			resp.writeBytes = function(bytes){
+				check(writer.WriteBytes(bytes));
+			};
+			resp.writeBase64 = function(data){
+				check(writer.WriteBase64(data));
+			};
+			resp.flush = function(){
+				check(writer.Flush());
+			};
+			resp.keepOpen = function(){
+				check(writer.KeepOpen());
+			};
+			resp.end = function(){
+				writer.End();
+			};
+			return resp;
+		}
+
 		network.registerIncomingHttpCallback = function(callback){
 			if(typeof callback !== "function"){
 				throw Error("Attempting to register a non-function as incoming http callback");
@@ -444,6 +851,78 @@ func bindNetworking(vm *otto.Otto){
 			network.incomingHttpCallback = callback;
 		}
 		
+		// Outbound http
+		
+		// Sends a http request and returns the response. The runtime is blocked until
+		// the response arrives, or the request times out. Throws an error if the request
+		// fails, or if the dapp is not allowed to send requests to the host.
+		//
+		// Params: method - "GET", "POST", etc. (string)
+		//         url - the full url, must be http or https (string)
+		//         headers - optional (object, values can be strings or arrays of strings)
+		//         body - optional (string)
+		//         timeoutMs - optional, default is 30000 (number)
+		// Returns: a response object ({"Status", "Header", "Body"})
+		network.httpRequest = function(method, url, headers, body, timeoutMs){
+			return JSON.parse(HttpRequest(method, url, headers, body, timeoutMs));
+		}
+		
+		// callbacks for async http requests.
+		network.httpCallbacks = {};
+		network.httpCallbackId = 0;
+		
+		// Same as network.httpRequest, but does not block. The callback is called
+		// with (error, response) when the request is done. If the request failed,
+		// error is a string and response is null, otherwise error is null.
+		network.httpRequestAsync = function(method, url, headers, body, timeoutMs, callback){
+			if(typeof callback !== "function"){
+				throw Error("Attempting to register a non-function as http response callback");
+			}
+			var id = (network.httpCallbackId++).toString();
+			network.httpCallbacks[id] = callback;
+			try {
+				HttpRequestAsync(id, method, url, headers, body, timeoutMs);
+			} catch (err) {
+				delete network.httpCallbacks[id];
+				throw err;
+			}
+		}
+		
+		// Called from go code when the response to an async request arrives.
+		// WARNING: Should not be used.
+		network.httpResponse = function(id, respJson, error){
+			var callback = network.httpCallbacks[id];
+			delete network.httpCallbacks[id];
+			if(typeof callback !== "function"){
+				Println("No callback for http response: " + id);
+				return;
+			}
+			if(error !== ""){
+				callback(error, null);
+			} else {
+				callback(null, JSON.parse(respJson));
+			}
+		}
+		
+		// Server-sent events
+		
+		network.sse = {};
+		
+		// Publish an event to clients that are connected to /sse/<dappId>. Clients
+		// can choose to only receive events from certain channels.
+		//
+		// Params: channel - the channel name, used as the event type (string)
+		//         data - the event data. Non-strings are json encoded.
+		network.sse.publish = function(channel, data){
+			if(typeof(sse_publisher) === "undefined"){
+				throw Error("Server-sent events are not available.");
+			}
+			if(typeof(data) !== "string"){
+				data = JSON.stringify(data);
+			}
+			sse_publisher.Publish(channel, data);
+		}
+		
 		// Websockets
 		
 		// Error codes for ESRPC
@@ -547,6 +1026,21 @@ func bindNetworking(vm *otto.Otto){
 			};
 		};
 		
+		// Send a message to all websocket sessions of this dapp. Sessions that
+		// can not keep up miss the message.
+		//
+		// Params: data - the message. Non-strings are json encoded.
+		// Returns: the number of sessions the message was sent to.
+		network.broadcastWs = function(data){
+			if(typeof(ws_broadcaster) === "undefined"){
+				throw Error("Websocket broadcasting is not available.");
+			}
+			if(typeof(data) !== "string"){
+				data = JSON.stringify(data);
+			}
+			return ws_broadcaster.Broadcast(data);
+		}
+		
 		// This is called from go code as a response to newly negotiated
 		// websocket connections. It is used to bind the session object
 		// to the runtime.
@@ -586,11 +1080,11 @@ func bindNetworking(vm *otto.Otto){
 			try {
 				var request = JSON.parse(reqJson);
 				if (typeof(request.Method) === "undefined" || request.Method === ""){
-					return JSON.stringify(network.getWsError(E_NO_METHOD, "No method in request."));
+					return JSON.stringify(network.getWsErrorDetailed(E_NO_METHOD, "No method in request.", null));
 				} else {
 					var handler = network.wsHandlers[sessionId];
 					if (typeof handler !== "function"){
-						return JSON.stringify(network.getWsError(E_SERVER, "Handler not registered for websocket session: " + sessionId.toString()) );
+						return JSON.stringify(network.getWsErrorDetailed(E_SERVER, "Handler not registered for websocket session: " + sessionId.toString(), null));
 					}
 					var response = handler(request);
 					if(response === null){
@@ -601,13 +1095,92 @@ func bindNetworking(vm *otto.Otto){
 						response.Time = TimeMS();
 						respStr = JSON.stringify(response);
 					} catch (err) {
-						return JSON.stringify(network.getWsError(E_INTERNAL, "Failed to marshal response: " + err));
+						return JSON.stringify(network.getWsErrorDetailed(E_INTERNAL, "Failed to marshal response: " + err, null));
 					}
 					return respStr;
 				}
 			} catch (err){
-				response = JSON.stringify(network.getWsError(E_PARSE, err));
+				return JSON.stringify(network.getWsErrorDetailed(E_PARSE, String(err), null));
+			}
+		}
+		
+		// JSON-RPC 2.0
+		
+		// The methods that has been registered, by name.
+		network.rpcMethods = {};
+		
+		// Register a JSON-RPC method. Only used by dapps that has set 'ws_protocol'
+		// to "jsonrpc2" in their package file. The server takes care of the protocol.
+		//
+		// Params: name - the method name (string)
+		//         handler - function(params, sessionId). Params is the array or object
+		//                   from the request (or undefined). The return value is the result.
+		//                   To return an error, throw network.rpcError(code, message, data).
+		network.registerRpcMethod = function(name, handler){
+			if(typeof(handler) !== "function"){
+				throw Error("Rpc handler for '" + name + "' is not a function.");
+			}
+			network.rpcMethods[name] = handler;
+		}
+		
+		// Create an error that rpc handlers can throw. Data is optional.
+		network.rpcError = function(code, message, data){
+			return {
+				"isRpcError" : true,
+				"code" : code,
+				"message" : message,
+				"data" : data
+			};
+		}
+		
+		// Send a JSON-RPC notification to a session. Params should be an array
+		// or an object (other values are wrapped in an array).
+		// Returns: false if the notification could not be sent.
+		network.notifyWs = function(sessionId, method, params){
+			if(typeof(ws_broadcaster) === "undefined"){
+				throw Error("Websocket notifications are not available.");
+			}
+			var paramsJson = typeof(params) === "undefined" ? "" : JSON.stringify(params);
+			return ws_broadcaster.Notify(sessionId, method, paramsJson);
+		}
+		
+		// Send a JSON-RPC notification to all sessions of this dapp.
+		// Returns: the number of sessions it was sent to.
+		network.broadcastNotification = function(method, params){
+			if(typeof(ws_broadcaster) === "undefined"){
+				throw Error("Websocket notifications are not available.");
+			}
+			var paramsJson = typeof(params) === "undefined" ? "" : JSON.stringify(params);
+			return ws_broadcaster.BroadcastNotification(method, paramsJson);
+		}
+		
+		// Called from go code to run a JSON-RPC method. Returns a json string
+		// with either a 'result' or an 'error' field.
+		// WARNING: Should not be used.
+		network.callRpcMethod = function(sessionId, method, paramsJson){
+			var handler = network.rpcMethods[method];
+			if(typeof(handler) !== "function" || method.indexOf("rpc.") === 0){
+				return JSON.stringify({"error" : {"code" : E_NO_METHOD, "message" : "Method not found: " + method}});
+			}
+			var params = paramsJson === "" ? undefined : JSON.parse(paramsJson);
+			var result;
+			try {
+				result = handler(params, sessionId);
+			} catch (err) {
+				if(err !== null && typeof(err) === "object" && err.isRpcError === true){
+					var rpcErr = {"code" : err.code, "message" : String(err.message)};
+					if(typeof(err.data) !== "undefined"){
+						rpcErr.data = err.data;
+					}
+					return JSON.stringify({"error" : rpcErr});
+				}
+				Println("Error in rpc method '" + method + "': " + err);
+				return JSON.stringify({"error" : {"code" : E_INTERNAL, "message" : "Internal error."}});
+			}
+			if(typeof(result) === "undefined"){
+				result = null;
 			}
+			return JSON.stringify({"result" : result});
 		}
 		
 	`)
@@ -0,0 +1,70 @@
+package runtimemanager
+
+import (
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/robertkrimen/otto"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// Creates the error that is thrown when a script calls something it
+// has not been granted access to.
+func (rt *Runtime) permissionError(capability string) otto.Value {
+	msg := fmt.Sprintf("Permission denied: dapp '%s' has not been granted '%s'.", rt.name, capability)
+	return rt.vm.MakeCustomError("PermissionError", msg)
+}
+
+// Panics with a javascript PermissionError unless the runtime has the
+// given capability. Must only be called from inside functions that are
+// bound to the vm, since otto turns the panic into a javascript exception.
+func (rt *Runtime) requireCapability(capability string) {
+	if !rt.caps.Has(capability) {
+		panic(rt.permissionError(capability))
+	}
+}
+
+// Binds a stand-in for an api object that the runtime has not been granted.
+// It has the same methods as the real object, but they all throw a
+// PermissionError, so that dapps gets a clear message instead of a
+// reference error.
+func (rt *Runtime) bindDeniedObject(name string, api interface{}) error {
+	capability := scripting.ModuleCapability(name)
+	stub, err := rt.vm.Object("({})")
+	if err != nil {
+		return err
+	}
+	tp := reflect.TypeOf(api)
+	for i := 0; i < tp.NumMethod(); i++ {
+		err = stub.Set(tp.Method(i).Name, func(call otto.FunctionCall) otto.Value {
+			panic(rt.permissionError(capability))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return rt.BindScriptObject(name, stub)
+}
+
+// Checks if the host of the url is in the list of allowed hosts. Entries
+// without a port matches any port, and entries starting with "*." matches
+// all sub-domains.
+func hostAllowed(u *url.URL, allowed []string) bool {
+	host := strings.ToLower(u.Host)
+	hostname := host
+	if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+		hostname = host[:idx]
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "*.") {
+			if strings.HasSuffix(hostname, a[1:]) {
+				return true
+			}
+		} else if a == host || a == hostname {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package runtimemanager
+
+import (
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/metrics"
+	"github.com/robertkrimen/otto"
+	"sync"
+	"time"
+)
+
+// The maximum number of breaks that are kept. Older ones are dropped.
+const MAX_BREAKS = 100
+
+// Unlike the profiles, these are never reset (except when the runtime is
+// removed).
+var (
+	callDuration = metrics.NewHistogramVec("decerver_runtime_call_duration_seconds",
+		"Time spent in calls from go into a runtime, by function.", nil, "runtime", "function")
+	callErrors = metrics.NewCounterVec("decerver_runtime_call_errors_total",
+		"Calls from go into a runtime that failed, by function.", "runtime", "function")
+)
+
+// The profiler keeps call statistics for functions that are called
+// into the runtime from go, along with the data from any 'debugger'
+// statements that has been hit.
+type profiler struct {
+	mutex     *sync.Mutex
+	runtimeId string
+	started   time.Time
+	stats     map[string]*scripting.CallStats
+	breaks    []*scripting.BreakData
+}
+
+func newProfiler(runtimeId string) *profiler {
+	p := &profiler{}
+	p.mutex = &sync.Mutex{}
+	p.runtimeId = runtimeId
+	p.reset()
+	return p
+}
+
+// Not thread safe. Caller must hold the lock (or own the profiler).
+func (p *profiler) reset() {
+	p.started = time.Now()
+	p.stats = make(map[string]*scripting.CallStats)
+	p.breaks = make([]*scripting.BreakData, 0)
+}
+
+func (p *profiler) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reset()
+}
+
+// Record a call. 'wait' is the time spent waiting for the runtime lock,
+// and 'dur' is the time spent inside the vm.
+func (p *profiler) record(funcName string, wait, dur time.Duration, failed bool) {
+	callDuration.With(p.runtimeId, funcName).Observe(dur.Seconds())
+	if failed {
+		callErrors.With(p.runtimeId, funcName).Inc()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	cs, ok := p.stats[funcName]
+	if !ok {
+		cs = &scripting.CallStats{}
+		p.stats[funcName] = cs
+	}
+	cs.Calls++
+	if failed {
+		cs.Errors++
+	}
+	cs.TotalTime += dur
+	cs.LockWait += wait
+	if dur > cs.MaxTime {
+		cs.MaxTime = dur
+	}
+}
+
+// Used as the otto debugger handler. It does not halt execution, but
+// records the current context so that it can be inspected later.
+func (p *profiler) onBreak(vm *otto.Otto) {
+	ctx := vm.Context()
+	bd := &scripting.BreakData{}
+	bd.Time = time.Now()
+	bd.Callee = ctx.Callee
+	bd.Filename = ctx.Filename
+	bd.Line = ctx.Line
+	bd.Column = ctx.Column
+	bd.Stacktrace = ctx.Stacktrace
+	bd.Symbols = make(map[string]string)
+	for name, val := range ctx.Symbols {
+		bd.Symbols[name] = val.String()
+	}
+	logger.Printf("Break in runtime '%s': %s (%s:%d:%d)\n", p.runtimeId, bd.Callee, bd.Filename, bd.Line, bd.Column)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.breaks) == MAX_BREAKS {
+		p.breaks = p.breaks[1:]
+	}
+	p.breaks = append(p.breaks, bd)
+}
+
+// Get a copy of the profiling data.
+func (p *profiler) Profile() *scripting.Profile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	prof := &scripting.Profile{}
+	prof.RuntimeId = p.runtimeId
+	prof.Started = p.started
+	prof.Functions = make(map[string]*scripting.CallStats)
+	for name, cs := range p.stats {
+		csCopy := *cs
+		prof.Functions[name] = &csCopy
+	}
+	prof.Breaks = make([]*scripting.BreakData, len(p.breaks))
+	copy(prof.Breaks, p.breaks)
+	return prof
+}
@@ -1,6 +1,473 @@
 package runtimemanager
 
 import (
-
+	"context"
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
+	"github.com/robertkrimen/otto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
 )
 
+func TestProfile(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.AddScript("var obj = {}; obj.fn = function(){ debugger; return 'ok'; };")
+	rt.SetBreakpointsEnabled(true)
+
+	for i := 0; i < 3; i++ {
+		ret, err := rt.CallFuncOnObj("obj", "fn")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if ret != "ok" {
+			t.Errorf("Wrong return value: %v\n", ret)
+		}
+	}
+
+	prof := rt.Profile()
+	cs, ok := prof.Functions["obj.fn"]
+	if !ok {
+		t.Fatal("No call stats for 'obj.fn'")
+	}
+	if cs.Calls != 3 {
+		t.Errorf("Wrong number of calls. Expected: 3, Got: %d\n", cs.Calls)
+	}
+	if len(prof.Breaks) != 3 {
+		t.Errorf("Wrong number of breaks. Expected: 3, Got: %d\n", len(prof.Breaks))
+	}
+
+	rt.ResetProfile()
+	if len(rt.Profile().Functions) != 0 {
+		t.Error("Profile not reset")
+	}
+}
+
+type testApi struct{}
+
+func (ta *testApi) Hello() string {
+	return "hello"
+}
+
+func TestPermissions(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.Init("test")
+	rt.bindDeniedObject("testapi", &testApi{})
+
+	scripts := []string{
+		"WriteTempFile('file', 'data');",
+		"testapi.Hello();",
+	}
+	for _, s := range scripts {
+		err := rt.AddScript(s)
+		if err == nil {
+			t.Errorf("No error when calling without permission: %s\n", s)
+		} else if !strings.Contains(err.Error(), "PermissionError") {
+			t.Errorf("Wrong error: %s\n", err.Error())
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.AddScript("var obj = {}; obj.loop = function(){ while(true){} }; obj.ok = function(){ return 'ok'; };")
+	rt.SetQuotas(&scripting.Quotas{MaxCallTime: 50})
+
+	_, err := rt.CallFuncOnObj("obj", "loop")
+	if err == nil {
+		t.Fatal("Call was not interrupted")
+	}
+	// The runtime must still be usable.
+	ret, err := rt.CallFuncOnObj("obj", "ok")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != "ok" {
+		t.Errorf("Wrong return value: %v\n", ret)
+	}
+
+	// Scripts are limited too, and must not pin the runtime.
+	if err := rt.AddScript("while(true){}"); err == nil {
+		t.Fatal("Script was not interrupted")
+	}
+	if _, err := rt.CallFuncOnObj("obj", "ok"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestHttpRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", r.Header.Get("X-Test"))
+		w.WriteHeader(201)
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	caps := scripting.Capabilities{scripting.CAP_NETWORK_OUTBOUND: true}
+	rt := newRuntime("test", nil, nil, caps)
+	rt.Init("test")
+	rt.SetAllowedHosts([]string{u.Host})
+
+	rt.AddScript("var obj = {}; obj.get = function(url){ return JSON.stringify(network.httpRequest('POST', url, {'X-Test' : 'yes'}, 'data', 1000)); };")
+	ret, err := rt.CallFuncOnObj("obj", "get", srv.URL+"/path")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp := &httpClientResp{}
+	json.Unmarshal([]byte(ret.(string)), resp)
+	if resp.Status != 201 || resp.Body != "POST /path" || resp.Header.Get("X-Test") != "yes" {
+		t.Errorf("Wrong response: %v\n", resp)
+	}
+
+	// Hosts that are not allowed.
+	_, err = rt.CallFuncOnObj("obj", "get", "http://example.com/")
+	if err == nil {
+		t.Error("No error when requesting a host that is not allowed.")
+	}
+
+	// Response size limit.
+	rt.SetQuotas(&scripting.Quotas{MaxHttpResponseBytes: 4})
+	_, err = rt.CallFuncOnObj("obj", "get", srv.URL+"/path")
+	if err == nil {
+		t.Error("No error when the response is larger then the limit.")
+	}
+	rt.SetQuotas(nil)
+
+	// Callback style.
+	done := make(chan string, 1)
+	rt.BindScriptObject("done", func(call otto.FunctionCall) otto.Value {
+		done <- call.Argument(0).String()
+		return otto.Value{}
+	})
+	err = rt.AddScript("network.httpRequestAsync('GET', '" + srv.URL + "/async', null, null, 1000, function(err, resp){ done(resp.Body); });")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case body := <-done:
+		if body != "GET /async" {
+			t.Errorf("Wrong async response body: %s\n", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for async response.")
+	}
+}
+
+func TestHttpRequestCallTime(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	u, _ := url.Parse(srv.URL)
+
+	caps := scripting.Capabilities{scripting.CAP_NETWORK_OUTBOUND: true}
+	rt := newRuntime("test", nil, nil, caps)
+	rt.Init("test")
+	rt.SetAllowedHosts([]string{u.Host})
+	rt.SetQuotas(&scripting.Quotas{MaxCallTime: 100})
+	rt.AddScript("var obj = {}; obj.get = function(url){ return network.httpRequest('GET', url, null, null, 5000); };")
+
+	// The request timeout is longer then the call is allowed to take.
+	start := time.Now()
+	_, err := rt.CallFuncOnObj("obj", "get", srv.URL)
+	if err == nil {
+		t.Fatal("No error when the request outlasted the call time.")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Call took %v, with a max call time of 100ms.\n", d)
+	}
+}
+
+func TestRpcMethods(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.Init("test")
+	rt.AddScript(`
+		network.registerRpcMethod("add", function(params){ return params[0] + params[1]; });
+		network.registerRpcMethod("session", function(params, sessionId){ return sessionId; });
+		network.registerRpcMethod("fail", function(){ throw network.rpcError(E_BAD_PARAMS, "bad", {"field" : "x"}); });
+		network.registerRpcMethod("crash", function(){ throw Error("oops"); });
+		network.registerRpcMethod("nothing", function(){});
+	`)
+
+	tests := []struct {
+		method string
+		params string
+		want   string
+	}{
+		{"add", "[1, 2]", `{"result":3}`},
+		{"session", "", `{"result":7}`},
+		{"fail", "", `{"error":{"code":-32602,"message":"bad","data":{"field":"x"}}}`},
+		{"crash", "", `{"error":{"code":-32603,"message":"Internal error."}}`},
+		{"nothing", "", `{"result":null}`},
+		{"missing", "", `{"error":{"code":-32601,"message":"Method not found: missing"}}`},
+	}
+	for _, test := range tests {
+		ret, err := rt.CallFuncOnObj("network", "callRpcMethod", 7, test.method, test.params)
+		if err != nil {
+			t.Errorf("%s: %s\n", test.method, err.Error())
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal([]byte(ret.(string)), &got)
+		json.Unmarshal([]byte(test.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Expected: %s, Got: %v\n", test.method, test.want, ret)
+		}
+	}
+}
+
+// Has the same methods as the body reader from the server.
+type fakeHttpBody struct {
+	data []byte
+}
+
+func (fb *fakeHttpBody) Read(max int) map[string]interface{} {
+	n := len(fb.data)
+	if max > 0 && max < n {
+		n = max
+	}
+	bts := fb.data[:n]
+	fb.data = fb.data[n:]
+	return map[string]interface{}{"data": bts, "error": ""}
+}
+
+func (fb *fakeHttpBody) ReadString(max int) map[string]interface{} {
+	ret := fb.Read(max)
+	ret["data"] = string(ret["data"].([]byte))
+	return ret
+}
+
+func (fb *fakeHttpBody) OpenFile(field string, index int) map[string]interface{} {
+	if field != "upload" {
+		return map[string]interface{}{"data": nil, "error": "No file"}
+	}
+	return map[string]interface{}{"data": &fakeHttpBody{[]byte("file")}, "error": ""}
+}
+
+// Has the same methods as the response writer from the server.
+type fakeHttpResponse struct {
+	status int
+	header string
+	body   []byte
+	ended  bool
+}
+
+func (fr *fakeHttpResponse) WriteHeader(status int, header string) string {
+	fr.status, fr.header = status, header
+	return ""
+}
+
+func (fr *fakeHttpResponse) Write(data string) string {
+	fr.body = append(fr.body, data...)
+	return ""
+}
+
+func (fr *fakeHttpResponse) WriteBytes(data []byte) string {
+	fr.body = append(fr.body, data...)
+	return ""
+}
+
+func (fr *fakeHttpResponse) End() {
+	fr.ended = true
+}
+
+func TestHttpBodyAndResponse(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.Init("test")
+	rt.AddScript(`
+		network.registerIncomingHttpCallback(function(req, resp){
+			var first = req.body.read(2);
+			var rest = req.body.readString();
+			var file = req.openFile("upload").readString();
+			var missing = "";
+			try { req.openFile("other"); } catch(e) { missing = e.message; }
+			resp.writeHeader(201, {"X-Multi" : ["a", "b"]});
+			resp.writeBytes(first);
+			resp.write("|" + rest + "|" + file + "|" + missing);
+			resp.end();
+		});
+	`)
+	body := &fakeHttpBody{[]byte{0, 255, 'a', 'b'}}
+	resp := &fakeHttpResponse{}
+	_, err := rt.CallFuncOnObj("network", "handleIncomingHttp", `{"Method":"POST"}`, body, resp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.status != 201 || resp.header != `{"X-Multi":["a","b"]}` {
+		t.Errorf("Wrong header: %d %s\n", resp.status, resp.header)
+	}
+	want := append([]byte{0, 255}, "|ab|file|No file"...)
+	if string(resp.body) != string(want) {
+		t.Errorf("Wrong body: %v\n", resp.body)
+	}
+	if !resp.ended {
+		t.Error("Response was not ended.")
+	}
+}
+
+func TestNegotiateType(t *testing.T) {
+	offers := []string{"application/json", "text/html"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"text/html", "text/html"},
+		{"text/*", "text/html"},
+		{"*/*", "application/json"},
+		{"text/html;q=0.5, application/json;q=0.4", "text/html"},
+		{"text/*;q=0.9, text/html;q=0.1, application/json;q=0.5", "application/json"},
+		{"application/json;q=0, */*", "text/html"},
+		{"image/png", ""},
+	}
+	for _, test := range tests {
+		if got := negotiateType(test.accept, offers); got != test.want {
+			t.Errorf("%q: Expected: %q, Got: %q\n", test.accept, test.want, got)
+		}
+	}
+}
+
+func TestHttpResponseHelpers(t *testing.T) {
+	rt := newRuntime("test", nil, nil, nil)
+	rt.Init("test")
+	rt.AddScript(`
+		network.registerIncomingHttpCallback(function(req){
+			if(req.URL.Path === "/redirect"){
+				return network.getHttpRedirect("/other");
+			}
+			var resp = network.getHttpResponse(200, {}, "");
+			resp.Header["Content-Type"] = network.negotiateType(req, ["application/json", "text/html"]);
+			network.setCookie(resp, "a", "1", {"path" : "/", "httpOnly" : true, "sameSite" : "lax", "expires" : new Date(1000)});
+			network.clearCookie(resp, "b");
+			return resp;
+		});
+	`)
+	ret, err := rt.CallFuncOnObj("network", "handleIncomingHttp", `{"URL":{"Path":"/"},"Header":{"Accept":["text/html"]}}`, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(ret.(string)), &resp); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ct := resp["Header"].(map[string]interface{})["Content-Type"]; ct != "text/html" {
+		t.Errorf("Wrong content type: %v\n", ct)
+	}
+	cookies := resp["Cookies"].([]interface{})
+	if len(cookies) != 2 {
+		t.Fatalf("Wrong cookies: %v\n", cookies)
+	}
+	a := cookies[0].(map[string]interface{})
+	if a["name"] != "a" || a["value"] != "1" || a["httpOnly"] != true || a["sameSite"] != "lax" || a["expires"] != 1000.0 {
+		t.Errorf("Wrong cookie: %v\n", a)
+	}
+	if b := cookies[1].(map[string]interface{}); b["name"] != "b" || b["maxAge"] != -1.0 {
+		t.Errorf("Wrong cleared cookie: %v\n", b)
+	}
+
+	ret, err = rt.CallFuncOnObj("network", "handleIncomingHttp", `{"URL":{"Path":"/redirect"}}`, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp = make(map[string]interface{})
+	json.Unmarshal([]byte(ret.(string)), &resp)
+	if resp["Status"] != 302.0 || resp["Redirect"] != "/other" {
+		t.Errorf("Wrong redirect: %v\n", resp)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	dir := t.TempDir()
+	if err := tracing.Configure(&tracing.Config{File: "traces.json", SampleRate: 1}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tracing.Shutdown()
+	caps := scripting.Capabilities{scripting.CAP_NETWORK_OUTBOUND: true}
+	rt := newRuntime("test", nil, nil, caps)
+	rt.Init("test")
+	rt.SetAllowedHosts([]string{u.Host})
+	if err := rt.bindTracedObject("testapi", &testApi{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	rt.AddScript("var obj = {}; obj.fn = function(url){ network.httpRequest('GET', url); return testapi.Hello(); };")
+
+	ctx, parent := tracing.Start(context.Background(), "parent", tracing.KIND_SERVER)
+	ret, err := rt.CallFuncOnObjContext(ctx, "obj", "fn", srv.URL)
+	parent.End()
+	if err != nil || ret != "hello" {
+		t.Fatalf("Wrong result: %v, %v\n", ret, err)
+	}
+	tracing.Shutdown()
+
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "traces.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	type span struct {
+		SpanId       string `json:"spanId"`
+		ParentSpanId string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	req := &struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []*span `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}{}
+	if err := json.Unmarshal(bts, req); err != nil {
+		t.Fatal(err.Error())
+	}
+	spans := make(map[string]*span)
+	for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[s.Name] = s
+	}
+	parentId := parent.Context().SpanId.String()
+	tests := []struct {
+		name, parent string
+	}{
+		{"js obj.fn", parentId},
+		{"runtime wait", ""},
+		{"module testapi.Hello", ""},
+		{"GET " + u.Host, ""},
+	}
+	if len(spans) != len(tests)+1 {
+		t.Fatalf("Wrong number of spans: %d\n", len(spans))
+	}
+	for _, test := range tests {
+		s, ok := spans[test.name]
+		if !ok {
+			t.Errorf("Missing span: %s\n", test.name)
+			continue
+		}
+		if test.parent == "" {
+			test.parent = spans["js obj.fn"].SpanId
+		}
+		if s.ParentSpanId != test.parent {
+			t.Errorf("%s: Wrong parent. Expected: %s, Got: %s\n", test.name, test.parent, s.ParentSpanId)
+		}
+	}
+	if !strings.Contains(traceparent, spans["GET "+u.Host].SpanId) {
+		t.Errorf("Wrong traceparent on the outbound request: %s\n", traceparent)
+	}
+}
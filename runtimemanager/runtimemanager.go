@@ -2,21 +2,25 @@ package runtimemanager
 
 
 import (
+	"context"
 	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/decerver"
 	"github.com/eris-ltd/decerver/interfaces/events"
 	"github.com/eris-ltd/decerver/interfaces/files"
 	"github.com/eris-ltd/decerver/interfaces/logging"
 	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
 	mtypes "github.com/eris-ltd/modules/types"
 	"github.com/robertkrimen/otto"
 	"io/ioutil"
-	"log"
 	"sync"
 	"encoding/json"
+	"path"
+	"sort"
+	"time"
 )
 
-var logger *log.Logger = logging.NewLogger("ScriptEngine")
+var logger *logging.Logger = logging.NewLogger("ScriptEngine")
 
 //type RuntimeEventProcessor struct {
 //	er events.EventProcessor
@@ -27,22 +31,31 @@ type JsObj struct {
 	Object interface{}
 }
 
+type JsObjFactory struct {
+	Name    string
+	Factory func(scripting.Runtime) interface{}
+}
+
 // Implements RuntimeManager
 type RuntimeManager struct {
 	runtimes  map[string]scripting.Runtime
 	apiObjs   []*JsObj
+	apiFactories []*JsObjFactory
 	apiScript []string
 	ep        events.EventProcessor
 	fio		  files.FileIO
+	debug     bool
 }
 
 func NewRuntimeManager(dc decerver.Decerver) scripting.RuntimeManager {
 	return &RuntimeManager{
 		make(map[string]scripting.Runtime),
 		make([]*JsObj, 0),
+		make([]*JsObjFactory, 0),
 		make([]string, 0),
 		dc.EventProcessor(),
 		dc.FileIO(),
+		dc.Config().DebugMode,
 	}
 }
 
@@ -52,13 +65,31 @@ func (rm *RuntimeManager) ShutdownRuntimes() {
 	}
 }
 
-func (rm *RuntimeManager) CreateRuntime(name string) scripting.Runtime {
-	rt := newRuntime(name, rm.ep, rm.fio)
+func (rm *RuntimeManager) CreateRuntime(name string, caps scripting.Capabilities) scripting.Runtime {
+	rt := newRuntime(name, rm.ep, rm.fio, caps)
 	rm.runtimes[name] = rt
+	// Breakpoints are only used when debugging.
+	rt.SetBreakpointsEnabled(rm.debug)
 
 	rt.Init(name)
 	for _, jo := range rm.apiObjs {
-		err := rt.BindScriptObject(jo.Name, jo.Object)
+		var err error
+		if caps.Has(scripting.ModuleCapability(jo.Name)) {
+			if tracing.Enabled() {
+				err = rt.bindTracedObject(jo.Name, jo.Object)
+			} else {
+				err = rt.BindScriptObject(jo.Name, jo.Object)
+			}
+		} else {
+			logger.Printf("Runtime '%s' has not been granted access to '%s'.\n", name, jo.Name)
+			err = rt.bindDeniedObject(jo.Name, jo.Object)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	for _, jf := range rm.apiFactories {
+		err := rt.BindScriptObject(jf.Name, jf.Factory(rt))
 		if err != nil {
 			fmt.Println(err.Error())
 		}
@@ -85,18 +116,57 @@ func (rm *RuntimeManager) GetRuntime(name string) scripting.Runtime {
 	}
 }
 
+func (rm *RuntimeManager) RuntimeIds() []string {
+	ids := make([]string, 0, len(rm.runtimes))
+	for id := range rm.runtimes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 func (rm *RuntimeManager) RemoveRuntime(name string) {
 	rt, ok := rm.runtimes[name]
 	if ok {
 		delete(rm.runtimes, name)
+		if rm.debug {
+			rm.writeProfile(rt)
+		}
 		rt.Shutdown()
+		callDuration.DeleteMatching("runtime", name)
+		callErrors.DeleteMatching("runtime", name)
+		logging.CloseDappLog(name)
+	}
+}
+
+// Write the profiling data of the runtime with the given name to a file
+// in the log directory. Returns the path to that file.
+func (rm *RuntimeManager) DumpProfile(name string) (string, error) {
+	rt, ok := rm.runtimes[name]
+	if !ok {
+		return "", fmt.Errorf("No runtime with id: %s", name)
 	}
+	return rm.writeProfile(rt)
+}
+
+func (rm *RuntimeManager) writeProfile(rt scripting.Runtime) (string, error) {
+	fileName := fmt.Sprintf("profile_%s_%d.json", rt.Id(), time.Now().Unix())
+	err := rm.fio.MarshalJsonToFile(rm.fio.Log(), fileName, rt.Profile())
+	if err != nil {
+		logger.Println("Failed to write profile: " + err.Error())
+		return "", err
+	}
+	return path.Join(rm.fio.Log(), fileName), nil
 }
 
 func (rm *RuntimeManager) RegisterApiObject(objectname string, api interface{}) {
 	rm.apiObjs = append(rm.apiObjs, &JsObj{objectname, api})
 }
 
+func (rm *RuntimeManager) RegisterApiObjectFactory(objectname string, factory func(scripting.Runtime) interface{}) {
+	rm.apiFactories = append(rm.apiFactories, &JsObjFactory{objectname, factory})
+}
+
 func (rm *RuntimeManager) RegisterApiScript(script string) {
 	rm.apiScript = append(rm.apiScript, script)
 }
@@ -107,18 +177,47 @@ type Runtime struct {
 	ep            events.EventProcessor
 	fio		      files.FileIO
 	name          string
+	// The log of the dapp (JS Print, Println and Printf).
+	log           *logging.Logger
 	mutex         *sync.Mutex
+	prof          *profiler
+	caps          scripting.Capabilities
+	quotas        *scripting.Quotas
+	allowedHosts  []string
+	// Incremented for each call, so that interrupts from calls that has
+	// already finished can be ignored.
+	callNum       uint64
+	// When the running call must be done by, or zero if there is no call
+	// time limit. Guarded by the runtime lock.
+	callDeadline  time.Time
+	// The span of the call that is running, if it is traced. Guarded by
+	// the runtime lock.
+	span          *tracing.Span
+}
+
+// Passed to panic by the interrupt that stops calls which are taking too long.
+type callTimeout struct {
+	maxTime time.Duration
 }
 
 // Package private
-func newRuntime(name string, ep events.EventProcessor, fio files.FileIO) scripting.Runtime {
+func newRuntime(name string, ep events.EventProcessor, fio files.FileIO, caps scripting.Capabilities) *Runtime {
 	vm := otto.New()
 	rt := &Runtime{}
 	rt.vm = vm
 	rt.ep = ep
 	rt.name = name
+	rt.log = logging.DappLogger(name)
 	rt.fio = fio
+	if caps == nil {
+		caps = make(scripting.Capabilities)
+	}
+	rt.caps = caps
+	rt.quotas = &scripting.Quotas{}
+	// The buffer prevents the timer from blocking.
+	vm.Interrupt = make(chan func(), 1)
 	rt.mutex = &sync.Mutex{}
+	rt.prof = newProfiler(name)
 	return rt
 }
 
@@ -131,6 +230,10 @@ func (rt *Runtime) Id() string {
 	return rt.name
 }
 
+func (rt *Runtime) Capabilities() scripting.Capabilities {
+	return rt.caps
+}
+
 // TODO add an interrupt channel.
 func (rt *Runtime) Init(name string) {
 	// Bind an event subscribe function to otto
@@ -141,7 +244,10 @@ func (rt *Runtime) Init(name string) {
 		target, _ := call.Argument(2).ToString()
 		id, _ := call.Argument(3).ToString()
 		rtSub := newRuntimeSub(source,tpe,target,id, rt)
-		rt.ep.Subscribe(rtSub)
+		err := rt.ep.Subscribe(rtSub)
+		if err != nil {
+			panic(rt.vm.MakeCustomError("QuotaError", err.Error()))
+		}
 	    return otto.Value{}
 	})
 	// Bind an event unsubscribe function to otto
@@ -153,6 +259,7 @@ func (rt *Runtime) Init(name string) {
 	
 	// Bind an event unsubscribe function to otto
 	rt.vm.Set("WriteTempFile", func(call otto.FunctionCall) otto.Value {
+	    rt.requireCapability(scripting.CAP_TEMPFILES)
 	    filename, err := call.Argument(0).ToString()
 	    if err != nil {
 	    	logger.Println("File not written: " + err.Error())
@@ -173,6 +280,7 @@ func (rt *Runtime) Init(name string) {
 	
 	// Bind an event unsubscribe function to otto
 	rt.vm.Set("ReadTempFile", func(call otto.FunctionCall) otto.Value {
+	    rt.requireCapability(scripting.CAP_TEMPFILES)
 	    filename, err := call.Argument(0).ToString()
 	    if err != nil {
 	    	logger.Println("File not read: " + err.Error())
@@ -225,28 +333,54 @@ func (rt *Runtime) BindScriptObject(name string, val interface{}) error {
 	return err
 }
 
+// Scripts are limited by the MaxCallTime quota as well, since dapp models
+// and session scripts are run this way.
 func (rt *Runtime) AddScript(script string) error {
 	rt.mutex.Lock()
 	defer rt.mutex.Unlock()
-	_, err := rt.vm.Run(script)
+	_, err := rt.limitCall(func() (otto.Value, error) {
+		return rt.vm.Run(script)
+	})
 	return err
 }
 
 func (rt *Runtime) CallFuncOnObj(objName, funcName string, param ...interface{}) (interface{}, error) {
+	return rt.CallFuncOnObjContext(context.Background(), objName, funcName, param...)
+}
+
+// The call is traced as a span, with the time spent waiting for the
+// runtime lock as a child span.
+func (rt *Runtime) CallFuncOnObjContext(ctx context.Context, objName, funcName string, param ...interface{}) (interface{}, error) {
+	ctx, span := tracing.Start(ctx, "js "+objName+"."+funcName, tracing.KIND_INTERNAL)
+	span.SetAttribute("decerver.dapp", rt.name)
+	_, waitSpan := tracing.Start(ctx, "runtime wait", tracing.KIND_INTERNAL)
+	waitStart := time.Now()
 	rt.mutex.Lock()
 	defer rt.mutex.Unlock()
+	waitSpan.End()
 	ob, err := rt.vm.Get(objName)
 	if err != nil {
+		span.SetError(err.Error())
+		span.End()
 		fmt.Println(err.Error())
 		return nil, err
 	}
 
-	val, callErr := ob.Object().Call(funcName, param...)
+	rt.span = span
+	callStart := time.Now()
+	val, callErr := rt.limitCall(func() (otto.Value, error) {
+		return ob.Object().Call(funcName, param...)
+	})
+	rt.span = nil
+	rt.prof.record(objName+"."+funcName, callStart.Sub(waitStart), time.Since(callStart), callErr != nil)
 
 	if callErr != nil {
+		span.SetError(callErr.Error())
+		span.End()
 		fmt.Println(callErr.Error())
-		return nil, err
+		return nil, callErr
 	}
+	span.End()
 
 	// Take the result and turn it into a go value.
 	obj, expErr := val.Export()
@@ -258,9 +392,14 @@ func (rt *Runtime) CallFuncOnObj(objName, funcName string, param ...interface{})
 }
 
 func (rt *Runtime) CallFunc(funcName string, param ...interface{}) (interface{}, error) {
+	waitStart := time.Now()
 	rt.mutex.Lock()
 	defer rt.mutex.Unlock()
-	val, callErr := rt.vm.Call(funcName, nil, param)
+	callStart := time.Now()
+	val, callErr := rt.limitCall(func() (otto.Value, error) {
+		return rt.vm.Call(funcName, nil, param)
+	})
+	rt.prof.record(funcName, callStart.Sub(waitStart), time.Since(callStart), callErr != nil)
 
 	if callErr != nil {
 		fmt.Println(callErr.Error())
@@ -279,6 +418,85 @@ func (rt *Runtime) CallFunc(funcName string, param ...interface{}) (interface{},
 	return obj, nil
 }
 
+// Runs the call, and interrupts it if it takes longer then the MaxCallTime
+// quota allows. Caller must hold the runtime lock.
+func (rt *Runtime) limitCall(call func() (otto.Value, error)) (val otto.Value, err error) {
+	rt.callNum++
+	if rt.quotas.MaxCallTime <= 0 {
+		return call()
+	}
+	maxTime := time.Duration(rt.quotas.MaxCallTime) * time.Millisecond
+	num := rt.callNum
+	rt.callDeadline = time.Now().Add(maxTime)
+	defer func() {
+		rt.callDeadline = time.Time{}
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			to, ok := r.(*callTimeout)
+			if !ok {
+				panic(r)
+			}
+			logger.Printf("Call in runtime '%s' interrupted after %s.\n", rt.name, to.maxTime)
+			err = fmt.Errorf("Call interrupted: exceeded the maximum call time (%s).", to.maxTime)
+		}
+	}()
+
+	timer := time.AfterFunc(maxTime, func() {
+		rt.vm.Interrupt <- func() {
+			// The interrupt may be picked up by a later call.
+			if rt.callNum == num {
+				panic(&callTimeout{maxTime})
+			}
+		}
+	})
+	defer timer.Stop()
+	return call()
+}
+
+func (rt *Runtime) SetQuotas(quotas *scripting.Quotas) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if quotas == nil {
+		quotas = &scripting.Quotas{}
+	}
+	rt.quotas = quotas
+}
+
+func (rt *Runtime) Quotas() *scripting.Quotas {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	return rt.quotas
+}
+
+func (rt *Runtime) SetAllowedHosts(hosts []string) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.allowedHosts = hosts
+}
+
+func (rt *Runtime) Profile() *scripting.Profile {
+	return rt.prof.Profile()
+}
+
+func (rt *Runtime) ResetProfile() {
+	rt.prof.Reset()
+}
+
+// When enabled, 'debugger' statements in dapp scripts will record the
+// current context (callee, position, stack and local symbols) in the
+// profile. Execution is never halted.
+func (rt *Runtime) SetBreakpointsEnabled(enabled bool) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if enabled {
+		rt.vm.SetDebuggerHandler(rt.prof.onBreak)
+	} else {
+		rt.vm.SetDebuggerHandler(nil)
+	}
+}
+
 // Will be refactored asap. See events/events.go for an explanation.
 type RuntimeSub struct {
 	source    string
@@ -314,6 +532,11 @@ func (rs *RuntimeSub) Event() string {
 	return rs.tpe
 }
 
+// Subscriptions are owned by the runtime (dapp) that made them.
+func (rs *RuntimeSub) Owner() string {
+	return rs.rt.Id()
+}
+
 // Passing along the sub ID means the right callback is used.
 func (rs *RuntimeSub) Post(e mtypes.Event) {
 	bts, _ := json.Marshal(e)
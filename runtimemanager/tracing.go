@@ -0,0 +1,92 @@
+package runtimemanager
+
+import (
+	"github.com/eris-ltd/decerver/tracing"
+	"github.com/robertkrimen/otto"
+	"net/http"
+	"reflect"
+)
+
+// Wraps the methods of an api object, so that the calls that scripts
+// make to them are traced as children of the span of the running call.
+// The fields of the object are still reachable, since the object is the
+// prototype of the wrapper.
+const tracedObjectScript = `(function(api, name, methods, start, end) {
+	var obj = Object.create(api);
+	methods.forEach(function(m) {
+		obj[m] = function() {
+			var span = start(name + "." + m), err = "";
+			try {
+				return api[m].apply(api, arguments);
+			} catch (e) {
+				err = String(e);
+				throw e;
+			} finally {
+				end(span, err);
+			}
+		};
+	});
+	return obj;
+})`
+
+// Binds an api object, with the calls to its methods traced.
+func (rt *Runtime) bindTracedObject(name string, api interface{}) error {
+	tp := reflect.TypeOf(api)
+	methods := make([]string, 0, tp.NumMethod())
+	for i := 0; i < tp.NumMethod(); i++ {
+		methods = append(methods, tp.Method(i).Name)
+	}
+	start := func(call otto.FunctionCall) otto.Value {
+		span := tracing.StartChild(rt.span, "module "+call.Argument(0).String(), tracing.KIND_INTERNAL)
+		if span == nil {
+			return otto.NullValue()
+		}
+		val, _ := rt.vm.ToValue(span)
+		return val
+	}
+	end := func(call otto.FunctionCall) otto.Value {
+		exp, _ := call.Argument(0).Export()
+		if span, ok := exp.(*tracing.Span); ok {
+			if msg := call.Argument(1).String(); msg != "" {
+				span.SetError(msg)
+			}
+			span.End()
+		}
+		return otto.UndefinedValue()
+	}
+	apiVal, err := rt.vm.ToValue(api)
+	if err != nil {
+		return err
+	}
+	rt.mutex.Lock()
+	obj, err := rt.vm.Call(tracedObjectScript, nil, apiVal, name, methods, start, end)
+	rt.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return rt.BindScriptObject(name, obj)
+}
+
+// Start a client span for an outbound http request, as a child of the
+// span of the running call. The trace context is added to the request.
+// Caller must hold the runtime lock.
+func (rt *Runtime) startHttpClientSpan(req *httpClientReq) *tracing.Span {
+	span := tracing.StartChild(rt.span, req.Method+" "+req.URL.Host, tracing.KIND_CLIENT)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	tracing.Inject(req.Header, span.Context())
+	return span
+}
+
+// End the span of an outbound http request.
+func endHttpClientSpan(span *tracing.Span, resp *httpClientResp, err error) {
+	if err != nil {
+		span.SetError(err.Error())
+	} else {
+		span.SetAttribute("http.response.status_code", resp.Status)
+		if resp.Status >= 400 {
+			span.SetError(http.StatusText(resp.Status))
+		}
+	}
+	span.End()
+}
@@ -2,9 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/decerver"
 	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
 	"io/ioutil"
 	"net/http"
 	"path"
@@ -29,6 +31,7 @@ func (das *DecerverAPIServer) handleReadyGET(w http.ResponseWriter, r *http.Requ
 
 	if !das.dc.IsStarted() {
 		das.writeError(w, 400, "decerver not started")
+		return
 	}
 
 	dapplist := das.dm.DappList()
@@ -41,8 +44,8 @@ func (das *DecerverAPIServer) handleReadyGET(w http.ResponseWriter, r *http.Requ
 	jsn := string(bts)
 	// DEBUG
 	logger.Println("Dapplist:\n" + jsn)
-	w.WriteHeader(200)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 	fmt.Fprint(w, jsn)
 }
 
@@ -55,8 +58,8 @@ func (das *DecerverAPIServer) handleDecerverGET(w http.ResponseWriter, r *http.R
 		das.writeError(w, 500, err.Error())
 		return
 	}
-	w.WriteHeader(200)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 	fmt.Fprint(w, string(bts))
 }
 
@@ -92,8 +95,8 @@ func (das *DecerverAPIServer) handleDecerverPOST(w http.ResponseWriter, r *http.
 	fio := das.dc.FileIO()
 	fio.MarshalJsonToFile(fio.Root(),"config",cfg)
 
-	w.WriteHeader(204)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(204)
 }
 
 // Modules
@@ -117,8 +120,8 @@ func (das *DecerverAPIServer) handleModuleGET(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	w.WriteHeader(200)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 	fmt.Fprint(w, string(bts))
 }
 
@@ -167,8 +170,8 @@ func (das *DecerverAPIServer) handleModulePOST(w http.ResponseWriter, r *http.Re
 	}
 
 	fio.WriteFile(pt, "config", bts)
-	w.WriteHeader(204)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(204)
 }
 
 func (das *DecerverAPIServer) handleDappSwitch(w http.ResponseWriter, r *http.Request) {
@@ -187,19 +190,250 @@ func (das *DecerverAPIServer) handleDappSwitch(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	w.WriteHeader(200)
-
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
 	// Whatever...
 	fmt.Fprint(w, "success")
 }
 
+// Permissions
+func (das *DecerverAPIServer) handlePermissionsGET(w http.ResponseWriter, r *http.Request) {
+	dappId := path.Base(r.URL.Path)
+	if dappId == "." || dappId == "/" || dappId == "" {
+		das.writeError(w, 404, "Malformed URL")
+		return
+	}
+	logger.Printf("GET %s permissions\n", dappId)
+	pi, err := das.dm.Permissions(dappId)
+	if err != nil {
+		das.writeError(w, 404, err.Error())
+		return
+	}
+	bts, err := json.Marshal(pi)
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+func (das *DecerverAPIServer) handlePermissionsPOST(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	idx := strings.Index(contentType, ";")
+	if idx != -1 {
+		contentType = contentType[:idx]
+	}
+	ct := strings.ToLower(contentType)
+
+	if ct != "application/json" {
+		das.writeError(w, 415, "unrecognized Content-Type: "+contentType)
+		return
+	}
+
+	dappId := path.Base(r.URL.Path)
+	if dappId == "." || dappId == "/" || dappId == "" {
+		das.writeError(w, 404, "Malformed URL")
+		return
+	}
+	logger.Printf("POST %s permissions\n", dappId)
+
+	bts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		das.writeError(w, 400, err.Error())
+		return
+	}
+	update := &dapps.PermissionUpdate{}
+	err = json.Unmarshal(bts, update)
+	if err != nil {
+		das.writeError(w, 422, err.Error())
+		return
+	}
+	err = das.dm.UpdatePermissions(dappId, update)
+	if err != nil {
+		das.writeError(w, 400, err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Quotas
+func (das *DecerverAPIServer) handleQuotasGET(w http.ResponseWriter, r *http.Request) {
+	dappId := path.Base(r.URL.Path)
+	if dappId == "." || dappId == "/" || dappId == "" {
+		das.writeError(w, 404, "Malformed URL")
+		return
+	}
+	logger.Printf("GET %s quotas\n", dappId)
+	qi, err := quotaInfo(das.dc, das.dm, dappId)
+	if errors.Is(err, dapps.ErrDappNotFound) {
+		das.writeError(w, 404, err.Error())
+		return
+	} else if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+
+	bts, err := json.Marshal(qi)
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// Get the quotas of a dapp, and how much it is using.
+func quotaInfo(dc decerver.Decerver, dm dapps.DappManager, dappId string) (*dapps.QuotaInfo, error) {
+	limits, err := dm.Quotas(dappId)
+	if err != nil {
+		return nil, err
+	}
+	qi := &dapps.QuotaInfo{}
+	qi.DappId = dappId
+	qi.Limits = limits
+	qi.RateLimits, err = dm.RateLimits(dappId)
+	if err != nil {
+		return nil, err
+	}
+	qi.Usage = &dapps.QuotaUsage{}
+	qi.Usage.TempFileBytes, err = dc.FileIO().DappTempUsage(dappId)
+	if err != nil {
+		return nil, err
+	}
+	qi.Usage.Subscriptions = dc.EventProcessor().SubscriptionCount(dappId)
+	qi.Usage.WsSessions = dc.Server().SessionCount(dappId)
+	qi.Usage.Throttled = dc.Server().Throttled(dappId)
+	return qi, nil
+}
+
+// Websocket sessions
+func (das *DecerverAPIServer) handleSessionsGET(w http.ResponseWriter, r *http.Request) {
+	logger.Println("GET sessions")
+	bts, err := json.Marshal(das.dc.Server().Sessions())
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// Dapps
+func (das *DecerverAPIServer) handleDappsGET(w http.ResponseWriter, r *http.Request) {
+	bts, err := json.Marshal(das.dm.DappList())
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// Runtimes
+func (das *DecerverAPIServer) handleRuntimesGET(w http.ResponseWriter, r *http.Request) {
+	bts, err := json.Marshal(das.dc.RuntimeManager().RuntimeIds())
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// The modules and their state. Module config is at /admin/modules/<name>.
+func (das *DecerverAPIServer) handleModulesGET(w http.ResponseWriter, r *http.Request) {
+	bts, err := json.Marshal(das.dc.ModuleManager().Status())
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// Event traffic. It is only collected in debug mode.
+func (das *DecerverAPIServer) handleTrafficGET(w http.ResponseWriter, r *http.Request) {
+	if !das.dc.Config().DebugMode {
+		das.writeError(w, 404, "Event traffic is only collected in debug mode.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprint(w, das.dc.EventProcessor().TrafficData())
+}
+
+// Profiling
+func (das *DecerverAPIServer) handleProfileGET(w http.ResponseWriter, r *http.Request) {
+	rt, ok := das.profiledRuntime(w, r)
+	if !ok {
+		return
+	}
+	logger.Printf("GET %s profile\n", rt.Id())
+	bts, err := json.MarshalIndent(rt.Profile(), "", "\t")
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+// Writes the profile to a file in the log directory.
+func (das *DecerverAPIServer) handleProfilePOST(w http.ResponseWriter, r *http.Request) {
+	rt, ok := das.profiledRuntime(w, r)
+	if !ok {
+		return
+	}
+	logger.Printf("POST %s profile dump\n", rt.Id())
+	fileName, err := das.dc.RuntimeManager().DumpProfile(rt.Id())
+	if err != nil {
+		das.writeError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprint(w, fileName)
+}
+
+func (das *DecerverAPIServer) handleProfileDELETE(w http.ResponseWriter, r *http.Request) {
+	rt, ok := das.profiledRuntime(w, r)
+	if !ok {
+		return
+	}
+	logger.Printf("DELETE %s profile\n", rt.Id())
+	rt.ResetProfile()
+	w.WriteHeader(204)
+}
+
+// Get the runtime from the url. Writes the error response if that fails.
+func (das *DecerverAPIServer) profiledRuntime(w http.ResponseWriter, r *http.Request) (scripting.Runtime, bool) {
+	dappId := path.Base(r.URL.Path)
+	if dappId == "." || dappId == "/" || dappId == "" {
+		das.writeError(w, 404, "Malformed URL")
+		return nil, false
+	}
+	rt := das.dc.RuntimeManager().GetRuntime(dappId)
+	if rt == nil {
+		das.writeError(w, 404, "No runtime for dapp: "+dappId)
+		return nil, false
+	}
+	return rt, true
+}
+
 func (das *DecerverAPIServer) handleFoF(w http.ResponseWriter, r *http.Request) {
 	das.writeError(w, 400, "The route not open (the dapp is not in focus).")
 }
 
 func (das *DecerverAPIServer) writeError(w http.ResponseWriter, status int, msg string) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
 	fmt.Fprint(w, msg)
 }
@@ -4,10 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/scripting"
-	"io/ioutil"
+	"github.com/eris-ltd/decerver/tracing"
 	"net/http"
 	"net/url"
-	"strings"
 )
 
 type HttpReqProxy struct {
@@ -15,30 +14,35 @@ type HttpReqProxy struct {
 	Method string
 	Host string
 	Header http.Header
+	// The cookies, by name.
+	Cookies map[string]string
+	// The body, if it is text and no larger then MAX_INLINE_BODY.
 	Body string
+	// Set if the body was not put in Body. It must be read with the
+	// body reader instead.
+	Streamed bool
+	// The values and files of multipart forms.
+	Form map[string][]string
+	Files map[string][]*HttpFileInfo
 }
 
-func ProxyFromHttpReq(r *http.Request) (*HttpReqProxy, error) {
-	
-	bts, err := ioutil.ReadAll(r.Body);
+// Make a runtime compatible object. The body reader is used for bodies
+// that are binary or large, and for uploaded files.
+func ProxyFromHttpReq(r *http.Request) (*HttpReqProxy, *HttpBodyJs, error) {
+	p := &HttpReqProxy{}
+	p.Method = r.Method
+	p.Host = r.Host
+	p.URL = r.URL
+	p.Header = r.Header
+	p.Cookies = make(map[string]string)
+	for _, c := range r.Cookies() {
+		p.Cookies[c.Name] = c.Value
+	}
+	body, err := readHttpBody(r, p)
 	if err != nil {
-		return nil, err;
-	} else {
-		// Make a runtime compatible object
-		p := &HttpReqProxy{}
-		p.Method = r.Method
-		p.Host = r.Host
-		p.URL = r.URL
-		p.Header = r.Header
-		p.Body = string(bts)
-		return p, nil
-	} 
-}
-
-type HttpResp struct {
-	Status int               `json:"status"`
-	Header map[string]string `json:"header"`
-	Body   string            `json:"body"`
+		return nil, nil, err
+	}
+	return p, body, nil
 }
 
 type HttpAPIServer struct {
@@ -52,30 +56,59 @@ func NewHttpAPIServer(rm scripting.RuntimeManager) *HttpAPIServer {
 // This is our basic http receiver that takes the request and passes it into the js runtime.
 func (has *HttpAPIServer) handleHttp(w http.ResponseWriter, r *http.Request) {
 
-	u := r.URL
-	p := u.Path 
-	caller := strings.Split(strings.TrimLeft(p,"/"),"/")[1];
+	caller := dappIdOf(r)
+
+	// The request is traced as part of the clients trace, if it sent one.
+	ctx := tracing.ContextWithRemote(r.Context(), tracing.Extract(r.Header))
+	ctx, span := tracing.Start(ctx, r.Method+" "+HTTP_BASE+caller, tracing.KIND_SERVER)
+	if span != nil {
+		sr := &statusRecorder{ResponseWriter: w}
+		w = sr
+		defer endHttpSpan(span, sr, r)
+	}
 	
 	rt := has.rm.GetRuntime(caller)
 	// TODO Update this. It's basically how we check if dapp is ready now.
 	if rt == nil {
-		w.WriteHeader(400)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, "Dapp not in focus")
+		has.writeError(w, 400, "Dapp not in focus")
 		return
 	}
 	
 	// logger.Println("Incoming: %v\n", r)
-	
-	prx, errpr := ProxyFromHttpReq(r)
-	// Shouldn't happen.
-	if errpr != nil {
+
+	if limit := rt.Quotas().MaxHttpRequestBytes; limit > 0 {
+		if r.ContentLength > limit {
+			has.writeError(w, 413, errBodyTooLarge.Error())
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	prx, body, errpr := ProxyFromHttpReq(r)
+	if errpr == errBodyTooLarge {
+		has.writeError(w, 413, errpr.Error())
+		return
+	} else if errpr != nil {
 		has.writeError(w, 400, errpr.Error())
 		return
 	}
+	defer body.close()
+	resp := newHttpResponseJs(w)
+	defer resp.close()
+
 	// TODO this is a bad solution. It should be possible to pass objects (at least maps) right in.
 	bts, _ := json.Marshal(prx)
-	ret, err := rt.CallFuncOnObj("network", "handleIncomingHttp", string(bts))
+	ret, err := rt.CallFuncOnObjContext(ctx, "network", "handleIncomingHttp", string(bts), body, resp)
+
+	// If the dapp has used the response writer, the response is its own.
+	if used, keepOpen := resp.state(); used {
+		if err != nil {
+			logger.Printf("Js runtime error in streamed http response: %s\n", err.Error())
+		} else if keepOpen {
+			resp.wait(r)
+		}
+		return
+	}
 
 	if err != nil {
 		has.writeError(w, 500, err.Error())
@@ -95,21 +128,36 @@ func (has *HttpAPIServer) handleHttp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	has.writeReq(hr, w)
+	has.writeReq(hr, w, r)
 }
 
-func (has *HttpAPIServer) writeReq(resp *HttpResp, w http.ResponseWriter) {
+func endHttpSpan(span *tracing.Span, sr *statusRecorder, r *http.Request) {
+	status := sr.status
+	if status == 0 {
+		status = 200
+	}
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("client.address", remoteIp(r.RemoteAddr))
+	span.SetAttribute("decerver.dapp", dappIdOf(r))
+	span.SetAttribute("http.response.status_code", status)
+	if status >= 500 {
+		span.SetError(http.StatusText(status))
+	}
+	span.End()
+}
+
+func (has *HttpAPIServer) writeReq(resp *HttpResp, w http.ResponseWriter, r *http.Request) {
 	logger.Printf("Response status message: %d\n", resp.Status)
 	logger.Printf("Response header stuff: %v\n", resp.Header)
-	w.WriteHeader(resp.Status)
-	for k, v := range resp.Header {
-		w.Header().Set(k, v)
+	if err := writeHttpResp(w, r, resp); err != nil {
+		logger.Println("Bad http response from dapp: " + err.Error())
+		has.writeError(w, 500, err.Error())
 	}
-	w.Write([]byte(resp.Body))
 }
 
 func (has *HttpAPIServer) writeError(w http.ResponseWriter, status int, msg string) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
 	fmt.Fprint(w, msg)
 }
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of events that are kept for each dapp, so that clients
+	// can catch up after reconnecting (using the Last-Event-ID header).
+	sseBufferSize = 256
+
+	// Comments are sent with this period to keep idle connections open.
+	sseHeartbeatPeriod = 15 * time.Second
+
+	// The number of events that can be queued for a client. Clients that
+	// falls further behind are disconnected, and has to reconnect. It is
+	// the same as the buffer size so that a full replay always fits.
+	sseClientQueueSize = sseBufferSize
+)
+
+// An event that is published by a dapp.
+type sseEvent struct {
+	id      uint64
+	channel string
+	data    string
+}
+
+// A connected client. If channels is nil, the client receives events
+// from all channels.
+type sseClient struct {
+	channels map[string]bool
+	events   chan *sseEvent
+}
+
+func (sc *sseClient) wants(evt *sseEvent) bool {
+	return sc.channels == nil || sc.channels[evt.channel]
+}
+
+// The event stream of a dapp. It keeps the most recent events, and the
+// clients that are currently connected.
+type sseStream struct {
+	mutex   *sync.Mutex
+	lastId  uint64
+	buffer  []*sseEvent
+	clients map[*sseClient]bool
+}
+
+func newSseStream() *sseStream {
+	st := &sseStream{}
+	st.mutex = &sync.Mutex{}
+	st.buffer = make([]*sseEvent, 0, sseBufferSize)
+	st.clients = make(map[*sseClient]bool)
+	return st
+}
+
+func (st *sseStream) publish(channel, data string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.lastId++
+	evt := &sseEvent{st.lastId, channel, data}
+	if len(st.buffer) == sseBufferSize {
+		st.buffer = st.buffer[1:]
+	}
+	st.buffer = append(st.buffer, evt)
+
+	for client := range st.clients {
+		if !client.wants(evt) {
+			continue
+		}
+		select {
+		case client.events <- evt:
+		default:
+			// The client is too slow. Closing the queue makes the handler
+			// disconnect it.
+			delete(st.clients, client)
+			close(client.events)
+		}
+	}
+}
+
+// Add a client. Buffered events with an id higher then lastId are queued
+// for the client right away, so that there are no gaps.
+func (st *sseStream) add(client *sseClient, lastId uint64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, evt := range st.buffer {
+		if evt.id <= lastId || !client.wants(evt) {
+			continue
+		}
+		select {
+		case client.events <- evt:
+		default:
+		}
+	}
+	st.clients[client] = true
+}
+
+func (st *sseStream) remove(client *sseClient) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, ok := st.clients[client]; ok {
+		delete(st.clients, client)
+		close(client.events)
+	}
+}
+
+// The server-sent events server. Dapps publish events to named channels
+// using network.sse.publish, and clients receive them by connecting to
+// /sse/<dappId>. The 'channel' query parameter (can be repeated) is used
+// to only receive events from certain channels.
+type SseAPIServer struct {
+	rm      scripting.RuntimeManager
+	was     *WsAPIServer
+	mutex   *sync.Mutex
+	streams map[string]*sseStream
+	// How often heartbeats are sent.
+	heartbeatPeriod time.Duration
+	// Closed on shutdown, to end all event streams.
+	closing chan struct{}
+}
+
+func NewSseAPIServer(rm scripting.RuntimeManager, was *WsAPIServer) *SseAPIServer {
+	srv := &SseAPIServer{}
+	srv.rm = rm
+	srv.was = was
+	srv.mutex = &sync.Mutex{}
+	srv.streams = make(map[string]*sseStream)
+	srv.heartbeatPeriod = sseHeartbeatPeriod
+	srv.closing = make(chan struct{})
+	// Every runtime gets its own publisher, so dapps can only publish to
+	// their own streams.
+	rm.RegisterApiObjectFactory("sse_publisher", func(rt scripting.Runtime) interface{} {
+		return &SsePublisherJs{srv, rt.Id()}
+	})
+	return srv
+}
+
+func (srv *SseAPIServer) stream(dappId string) *sseStream {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	st, ok := srv.streams[dappId]
+	if !ok {
+		st = newSseStream()
+		srv.streams[dappId] = st
+	}
+	return st
+}
+
+// End all event streams. New streams are refused by the websocket
+// servers admission control while it is shut down.
+func (srv *SseAPIServer) Shutdown() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	select {
+	case <-srv.closing:
+	default:
+		close(srv.closing)
+	}
+}
+
+// Allow streams again after a shutdown.
+func (srv *SseAPIServer) Open() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	select {
+	case <-srv.closing:
+		srv.closing = make(chan struct{})
+	default:
+	}
+}
+
+func (srv *SseAPIServer) closingChan() chan struct{} {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.closing
+}
+
+func (srv *SseAPIServer) Publish(dappId, channel, data string) {
+	srv.stream(dappId).publish(channel, data)
+}
+
+func (srv *SseAPIServer) handleSse(w http.ResponseWriter, r *http.Request) {
+	caller := dappIdOf(r)
+
+	rt := srv.rm.GetRuntime(caller)
+	// TODO Update this. It's basically how we check if dapp is ready now.
+	if rt == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Dapp not in focus")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprint(w, "Streaming not supported")
+		return
+	}
+
+	id, err := srv.was.OpenStream(caller, r.RemoteAddr, rt)
+	if err != nil {
+		logger.Println("Event stream refused: " + err.Error())
+		writeUnavailable(w, err.Error())
+		return
+	}
+	defer srv.was.CloseStream(id)
+
+	client := &sseClient{}
+	client.events = make(chan *sseEvent, sseClientQueueSize)
+	if chs, ok := r.URL.Query()["channel"]; ok {
+		client.channels = make(map[string]bool)
+		for _, ch := range chs {
+			client.channels[ch] = true
+		}
+	}
+
+	lastIdStr := r.Header.Get("Last-Event-ID")
+	if lastIdStr == "" {
+		lastIdStr = r.URL.Query().Get("lastEventId")
+	}
+	lastId, _ := strconv.ParseUint(lastIdStr, 10, 64)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	st := srv.stream(caller)
+	st.add(client, lastId)
+	defer st.remove(client)
+	logger.Printf("New event stream for '%s' (session: %d)\n", caller, id)
+
+	heartbeat := time.NewTicker(srv.heartbeatPeriod)
+	defer heartbeat.Stop()
+	closing := srv.closingChan()
+
+	for {
+		select {
+		case evt, ok := <-client.events:
+			if !ok {
+				logger.Printf("Event stream for '%s' is too slow, disconnecting (session: %d)\n", caller, id)
+				return
+			}
+			if err := writeSseEvent(w, evt); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			logger.Printf("Event stream for '%s' closed (session: %d)\n", caller, id)
+			return
+		case <-closing:
+			logger.Printf("Event stream for '%s' ended by shutdown (session: %d)\n", caller, id)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSseEvent(w http.ResponseWriter, evt *sseEvent) error {
+	msg := fmt.Sprintf("id: %d\n", evt.id)
+	if evt.channel != "" {
+		// Line breaks would end the field.
+		msg += "event: " + strings.NewReplacer("\r", "", "\n", "").Replace(evt.channel) + "\n"
+	}
+	// Multi-line data must be split over several data fields. Clients end
+	// lines on "\r\n", "\r" and "\n", so all of them are split on.
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(evt.data)
+	for _, line := range strings.Split(data, "\n") {
+		msg += "data: " + line + "\n"
+	}
+	_, err := fmt.Fprint(w, msg+"\n")
+	return err
+}
+
+// The object that is bound to each runtime as 'sse_publisher'.
+type SsePublisherJs struct {
+	server *SseAPIServer
+	dappId string
+}
+
+func (spj *SsePublisherJs) Publish(channel, data string) {
+	spj.server.Publish(spj.dappId, channel, data)
+}
@@ -1,152 +1,526 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/events"
+	"github.com/eris-ltd/decerver/interfaces/network"
 	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
 	"github.com/eris-ltd/decerver/util"
 	"github.com/gorilla/websocket"
 	"net/http"
-	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// The websocket server handles connections.
+// Clients that are refused because of connection limits are asked to
+// retry after this many seconds.
+const RETRY_AFTER = 5
+
+// Returned when a connection is refused because a limit has been reached.
+type AdmissionError struct {
+	msg string
+}
+
+func (ae *AdmissionError) Error() string {
+	return ae.msg
+}
+
+// A connection that has been admitted.
+type connSlot struct {
+	caller string
+	ip     string
+}
+
+// The websocket server handles connections. It also does admission control
+// for other streaming connections (see OpenStream), so that they all count
+// towards the same limits.
 type WsAPIServer struct {
-	rm                scripting.RuntimeManager
-	activeConnections uint32
-	maxConnections    uint32
-	idPool            *util.IdPool
-	sessions          map[uint32]*Session
+	rm             scripting.RuntimeManager
+	ep             events.EventProcessor
+	maxConnections uint32
+	// The maximum number of connections from a single ip (0 means no limit).
+	maxConnectionsPerIp int
+	idPool              *util.IdPool
+	// Guards slots, ipCounts, protocols and closed.
+	mutex    *sync.Mutex
+	slots    map[uint32]*connSlot
+	ipCounts map[string]int
+	// The websocket protocol of each dapp. Missing means ESRPC.
+	protocols map[string]string
+	// The origin policies of the dapps. Also used by the http and event
+	// stream servers.
+	origins *originPolicies
+	// The rate limits of the dapps. Also used by the http and event stream
+	// servers.
+	limits *rateLimiter
+	// Set while the server is shut down. No connections are admitted.
+	closed   bool
+	sessions *sessionRegistry
+	settings *wsSettings
+	upgrader *websocket.Upgrader
 }
 
-func NewWsAPIServer(rm scripting.RuntimeManager, maxConnections uint32) *WsAPIServer {
+func NewWsAPIServer(rm scripting.RuntimeManager, ep events.EventProcessor, maxConnections uint32, maxConnectionsPerIp int, cfg *decerver.WsConfig) *WsAPIServer {
 	srv := &WsAPIServer{}
-	srv.sessions = make(map[uint32]*Session)
+	srv.ep = ep
+	srv.settings = newWsSettings(cfg)
+	srv.upgrader = srv.settings.upgrader()
+	srv.mutex = &sync.Mutex{}
+	srv.sessions = newSessionRegistry()
+	srv.slots = make(map[uint32]*connSlot)
+	srv.ipCounts = make(map[string]int)
+	srv.protocols = make(map[string]string)
+	srv.origins = newOriginPolicies()
+	srv.limits = newRateLimiter()
 	srv.maxConnections = maxConnections
+	srv.maxConnectionsPerIp = maxConnectionsPerIp
 	srv.idPool = util.NewIdPool(maxConnections)
 	srv.rm = rm
+	// Every runtime gets its own broadcaster, so dapps can only broadcast
+	// to their own sessions.
+	rm.RegisterApiObjectFactory("ws_broadcaster", func(rt scripting.Runtime) interface{} {
+		return &WsBroadcasterJs{srv, rt.Id()}
+	})
 	return srv
 }
 
 func (srv *WsAPIServer) CurrentActiveConnections() uint32 {
-	return srv.activeConnections
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return uint32(len(srv.slots))
 }
 
 func (srv *WsAPIServer) MaxConnections() uint32 {
 	return srv.maxConnections
 }
 
+// The number of connections that are open for a dapp.
+func (srv *WsAPIServer) DappSessionCount(dappId string) int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.dappSessionCount(dappId)
+}
+
+// Not thread safe.
+func (srv *WsAPIServer) dappSessionCount(dappId string) int {
+	num := 0
+	for _, slot := range srv.slots {
+		if slot.caller == dappId {
+			num++
+		}
+	}
+	return num
+}
+
+// Check the connection limits, and reserve an id for the connection if
+// they allow it. Returns an *AdmissionError otherwise.
+func (srv *WsAPIServer) admit(caller, remoteAddr string, rt scripting.Runtime) (uint32, error) {
+	ip := remoteIp(remoteAddr)
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	if srv.closed {
+		return 0, &AdmissionError{"Server is shutting down."}
+	}
+	if uint32(len(srv.slots)) >= srv.maxConnections {
+		return 0, &AdmissionError{fmt.Sprintf("Already at capacity (%d).", srv.maxConnections)}
+	}
+	max := rt.Quotas().MaxWsSessions
+	if max > 0 && srv.dappSessionCount(caller) >= max {
+		return 0, &AdmissionError{fmt.Sprintf("'%s' has reached its session quota (%d).", caller, max)}
+	}
+	if srv.maxConnectionsPerIp > 0 && srv.ipCounts[ip] >= srv.maxConnectionsPerIp {
+		return 0, &AdmissionError{fmt.Sprintf("Too many connections from %s (%d).", ip, srv.maxConnectionsPerIp)}
+	}
+	id, err := srv.idPool.GetId()
+	if err != nil {
+		return 0, &AdmissionError{err.Error()}
+	}
+	srv.slots[id] = &connSlot{caller, ip}
+	srv.ipCounts[ip]++
+	return id, nil
+}
+
+// Release a connection id. Does nothing if the id is not in use.
+func (srv *WsAPIServer) release(id uint32) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	slot, ok := srv.slots[id]
+	if !ok {
+		return
+	}
+	delete(srv.slots, id)
+	srv.sessions.remove(id)
+	srv.ipCounts[slot.ip]--
+	if srv.ipCounts[slot.ip] == 0 {
+		delete(srv.ipCounts, slot.ip)
+	}
+	srv.idPool.ReleaseId(id)
+}
+
+// Register a streaming connection that is not a websocket, so that it counts
+// towards the connection limits and the dapps session quota.
+func (srv *WsAPIServer) OpenStream(caller, remoteAddr string, rt scripting.Runtime) (uint32, error) {
+	return srv.admit(caller, remoteAddr, rt)
+}
+
+func (srv *WsAPIServer) CloseStream(id uint32) {
+	srv.release(id)
+}
+
 func (srv *WsAPIServer) RemoveSession(ss *Session) {
-	srv.activeConnections--
-	srv.idPool.ReleaseId(ss.wsConn.SessionId())
-	delete(srv.sessions, ss.wsConn.SessionId())
+	srv.release(ss.wsConn.SessionId())
 }
 
-func (srv *WsAPIServer) CreateSession(caller string, rt scripting.Runtime, wsConn *WsConn) *Session {
+// Create a session for a connection that has been admitted.
+func (srv *WsAPIServer) CreateSession(id uint32, caller, remoteAddr string, rt scripting.Runtime, wsConn *WsConn) *Session {
 	ss := &Session{}
 	ss.wsConn = wsConn
 	ss.server = srv
 	ss.caller = caller
+	ss.remoteAddr = remoteAddr
+	ss.opened = time.Now()
 	ss.runtime = rt
-	srv.activeConnections++
-	id := srv.idPool.GetId()
+	ss.messageLimit = srv.settings.messageLimit(rt.Quotas())
+	ss.protocol = srv.WsProtocol(caller)
+	ss.subMutex = &sync.Mutex{}
+	ss.subs = make(map[string]*SessionSub)
 	ss.wsConn.sessionId = id
-	srv.sessions[id] = ss
+	srv.sessions.add(ss)
 	return ss
 }
 
-// This is passed to the Martini server.
-// Find out what endpoint they called and create a session based on that.
+// Set the websocket protocol of a dapp. It applies to new sessions.
+func (srv *WsAPIServer) SetWsProtocol(dappId, protocol string) error {
+	if !validWsProtocol(protocol) {
+		return fmt.Errorf("Unknown websocket protocol: '%s'", protocol)
+	}
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if protocol == "" || protocol == dapps.WS_PROTOCOL_ESRPC {
+		delete(srv.protocols, dappId)
+	} else {
+		srv.protocols[dappId] = protocol
+	}
+	return nil
+}
+
+func (srv *WsAPIServer) WsProtocol(dappId string) string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if protocol, ok := srv.protocols[dappId]; ok {
+		return protocol
+	}
+	return dapps.WS_PROTOCOL_ESRPC
+}
+
+// Set the origin policy of a dapp. It applies to new connections.
+func (srv *WsAPIServer) SetOriginPolicy(dappId string, policy *dapps.OriginPolicy) error {
+	return srv.origins.set(dappId, policy)
+}
+
+// Set the rate limits of a dapp. nil means no limits.
+func (srv *WsAPIServer) SetRateLimits(dappId string, limits *dapps.RateLimits) error {
+	return srv.limits.set(dappId, limits)
+}
+
+// Get a live session by id. Returns nil if there is no such session.
+func (srv *WsAPIServer) Session(id uint32) *Session {
+	return srv.sessions.get(id)
+}
+
+// Queue a message for all open sessions of a dapp. It never blocks;
+// sessions that can not keep up miss the message. Returns the number of
+// sessions the message was queued for.
+func (srv *WsAPIServer) Broadcast(dappId string, msg []byte) int {
+	num := 0
+	for _, ss := range srv.sessions.forDapp(dappId) {
+		if ss.State() == SESSION_OPEN && ss.wsConn.tryWriteJsonMsg(msg) {
+			num++
+		}
+	}
+	return num
+}
+
+// Send a JSON-RPC notification to a session of a dapp. Returns false if
+// the session does not exist, belongs to another dapp, is not using
+// JSON-RPC, or could not keep up.
+func (srv *WsAPIServer) Notify(dappId string, sessionId uint32, method string, params json.RawMessage) bool {
+	ss := srv.sessions.get(sessionId)
+	if ss == nil || ss.caller != dappId {
+		return false
+	}
+	return ss.notify(method, params)
+}
+
+// Send a JSON-RPC notification to all sessions of a dapp. Returns the
+// number of sessions it was queued for.
+func (srv *WsAPIServer) BroadcastNotification(dappId, method string, params json.RawMessage) int {
+	num := 0
+	for _, ss := range srv.sessions.forDapp(dappId) {
+		if ss.notify(method, params) {
+			num++
+		}
+	}
+	return num
+}
+
+// Information about all live sessions.
+func (srv *WsAPIServer) Sessions() []*network.SessionInfo {
+	sss := srv.sessions.all()
+	infos := make([]*network.SessionInfo, len(sss))
+	for i, ss := range sss {
+		infos[i] = ss.Info()
+	}
+	return infos
+}
+
+// Close all sessions, and refuse new connections until Open is called.
+// Sessions are closed in parallel. Returns the number of sessions that
+// had not finished closing when the context was done.
+func (srv *WsAPIServer) Shutdown(ctx context.Context) int {
+	srv.mutex.Lock()
+	srv.closed = true
+	srv.mutex.Unlock()
+
+	sss := srv.sessions.all()
+	left := int32(len(sss))
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, ss := range sss {
+		wg.Add(1)
+		go func(ss *Session) {
+			ss.Close()
+			atomic.AddInt32(&left, -1)
+			wg.Done()
+		}(ss)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return int(atomic.LoadInt32(&left))
+	}
+}
+
+// Start accepting connections again after a shutdown.
+func (srv *WsAPIServer) Open() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.closed = false
+}
+
+// Writes a 503 with a Retry-After header.
+func writeUnavailable(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER))
+	w.WriteHeader(503)
+	fmt.Fprint(w, msg)
+}
+
+// This is passed to the router. The dapp id comes from the route, and a
+// session is created for that dapp.
 func (srv *WsAPIServer) handleWs(w http.ResponseWriter, r *http.Request) {
 	logger.Println("New websocket connection registering.")
-	if srv.activeConnections == srv.maxConnections {
-		logger.Println("Connection failed: Already at capacity.")
-	}
-	u := r.URL
-	p := u.Path
-	caller := path.Base(p)
+	caller := dappIdOf(r)
 
 	rt := srv.rm.GetRuntime(caller)
 	// TODO Update this. It's basically how we check if dapp is ready now.
 	if rt == nil {
-		w.WriteHeader(400)
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
 		fmt.Fprint(w, "Dapp not in focus")
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		logger.Printf("Failed to upgrade to websocket (%s)\n", err.Error())
+	if !srv.origins.allowed(caller, r) {
+		logger.Printf("Connection refused: origin '%s' is not allowed by '%s'.\n", r.Header.Get("Origin"), caller)
+		writeForbidden(w, "Origin not allowed.")
 		return
 	}
-	// TODO buffering...
-	wsConn := &WsConn{
-		conn:              conn,
-		writeMsgChannel:   make(chan *Message, 256),
-		writeCloseChannel: make(chan *Message, 256),
+
+	id, err := srv.admit(caller, r.RemoteAddr, rt)
+	if err != nil {
+		logger.Println("Connection failed: " + err.Error())
+		writeUnavailable(w, err.Error())
+		return
 	}
 
-	ss := srv.CreateSession(caller, rt, wsConn)
-	// We add this session to the callers (dapps) runtime.
-	err = rt.BindScriptObject("tempObj", NewSessionJs(ss))
+	// Tell the client how large messages it may send.
+	limit := srv.settings.messageLimit(rt.Quotas())
+	header := http.Header{}
+	header.Set("X-Max-Message-Size", strconv.FormatInt(limit, 10))
+	conn, err := srv.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		logger.Printf("Failed to upgrade to websocket (%s)\n", err.Error())
+		srv.release(id)
+		return
+	}
+	ss := srv.CreateSession(id, caller, r.RemoteAddr, rt, newWsConn(conn))
+	ss.traceParent = tracing.Extract(r.Header)
+	// The writer must be running before the dapp gets the session, since
+	// it may start writing right away.
+	go writer(ss)
 
+	// We add this session to the callers (dapps) runtime. The object gets a
+	// name of its own, since several connections can be set up at once.
+	objName := fmt.Sprintf("tempObj_%d", id)
+	err = rt.BindScriptObject(objName, NewSessionJs(ss))
 	if err != nil {
-		panic(err.Error())
+		logger.Printf("Failed to bind session object (session: %d): %s\n", id, err.Error())
+		ss.Close()
+		return
 	}
 
 	// TODO fix...
-	rt.AddScript("tempObj.sessionId = function(){return this.SessionId()};tempObj.writeJson = function(data){return this.WriteJson(data)};network.newWsSession(tempObj); tempObj = null;")
+	rt.AddScript(fmt.Sprintf("(function(so){so.sessionId = function(){return this.SessionId()};so.writeJson = function(data){return this.WriteJson(data)};network.newWsSession(so);})(%[1]s); %[1]s = undefined;", objName))
 	//rt.CallFuncOnObj("network", "newWsSession", val)
-	go writer(ss)
 	reader(ss)
-	ss.wsConn.writeMsgChannel <- &Message{Data: nil}
 	ss.Close()
 }
 
 type Session struct {
-	caller    string
-	runtime   scripting.Runtime
-	server    *WsAPIServer
-	wsConn    *WsConn
-	sessionJs *SessionJs
+	// Message counters. They are updated atomically, and must come first
+	// in the struct so that they are 64-bit aligned on all platforms.
+	msgsIn   uint64
+	msgsOut  uint64
+	bytesIn  uint64
+	bytesOut uint64
+
+	caller     string
+	remoteAddr string
+	opened     time.Time
+	runtime    scripting.Runtime
+	server     *WsAPIServer
+	wsConn     *WsConn
+	// The largest message the client may send.
+	messageLimit int64
+	// The websocket protocol (see dapps.WS_PROTOCOL_*).
+	protocol string
+	// The trace context that the client sent with the websocket handshake.
+	// Messages are traced as its children.
+	traceParent tracing.SpanContext
+	state       int32
+	closeOnce   sync.Once
+	// Event subscriptions made by the client, by id.
+	subMutex *sync.Mutex
+	subs     map[string]*SessionSub
 }
 
 func (ss *Session) SessionId() uint32 {
 	return ss.wsConn.sessionId
 }
 
+func (ss *Session) State() int32 {
+	return atomic.LoadInt32(&ss.state)
+}
+
+func (ss *Session) countIn(bytes int) {
+	atomic.AddUint64(&ss.msgsIn, 1)
+	atomic.AddUint64(&ss.bytesIn, uint64(bytes))
+}
+
+func (ss *Session) countOut(bytes int) {
+	atomic.AddUint64(&ss.msgsOut, 1)
+	atomic.AddUint64(&ss.bytesOut, uint64(bytes))
+}
+
+func (ss *Session) Info() *network.SessionInfo {
+	si := &network.SessionInfo{}
+	si.Id = ss.SessionId()
+	si.DappId = ss.caller
+	si.RemoteAddr = ss.remoteAddr
+	si.State = sessionStateName(ss.State())
+	si.Opened = ss.opened
+	si.Protocol = ss.protocol
+	si.MsgsIn = atomic.LoadUint64(&ss.msgsIn)
+	si.MsgsOut = atomic.LoadUint64(&ss.msgsOut)
+	si.BytesIn = atomic.LoadUint64(&ss.bytesIn)
+	si.BytesOut = atomic.LoadUint64(&ss.bytesOut)
+	return si
+}
+
+// Close the session from the dapp. This is called from inside the runtime,
+// so the actual closing is done in another goroutine (it calls back into
+// the runtime).
 func (ss *Session) WriteCloseMsg() {
-	ss.wsConn.WriteCloseMsg()
+	go ss.Close()
 }
 
+// Close the session. It is safe to call any number of times, and from any
+// goroutine except the writer or one that holds the runtime. Only the first
+// call does anything, and it returns when the session is closed.
 func (ss *Session) Close() {
-	logger.Printf("CLOSING SESSION: %d\n", ss.wsConn.sessionId)
-	// Deregister ourselves.
-	ss.server.RemoveSession(ss)
-	ss.runtime.CallFuncOnObj("network", "deleteWsSession", int(ss.SessionId()))
-	if ss.wsConn.conn != nil {
-		err := ss.wsConn.conn.Close()
-		if err != nil {
-			logger.Printf("Failed to close websocket connection, already removed: %d\n", ss.wsConn.sessionId)
+	ss.closeOnce.Do(func() {
+		logger.Printf("CLOSING SESSION: %d\n", ss.SessionId())
+		atomic.StoreInt32(&ss.state, SESSION_CLOSING)
+		// Stop the writer, and give it a chance to send the close frame.
+		close(ss.wsConn.closing)
+		select {
+		case <-ss.wsConn.writerDone:
+		case <-time.After(ss.server.settings.writeWait):
+			logger.Printf("Writer did not stop in time (session: %d)\n", ss.SessionId())
 		}
-	}
+		// This also makes the reader return.
+		if ss.wsConn.conn != nil {
+			err := ss.wsConn.conn.Close()
+			if err != nil {
+				logger.Printf("Failed to close websocket connection, already removed: %d\n", ss.SessionId())
+			}
+		}
+		ss.unsubscribeAll()
+		// The dapp must be done with the session before the id is released,
+		// or it could delete the session of a new connection with the same id.
+		ss.runtime.CallFuncOnObj("network", "deleteWsSession", int(ss.SessionId()))
+		// Deregister ourselves.
+		ss.server.RemoveSession(ss)
+		atomic.StoreInt32(&ss.state, SESSION_CLOSED)
+	})
 }
 
 func (ss *Session) handleRequest(rpcReq string) {
 	logger.Println("RPC Message: " + rpcReq)
-	ret, err := ss.runtime.CallFuncOnObj("network", "incomingWsMsg", int(ss.wsConn.sessionId), rpcReq)
+	ctx := tracing.ContextWithRemote(context.Background(), ss.traceParent)
+	ctx, span := tracing.Start(ctx, "ws message", tracing.KIND_SERVER)
+	span.SetAttribute("decerver.dapp", ss.caller)
+	span.SetAttribute("decerver.session", ss.SessionId())
+	span.SetAttribute("decerver.ws_protocol", ss.protocol)
+	defer span.End()
+	if ss.protocol == dapps.WS_PROTOCOL_JSONRPC {
+		ss.handleJsonRpc(ctx, rpcReq)
+		return
+	}
+	if ss.handleEsrpcSubscription(rpcReq) {
+		return
+	}
+	ret, err := ss.runtime.CallFuncOnObjContext(ctx, "network", "incomingWsMsg", int(ss.wsConn.sessionId), rpcReq)
 
 	if err != nil {
 		logger.Printf("Js runtime error, could not pass message. Closing socket. (sesion: %d)\nMessage dump: %s\n", ss.SessionId(), rpcReq)
-		ss.wsConn.writeCloseChannel <- GetCloseMessage()
+		span.SetError(err.Error())
+		ss.Close()
 		return
 	}
 	if ret == nil {
 		return
 	}
-	retStr := ret.(string)
+	retStr, ok := ret.(string)
+	if !ok {
+		return
+	}
 	// If there is a return value, pass to the write channel.
-	ss.wsConn.writeMsgChannel <- &Message{Data: []byte(retStr), Type: websocket.TextMessage}
+	ss.wsConn.WriteJsonMsg([]byte(retStr))
 }
 
 type SessionJs struct {
@@ -164,3 +538,22 @@ func (sjs *SessionJs) WriteJson(msg string) {
 func (sjs *SessionJs) SessionId() int {
 	return int(sjs.session.SessionId())
 }
+
+// The object that is bound to each runtime as 'ws_broadcaster'.
+type WsBroadcasterJs struct {
+	server *WsAPIServer
+	dappId string
+}
+
+func (wbj *WsBroadcasterJs) Broadcast(msg string) int {
+	return wbj.server.Broadcast(wbj.dappId, []byte(msg))
+}
+
+// Params is a json string. It can be empty.
+func (wbj *WsBroadcasterJs) Notify(sessionId int, method, params string) bool {
+	return wbj.server.Notify(wbj.dappId, uint32(sessionId), method, json.RawMessage(params))
+}
+
+func (wbj *WsBroadcasterJs) BroadcastNotification(method, params string) int {
+	return wbj.server.BroadcastNotification(wbj.dappId, method, json.RawMessage(params))
+}
@@ -0,0 +1,355 @@
+// This file contains authentication for the admin api. A read-only and a
+// read-write token are generated the first time the decerver starts, and
+// stored in the root directory. Clients pass them as bearer tokens.
+//
+// Browsers can log in with a token to get a session cookie instead. Since
+// the cookie is sent automatically, requests that change anything must then
+// also carry the csrf token (in the X-CSRF-Token header), and must not come
+// from another origin.
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/files"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file in the root directory that the tokens are stored in.
+const ADMIN_TOKEN_FILE_NAME = "admin_tokens"
+
+// Scopes. The write scope includes read.
+const (
+	SCOPE_READ  = "read"
+	SCOPE_WRITE = "write"
+)
+
+const (
+	ADMIN_SESSION_COOKIE = "decerver_admin"
+	ADMIN_CSRF_COOKIE    = "decerver_csrf"
+	ADMIN_CSRF_HEADER    = "X-CSRF-Token"
+)
+
+// How long a browser session lasts.
+const adminSessionTTL = 12 * time.Hour
+
+// The session cookie is sent to the admin routes and the v2 api. The csrf
+// cookie is only needed by the dashboard.
+var adminSessionPaths = []string{"/admin", API_V2_BASE}
+
+type AdminTokens struct {
+	Read  string `json:"read"`
+	Write string `json:"write"`
+}
+
+type adminSession struct {
+	scope   string
+	csrf    string
+	expires time.Time
+}
+
+type adminLogin struct {
+	Token string `json:"token"`
+}
+
+type adminLoginResponse struct {
+	Scope     string `json:"scope"`
+	CsrfToken string `json:"csrf_token"`
+}
+
+type adminAuth struct {
+	tokens   *AdminTokens
+	mutex    *sync.Mutex
+	sessions map[string]*adminSession
+}
+
+func newAdminAuth(fio files.FileIO) (*adminAuth, error) {
+	tokens, err := loadAdminTokens(fio)
+	if err != nil {
+		return nil, err
+	}
+	aa := &adminAuth{}
+	aa.tokens = tokens
+	aa.mutex = &sync.Mutex{}
+	aa.sessions = make(map[string]*adminSession)
+	return aa, nil
+}
+
+// Load the tokens, or generate them if there is no token file. A file that
+// other users can read is not used, since the tokens may have leaked.
+func loadAdminTokens(fio files.FileIO) (*AdminTokens, error) {
+	tokenFile := path.Join(fio.Root(), ADMIN_TOKEN_FILE_NAME)
+	fi, err := os.Stat(tokenFile)
+	if os.IsNotExist(err) {
+		tokens := &AdminTokens{randomToken(), randomToken()}
+		if err := fio.MarshalJsonToFile(fio.Root(), ADMIN_TOKEN_FILE_NAME, tokens); err != nil {
+			return nil, fmt.Errorf("Failed to store admin tokens: %s", err.Error())
+		}
+		logger.Println("Generated admin tokens: " + tokenFile)
+		return tokens, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Admin token file '%s' is accessible to other users (mode %v). Delete it to generate new tokens.", tokenFile, fi.Mode().Perm())
+	}
+	tokens := &AdminTokens{}
+	if err := fio.UnmarshalJsonFromFile(fio.Root(), ADMIN_TOKEN_FILE_NAME, tokens); err != nil {
+		return nil, fmt.Errorf("Failed to read admin tokens: %s", err.Error())
+	}
+	if tokens.Read == "" || tokens.Write == "" || tokens.Read == tokens.Write {
+		return nil, fmt.Errorf("Admin token file '%s' must have two different, non-empty tokens.", tokenFile)
+	}
+	return tokens, nil
+}
+
+func randomToken() string {
+	bts := make([]byte, 32)
+	if _, err := rand.Read(bts); err != nil {
+		panic("Failed to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(bts)
+}
+
+// Require authentication on the admin routes. Login and logout are
+// handled here as well. The path is checked as it is, since that is what
+// the routes match (the web server only accepts canonical paths anyway).
+func (aa *adminAuth) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/login":
+			aa.handleLogin(w, r)
+			return
+		case "/admin/logout":
+			aa.handleLogout(w, r)
+			return
+		}
+		// The dashboard has the login form. It has no data of its own.
+		if isDashboardPath(r.URL.Path) && safeMethod(r.Method) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		scope, ok := aa.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if requiredScope(r) == SCOPE_WRITE && scope != SCOPE_WRITE {
+			writeAuthError(w, r, 403, "This requires a read-write token.")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Get the scope of the request. Writes the error response if the request
+// is not authenticated.
+func (aa *adminAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		scope := ""
+		if strings.HasPrefix(authz, "Bearer ") {
+			scope = aa.tokenScope(strings.TrimSpace(authz[len("Bearer "):]))
+		}
+		if scope == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="decerver", error="invalid_token"`)
+			writeAuthError(w, r, 401, "Invalid token.")
+			return "", false
+		}
+		return scope, true
+	}
+
+	session := aa.session(r)
+	if session == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="decerver"`)
+		writeAuthError(w, r, 401, "Authentication required.")
+		return "", false
+	}
+	if !safeMethod(r.Method) {
+		if !sameOrigin(r) {
+			writeAuthError(w, r, 403, "Cross-origin request refused.")
+			return "", false
+		}
+		csrf := r.Header.Get(ADMIN_CSRF_HEADER)
+		if csrf == "" || subtle.ConstantTimeCompare([]byte(csrf), []byte(session.csrf)) != 1 {
+			writeAuthError(w, r, 403, "Missing or invalid csrf token.")
+			return "", false
+		}
+	}
+	return session.scope, true
+}
+
+// Returns the empty string if the token is not valid.
+func (aa *adminAuth) tokenScope(token string) string {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(aa.tokens.Write)) == 1 {
+		return SCOPE_WRITE
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(aa.tokens.Read)) == 1 {
+		return SCOPE_READ
+	}
+	return ""
+}
+
+// Get the session from the session cookie. Returns nil if there is none,
+// or if it has expired.
+func (aa *adminAuth) session(r *http.Request) *adminSession {
+	cookie, err := r.Cookie(ADMIN_SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+	aa.mutex.Lock()
+	defer aa.mutex.Unlock()
+	session, ok := aa.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.expires) {
+		delete(aa.sessions, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+// Exchange a token for a session cookie. The token is passed as a bearer
+// token, or as json: {"token": "..."}.
+func (aa *adminAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAuthError(w, r, 405, "Method not allowed.")
+		return
+	}
+	// Logging someone in to the attackers session is also an attack.
+	if !sameOrigin(r) {
+		writeAuthError(w, r, 403, "Cross-origin request refused.")
+		return
+	}
+	token := ""
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		token = strings.TrimSpace(authz[len("Bearer "):])
+	} else {
+		bts, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			writeAuthError(w, r, 400, err.Error())
+			return
+		}
+		login := &adminLogin{}
+		if err := json.Unmarshal(bts, login); err != nil {
+			writeAuthError(w, r, 400, "Malformed login: "+err.Error())
+			return
+		}
+		token = login.Token
+	}
+	scope := aa.tokenScope(token)
+	if scope == "" {
+		writeAuthError(w, r, 401, "Invalid token.")
+		return
+	}
+
+	id := randomToken()
+	session := &adminSession{scope, randomToken(), time.Now().Add(adminSessionTTL)}
+	aa.mutex.Lock()
+	now := time.Now()
+	for sid, s := range aa.sessions {
+		if now.After(s.expires) {
+			delete(aa.sessions, sid)
+		}
+	}
+	aa.sessions[id] = session
+	aa.mutex.Unlock()
+
+	secure := r.TLS != nil
+	for _, p := range adminSessionPaths {
+		http.SetCookie(w, &http.Cookie{
+			Name:     ADMIN_SESSION_COOKIE,
+			Value:    id,
+			Path:     p,
+			Expires:  session.expires,
+			Secure:   secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	// Readable by scripts, so that pages can put it in the header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     ADMIN_CSRF_COOKIE,
+		Value:    session.csrf,
+		Path:     "/admin",
+		Expires:  session.expires,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	bts, _ := json.Marshal(&adminLoginResponse{scope, session.csrf})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(bts)
+}
+
+func (aa *adminAuth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAuthError(w, r, 405, "Method not allowed.")
+		return
+	}
+	if !sameOrigin(r) {
+		writeAuthError(w, r, 403, "Cross-origin request refused.")
+		return
+	}
+	if cookie, err := r.Cookie(ADMIN_SESSION_COOKIE); err == nil {
+		aa.mutex.Lock()
+		delete(aa.sessions, cookie.Value)
+		aa.mutex.Unlock()
+	}
+	for _, p := range adminSessionPaths {
+		http.SetCookie(w, &http.Cookie{Name: ADMIN_SESSION_COOKIE, Path: p, MaxAge: -1})
+	}
+	http.SetCookie(w, &http.Cookie{Name: ADMIN_CSRF_COOKIE, Path: "/admin", MaxAge: -1})
+	w.WriteHeader(204)
+}
+
+// Reading is done with GET. Switching dapps with the old api is a GET as
+// well, but it changes which dapp is running.
+func requiredScope(r *http.Request) string {
+	if !safeMethod(r.Method) || strings.HasPrefix(r.URL.Path, "/admin/switch/") {
+		return SCOPE_WRITE
+	}
+	return SCOPE_READ
+}
+
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Check that a request was not made by a page from another origin. Requests
+// without Origin and Sec-Fetch-Site headers are not from browsers (or are
+// from old browsers that do not send them for same-origin requests).
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || isSameOrigin(r, origin)
+}
+
+// Errors from the v2 api are json.
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if isApiV2Path(r.URL.Path) {
+		writeApiError(w, status, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, msg)
+}
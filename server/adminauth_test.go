@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAdminTokens(t *testing.T) {
+	fio := &fakeFileIO{root: t.TempDir()}
+	tokens, err := loadAdminTokens(fio)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tokens.Read) != 64 || len(tokens.Write) != 64 || tokens.Read == tokens.Write {
+		t.Errorf("Bad tokens: %v\n", tokens)
+	}
+	tokenFile := path.Join(fio.root, ADMIN_TOKEN_FILE_NAME)
+	fi, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong token file mode: %v\n", fi.Mode())
+	}
+
+	// The same tokens are loaded the second time.
+	tokens2, err := loadAdminTokens(fio)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if *tokens2 != *tokens {
+		t.Error("New tokens were generated.")
+	}
+
+	os.Chmod(tokenFile, 0644)
+	if _, err := loadAdminTokens(fio); err == nil {
+		t.Error("Token file readable by others was accepted.")
+	}
+}
+
+func newTestAdminServer(t *testing.T) (*adminAuth, *httptest.Server) {
+	aa, err := newAdminAuth(&fakeFileIO{root: t.TempDir()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	srv := httptest.NewServer(canonicalPath(aa.wrap(handler)))
+	return aa, srv
+}
+
+func doAdminRequest(t *testing.T, method, url string, headers map[string]string, cookies []*http.Cookie) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader("{}"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAdminBearerAuth(t *testing.T) {
+	aa, srv := newTestAdminServer(t)
+	defer srv.Close()
+	read := "Bearer " + aa.tokens.Read
+	write := "Bearer " + aa.tokens.Write
+
+	tests := []struct {
+		method string
+		path   string
+		authz  string
+		status int
+	}{
+		{"GET", "/http/test/", "", 200},
+		{"GET", "/admin/ready", "", 401},
+		{"GET", "/admin/ready", "Bearer nope", 401},
+		{"GET", "/admin/ready", aa.tokens.Read, 401},
+		{"GET", "/admin/ready", read, 200},
+		{"POST", "/admin/decerver", read, 403},
+		{"GET", "/admin/switch/test", read, 403},
+		{"GET", "/admin/./switch/test", read, 403},
+		{"GET", "/admin/ready", write, 200},
+		{"POST", "/admin/decerver", write, 200},
+		{"GET", "/admin/switch/test", write, 200},
+		// The dashboard page can be loaded without a token.
+		{"GET", "/admin/ui", "", 200},
+		{"GET", "/admin/ui/dashboard.js", "", 200},
+		{"POST", "/admin/ui", "", 401},
+		{"GET", "/admin/ui/other", "", 401},
+		{"GET", "/admin/ui/../ready", "", 401},
+		// The v2 api.
+		{"GET", "/api/v2/status", "", 401},
+		{"GET", "/api/v2/status", read, 200},
+		{"POST", "/api/v2/dapps/test/runtime", read, 403},
+		{"POST", "/api/v2/dapps/test/runtime", write, 200},
+		// Metrics.
+		{"GET", "/metrics", "", 401},
+		{"GET", "/metrics", read, 200},
+	}
+	for _, test := range tests {
+		headers := map[string]string{}
+		if test.authz != "" {
+			headers["Authorization"] = test.authz
+		}
+		resp := doAdminRequest(t, test.method, srv.URL+test.path, headers, nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s (%s): Wrong status. Expected: %d, Got: %d\n", test.method, test.path, test.authz, test.status, resp.StatusCode)
+		}
+	}
+}
+
+// Paths with '..' used to be authenticated by their cleaned form, which
+// is not an admin path, while the routes matched the raw path.
+func TestAdminAuthTraversal(t *testing.T) {
+	aa, err := newAdminAuth(&fakeFileIO{root: t.TempDir()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reached := make(chan string, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- r.URL.Path
+		w.WriteHeader(204)
+	})
+	tests := []struct {
+		method string
+		path   string
+		// Status with and without the canonical path handler.
+		status   int
+		wrapOnly int
+	}{
+		{"POST", "/admin/modules/../../monk", 400, 401},
+		{"GET", "/admin/switch/../../evil", 301, 401},
+		{"POST", "/admin/permissions/..%2f..%2fdapp", 400, 401},
+		{"POST", "/api/v2/../../x", 400, 401},
+		{"POST", "/admin/modules/monk", 401, 401},
+	}
+	for i, h := range []http.Handler{canonicalPath(aa.wrap(handler)), aa.wrap(handler)} {
+		srv := httptest.NewServer(h)
+		dial := func() (net.Conn, error) {
+			return net.Dial("tcp", srv.Listener.Addr().String())
+		}
+		for _, test := range tests {
+			want := test.status
+			if i == 1 {
+				want = test.wrapOnly
+			}
+			if resp := doRawRequest(t, dial, test.method, test.path, nil); resp.StatusCode != want {
+				t.Errorf("%d: %s %s: Expected: %d, Got: %d\n", i, test.method, test.path, want, resp.StatusCode)
+			}
+		}
+		srv.Close()
+	}
+	if len(reached) > 0 {
+		t.Errorf("Request for %s reached the handler without a token.\n", <-reached)
+	}
+
+	// Canonical requests with a token still get through.
+	srv := httptest.NewServer(canonicalPath(aa.wrap(handler)))
+	defer srv.Close()
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", srv.Listener.Addr().String())
+	}
+	resp := doRawRequest(t, dial, "POST", "/admin/modules/monk", map[string]string{"Authorization": "Bearer " + aa.tokens.Write})
+	if resp.StatusCode != 204 {
+		t.Errorf("Wrong status with a token: %d\n", resp.StatusCode)
+	}
+}
+
+// Auth errors from the v2 api are json, like its other errors.
+func TestAdminAuthApiV2Errors(t *testing.T) {
+	aa, srv := newTestAdminServer(t)
+	defer srv.Close()
+
+	for _, authz := range []string{"", "Bearer nope", "Bearer " + aa.tokens.Read} {
+		req, _ := http.NewRequest("PUT", srv.URL+"/api/v2/config", strings.NewReader("{}"))
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		bts, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: Wrong content type: %s\n", authz, ct)
+		}
+		ae := &ApiErrorResponse{}
+		if err := json.Unmarshal(bts, ae); err != nil || ae.Error == nil || ae.Error.Message == "" {
+			t.Errorf("%q: Bad error: %s\n", authz, string(bts))
+			continue
+		}
+		if ae.Error.Code != apiErrorCodes[resp.StatusCode] {
+			t.Errorf("%q: Wrong error code for status %d: %s\n", authz, resp.StatusCode, ae.Error.Code)
+		}
+	}
+}
+
+func TestAdminSessionAuth(t *testing.T) {
+	aa, srv := newTestAdminServer(t)
+	defer srv.Close()
+
+	// Login from another origin.
+	login := `{"token": "` + aa.tokens.Write + `"}`
+	req, _ := http.NewRequest("POST", srv.URL+"/admin/login", strings.NewReader(login))
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Errorf("Cross-origin login: Wrong status: %d\n", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/admin/login", "application/json", strings.NewReader(login))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bts, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Login failed: %d %s\n", resp.StatusCode, string(bts))
+	}
+	lr := &adminLoginResponse{}
+	json.Unmarshal(bts, lr)
+	if lr.Scope != SCOPE_WRITE || lr.CsrfToken == "" {
+		t.Errorf("Bad login response: %s\n", string(bts))
+	}
+	cookies := resp.Cookies()
+	// The session is also sent to the v2 api.
+	sessionPaths := make([]string, 0)
+	for _, c := range cookies {
+		if c.Name == ADMIN_SESSION_COOKIE {
+			sessionPaths = append(sessionPaths, c.Path)
+		}
+	}
+	if strings.Join(sessionPaths, " ") != "/admin "+API_V2_BASE {
+		t.Errorf("Wrong session cookie paths: %v\n", sessionPaths)
+	}
+
+	origin := srv.URL
+	tests := []struct {
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"GET", "/admin/ready", nil, 200},
+		{"POST", "/admin/decerver", nil, 403},
+		{"POST", "/admin/decerver", map[string]string{ADMIN_CSRF_HEADER: "nope"}, 403},
+		{"POST", "/admin/decerver", map[string]string{ADMIN_CSRF_HEADER: lr.CsrfToken}, 200},
+		{"POST", "/admin/decerver", map[string]string{ADMIN_CSRF_HEADER: lr.CsrfToken, "Origin": origin}, 200},
+		{"POST", "/admin/decerver", map[string]string{ADMIN_CSRF_HEADER: lr.CsrfToken, "Origin": "http://evil.example.com"}, 403},
+		{"POST", "/admin/decerver", map[string]string{ADMIN_CSRF_HEADER: lr.CsrfToken, "Sec-Fetch-Site": "cross-site"}, 403},
+		{"GET", "/api/v2/status", nil, 200},
+		{"PUT", "/api/v2/config", nil, 403},
+		{"PUT", "/api/v2/config", map[string]string{ADMIN_CSRF_HEADER: lr.CsrfToken}, 200},
+	}
+	for _, test := range tests {
+		resp := doAdminRequest(t, test.method, srv.URL+test.path, test.headers, cookies)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s (%v): Wrong status. Expected: %d, Got: %d\n", test.method, test.path, test.headers, test.status, resp.StatusCode)
+		}
+	}
+
+	resp = doAdminRequest(t, "POST", srv.URL+"/admin/logout", nil, cookies)
+	if resp.StatusCode != 204 {
+		t.Errorf("Logout: Wrong status: %d\n", resp.StatusCode)
+	}
+	resp = doAdminRequest(t, "GET", srv.URL+"/admin/ready", nil, cookies)
+	if resp.StatusCode != 401 {
+		t.Errorf("Session still valid after logout: %d\n", resp.StatusCode)
+	}
+
+	// Read-only sessions.
+	resp, err = http.Post(srv.URL+"/admin/login", "application/json", strings.NewReader(`{"token": "`+aa.tokens.Read+`"}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	resp = doAdminRequest(t, "GET", srv.URL+"/admin/switch/test", nil, resp.Cookies())
+	if resp.StatusCode != 403 {
+		t.Errorf("Read-only session could switch dapps: %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,594 @@
+// This file contains version 2 of the admin api. All responses are json:
+// data is returned as {"data": ..., "meta": ...}, where meta is only set
+// for lists, and errors as {"error": {"code": ..., "message": ...}}.
+//
+// The routes are defined in a table, which is also used to generate the
+// OpenAPI document (served at /api/v2/openapi.json).
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/logging"
+	"github.com/eris-ltd/decerver/interfaces/modules"
+	"github.com/eris-ltd/decerver/interfaces/network"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const API_V2_BASE = "/api/v2"
+
+// Lists are paginated with the offset and limit query parameters.
+const (
+	API_DEFAULT_LIMIT = 50
+	API_MAX_LIMIT     = 500
+)
+
+// The largest request body the api accepts.
+const API_MAX_BODY = 1024 * 1024
+
+// Error codes.
+const (
+	API_ERR_BAD_REQUEST        = "bad_request"
+	API_ERR_UNAUTHORIZED       = "unauthorized"
+	API_ERR_FORBIDDEN          = "forbidden"
+	API_ERR_NOT_FOUND          = "not_found"
+	API_ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	API_ERR_CONFLICT           = "conflict"
+	API_ERR_TOO_LARGE          = "too_large"
+	API_ERR_UNSUPPORTED_TYPE   = "unsupported_media_type"
+	API_ERR_INVALID            = "invalid"
+	API_ERR_INTERNAL           = "internal"
+)
+
+var apiErrorCodes = map[int]string{
+	400: API_ERR_BAD_REQUEST,
+	401: API_ERR_UNAUTHORIZED,
+	403: API_ERR_FORBIDDEN,
+	404: API_ERR_NOT_FOUND,
+	405: API_ERR_METHOD_NOT_ALLOWED,
+	409: API_ERR_CONFLICT,
+	413: API_ERR_TOO_LARGE,
+	415: API_ERR_UNSUPPORTED_TYPE,
+	422: API_ERR_INVALID,
+	500: API_ERR_INTERNAL,
+}
+
+type ApiResponse struct {
+	Data interface{} `json:"data"`
+	Meta *ApiMeta    `json:"meta,omitempty"`
+}
+
+type ApiMeta struct {
+	// The number of items in the whole list.
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+type ApiErrorResponse struct {
+	Error *ApiError `json:"error"`
+}
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ApiStatus struct {
+	Started bool `json:"started"`
+	// The id of the running dapp. Empty if none is running.
+	RunningDapp string `json:"running_dapp"`
+}
+
+type ApiProfileDump struct {
+	// The file the profile was written to.
+	File string `json:"file"`
+}
+
+// An error with the status it should be sent with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (ae *apiError) Error() string {
+	return ae.msg
+}
+
+func newApiError(status int, format string, args ...interface{}) error {
+	return &apiError{status, fmt.Sprintf(format, args...)}
+}
+
+// The values of the {parameters} in the route path, by name.
+type apiParams map[string]string
+
+type apiRoute struct {
+	method string
+	// Relative to API_V2_BASE. Parameters are written as {name}.
+	path    string
+	summary string
+	// The types of the request and response data (zero values, used for the
+	// api document). nil means none.
+	request  interface{}
+	response interface{}
+	// Lists are paginated. The handler returns the whole list.
+	list    bool
+	handler func(r *http.Request, params apiParams, body []byte) (interface{}, error)
+	// The split path.
+	segments []string
+}
+
+type ApiV2Server struct {
+	dc     decerver.Decerver
+	dm     dapps.DappManager
+	routes []*apiRoute
+	spec   []byte
+}
+
+func NewApiV2Server(dc decerver.Decerver, dm dapps.DappManager) *ApiV2Server {
+	api := &ApiV2Server{dc: dc, dm: dm}
+	api.routes = []*apiRoute{
+		{method: "GET", path: "/status", summary: "Get the decerver status.", response: ApiStatus{},
+			handler: api.getStatus},
+		{method: "GET", path: "/config", summary: "Get the decerver config.", response: decerver.DCConfig{},
+			handler: api.getConfig},
+		{method: "PUT", path: "/config", summary: "Replace the decerver config. It is used after a restart.", request: decerver.DCConfig{}, response: decerver.DCConfig{},
+			handler: api.putConfig},
+		{method: "GET", path: "/dapps", summary: "List the dapps.", response: []dapps.DappInfo{}, list: true,
+			handler: api.listDapps},
+		{method: "GET", path: "/dapps/{id}", summary: "Get a dapp.", response: dapps.DappInfo{},
+			handler: api.getDapp},
+		{method: "POST", path: "/dapps/{id}/runtime", summary: "Run a dapp. The dapp that is running is stopped.", response: ApiStatus{},
+			handler: api.runDapp},
+		{method: "DELETE", path: "/dapps/{id}/runtime", summary: "Stop a running dapp.", response: ApiStatus{},
+			handler: api.stopDapp},
+		{method: "GET", path: "/dapps/{id}/permissions", summary: "Get the permissions of a dapp.", response: dapps.PermissionInfo{},
+			handler: api.getPermissions},
+		{method: "PATCH", path: "/dapps/{id}/permissions", summary: "Grant and/or deny permissions. Takes effect the next time the dapp is run.", request: dapps.PermissionUpdate{}, response: dapps.PermissionInfo{},
+			handler: api.patchPermissions},
+		{method: "GET", path: "/dapps/{id}/quotas", summary: "Get the quotas of a dapp, and its usage.", response: dapps.QuotaInfo{},
+			handler: api.getQuotas},
+		{method: "GET", path: "/modules", summary: "List the modules and their state.", response: []modules.ModuleStatus{}, list: true,
+			handler: api.listModules},
+		{method: "GET", path: "/modules/{name}/config", summary: "Get the config of a module.", response: json.RawMessage{},
+			handler: api.getModuleConfig},
+		{method: "PUT", path: "/modules/{name}/config", summary: "Replace the config of a module. It is used after a restart.", request: json.RawMessage{}, response: json.RawMessage{},
+			handler: api.putModuleConfig},
+		{method: "GET", path: "/sessions", summary: "List the websocket sessions.", response: []network.SessionInfo{}, list: true,
+			handler: api.listSessions},
+		{method: "GET", path: "/runtimes", summary: "List the ids of the runtimes.", response: []string{}, list: true,
+			handler: api.listRuntimes},
+		{method: "GET", path: "/runtimes/{id}/profile", summary: "Get the profile of a runtime.", response: scripting.Profile{},
+			handler: api.getProfile},
+		{method: "DELETE", path: "/runtimes/{id}/profile", summary: "Reset the profile of a runtime.",
+			handler: api.deleteProfile},
+		{method: "POST", path: "/runtimes/{id}/profile/dumps", summary: "Write the profile of a runtime to the log directory.", response: ApiProfileDump{},
+			handler: api.dumpProfile},
+		{method: "GET", path: "/traffic", summary: "Get the event traffic. It is only collected in debug mode.", response: json.RawMessage{},
+			handler: api.getTraffic},
+		{method: "GET", path: "/logging/levels", summary: "Get the log levels of the decerver components.", response: logging.LevelInfo{},
+			handler: api.getLogLevels},
+		{method: "PATCH", path: "/logging/levels", summary: "Change log levels. An empty component level resets it to the default.", request: logging.LevelUpdate{}, response: logging.LevelInfo{},
+			handler: api.patchLogLevels},
+	}
+	for _, route := range api.routes {
+		route.segments = strings.Split(strings.Trim(route.path, "/"), "/")
+	}
+	api.spec = openApiSpec(api.routes)
+	return api
+}
+
+func (api *ApiV2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, API_V2_BASE)
+	if p == "/openapi.json" && (r.Method == "GET" || r.Method == "HEAD") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(api.spec)
+		return
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	allowed := make([]string, 0)
+	for _, route := range api.routes {
+		params, ok := matchApiRoute(route.segments, segments)
+		if !ok {
+			continue
+		}
+		// Head requests are handled as gets (the body is not sent).
+		if route.method != r.Method && !(r.Method == "HEAD" && route.method == "GET") {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		api.serveRoute(w, r, route, params)
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeApiError(w, 405, "Method not allowed: "+r.Method)
+		return
+	}
+	writeApiError(w, 404, "No such route: "+r.URL.Path)
+}
+
+func (api *ApiV2Server) serveRoute(w http.ResponseWriter, r *http.Request, route *apiRoute, params apiParams) {
+	var body []byte
+	if route.request != nil {
+		var err error
+		body, err = readApiBody(w, r)
+		if err != nil {
+			writeApiErr(w, err)
+			return
+		}
+	}
+	offset, limit := 0, 0
+	if route.list {
+		var err error
+		offset, limit, err = apiPagination(r)
+		if err != nil {
+			writeApiErr(w, err)
+			return
+		}
+	}
+	data, err := route.handler(r, params, body)
+	if err != nil {
+		writeApiErr(w, err)
+		return
+	}
+	resp := &ApiResponse{Data: data}
+	if route.list {
+		resp.Data, resp.Meta = paginate(data, offset, limit)
+	}
+	writeApiJson(w, 200, resp)
+}
+
+// Match a route against the path segments of a request.
+func matchApiRoute(route, segments []string) (apiParams, bool) {
+	if len(route) != len(segments) {
+		return nil, false
+	}
+	params := make(apiParams)
+	for i, seg := range route {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func readApiBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil, newApiError(415, "Unsupported Content-Type: %s", r.Header.Get("Content-Type"))
+	}
+	bts, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return nil, newApiError(413, "Request body is too large.")
+		}
+		return nil, newApiError(400, "%s", err.Error())
+	}
+	if !json.Valid(bts) {
+		return nil, newApiError(422, "Malformed json.")
+	}
+	return bts, nil
+}
+
+// Decode a request body. Unknown fields are not allowed, since they are
+// most likely mistakes.
+func decodeApiBody(body []byte, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newApiError(422, "%s", err.Error())
+	}
+	return nil
+}
+
+func apiPagination(r *http.Request) (offset, limit int, err error) {
+	q := r.URL.Query()
+	offset, limit = 0, API_DEFAULT_LIMIT
+	if s := q.Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, newApiError(400, "Invalid offset: %s", s)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > API_MAX_LIMIT {
+			return 0, 0, newApiError(400, "Invalid limit: %s (must be 1-%d)", s, API_MAX_LIMIT)
+		}
+	}
+	return offset, limit, nil
+}
+
+// Get a page of a list. The list is a slice.
+func paginate(list interface{}, offset, limit int) (interface{}, *ApiMeta) {
+	page, total := slicePage(list, offset, limit)
+	return page, &ApiMeta{total, offset, limit}
+}
+
+func slicePage(list interface{}, offset, limit int) (interface{}, int) {
+	v := reflect.ValueOf(list)
+	total := v.Len()
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return v.Slice(offset, end).Interface(), total
+}
+
+func writeApiJson(w http.ResponseWriter, status int, v interface{}) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		writeApiError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bts)
+}
+
+func writeApiError(w http.ResponseWriter, status int, msg string) {
+	code, ok := apiErrorCodes[status]
+	if !ok {
+		code = API_ERR_INTERNAL
+	}
+	bts, _ := json.Marshal(&ApiErrorResponse{&ApiError{code, msg}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bts)
+}
+
+// Write an error returned by a handler. Errors from the dapp manager are
+// given the right status, and other errors are internal.
+func writeApiErr(w http.ResponseWriter, err error) {
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		writeApiError(w, ae.status, ae.msg)
+	case errors.Is(err, dapps.ErrDappNotFound):
+		writeApiError(w, 404, err.Error())
+	case errors.Is(err, dapps.ErrDappRunning), errors.Is(err, dapps.ErrDappNotRunning):
+		writeApiError(w, 409, err.Error())
+	default:
+		writeApiError(w, 500, err.Error())
+	}
+}
+
+// The old admin routes are kept as aliases of the v2 api, but tell clients
+// where to go instead. %s in the successor is replaced by the last part of
+// the request path.
+func deprecated(successor string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		if strings.Contains(link, "%s") {
+			link = fmt.Sprintf(link, url.PathEscape(path.Base(r.URL.Path)))
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+link+`>; rel="successor-version"`)
+		handler(w, r)
+	}
+}
+
+func isApiV2Path(p string) bool {
+	return p == API_V2_BASE || strings.HasPrefix(p, API_V2_BASE+"/")
+}
+
+// Status and config
+
+func (api *ApiV2Server) status() *ApiStatus {
+	return &ApiStatus{api.dc.IsStarted(), api.dm.RunningDapp()}
+}
+
+func (api *ApiV2Server) getStatus(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.status(), nil
+}
+
+func (api *ApiV2Server) getConfig(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.dc.Config(), nil
+}
+
+func (api *ApiV2Server) putConfig(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	cfg := &decerver.DCConfig{}
+	if err := decodeApiBody(body, cfg); err != nil {
+		return nil, err
+	}
+	fio := api.dc.FileIO()
+	if err := fio.MarshalJsonToFile(fio.Root(), "config", cfg); err != nil {
+		return nil, err
+	}
+	logger.Println("Updated decerver config.")
+	return cfg, nil
+}
+
+// Dapps
+
+func (api *ApiV2Server) listDapps(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	list := api.dm.DappList()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (api *ApiV2Server) getDapp(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	for _, di := range api.dm.DappList() {
+		if di.Id == params["id"] {
+			return di, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", dapps.ErrDappNotFound, params["id"])
+}
+
+func (api *ApiV2Server) runDapp(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	logger.Println("Switching to dapp: " + params["id"])
+	if err := api.dm.LoadDapp(params["id"]); err != nil {
+		return nil, err
+	}
+	return api.status(), nil
+}
+
+func (api *ApiV2Server) stopDapp(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	logger.Println("Stopping dapp: " + params["id"])
+	if err := api.dm.StopDapp(params["id"]); err != nil {
+		return nil, err
+	}
+	return api.status(), nil
+}
+
+func (api *ApiV2Server) getPermissions(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.dm.Permissions(params["id"])
+}
+
+func (api *ApiV2Server) patchPermissions(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	update := &dapps.PermissionUpdate{}
+	if err := decodeApiBody(body, update); err != nil {
+		return nil, err
+	}
+	if err := api.dm.UpdatePermissions(params["id"], update); err != nil {
+		if errors.Is(err, dapps.ErrDappNotFound) {
+			return nil, err
+		}
+		// The update names unknown permissions.
+		return nil, newApiError(422, "%s", err.Error())
+	}
+	return api.dm.Permissions(params["id"])
+}
+
+func (api *ApiV2Server) getQuotas(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return quotaInfo(api.dc, api.dm, params["id"])
+}
+
+// Modules
+
+func (api *ApiV2Server) listModules(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.dc.ModuleManager().Status(), nil
+}
+
+// Get the config directory of a module. Only registered modules has one.
+func (api *ApiV2Server) moduleDir(name string) (string, error) {
+	if _, ok := api.dc.ModuleManager().Modules()[name]; !ok {
+		return "", newApiError(404, "No module with name: %s", name)
+	}
+	return api.dc.FileIO().Modules() + "/" + name, nil
+}
+
+func (api *ApiV2Server) getModuleConfig(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	dir, err := api.moduleDir(params["name"])
+	if err != nil {
+		return nil, err
+	}
+	bts, err := api.dc.FileIO().ReadFile(dir, "config")
+	if err != nil {
+		return nil, newApiError(404, "No config for module: %s", params["name"])
+	}
+	if !json.Valid(bts) {
+		return nil, newApiError(500, "The config of module '%s' is not valid json.", params["name"])
+	}
+	return json.RawMessage(bts), nil
+}
+
+func (api *ApiV2Server) putModuleConfig(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	dir, err := api.moduleDir(params["name"])
+	if err != nil {
+		return nil, err
+	}
+	var cfg interface{}
+	json.Unmarshal(body, &cfg)
+	bts, _ := json.MarshalIndent(cfg, "", "    ")
+	if err := api.dc.FileIO().WriteFile(dir, "config", bts); err != nil {
+		return nil, err
+	}
+	logger.Printf("Updated %s config.\n", params["name"])
+	return json.RawMessage(body), nil
+}
+
+// Sessions and runtimes
+
+func (api *ApiV2Server) listSessions(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.dc.Server().Sessions(), nil
+}
+
+func (api *ApiV2Server) listRuntimes(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return api.dc.RuntimeManager().RuntimeIds(), nil
+}
+
+func (api *ApiV2Server) runtime(id string) (scripting.Runtime, error) {
+	rt := api.dc.RuntimeManager().GetRuntime(id)
+	if rt == nil {
+		return nil, newApiError(404, "No runtime for dapp: %s", id)
+	}
+	return rt, nil
+}
+
+func (api *ApiV2Server) getProfile(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	rt, err := api.runtime(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return rt.Profile(), nil
+}
+
+func (api *ApiV2Server) deleteProfile(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	rt, err := api.runtime(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	rt.ResetProfile()
+	return nil, nil
+}
+
+func (api *ApiV2Server) dumpProfile(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	if _, err := api.runtime(params["id"]); err != nil {
+		return nil, err
+	}
+	fileName, err := api.dc.RuntimeManager().DumpProfile(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return &ApiProfileDump{fileName}, nil
+}
+
+func (api *ApiV2Server) getTraffic(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	if !api.dc.Config().DebugMode {
+		return nil, newApiError(404, "Event traffic is only collected in debug mode.")
+	}
+	return json.RawMessage(api.dc.EventProcessor().TrafficData()), nil
+}
+
+// Logging
+
+func (api *ApiV2Server) getLogLevels(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	return logging.Levels(), nil
+}
+
+func (api *ApiV2Server) patchLogLevels(r *http.Request, params apiParams, body []byte) (interface{}, error) {
+	update := &logging.LevelUpdate{}
+	if err := decodeApiBody(body, update); err != nil {
+		return nil, err
+	}
+	if err := logging.SetLevels(update); err != nil {
+		return nil, newApiError(422, "%s", err.Error())
+	}
+	logger.Info("Changed log levels.", "default", update.Default, "components", update.Components)
+	return logging.Levels(), nil
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/files"
+	"github.com/eris-ltd/decerver/interfaces/modules"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeDecerver struct {
+	decerver.Decerver
+	config *decerver.DCConfig
+	fio    files.FileIO
+	mm     modules.ModuleManager
+}
+
+func (fd *fakeDecerver) Config() *decerver.DCConfig {
+	return fd.config
+}
+
+func (fd *fakeDecerver) IsStarted() bool {
+	return true
+}
+
+func (fd *fakeDecerver) FileIO() files.FileIO {
+	return fd.fio
+}
+
+func (fd *fakeDecerver) ModuleManager() modules.ModuleManager {
+	return fd.mm
+}
+
+type fakeModuleManager struct {
+	modules.ModuleManager
+	status []*modules.ModuleStatus
+}
+
+func (fmm *fakeModuleManager) Status() []*modules.ModuleStatus {
+	return fmm.status
+}
+
+func (fmm *fakeModuleManager) Modules() map[string]modules.Module {
+	return map[string]modules.Module{}
+}
+
+// A dapp manager with a list of dapps, one of which may be running.
+type fakeDappManager struct {
+	dapps.DappManager
+	dapps   []*dapps.DappInfo
+	running string
+}
+
+func (fdm *fakeDappManager) DappList() []*dapps.DappInfo {
+	return fdm.dapps
+}
+
+func (fdm *fakeDappManager) RunningDapp() string {
+	return fdm.running
+}
+
+func (fdm *fakeDappManager) find(dappId string) error {
+	for _, di := range fdm.dapps {
+		if di.Id == dappId {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", dapps.ErrDappNotFound, dappId)
+}
+
+func (fdm *fakeDappManager) LoadDapp(dappId string) error {
+	if err := fdm.find(dappId); err != nil {
+		return err
+	}
+	if fdm.running == dappId {
+		return fmt.Errorf("%w: %s", dapps.ErrDappRunning, dappId)
+	}
+	fdm.running = dappId
+	return nil
+}
+
+func (fdm *fakeDappManager) StopDapp(dappId string) error {
+	if err := fdm.find(dappId); err != nil {
+		return err
+	}
+	if fdm.running != dappId {
+		return fmt.Errorf("%w: %s", dapps.ErrDappNotRunning, dappId)
+	}
+	fdm.running = ""
+	return nil
+}
+
+func newTestApiV2Server(t *testing.T) *ApiV2Server {
+	dc := &fakeDecerver{
+		config: &decerver.DCConfig{Port: 3000},
+		fio:    &fakeFileIO{root: t.TempDir()},
+		mm: &fakeModuleManager{status: []*modules.ModuleStatus{
+			{Name: "ipfs", State: modules.MODULE_RUNNING},
+		}},
+	}
+	dm := &fakeDappManager{}
+	for i := 0; i < 5; i++ {
+		dm.dapps = append(dm.dapps, &dapps.DappInfo{Id: fmt.Sprintf("dapp%d", i)})
+	}
+	return NewApiV2Server(dc, dm)
+}
+
+func doApiRequest(api *ApiV2Server, method, url, contentType, body string) (*httptest.ResponseRecorder, *ApiResponse, *ApiError) {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code >= 400 {
+		er := &ApiErrorResponse{}
+		json.Unmarshal(w.Body.Bytes(), er)
+		return w, nil, er.Error
+	}
+	resp := &ApiResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w, resp, nil
+}
+
+func TestApiV2Errors(t *testing.T) {
+	api := newTestApiV2Server(t)
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"GET", "/api/v2/status", "", "", 200},
+		{"HEAD", "/api/v2/status", "", "", 200},
+		{"GET", "/api/v2/nope", "", "", 404},
+		{"GET", "/api/v2/dapps/nope", "", "", 404},
+		{"GET", "/api/v2/dapps//permissions", "", "", 404},
+		{"DELETE", "/api/v2/status", "", "", 405},
+		{"PUT", "/api/v2/config", "text/plain", "{}", 415},
+		{"PUT", "/api/v2/config", "application/json", "{", 422},
+		{"PUT", "/api/v2/config", "application/json", `{"nope": 1}`, 422},
+		{"PUT", "/api/v2/config", "application/json; charset=utf-8", `{"port": 3001}`, 200},
+		{"PUT", "/api/v2/config", "application/json", `"` + strings.Repeat("a", API_MAX_BODY) + `"`, 413},
+		{"GET", "/api/v2/dapps?limit=0", "", "", 400},
+		{"GET", "/api/v2/dapps?limit=501", "", "", 400},
+		{"GET", "/api/v2/dapps?offset=-1", "", "", 400},
+		{"POST", "/api/v2/dapps/nope/runtime", "", "", 404},
+		{"POST", "/api/v2/dapps/dapp1/runtime", "", "", 200},
+		{"POST", "/api/v2/dapps/dapp1/runtime", "", "", 409},
+		{"DELETE", "/api/v2/dapps/dapp2/runtime", "", "", 409},
+		{"DELETE", "/api/v2/dapps/dapp1/runtime", "", "", 200},
+		{"GET", "/api/v2/modules/nope/config", "", "", 404},
+		{"GET", "/api/v2/traffic", "", "", 404},
+		{"GET", "/api/v2/logging/levels", "", "", 200},
+		{"PATCH", "/api/v2/logging/levels", "application/json", `{"components": {"Webserver": "loud"}}`, 422},
+	}
+	for _, test := range tests {
+		w, _, ae := doApiRequest(api, test.method, test.path, test.contentType, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s %s: Wrong status. Expected: %d, Got: %d (%s)\n", test.method, test.path, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Wrong content type: %s\n", test.method, test.path, ct)
+		}
+		if test.status < 400 {
+			continue
+		}
+		if ae == nil || ae.Message == "" || ae.Code != apiErrorCodes[test.status] {
+			t.Errorf("%s %s: Bad error: %s\n", test.method, test.path, w.Body.String())
+		}
+	}
+
+	w, _, _ := doApiRequest(api, "DELETE", "/api/v2/dapps/dapp1", "", "")
+	if w.Code != 405 || w.Header().Get("Allow") != "GET" {
+		t.Errorf("Wrong 405 response: %d, Allow: %s\n", w.Code, w.Header().Get("Allow"))
+	}
+
+	// Messages from errors are not used as format strings.
+	_, _, ae := doApiRequest(api, "PUT", "/api/v2/config", "application/json", `{"%d": 1}`)
+	if ae == nil || !strings.Contains(ae.Message, `"%d"`) || strings.Contains(ae.Message, "MISSING") {
+		t.Errorf("Wrong error for an unknown field: %+v\n", ae)
+	}
+}
+
+func TestApiV2Pagination(t *testing.T) {
+	api := newTestApiV2Server(t)
+	tests := []struct {
+		query string
+		ids   []string
+		meta  ApiMeta
+	}{
+		{"", []string{"dapp0", "dapp1", "dapp2", "dapp3", "dapp4"}, ApiMeta{5, 0, API_DEFAULT_LIMIT}},
+		{"?limit=2", []string{"dapp0", "dapp1"}, ApiMeta{5, 0, 2}},
+		{"?offset=3&limit=2", []string{"dapp3", "dapp4"}, ApiMeta{5, 3, 2}},
+		{"?offset=4&limit=2", []string{"dapp4"}, ApiMeta{5, 4, 2}},
+		{"?offset=10", []string{}, ApiMeta{5, 10, API_DEFAULT_LIMIT}},
+	}
+	for _, test := range tests {
+		w, resp, _ := doApiRequest(api, "GET", "/api/v2/dapps"+test.query, "", "")
+		if w.Code != 200 {
+			t.Errorf("%s: Wrong status: %d\n", test.query, w.Code)
+			continue
+		}
+		ids := make([]string, 0)
+		for _, di := range resp.Data.([]interface{}) {
+			ids = append(ids, di.(map[string]interface{})["id"].(string))
+		}
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+			t.Errorf("%s: Wrong page: %v\n", test.query, ids)
+		}
+		if resp.Meta == nil || *resp.Meta != test.meta {
+			t.Errorf("%s: Wrong meta: %v\n", test.query, resp.Meta)
+		}
+	}
+
+	// Things that are not lists have no meta.
+	_, resp, _ := doApiRequest(api, "GET", "/api/v2/status", "", "")
+	if resp.Meta != nil {
+		t.Error("Status has meta.")
+	}
+}
+
+func TestApiV2OpenApi(t *testing.T) {
+	api := newTestApiV2Server(t)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/openapi.json", nil))
+	if w.Code != 200 {
+		t.Fatalf("Wrong status: %d\n", w.Code)
+	}
+	spec := struct {
+		OpenApi    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err.Error())
+	}
+	if spec.OpenApi != OPENAPI_VERSION {
+		t.Errorf("Wrong version: %s\n", spec.OpenApi)
+	}
+	ids := make(map[string]bool)
+	for _, route := range api.routes {
+		op, ok := spec.Paths[API_V2_BASE+route.path][strings.ToLower(route.method)]
+		if !ok {
+			t.Errorf("%s %s is not in the document.\n", route.method, route.path)
+			continue
+		}
+		id := op["operationId"].(string)
+		if ids[id] {
+			t.Errorf("Duplicate operation id: %s\n", id)
+		}
+		ids[id] = true
+	}
+	// All references must resolve.
+	for _, match := range strings.Split(w.Body.String(), `"#/components/schemas/`)[1:] {
+		name := match[:strings.Index(match, `"`)]
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("Missing schema: %s\n", name)
+		}
+	}
+}
+
+func TestDeprecatedRoute(t *testing.T) {
+	handler := deprecated(API_V2_BASE+"/dapps/%s/permissions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/admin/permissions/my%20dapp", nil))
+	if w.Header().Get("Deprecation") != "true" {
+		t.Error("No Deprecation header.")
+	}
+	expected := `</api/v2/dapps/my%20dapp/permissions>; rel="successor-version"`
+	if link := w.Header().Get("Link"); link != expected {
+		t.Errorf("Wrong link. Expected: %s, Got: %s\n", expected, link)
+	}
+}
@@ -0,0 +1,380 @@
+// This file contains the admin dashboard, served at /admin/ui. It is a
+// static page that uses the v2 admin api, so it can be loaded without a token.
+// Users log in on the page, which gives the browser a session cookie.
+package server
+
+import (
+	"net/http"
+)
+
+const DASHBOARD_PATH = "/admin/ui"
+
+// How often the dashboard refreshes, in milliseconds.
+const dashboardRefreshMs = "3000"
+
+// The same as API_MAX_LIMIT, so that whole lists are shown.
+const dashboardLimit = "500"
+
+type dashboardAsset struct {
+	contentType string
+	content     string
+}
+
+var dashboardAssets = map[string]*dashboardAsset{
+	DASHBOARD_PATH:                    {"text/html; charset=utf-8", dashboardHtml},
+	DASHBOARD_PATH + "/":              {"text/html; charset=utf-8", dashboardHtml},
+	DASHBOARD_PATH + "/dashboard.js":  {"text/javascript; charset=utf-8", dashboardJs},
+	DASHBOARD_PATH + "/dashboard.css": {"text/css; charset=utf-8", dashboardCss},
+}
+
+// Check if a path is part of the dashboard (and needs no authentication).
+func isDashboardPath(p string) bool {
+	_, ok := dashboardAssets[p]
+	return ok
+}
+
+func (das *DecerverAPIServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	asset, ok := dashboardAssets[r.URL.Path]
+	if !ok {
+		das.writeError(w, 404, "Not found")
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", asset.contentType)
+	// The page only loads its own files, and may not be put in a frame.
+	h.Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	if r.Method != "HEAD" {
+		w.Write([]byte(asset.content))
+	}
+}
+
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>decerver</title>
+	<link rel="stylesheet" href="/admin/ui/dashboard.css">
+	<script src="/admin/ui/dashboard.js" defer></script>
+</head>
+<body>
+	<header>
+		<h1>decerver</h1>
+		<span id="scope"></span>
+		<button id="logout" hidden>Log out</button>
+	</header>
+	<p id="error" class="error" hidden></p>
+
+	<form id="login" hidden>
+		<label for="token">Admin token</label>
+		<input id="token" type="password" autocomplete="off">
+		<button type="submit">Log in</button>
+	</form>
+
+	<main id="main" hidden>
+		<section>
+			<h2>Dapps</h2>
+			<table>
+				<thead><tr><th>Name</th><th>Id</th><th>Version</th><th>State</th><th></th></tr></thead>
+				<tbody id="dapps"></tbody>
+			</table>
+		</section>
+
+		<section>
+			<h2>Modules</h2>
+			<table>
+				<thead><tr><th>Name</th><th>State</th><th>Error</th><th></th></tr></thead>
+				<tbody id="modules"></tbody>
+			</table>
+			<form id="config" hidden>
+				<h3>Config: <span id="config-name"></span></h3>
+				<textarea id="config-text" rows="16" spellcheck="false"></textarea>
+				<button type="submit">Save</button>
+				<button type="button" id="config-cancel">Cancel</button>
+			</form>
+		</section>
+
+		<section>
+			<h2>Websocket sessions</h2>
+			<table>
+				<thead><tr><th>Id</th><th>Dapp</th><th>Address</th><th>State</th><th>Opened</th><th>Messages in/out</th><th>Bytes in/out</th></tr></thead>
+				<tbody id="sessions"></tbody>
+			</table>
+		</section>
+
+		<section>
+			<h2>Event traffic</h2>
+			<pre id="traffic"></pre>
+		</section>
+	</main>
+</body>
+</html>
+`
+
+const dashboardCss = `body {
+	font-family: sans-serif;
+	margin: 0 2em 2em 2em;
+	color: #222;
+}
+header {
+	display: flex;
+	align-items: center;
+	gap: 1em;
+	border-bottom: 1px solid #ccc;
+}
+header h1 {
+	flex-grow: 1;
+}
+table {
+	border-collapse: collapse;
+	width: 100%;
+}
+th, td {
+	text-align: left;
+	padding: 0.3em 0.6em;
+	border-bottom: 1px solid #eee;
+}
+textarea {
+	width: 100%;
+	font-family: monospace;
+}
+pre {
+	background: #f6f6f6;
+	padding: 1em;
+	overflow: auto;
+}
+.error {
+	color: #b00;
+}
+.running {
+	color: #080;
+	font-weight: bold;
+}
+`
+
+const dashboardJs = `(function(){
+	"use strict";
+
+	var REFRESH_MS = ` + dashboardRefreshMs + `;
+	var API = "` + API_V2_BASE + `";
+	// The largest page the api gives.
+	var LIMIT = ` + dashboardLimit + `;
+	var timer = null;
+	var trafficEnabled = true;
+
+	function $(id){
+		return document.getElementById(id);
+	}
+
+	function showError(msg){
+		var el = $("error");
+		el.textContent = msg || "";
+		el.hidden = !msg;
+	}
+
+	function csrfToken(){
+		var m = document.cookie.match(/(?:^|;\s*)decerver_csrf=([^;]*)/);
+		return m ? decodeURIComponent(m[1]) : "";
+	}
+
+	// Calls the admin api. Resolves with the data of the response, and rejects
+	// with an error that has the status.
+	function api(method, url, body){
+		var opts = {method: method, credentials: "same-origin", headers: {}};
+		if(method !== "GET"){
+			opts.headers["X-CSRF-Token"] = csrfToken();
+		}
+		if(body !== undefined){
+			opts.headers["Content-Type"] = "application/json";
+			opts.body = body;
+		}
+		return fetch(url, opts).then(function(resp){
+			return resp.text().then(function(text){
+				var json = null;
+				if((resp.headers.get("Content-Type") || "").indexOf("application/json") === 0 && text){
+					json = JSON.parse(text);
+				}
+				if(!resp.ok){
+					var err = new Error(json && json.error ? json.error.message : (text || resp.statusText));
+					err.status = resp.status;
+					throw err;
+				}
+				return json && "data" in json ? json.data : json;
+			});
+		});
+	}
+
+	function cell(row, text, cls){
+		var td = document.createElement("td");
+		td.textContent = text === undefined || text === null ? "" : String(text);
+		if(cls){
+			td.className = cls;
+		}
+		row.appendChild(td);
+		return td;
+	}
+
+	function button(row, text, onclick){
+		var td = document.createElement("td");
+		var b = document.createElement("button");
+		b.textContent = text;
+		b.addEventListener("click", onclick);
+		td.appendChild(b);
+		row.appendChild(td);
+	}
+
+	function fill(tbodyId, items, render){
+		var tbody = $(tbodyId);
+		while(tbody.firstChild){
+			tbody.removeChild(tbody.firstChild);
+		}
+		(items || []).forEach(function(item){
+			var row = document.createElement("tr");
+			render(row, item);
+			tbody.appendChild(row);
+		});
+	}
+
+	function refresh(){
+		return Promise.all([
+			api("GET", API + "/dapps?limit=" + LIMIT),
+			api("GET", API + "/runtimes?limit=" + LIMIT),
+			api("GET", API + "/modules?limit=" + LIMIT),
+			api("GET", API + "/sessions?limit=" + LIMIT)
+		]).then(function(res){
+			var running = res[1] || [];
+			fill("dapps", res[0], function(row, dapp){
+				var isRunning = running.indexOf(dapp.id) !== -1;
+				cell(row, dapp.name);
+				cell(row, dapp.id);
+				cell(row, dapp.version);
+				cell(row, isRunning ? "running" : "", isRunning ? "running" : "");
+				button(row, "Switch", function(){ switchDapp(dapp.id); });
+			});
+			fill("modules", res[2], function(row, mod){
+				cell(row, mod.name);
+				cell(row, mod.state, mod.state === "running" ? "running" : "");
+				cell(row, mod.error, "error");
+				button(row, "Config", function(){ editConfig(mod.name); });
+			});
+			fill("sessions", res[3], function(row, s){
+				cell(row, s.id);
+				cell(row, s.dapp_id);
+				cell(row, s.remote_addr);
+				cell(row, s.state);
+				cell(row, new Date(s.opened).toLocaleString());
+				cell(row, s.msgs_in + " / " + s.msgs_out);
+				cell(row, s.bytes_in + " / " + s.bytes_out);
+			});
+			showError("");
+			return refreshTraffic();
+		}).catch(handleError);
+	}
+
+	function refreshTraffic(){
+		if(!trafficEnabled){
+			return;
+		}
+		return api("GET", API + "/traffic").then(function(data){
+			$("traffic").textContent = JSON.stringify(data, null, "  ");
+		}, function(err){
+			if(err.status !== 404){
+				throw err;
+			}
+			trafficEnabled = false;
+			$("traffic").textContent = err.message;
+		});
+	}
+
+	function switchDapp(id){
+		api("POST", API + "/dapps/" + encodeURIComponent(id) + "/runtime").then(refresh).catch(handleError);
+	}
+
+	function editConfig(name){
+		api("GET", API + "/modules/" + encodeURIComponent(name) + "/config").then(function(config){
+			$("config-name").textContent = name;
+			$("config-text").value = JSON.stringify(config, null, "    ");
+			$("config").hidden = false;
+		}).catch(handleError);
+	}
+
+	function saveConfig(e){
+		e.preventDefault();
+		var name = $("config-name").textContent;
+		var text = $("config-text").value;
+		try {
+			JSON.parse(text);
+		} catch(err){
+			showError("The config is not valid json: " + err.message);
+			return;
+		}
+		api("PUT", API + "/modules/" + encodeURIComponent(name) + "/config", text).then(function(){
+			$("config").hidden = true;
+			showError("");
+		}).catch(handleError);
+	}
+
+	function handleError(err){
+		if(err.status === 401){
+			showLogin();
+			return;
+		}
+		showError(err.message);
+	}
+
+	function showLogin(){
+		if(timer){
+			clearInterval(timer);
+			timer = null;
+		}
+		$("main").hidden = true;
+		$("logout").hidden = true;
+		$("scope").textContent = "";
+		$("login").hidden = false;
+	}
+
+	function showMain(scope){
+		$("login").hidden = true;
+		$("main").hidden = false;
+		$("logout").hidden = false;
+		if(scope){
+			$("scope").textContent = scope === "write" ? "read-write" : "read-only";
+		}
+		trafficEnabled = true;
+		refresh();
+		if(!timer){
+			timer = setInterval(refresh, REFRESH_MS);
+		}
+	}
+
+	function login(e){
+		e.preventDefault();
+		var token = $("token").value;
+		api("POST", "/admin/login", JSON.stringify({token: token})).then(function(resp){
+			$("token").value = "";
+			showError("");
+			showMain(resp.scope);
+		}).catch(function(err){
+			showError(err.message);
+		});
+	}
+
+	function logout(){
+		api("POST", "/admin/logout").then(showLogin).catch(handleError);
+	}
+
+	document.addEventListener("DOMContentLoaded", function(){
+		$("login").addEventListener("submit", login);
+		$("logout").addEventListener("click", logout);
+		$("config").addEventListener("submit", saveConfig);
+		$("config-cancel").addEventListener("click", function(){ $("config").hidden = true; });
+		// Use the session cookie if there is one.
+		api("GET", API + "/status").then(function(){
+			showMain("");
+		}).catch(handleError);
+	});
+})();
+`
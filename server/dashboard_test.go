@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	das := NewDecerverAPIServer(nil, nil)
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/admin/ui", 200, "text/html"},
+		{"/admin/ui/", 200, "text/html"},
+		{"/admin/ui/dashboard.js", 200, "text/javascript"},
+		{"/admin/ui/dashboard.css", 200, "text/css"},
+		{"/admin/ui/missing.js", 404, "text/plain"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		das.handleDashboard(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: Wrong status: %d\n", test.path, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, test.contentType) {
+			t.Errorf("%s: Wrong content type: %s\n", test.path, ct)
+		}
+		if test.status == 200 && w.Header().Get("X-Frame-Options") != "DENY" {
+			t.Errorf("%s: The page may be framed.\n", test.path)
+		}
+	}
+}
+
+// The dashboard shows whole lists.
+func TestDashboardLimit(t *testing.T) {
+	if dashboardLimit != strconv.Itoa(API_MAX_LIMIT) {
+		t.Errorf("The dashboard uses limit %s, but the api allows %d.\n", dashboardLimit, API_MAX_LIMIT)
+	}
+}
@@ -0,0 +1,216 @@
+// This file lets websocket clients subscribe to module events directly,
+// without going through the dapps javascript. Both protocols use the
+// methods 'rpc.subscribe' and 'rpc.unsubscribe', which are reserved in
+// JSON-RPC. Events are sent to the client as 'rpc.event' notifications, or
+// (in ESRPC) as messages with that method and the event as the result.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	mtypes "github.com/eris-ltd/modules/types"
+	"sync/atomic"
+)
+
+const (
+	RPC_SUBSCRIBE   = "rpc.subscribe"
+	RPC_UNSUBSCRIBE = "rpc.unsubscribe"
+	RPC_EVENT       = "rpc.event"
+)
+
+// Used to make subscription ids unique.
+var sessionSubCounter uint64
+
+// An event subscription that belongs to a websocket session.
+type SessionSub struct {
+	source  string
+	tpe     string
+	tgt     string
+	id      string
+	session *Session
+}
+
+func (ss *SessionSub) Source() string {
+	return ss.source
+}
+
+func (ss *SessionSub) Id() string {
+	return ss.id
+}
+
+func (ss *SessionSub) Target() string {
+	return ss.tgt
+}
+
+func (ss *SessionSub) Event() string {
+	return ss.tpe
+}
+
+// Subscriptions count towards the dapps subscription quota.
+func (ss *SessionSub) Owner() string {
+	return ss.session.caller
+}
+
+// Called by the event processor. It must not block, so events are
+// dropped if the client can not keep up.
+func (ss *SessionSub) Post(e mtypes.Event) {
+	params, err := json.Marshal(&rpcEventParams{ss.id, e})
+	if err != nil {
+		logger.Printf("Failed to marshal event for subscription '%s': %s\n", ss.id, err.Error())
+		return
+	}
+	if ss.session.protocol == dapps.WS_PROTOCOL_JSONRPC {
+		ss.session.notify(RPC_EVENT, params)
+		return
+	}
+	if ss.session.State() == SESSION_OPEN {
+		ss.session.wsConn.tryWriteJsonMsg(esrpcMessage(RPC_EVENT, nil, params, nil))
+	}
+}
+
+type rpcEventParams struct {
+	Subscription string       `json:"subscription"`
+	Event        mtypes.Event `json:"event"`
+}
+
+type rpcSubscribeParams struct {
+	Source string `json:"source"`
+	Event  string `json:"event"`
+	Target string `json:"target"`
+}
+
+type rpcUnsubscribeParams struct {
+	Subscription string `json:"subscription"`
+}
+
+// Params can be an object, or an array with the values in order.
+func parseSubscribeParams(params json.RawMessage) (*rpcSubscribeParams, error) {
+	sp := &rpcSubscribeParams{}
+	if firstByte(params) == '[' {
+		var arr []string
+		if err := json.Unmarshal(params, &arr); err != nil || len(arr) < 2 || len(arr) > 3 {
+			return nil, fmt.Errorf("Params must be [source, event] or [source, event, target].")
+		}
+		sp.Source, sp.Event = arr[0], arr[1]
+		if len(arr) == 3 {
+			sp.Target = arr[2]
+		}
+	} else if err := json.Unmarshal(params, sp); err != nil {
+		return nil, fmt.Errorf("Malformed params: %s", err.Error())
+	}
+	if sp.Source == "" || sp.Event == "" {
+		return nil, fmt.Errorf("Source and event are required.")
+	}
+	return sp, nil
+}
+
+func parseUnsubscribeParams(params json.RawMessage) (string, error) {
+	if firstByte(params) == '[' {
+		var arr []string
+		if err := json.Unmarshal(params, &arr); err != nil || len(arr) != 1 {
+			return "", fmt.Errorf("Params must be [subscription].")
+		}
+		return arr[0], nil
+	}
+	up := &rpcUnsubscribeParams{}
+	if err := json.Unmarshal(params, up); err != nil {
+		return "", fmt.Errorf("Malformed params: %s", err.Error())
+	}
+	return up.Subscription, nil
+}
+
+// Handles 'rpc.subscribe'. Dapps can only pass on events from modules they
+// have been granted.
+func (ss *Session) rpcSubscribe(params json.RawMessage) (json.RawMessage, *RpcError) {
+	sp, err := parseSubscribeParams(params)
+	if err != nil {
+		return nil, &RpcError{Code: E_BAD_PARAMS, Message: err.Error()}
+	}
+	ep := ss.server.ep
+	if ep == nil {
+		return nil, &RpcError{Code: E_SERVER, Message: "Event subscriptions are not available."}
+	}
+	capability := scripting.ModuleCapability(sp.Source)
+	if !ss.runtime.Capabilities().Has(capability) {
+		msg := fmt.Sprintf("Permission denied: dapp '%s' has not been granted '%s'.", ss.caller, capability)
+		return nil, &RpcError{Code: E_SERVER, Message: msg}
+	}
+
+	sub := &SessionSub{}
+	sub.source = sp.Source
+	sub.tpe = sp.Event
+	sub.tgt = sp.Target
+	sub.id = fmt.Sprintf("ws_%d_%d", ss.SessionId(), atomic.AddUint64(&sessionSubCounter, 1))
+	sub.session = ss
+
+	ss.subMutex.Lock()
+	defer ss.subMutex.Unlock()
+	// Closing sessions must not get new subscriptions, since they would
+	// never be removed.
+	if ss.State() != SESSION_OPEN {
+		return nil, &RpcError{Code: E_SERVER, Message: "Session is closing."}
+	}
+	if err := ep.Subscribe(sub); err != nil {
+		return nil, &RpcError{Code: E_SERVER, Message: err.Error()}
+	}
+	ss.subs[sub.id] = sub
+	ret, _ := json.Marshal(sub.id)
+	return ret, nil
+}
+
+// Handles 'rpc.unsubscribe'. Clients can only remove their own subscriptions.
+func (ss *Session) rpcUnsubscribe(params json.RawMessage) (json.RawMessage, *RpcError) {
+	id, err := parseUnsubscribeParams(params)
+	if err != nil {
+		return nil, &RpcError{Code: E_BAD_PARAMS, Message: err.Error()}
+	}
+	ss.subMutex.Lock()
+	defer ss.subMutex.Unlock()
+	if _, ok := ss.subs[id]; !ok {
+		return nil, &RpcError{Code: E_BAD_PARAMS, Message: "No subscription with id: " + id}
+	}
+	delete(ss.subs, id)
+	ss.server.ep.Unsubscribe(id)
+	return json.RawMessage("true"), nil
+}
+
+// An ESRPC request. Only the fields that are used here.
+type esrpcRequest struct {
+	Method string
+	Params json.RawMessage
+	Id     json.RawMessage
+}
+
+// Handle 'rpc.subscribe' and 'rpc.unsubscribe' in ESRPC sessions. The params
+// and results are the same as in JSON-RPC. Returns false if the message is
+// not one of those, in which case it goes to the dapp.
+func (ss *Session) handleEsrpcSubscription(msg string) bool {
+	req := &esrpcRequest{}
+	if err := json.Unmarshal([]byte(msg), req); err != nil {
+		return false
+	}
+	var result json.RawMessage
+	var rpcErr *RpcError
+	switch req.Method {
+	case RPC_SUBSCRIBE:
+		result, rpcErr = ss.rpcSubscribe(req.Params)
+	case RPC_UNSUBSCRIBE:
+		result, rpcErr = ss.rpcUnsubscribe(req.Params)
+	default:
+		return false
+	}
+	ss.wsConn.WriteJsonMsg(esrpcMessage(req.Method, req.Id, result, rpcErr))
+	return true
+}
+
+// Remove all subscriptions. Called when the session is closed.
+func (ss *Session) unsubscribeAll() {
+	ss.subMutex.Lock()
+	defer ss.subMutex.Unlock()
+	for id := range ss.subs {
+		ss.server.ep.Unsubscribe(id)
+		delete(ss.subs, id)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/events"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	mtypes "github.com/eris-ltd/modules/types"
+	"github.com/gorilla/websocket"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An event processor that keeps the subscribers in a map.
+type fakeEventProcessor struct {
+	events.EventProcessor
+	mutex *sync.Mutex
+	subs  map[string]events.Subscriber
+}
+
+func newFakeEventProcessor() *fakeEventProcessor {
+	return &fakeEventProcessor{mutex: &sync.Mutex{}, subs: make(map[string]events.Subscriber)}
+}
+
+func (fep *fakeEventProcessor) Subscribe(sub events.Subscriber) error {
+	if sub.Source() != "monk" && sub.Source() != "ipfs" {
+		return fmt.Errorf("No module with name: %s", sub.Source())
+	}
+	fep.mutex.Lock()
+	defer fep.mutex.Unlock()
+	fep.subs[sub.Id()] = sub
+	return nil
+}
+
+func (fep *fakeEventProcessor) Unsubscribe(id string) error {
+	fep.mutex.Lock()
+	defer fep.mutex.Unlock()
+	delete(fep.subs, id)
+	return nil
+}
+
+func (fep *fakeEventProcessor) post(e mtypes.Event) {
+	fep.mutex.Lock()
+	defer fep.mutex.Unlock()
+	for _, sub := range fep.subs {
+		if sub.Source() == e.Source && sub.Event() == e.Event && sub.Target() == e.Target {
+			sub.Post(e)
+		}
+	}
+}
+
+func (fep *fakeEventProcessor) count() int {
+	fep.mutex.Lock()
+	defer fep.mutex.Unlock()
+	return len(fep.subs)
+}
+
+// Sends a request and reads the response.
+func rpcRoundTrip(t *testing.T, conn *websocket.Conn, req string) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp := make(map[string]interface{})
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		t.Fatal(err.Error())
+	}
+	return resp
+}
+
+func TestWsEventSubscriptions(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}}
+	rt.caps = scripting.Capabilities{scripting.ModuleCapability("monk"): true}
+	rm := newFakeRuntimeManager(rt)
+	ep := newFakeEventProcessor()
+	was := NewWsAPIServer(rm, ep, 10, 0, nil)
+	was.SetWsProtocol("test", dapps.WS_PROTOCOL_JSONRPC)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	// Not granted.
+	resp := rpcRoundTrip(t, conn, `{"jsonrpc":"2.0","method":"rpc.subscribe","params":["ipfs","added"],"id":1}`)
+	if resp["error"] == nil {
+		t.Error("Subscribed to a module that has not been granted.")
+	}
+	// Bad params.
+	resp = rpcRoundTrip(t, conn, `{"jsonrpc":"2.0","method":"rpc.subscribe","params":{"source":"monk"},"id":2}`)
+	if resp["error"] == nil {
+		t.Error("Subscribed without an event type.")
+	}
+
+	resp = rpcRoundTrip(t, conn, `{"jsonrpc":"2.0","method":"rpc.subscribe","params":{"source":"monk","event":"newBlock"},"id":3}`)
+	subId, ok := resp["result"].(string)
+	if !ok {
+		t.Fatalf("Subscribe failed: %v\n", resp["error"])
+	}
+	if ep.count() != 1 {
+		t.Fatalf("Wrong number of subscriptions. Expected: 1, Got: %d\n", ep.count())
+	}
+
+	ep.post(mtypes.Event{Event: "newBlock", Source: "monk", Resource: "block"})
+	// Different event type, should not arrive.
+	ep.post(mtypes.Event{Event: "newTx", Source: "monk"})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notif := &struct {
+		Method string
+		Params *rpcEventParams
+	}{}
+	if err := json.Unmarshal(msg, notif); err != nil {
+		t.Fatal(err.Error())
+	}
+	if notif.Method != RPC_EVENT || notif.Params.Subscription != subId || notif.Params.Event.Resource != "block" {
+		t.Errorf("Wrong notification: %s\n", string(msg))
+	}
+
+	// Unsubscribing twice should fail the second time.
+	req := fmt.Sprintf(`{"jsonrpc":"2.0","method":"rpc.unsubscribe","params":[%q],"id":4}`, subId)
+	if resp = rpcRoundTrip(t, conn, req); resp["result"] != true {
+		t.Errorf("Unsubscribe failed: %v\n", resp["error"])
+	}
+	if resp = rpcRoundTrip(t, conn, req); resp["error"] == nil {
+		t.Error("Unsubscribed from a subscription that does not exist.")
+	}
+	if ep.count() != 0 {
+		t.Errorf("Subscription was not removed.")
+	}
+
+	// Subscriptions are removed when the session closes.
+	for i := 0; i < 3; i++ {
+		rpcRoundTrip(t, conn, `{"jsonrpc":"2.0","method":"rpc.subscribe","params":["monk","newBlock"],"id":5}`)
+	}
+	if ep.count() != 3 {
+		t.Fatalf("Wrong number of subscriptions. Expected: 3, Got: %d\n", ep.count())
+	}
+	conn.Close()
+	waitForSessions(t, was, 0)
+	if ep.count() != 0 {
+		t.Errorf("Subscriptions were not removed when the session closed. %d left.\n", ep.count())
+	}
+}
+
+// ESRPC sessions (the default) subscribe with the same methods. Other
+// messages still go to the dapp.
+func TestWsEsrpcEventSubscriptions(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}, echo: true}
+	rt.caps = scripting.Capabilities{scripting.ModuleCapability("monk"): true}
+	rm := newFakeRuntimeManager(rt)
+	ep := newFakeEventProcessor()
+	was := NewWsAPIServer(rm, ep, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	resp := rpcRoundTrip(t, conn, `{"Protocol":"ESRPC","Method":"rpc.subscribe","Params":["ipfs","added"],"Id":"1"}`)
+	if resp["Error"] == nil || resp["Id"] != "1" {
+		t.Errorf("Subscribed to a module that has not been granted: %v\n", resp)
+	}
+	resp = rpcRoundTrip(t, conn, `{"Protocol":"ESRPC","Method":"rpc.subscribe","Params":{"source":"monk","event":"newBlock"},"Id":"2"}`)
+	subId, ok := resp["Result"].(string)
+	if !ok || subId == "" || resp["Error"] != nil || resp["Method"] != RPC_SUBSCRIBE || resp["Id"] != "2" {
+		t.Fatalf("Subscribe failed: %v\n", resp)
+	}
+	if ep.count() != 1 {
+		t.Fatalf("Wrong number of subscriptions. Expected: 1, Got: %d\n", ep.count())
+	}
+
+	ep.post(mtypes.Event{Event: "newBlock", Source: "monk", Resource: "block"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	evt := &struct {
+		Protocol string
+		Method   string
+		Result   *rpcEventParams
+	}{}
+	if err := json.Unmarshal(msg, evt); err != nil {
+		t.Fatal(err.Error())
+	}
+	if evt.Protocol != "ESRPC" || evt.Method != RPC_EVENT || evt.Result == nil || evt.Result.Subscription != subId || evt.Result.Event.Resource != "block" {
+		t.Errorf("Wrong event message: %s\n", string(msg))
+	}
+
+	// Other methods are passed to the dapp (which echoes them here).
+	req := `{"Protocol":"ESRPC","Method":"getBlock","Params":[],"Id":"3"}`
+	if resp = rpcRoundTrip(t, conn, req); resp["Method"] != "getBlock" {
+		t.Errorf("Message was not passed to the dapp: %v\n", resp)
+	}
+
+	req = fmt.Sprintf(`{"Protocol":"ESRPC","Method":"rpc.unsubscribe","Params":[%q],"Id":"4"}`, subId)
+	if resp = rpcRoundTrip(t, conn, req); resp["Result"] != true {
+		t.Errorf("Unsubscribe failed: %v\n", resp)
+	}
+	if ep.count() != 0 {
+		t.Errorf("Subscription was not removed.")
+	}
+	if resp = rpcRoundTrip(t, conn, req); resp["Error"] == nil {
+		t.Error("Unsubscribed from a subscription that does not exist.")
+	}
+}
@@ -0,0 +1,332 @@
+// This file contains the objects that let dapps read request bodies and
+// stream responses. They are passed to network.handleIncomingHttp along
+// with the request, and wrapped in javascript (see the runtime manager).
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+)
+
+// Bodies up to this size that are text are put in the Body field of the
+// request, so that dapps that only handle small requests can ignore the
+// reader.
+const MAX_INLINE_BODY = 64 * 1024
+
+// The part of a multipart form that is kept in memory. The rest is stored
+// in temporary files until the request is done.
+const MULTIPART_MEMORY = 1024 * 1024
+
+// The largest chunk that can be read from a body in one call.
+const MAX_BODY_READ = 1024 * 1024
+
+var errBodyTooLarge = errors.New("Request body is too large.")
+
+// Converts errors from http.MaxBytesReader.
+func bodyError(err error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// Information about an uploaded file.
+type HttpFileInfo struct {
+	FileName    string
+	ContentType string
+	Size        int64
+}
+
+// Reads a request body, or an uploaded file.
+type HttpBodyJs struct {
+	mutex *sync.Mutex
+	r     io.Reader
+	form  *multipart.Form
+	// The uploaded files that has been opened.
+	files  []io.Closer
+	closed bool
+}
+
+func newHttpBodyJs(r io.Reader, form *multipart.Form) *HttpBodyJs {
+	return &HttpBodyJs{mutex: &sync.Mutex{}, r: r, form: form}
+}
+
+// Read up to max bytes (or MAX_BODY_READ if max is 0). Returns an empty
+// array at the end of the body.
+func (hb *HttpBodyJs) Read(max int) map[string]interface{} {
+	bts, err := hb.read(max)
+	return bodyResult(bts, err)
+}
+
+func (hb *HttpBodyJs) ReadString(max int) map[string]interface{} {
+	bts, err := hb.read(max)
+	return bodyResult(string(bts), err)
+}
+
+func (hb *HttpBodyJs) ReadBase64(max int) map[string]interface{} {
+	bts, err := hb.read(max)
+	return bodyResult(base64.StdEncoding.EncodeToString(bts), err)
+}
+
+// Open an uploaded file from a multipart form.
+func (hb *HttpBodyJs) OpenFile(field string, index int) map[string]interface{} {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if hb.closed {
+		return bodyResult(nil, fmt.Errorf("The request is done."))
+	}
+	if hb.form == nil || index < 0 || index >= len(hb.form.File[field]) {
+		return bodyResult(nil, fmt.Errorf("No file: %s[%d]", field, index))
+	}
+	file, err := hb.form.File[field][index].Open()
+	if err != nil {
+		return bodyResult(nil, err)
+	}
+	hb.files = append(hb.files, file)
+	return bodyResult(newHttpBodyJs(file, nil), nil)
+}
+
+func (hb *HttpBodyJs) read(max int) ([]byte, error) {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if hb.closed {
+		return nil, fmt.Errorf("The request is done.")
+	}
+	if max <= 0 || max > MAX_BODY_READ {
+		max = MAX_BODY_READ
+	}
+	bts := make([]byte, max)
+	n, err := io.ReadFull(hb.r, bts)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return bts[:n], bodyError(err)
+}
+
+// Stop reading, and remove the temporary files of multipart forms.
+func (hb *HttpBodyJs) close() {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	hb.closed = true
+	for _, file := range hb.files {
+		file.Close()
+	}
+	if hb.form != nil {
+		hb.form.RemoveAll()
+	}
+}
+
+func bodyResult(data interface{}, err error) map[string]interface{} {
+	ret := map[string]interface{}{"data": data, "error": ""}
+	if err != nil {
+		ret["error"] = err.Error()
+	}
+	return ret
+}
+
+// Read the body into the request proxy. Small text bodies are put in the
+// Body field, and multipart forms are parsed. Returns the reader for the
+// rest of the body.
+func readHttpBody(r *http.Request, prx *HttpReqProxy) (*HttpBodyJs, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(MULTIPART_MEMORY); err != nil {
+			return nil, bodyError(err)
+		}
+		form := r.MultipartForm
+		prx.Form = form.Value
+		prx.Files = make(map[string][]*HttpFileInfo)
+		for field, fhs := range form.File {
+			for _, fh := range fhs {
+				fi := &HttpFileInfo{fh.Filename, fh.Header.Get("Content-Type"), fh.Size}
+				prx.Files[field] = append(prx.Files[field], fi)
+			}
+		}
+		return newHttpBodyJs(bytes.NewReader(nil), form), nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_INLINE_BODY+1))
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if len(buf) <= MAX_INLINE_BODY && utf8.Valid(buf) {
+		prx.Body = string(buf)
+	} else {
+		prx.Streamed = true
+	}
+	return newHttpBodyJs(io.MultiReader(bytes.NewReader(buf), r.Body), nil), nil
+}
+
+// Streams a response. Once the header has been written, the value that
+// the dapp returns from its callback is not used.
+type HttpResponseJs struct {
+	mutex    *sync.Mutex
+	w        http.ResponseWriter
+	started  bool
+	keepOpen bool
+	closed   bool
+	// Closed when the dapp ends a response that was kept open.
+	done chan struct{}
+}
+
+func newHttpResponseJs(w http.ResponseWriter) *HttpResponseJs {
+	return &HttpResponseJs{mutex: &sync.Mutex{}, w: w, done: make(chan struct{})}
+}
+
+// Write the status and the header. The header is a json object, where the
+// values are strings or arrays of strings.
+func (hr *HttpResponseJs) WriteHeader(status int, header string) string {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if err := hr.check(); err != nil {
+		return err.Error()
+	}
+	if hr.started {
+		return "The header has already been written."
+	}
+	if status < 100 || status > 999 {
+		return fmt.Sprintf("Invalid status: %d", status)
+	}
+	if header != "" {
+		hm := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(header), &hm); err != nil {
+			return "Malformed header: " + err.Error()
+		}
+		h := hr.w.Header()
+		for k, v := range hm {
+			if vs, isArr := v.([]interface{}); isArr {
+				h.Del(k)
+				for _, val := range vs {
+					h.Add(k, fmt.Sprint(val))
+				}
+			} else {
+				h.Set(k, fmt.Sprint(v))
+			}
+		}
+	}
+	hr.started = true
+	hr.w.WriteHeader(status)
+	return ""
+}
+
+func (hr *HttpResponseJs) Write(data string) string {
+	return hr.write([]byte(data))
+}
+
+func (hr *HttpResponseJs) WriteBytes(data []byte) string {
+	return hr.write(data)
+}
+
+func (hr *HttpResponseJs) WriteBase64(data string) string {
+	bts, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "Malformed base64: " + err.Error()
+	}
+	return hr.write(bts)
+}
+
+// Send what has been written so far. Responses without a Content-Length
+// header are sent in chunks.
+func (hr *HttpResponseJs) Flush() string {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if err := hr.check(); err != nil {
+		return err.Error()
+	}
+	hr.start()
+	if flusher, ok := hr.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return ""
+}
+
+// Keep the response open after the callback returns, so that the dapp can
+// write to it later (from event handlers, for example). It stays open until
+// End is called, or the client goes away.
+func (hr *HttpResponseJs) KeepOpen() string {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if err := hr.check(); err != nil {
+		return err.Error()
+	}
+	hr.keepOpen = true
+	return ""
+}
+
+func (hr *HttpResponseJs) End() {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if hr.closed {
+		return
+	}
+	hr.start()
+	hr.closed = true
+	close(hr.done)
+}
+
+func (hr *HttpResponseJs) write(data []byte) string {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if err := hr.check(); err != nil {
+		return err.Error()
+	}
+	hr.start()
+	if _, err := hr.w.Write(data); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// Write the default header if it has not been written. Caller must hold
+// the lock.
+func (hr *HttpResponseJs) start() {
+	if !hr.started {
+		hr.started = true
+		hr.w.WriteHeader(200)
+	}
+}
+
+// Caller must hold the lock.
+func (hr *HttpResponseJs) check() error {
+	if hr.closed {
+		return fmt.Errorf("The response has ended.")
+	}
+	return nil
+}
+
+// Returns whether the dapp has taken over the response, and if it wants
+// it kept open.
+func (hr *HttpResponseJs) state() (used, keepOpen bool) {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	return hr.started || hr.keepOpen, hr.keepOpen && !hr.closed
+}
+
+// Wait until the dapp ends the response, or the client goes away.
+func (hr *HttpResponseJs) wait(r *http.Request) {
+	select {
+	case <-hr.done:
+	case <-r.Context().Done():
+	}
+}
+
+// No more writes are allowed after this. It is called when the handler
+// returns, since the response writer may not be used after that.
+func (hr *HttpResponseJs) close() {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if !hr.closed {
+		hr.closed = true
+		close(hr.done)
+	}
+}
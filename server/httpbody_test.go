@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newHttpTestServer(rt *fakeRuntime) *httptest.Server {
+	return newHttpTestRouter(rt, newOriginPolicies())
+}
+
+// Routes HTTP_BASE/<id>/ to the http handler, with the origin checks.
+func newHttpTestRouter(rt *fakeRuntime, origins *originPolicies) *httptest.Server {
+	has := NewHttpAPIServer(newFakeRuntimeManager(rt))
+	g := NewRouteGroup(rt.id)
+	g.HandlePrefix(HTTP_BASE+rt.id, has.handleHttp, origins.middleware)
+	router := NewRouter(http.NotFoundHandler())
+	router.Add(g)
+	return httptest.NewServer(router)
+}
+
+// Reads the whole body, and returns it as the response.
+func echoBody(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string {
+	data := make([]byte, 0)
+	for {
+		ret := body.Read(1000)
+		if ret["error"] != "" {
+			return `{"status":422,"body":"` + ret["error"].(string) + `"}`
+		}
+		bts := ret["data"].([]byte)
+		if len(bts) == 0 {
+			break
+		}
+		data = append(data, bts...)
+	}
+	hr := &HttpResp{Status: 200, Body: req.Body}
+	if req.Streamed {
+		hr.Status = 201
+		hr.BodyBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+	bts, _ := json.Marshal(hr)
+	return string(bts)
+}
+
+func TestHttpBody(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{MaxHttpRequestBytes: 100000}, httpHandler: echoBody}
+	srv := newHttpTestServer(rt)
+	defer srv.Close()
+	u := srv.URL + HTTP_BASE + "test/"
+
+	binary := []byte{0, 1, 2, 0xff, 0xfe}
+	large := bytes.Repeat([]byte("a"), MAX_INLINE_BODY+10)
+	tests := []struct {
+		body   io.Reader
+		status int
+		want   []byte
+	}{
+		// Small text bodies are put in Body, the rest must be read.
+		{strings.NewReader("hello"), 200, []byte("hello")},
+		{bytes.NewReader(binary), 201, binary},
+		{bytes.NewReader(large), 201, large},
+		// Too large, with and without a Content-Length.
+		{bytes.NewReader(make([]byte, 100001)), 413, nil},
+		{io.MultiReader(bytes.NewReader(make([]byte, 100001))), 422, nil},
+	}
+	for i, test := range tests {
+		resp, err := http.Post(u, "application/octet-stream", test.body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		bts, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%d: Wrong status. Expected: %d, Got: %d (%s)\n", i, test.status, resp.StatusCode, string(bts))
+			continue
+		}
+		if test.want != nil && !bytes.Equal(bts, test.want) {
+			t.Errorf("%d: Wrong body: %v\n", i, bts)
+		}
+	}
+}
+
+func TestHttpMultipart(t *testing.T) {
+	var files map[string][]*HttpFileInfo
+	var form map[string][]string
+	var content string
+	handler := func(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string {
+		files, form = req.Files, req.Form
+		ret := body.OpenFile("upload", 0)
+		if ret["error"] != "" {
+			return `{"status":500,"body":"` + ret["error"].(string) + `"}`
+		}
+		content = ret["data"].(*HttpBodyJs).ReadString(0)["data"].(string)
+		if ret := body.OpenFile("upload", 1); ret["error"] == "" {
+			return `{"status":500,"body":"opened a missing file"}`
+		}
+		return `{"status":200}`
+	}
+	srv := newHttpTestServer(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, httpHandler: handler})
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("name", "value")
+	fw, _ := mw.CreateFormFile("upload", "file.bin")
+	fw.Write([]byte("file contents"))
+	mw.Close()
+	resp, err := http.Post(srv.URL+HTTP_BASE+"test/", mw.FormDataContentType(), buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bts, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Wrong status: %d (%s)\n", resp.StatusCode, string(bts))
+	}
+	if len(form["name"]) != 1 || form["name"][0] != "value" {
+		t.Errorf("Wrong form values: %v\n", form)
+	}
+	if len(files["upload"]) != 1 || files["upload"][0].FileName != "file.bin" || files["upload"][0].Size != 13 {
+		t.Errorf("Wrong files: %v\n", files)
+	}
+	if content != "file contents" {
+		t.Errorf("Wrong file content: %s\n", content)
+	}
+}
+
+func TestHttpStreamedResponse(t *testing.T) {
+	writers := make(chan *HttpResponseJs, 1)
+	handler := func(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string {
+		if e := resp.WriteHeader(202, `{"Content-Type":"text/plain","X-Multi":["a","b"]}`); e != "" {
+			return e
+		}
+		resp.Write("first\n")
+		resp.Flush()
+		resp.KeepOpen()
+		writers <- resp
+		// Ignored, since the writer has been used.
+		return `{"status":500}`
+	}
+	srv := newHttpTestServer(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, httpHandler: handler})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + HTTP_BASE + "test/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 202 || len(resp.Header["X-Multi"]) != 2 {
+		t.Errorf("Wrong status or header: %d %v\n", resp.StatusCode, resp.Header)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Response is not chunked: %v\n", resp.TransferEncoding)
+	}
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("Wrong first chunk: %s (%v)\n", line, err)
+	}
+
+	// Written after the callback has returned.
+	w := <-writers
+	time.Sleep(20 * time.Millisecond)
+	if e := w.WriteBytes([]byte{'s', 'e', 'c', 'o', 'n', 'd'}); e != "" {
+		t.Fatal(e)
+	}
+	w.End()
+	rest, _ := ioutil.ReadAll(br)
+	if string(rest) != "second" {
+		t.Errorf("Wrong rest of body: %s\n", string(rest))
+	}
+	if e := w.Write("more"); e == "" {
+		t.Error("Write after end did not fail.")
+	}
+}
+
+func TestHttpBase64Response(t *testing.T) {
+	handler := func(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string {
+		return `{"Status":200,"BodyBase64":"AAH/"}`
+	}
+	srv := newHttpTestServer(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, httpHandler: handler})
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + HTTP_BASE + "test/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bts, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(bts, []byte{0, 1, 0xff}) {
+		t.Errorf("Wrong body: %v\n", bts)
+	}
+}
+
+func TestHttpTracing(t *testing.T) {
+	dir := t.TempDir()
+	if err := tracing.Configure(&tracing.Config{File: "traces.json", SampleRate: 1}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tracing.Shutdown()
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}, callSpans: make(chan *tracing.Span, 1)}
+	srv := newHttpTestServer(rt)
+	defer srv.Close()
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("GET", srv.URL+HTTP_BASE+"test/path", nil)
+	req.Header.Set("traceparent", traceparent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	span := <-rt.callSpans
+	if span == nil || span.Name() != "GET "+HTTP_BASE+"test" {
+		t.Fatalf("The runtime was not called in the request span: %v\n", span)
+	}
+	sc := span.Context()
+	if sc.TraceId.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !sc.Sampled {
+		t.Errorf("The traceparent header was not honored: %s\n", sc.Traceparent())
+	}
+
+	// The span ends after the response has been written.
+	tracing.Shutdown()
+	bts, _ := ioutil.ReadFile(filepath.Join(dir, "traces.json"))
+	for _, want := range []string{
+		`"parentSpanId":"00f067aa0ba902b7"`,
+		`"spanId":"` + sc.SpanId.String() + `"`,
+		`{"key":"http.response.status_code","value":{"intValue":"200"}}`,
+		`{"key":"url.path","value":{"stringValue":"/http/test/path"}}`,
+	} {
+		if !strings.Contains(string(bts), want) {
+			t.Errorf("Missing from the exported span: %s\n%s\n", want, bts)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// This file contains the responses that dapps return from their http
+// callback, and how they are written.
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type HttpResp struct {
+	Status int            `json:"status"`
+	Header HttpRespHeader `json:"header"`
+	Body   string         `json:"body"`
+	// Used instead of Body for binary data.
+	BodyBase64 string `json:"bodyBase64"`
+	// Cookies to set. They are added to the Set-Cookie headers.
+	Cookies []*HttpCookie `json:"cookies"`
+	// If set, the client is redirected here. Status must be a redirect
+	// status, or 0 (which means 302).
+	Redirect string `json:"redirect"`
+}
+
+// Response headers. In json the values are strings, or arrays of strings
+// for headers that has several values.
+type HttpRespHeader map[string][]string
+
+func (hrh *HttpRespHeader) UnmarshalJSON(data []byte) error {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	h := make(HttpRespHeader)
+	for k, v := range raw {
+		switch val := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, elem := range val {
+				h[k] = append(h[k], fmt.Sprint(elem))
+			}
+		default:
+			h[k] = []string{fmt.Sprint(val)}
+		}
+	}
+	*hrh = h
+	return nil
+}
+
+type HttpCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Path   string `json:"path"`
+	Domain string `json:"domain"`
+	// Unix time in milliseconds. 0 means that it is a session cookie.
+	Expires int64 `json:"expires"`
+	// In seconds. 0 means not set, and a negative value deletes the cookie.
+	MaxAge   int  `json:"maxAge"`
+	Secure   bool `json:"secure"`
+	HttpOnly bool `json:"httpOnly"`
+	// "strict", "lax", "none" or empty.
+	SameSite string `json:"sameSite"`
+}
+
+func (hc *HttpCookie) toHttp() (*http.Cookie, error) {
+	c := &http.Cookie{
+		Name:     hc.Name,
+		Value:    hc.Value,
+		Path:     hc.Path,
+		Domain:   hc.Domain,
+		MaxAge:   hc.MaxAge,
+		Secure:   hc.Secure,
+		HttpOnly: hc.HttpOnly,
+	}
+	if hc.Expires != 0 {
+		c.Expires = time.Unix(0, hc.Expires*int64(time.Millisecond)).UTC()
+	}
+	switch strings.ToLower(hc.SameSite) {
+	case "":
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("Invalid SameSite value for cookie '%s': %s", hc.Name, hc.SameSite)
+	}
+	if err := c.Valid(); err != nil {
+		return nil, fmt.Errorf("Invalid cookie '%s': %s", hc.Name, err.Error())
+	}
+	return c, nil
+}
+
+// Headers that are kept in 304 (Not Modified) responses.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Vary"}
+
+// Write a response from a dapp. Headers and cookies are set before the
+// status is written, and GET requests with a matching If-None-Match header
+// gets a 304 without body. Errors in the response are written as a 500.
+func writeHttpResp(w http.ResponseWriter, r *http.Request, resp *HttpResp) error {
+	status := resp.Status
+	if status == 0 {
+		status = 200
+	}
+	if resp.Redirect != "" {
+		if resp.Status == 0 {
+			status = 302
+		}
+		if status < 300 || status > 399 {
+			return fmt.Errorf("Invalid redirect status: %d", status)
+		}
+	}
+	if status < 100 || status > 999 {
+		return fmt.Errorf("Invalid status: %d", status)
+	}
+	body := []byte(resp.Body)
+	if resp.BodyBase64 != "" {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(resp.BodyBase64)
+		if err != nil {
+			return fmt.Errorf("Malformed base64 body: %s", err.Error())
+		}
+	}
+	cookies := make([]*http.Cookie, 0, len(resp.Cookies))
+	for _, hc := range resp.Cookies {
+		c, err := hc.toHttp()
+		if err != nil {
+			return err
+		}
+		cookies = append(cookies, c)
+	}
+
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h.Del(k)
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+	if resp.Redirect != "" {
+		http.Redirect(w, r, resp.Redirect, status)
+		return nil
+	}
+	if status == 200 && (r.Method == "GET" || r.Method == "HEAD") && notModified(r, h.Get("Etag")) {
+		for k := range h {
+			if !containsFold(notModifiedHeaders, k) && k != "Set-Cookie" {
+				h.Del(k)
+			}
+		}
+		w.WriteHeader(304)
+		return nil
+	}
+	w.WriteHeader(status)
+	// These statuses can not have a body.
+	if status == 204 || status == 304 || status < 200 || r.Method == "HEAD" {
+		return nil
+	}
+	w.Write(body)
+	return nil
+}
+
+// Check if the If-None-Match header of a request matches an etag. The
+// comparison is weak, as the spec says it must be.
+func notModified(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if etag == "" || inm == "" {
+		return false
+	}
+	if strings.TrimSpace(inm) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(inm, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
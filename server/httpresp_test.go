@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHttpRespHeaderJson(t *testing.T) {
+	hr := &HttpResp{}
+	err := json.Unmarshal([]byte(`{"header":{"Content-Type":"text/plain","Vary":["Accept","Origin"],"X-Num":5,"X-Nil":null}}`), hr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := HttpRespHeader{"Content-Type": {"text/plain"}, "Vary": {"Accept", "Origin"}, "X-Num": {"5"}}
+	if !reflect.DeepEqual(hr.Header, want) {
+		t.Errorf("Wrong header: %v\n", hr.Header)
+	}
+}
+
+func TestWriteHttpResp(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		reqHdr  map[string]string
+		resp    *HttpResp
+		err     bool
+		status  int
+		header  map[string][]string
+		body    string
+		noHdr   []string
+		cookies []string
+	}{
+		{
+			name:   "default status",
+			resp:   &HttpResp{Body: "hello"},
+			status: 200,
+			body:   "hello",
+		},
+		{
+			name:   "content type reaches the client",
+			resp:   &HttpResp{Status: 201, Header: HttpRespHeader{"Content-Type": {"application/json"}}, Body: "{}"},
+			status: 201,
+			header: map[string][]string{"Content-Type": {"application/json"}},
+			body:   "{}",
+		},
+		{
+			name:   "multi-valued headers",
+			resp:   &HttpResp{Header: HttpRespHeader{"Vary": {"Accept", "Origin"}}},
+			status: 200,
+			header: map[string][]string{"Vary": {"Accept", "Origin"}},
+		},
+		{
+			name: "invalid status",
+			resp: &HttpResp{Status: 42},
+			err:  true,
+		},
+		{
+			name:   "base64 body",
+			resp:   &HttpResp{BodyBase64: "AAH/"},
+			status: 200,
+			body:   "\x00\x01\xff",
+		},
+		{
+			name: "malformed base64 body",
+			resp: &HttpResp{BodyBase64: "!!"},
+			err:  true,
+		},
+		{
+			name: "cookies",
+			resp: &HttpResp{Cookies: []*HttpCookie{
+				{Name: "a", Value: "1", Path: "/", HttpOnly: true, SameSite: "lax"},
+				{Name: "b", Value: "", MaxAge: -1},
+			}},
+			status:  200,
+			cookies: []string{"a=1; Path=/; HttpOnly; SameSite=Lax", "b=; Max-Age=0"},
+		},
+		{
+			name: "invalid same site",
+			resp: &HttpResp{Cookies: []*HttpCookie{{Name: "a", Value: "1", SameSite: "sometimes"}}},
+			err:  true,
+		},
+		{
+			name: "invalid cookie name",
+			resp: &HttpResp{Cookies: []*HttpCookie{{Name: "a b", Value: "1"}}},
+			err:  true,
+		},
+		{
+			name:   "redirect",
+			resp:   &HttpResp{Redirect: "/other"},
+			status: 302,
+			header: map[string][]string{"Location": {"/other"}},
+		},
+		{
+			name:   "permanent redirect",
+			resp:   &HttpResp{Status: 308, Redirect: "/other"},
+			status: 308,
+			header: map[string][]string{"Location": {"/other"}},
+		},
+		{
+			name: "redirect with non-redirect status",
+			resp: &HttpResp{Status: 200, Redirect: "/other"},
+			err:  true,
+		},
+		{
+			name:   "etag match",
+			reqHdr: map[string]string{"If-None-Match": `"v1"`},
+			resp:   &HttpResp{Header: HttpRespHeader{"Etag": {`"v1"`}, "Content-Type": {"text/plain"}}, Body: "hello"},
+			status: 304,
+			header: map[string][]string{"Etag": {`"v1"`}},
+			noHdr:  []string{"Content-Type"},
+		},
+		{
+			name:   "weak etag match",
+			reqHdr: map[string]string{"If-None-Match": `"v0", W/"v1"`},
+			resp:   &HttpResp{Header: HttpRespHeader{"Etag": {`"v1"`}}, Body: "hello"},
+			status: 304,
+		},
+		{
+			name:   "etag wildcard",
+			reqHdr: map[string]string{"If-None-Match": "*"},
+			resp:   &HttpResp{Header: HttpRespHeader{"Etag": {`"v1"`}}, Body: "hello"},
+			status: 304,
+		},
+		{
+			name:   "etag mismatch",
+			reqHdr: map[string]string{"If-None-Match": `"v0"`},
+			resp:   &HttpResp{Header: HttpRespHeader{"Etag": {`"v1"`}}, Body: "hello"},
+			status: 200,
+			body:   "hello",
+		},
+		{
+			name:   "etag match on post",
+			method: "POST",
+			reqHdr: map[string]string{"If-None-Match": `"v1"`},
+			resp:   &HttpResp{Header: HttpRespHeader{"Etag": {`"v1"`}}, Body: "hello"},
+			status: 200,
+			body:   "hello",
+		},
+		{
+			name:   "head has no body",
+			method: "HEAD",
+			resp:   &HttpResp{Body: "hello"},
+			status: 200,
+		},
+		{
+			name:   "no content has no body",
+			resp:   &HttpResp{Status: 204, Body: "hello"},
+			status: 204,
+		},
+	}
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		r := httptest.NewRequest(method, "/apis/test/", nil)
+		for k, v := range test.reqHdr {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		err := writeHttpResp(w, r, test.resp)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: Expected an error.\n", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s\n", test.name, err.Error())
+			continue
+		}
+		res := w.Result()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: Wrong status. Expected: %d, Got: %d\n", test.name, test.status, res.StatusCode)
+		}
+		for k, vs := range test.header {
+			if got := res.Header[http.CanonicalHeaderKey(k)]; !reflect.DeepEqual(got, vs) {
+				t.Errorf("%s: Wrong %s header: %v\n", test.name, k, got)
+			}
+		}
+		for _, k := range test.noHdr {
+			if res.Header.Get(k) != "" {
+				t.Errorf("%s: Header %s should not be set.\n", test.name, k)
+			}
+		}
+		if test.cookies != nil && !reflect.DeepEqual(res.Header["Set-Cookie"], test.cookies) {
+			t.Errorf("%s: Wrong cookies: %v\n", test.name, res.Header["Set-Cookie"])
+		}
+		// Redirects get a short html body from the http package.
+		if test.resp.Redirect == "" && w.Body.String() != test.body {
+			t.Errorf("%s: Wrong body: %q\n", test.name, w.Body.String())
+		}
+	}
+}
+
+// Errors in the response are written as a 500, and nothing of the bad
+// response reaches the client.
+func TestHttpBadResponse(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}, httpHandler: func(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string {
+		return `{"status":200,"header":{"X-Test":"a"},"cookies":[{"name":"a","value":"1","sameSite":"bad"}]}`
+	}}
+	srv := newHttpTestServer(rt)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + HTTP_BASE + "test/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Errorf("Wrong status: %d\n", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Test") != "" || len(resp.Cookies()) != 0 {
+		t.Errorf("Bad response was partially written: %v\n", resp.Header)
+	}
+}
@@ -0,0 +1,277 @@
+// This file contains the JSON-RPC 2.0 websocket protocol. Dapps that use
+// it (by setting 'ws_protocol' to "jsonrpc2" in their package file) only
+// register method handlers in javascript. Parsing, validation, batches,
+// notifications and error responses are all handled here.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/tracing"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	E_PARSE       = -32700
+	E_INVALID_REQ = -32600
+	E_NO_METHOD   = -32601
+	E_BAD_PARAMS  = -32602
+	E_INTERNAL    = -32603
+	E_SERVER      = -32000
+)
+
+// The largest number of requests allowed in a batch.
+const MAX_RPC_BATCH = 100
+
+var rpcNullId = json.RawMessage("null")
+
+type RpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (re *RpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", re.Message, re.Code)
+}
+
+type rpcRequest struct {
+	Method string
+	Params json.RawMessage
+	// nil for notifications.
+	Id json.RawMessage
+}
+
+type rpcResult struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcErrorResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Error   *RpcError       `json:"error"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcNotification struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Calls a method, and returns either the result or an error.
+type rpcCaller func(method string, params json.RawMessage) (json.RawMessage, *RpcError)
+
+// Check that a websocket protocol name is valid. The empty string means
+// the default protocol (ESRPC).
+func validWsProtocol(protocol string) bool {
+	return protocol == "" || protocol == dapps.WS_PROTOCOL_ESRPC || protocol == dapps.WS_PROTOCOL_JSONRPC
+}
+
+// Process a JSON-RPC message (a single request or a batch), and return
+// the response. Returns nil if there is nothing to send back, which is
+// the case for notifications.
+func processRpc(msg []byte, call rpcCaller) []byte {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(msg, &batch); err != nil {
+			return marshalRpc(rpcErrorResp(nil, E_PARSE, "Parse error: "+err.Error()))
+		}
+		if len(batch) == 0 {
+			return marshalRpc(rpcErrorResp(nil, E_INVALID_REQ, "Empty batch."))
+		}
+		if len(batch) > MAX_RPC_BATCH {
+			return marshalRpc(rpcErrorResp(nil, E_INVALID_REQ, fmt.Sprintf("Batch is too large (max %d).", MAX_RPC_BATCH)))
+		}
+		resps := make([]interface{}, 0, len(batch))
+		for _, raw := range batch {
+			if resp := processRpcRequest(raw, call); resp != nil {
+				resps = append(resps, resp)
+			}
+		}
+		if len(resps) == 0 {
+			return nil
+		}
+		return marshalRpc(resps)
+	}
+	if !json.Valid(msg) {
+		return marshalRpc(rpcErrorResp(nil, E_PARSE, "Parse error."))
+	}
+	resp := processRpcRequest(msg, call)
+	if resp == nil {
+		return nil
+	}
+	return marshalRpc(resp)
+}
+
+// Process a single request. Returns nil for notifications.
+func processRpcRequest(raw json.RawMessage, call rpcCaller) interface{} {
+	req, rpcErr := parseRpcRequest(raw)
+	if rpcErr != nil {
+		id := rpcNullId
+		if req != nil && req.Id != nil {
+			id = req.Id
+		}
+		return &rpcErrorResponse{"2.0", rpcErr, id}
+	}
+	result, rpcErr := call(req.Method, req.Params)
+	if req.Id == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return &rpcErrorResponse{"2.0", rpcErr, req.Id}
+	}
+	if len(result) == 0 {
+		result = rpcNullId
+	}
+	return &rpcResult{"2.0", result, req.Id}
+}
+
+// Parse and validate a request. If the id could be read, the request is
+// returned along with the error, so that the id can be used in the response.
+func parseRpcRequest(raw json.RawMessage) (*rpcRequest, *RpcError) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, &RpcError{Code: E_INVALID_REQ, Message: "Request is not an object."}
+	}
+	req := &rpcRequest{}
+	if id, ok := fields["id"]; ok {
+		switch firstByte(id) {
+		case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			req.Id = id
+		default:
+			return nil, &RpcError{Code: E_INVALID_REQ, Message: "Id must be a string, a number or null."}
+		}
+	}
+	var version string
+	if err := json.Unmarshal(fields["jsonrpc"], &version); err != nil || version != "2.0" {
+		return req, &RpcError{Code: E_INVALID_REQ, Message: "The 'jsonrpc' field must be \"2.0\"."}
+	}
+	if err := json.Unmarshal(fields["method"], &req.Method); err != nil || firstByte(fields["method"]) != '"' {
+		return req, &RpcError{Code: E_INVALID_REQ, Message: "The 'method' field must be a string."}
+	}
+	if params, ok := fields["params"]; ok {
+		if b := firstByte(params); b != '[' && b != '{' {
+			return req, &RpcError{Code: E_INVALID_REQ, Message: "The 'params' field must be an array or an object."}
+		}
+		req.Params = params
+	}
+	return req, nil
+}
+
+func firstByte(raw json.RawMessage) byte {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return 0
+	}
+	return raw[0]
+}
+
+func rpcErrorResp(id json.RawMessage, code int, msg string) *rpcErrorResponse {
+	if id == nil {
+		id = rpcNullId
+	}
+	return &rpcErrorResponse{"2.0", &RpcError{Code: code, Message: msg}, id}
+}
+
+func marshalRpc(v interface{}) []byte {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		// Should never happen, since all the parts are valid json.
+		logger.Println("Failed to marshal rpc response: " + err.Error())
+		bts, _ = json.Marshal(rpcErrorResp(nil, E_INTERNAL, "Failed to marshal response."))
+	}
+	return bts
+}
+
+// Create a notification. Params that are not structured (an array or an
+// object) are wrapped in an array, since the spec does not allow them.
+func newRpcNotification(method string, params json.RawMessage) ([]byte, error) {
+	if len(params) != 0 && !json.Valid(params) {
+		return nil, fmt.Errorf("Notification params for '%s' is not valid json.", method)
+	}
+	switch firstByte(params) {
+	case 0, '[', '{':
+	default:
+		params = json.RawMessage("[" + string(params) + "]")
+	}
+	return json.Marshal(&rpcNotification{"2.0", method, params})
+}
+
+// The value returned by network.callRpcMethod.
+type rpcCallResult struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RpcError       `json:"error"`
+}
+
+// Call a method. The reserved 'rpc.' methods are handled by the server,
+// and the rest are passed to the dapp.
+func (ss *Session) rpcCall(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *RpcError) {
+	ctx, span := tracing.Start(ctx, "rpc "+method, tracing.KIND_INTERNAL)
+	defer span.End()
+	var result json.RawMessage
+	var rpcErr *RpcError
+	switch method {
+	case RPC_SUBSCRIBE:
+		result, rpcErr = ss.rpcSubscribe(params)
+	case RPC_UNSUBSCRIBE:
+		result, rpcErr = ss.rpcUnsubscribe(params)
+	default:
+		result, rpcErr = ss.callRpcMethod(ctx, method, params)
+	}
+	if rpcErr != nil {
+		span.SetAttribute("rpc.jsonrpc.error_code", rpcErr.Code)
+		span.SetError(rpcErr.Message)
+	}
+	return result, rpcErr
+}
+
+// Call a method in the sessions runtime. Methods are registered in
+// javascript with network.registerRpcMethod.
+func (ss *Session) callRpcMethod(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *RpcError) {
+	ret, err := ss.runtime.CallFuncOnObjContext(ctx, "network", "callRpcMethod", int(ss.SessionId()), method, string(params))
+	if err != nil {
+		logger.Printf("Js runtime error in rpc method '%s' (session: %d): %s\n", method, ss.SessionId(), err.Error())
+		return nil, &RpcError{Code: E_INTERNAL, Message: "Internal error."}
+	}
+	retStr, ok := ret.(string)
+	if !ok {
+		return nil, &RpcError{Code: E_INTERNAL, Message: "Method did not return a result."}
+	}
+	cr := &rpcCallResult{}
+	if err := json.Unmarshal([]byte(retStr), cr); err != nil {
+		return nil, &RpcError{Code: E_INTERNAL, Message: "Method returned malformed json."}
+	}
+	if cr.Error != nil {
+		return nil, cr.Error
+	}
+	return cr.Result, nil
+}
+
+func (ss *Session) handleJsonRpc(ctx context.Context, msg string) {
+	call := func(method string, params json.RawMessage) (json.RawMessage, *RpcError) {
+		return ss.rpcCall(ctx, method, params)
+	}
+	if resp := processRpc([]byte(msg), call); resp != nil {
+		ss.wsConn.WriteJsonMsg(resp)
+	}
+}
+
+// Send a notification to a session. Returns false if the session is not
+// using JSON-RPC, or could not keep up.
+func (ss *Session) notify(method string, params json.RawMessage) bool {
+	if ss.protocol != dapps.WS_PROTOCOL_JSONRPC || ss.State() != SESSION_OPEN {
+		return false
+	}
+	msg, err := newRpcNotification(method, params)
+	if err != nil {
+		logger.Println(err.Error())
+		return false
+	}
+	return ss.wsConn.tryWriteJsonMsg(msg)
+}
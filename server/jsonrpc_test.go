@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Methods: "echo" returns its params, "fail" returns an error, and
+// anything else is not found.
+func testRpcCaller(method string, params json.RawMessage) (json.RawMessage, *RpcError) {
+	switch method {
+	case "echo":
+		return params, nil
+	case "fail":
+		return nil, &RpcError{Code: E_BAD_PARAMS, Message: "bad"}
+	}
+	return nil, &RpcError{Code: E_NO_METHOD, Message: "Method not found"}
+}
+
+// Compares two json strings. An empty string means no response.
+func jsonEqual(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	var av, bv interface{}
+	if json.Unmarshal([]byte(a), &av) != nil || json.Unmarshal([]byte(b), &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func TestProcessRpc(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		resp string
+	}{
+		{"call", `{"jsonrpc":"2.0","method":"echo","params":[1,2],"id":1}`,
+			`{"jsonrpc":"2.0","result":[1,2],"id":1}`},
+		{"string id", `{"jsonrpc":"2.0","method":"echo","params":{"a":1},"id":"abc"}`,
+			`{"jsonrpc":"2.0","result":{"a":1},"id":"abc"}`},
+		{"no params", `{"jsonrpc":"2.0","method":"echo","id":2}`,
+			`{"jsonrpc":"2.0","result":null,"id":2}`},
+		{"error", `{"jsonrpc":"2.0","method":"fail","id":3}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"bad"},"id":3}`},
+		{"no method", `{"jsonrpc":"2.0","method":"missing","id":4}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":4}`},
+		{"notification", `{"jsonrpc":"2.0","method":"echo","params":[1]}`, ``},
+		{"failed notification", `{"jsonrpc":"2.0","method":"fail"}`, ``},
+		{"parse error", `{"jsonrpc":"2.0","method":"echo",`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error."},"id":null}`},
+		{"wrong version", `{"jsonrpc":"1.0","method":"echo","id":5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"The 'jsonrpc' field must be \"2.0\"."},"id":5}`},
+		{"method not string", `{"jsonrpc":"2.0","method":1,"params":"bar"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"The 'method' field must be a string."},"id":null}`},
+		{"params not structured", `{"jsonrpc":"2.0","method":"echo","params":"bar","id":6}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"The 'params' field must be an array or an object."},"id":6}`},
+		{"bad id", `{"jsonrpc":"2.0","method":"echo","id":{}}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Id must be a string, a number or null."},"id":null}`},
+		{"not an object", `1`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Request is not an object."},"id":null}`},
+		{"empty batch", `[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Empty batch."},"id":null}`},
+		{"invalid batch", `[1,2]`,
+			`[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Request is not an object."},"id":null},
+			  {"jsonrpc":"2.0","error":{"code":-32600,"message":"Request is not an object."},"id":null}]`},
+		{"batch", `[
+			{"jsonrpc":"2.0","method":"echo","params":[1],"id":"1"},
+			{"jsonrpc":"2.0","method":"echo","params":[2]},
+			{"foo":"boo"},
+			{"jsonrpc":"2.0","method":"fail","id":"2"}]`,
+			`[{"jsonrpc":"2.0","result":[1],"id":"1"},
+			  {"jsonrpc":"2.0","error":{"code":-32600,"message":"The 'jsonrpc' field must be \"2.0\"."},"id":null},
+			  {"jsonrpc":"2.0","error":{"code":-32602,"message":"bad"},"id":"2"}]`},
+		{"notification batch", `[{"jsonrpc":"2.0","method":"echo"},{"jsonrpc":"2.0","method":"echo"}]`, ``},
+	}
+	for _, test := range tests {
+		resp := string(processRpc([]byte(test.req), testRpcCaller))
+		if !jsonEqual(resp, test.resp) {
+			t.Errorf("%s:\nExpected: %s\nGot: %s\n", test.name, test.resp, resp)
+		}
+	}
+}
+
+func TestRpcNotification(t *testing.T) {
+	tests := []struct {
+		params string
+		msg    string
+	}{
+		{``, `{"jsonrpc":"2.0","method":"m"}`},
+		{`[1]`, `{"jsonrpc":"2.0","method":"m","params":[1]}`},
+		{`{"a":1}`, `{"jsonrpc":"2.0","method":"m","params":{"a":1}}`},
+		// Not structured, so it's wrapped.
+		{`"str"`, `{"jsonrpc":"2.0","method":"m","params":["str"]}`},
+	}
+	for _, test := range tests {
+		msg, err := newRpcNotification("m", json.RawMessage(test.params))
+		if err != nil {
+			t.Errorf("%s: %s\n", test.params, err.Error())
+		} else if !jsonEqual(string(msg), test.msg) {
+			t.Errorf("Expected: %s, Got: %s\n", test.msg, string(msg))
+		}
+	}
+	if _, err := newRpcNotification("m", json.RawMessage("{bad")); err == nil {
+		t.Error("No error for invalid params.")
+	}
+}
+
+func TestWsJsonRpc(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}}
+	rt.rpcMethods = map[string]func(string) string{
+		"hello": func(params string) string { return `{"result":"hello"}` },
+	}
+	rm := newFakeRuntimeManager(rt, &fakeRuntime{id: "esrpc", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	if err := was.SetWsProtocol("test", "bogus"); err == nil {
+		t.Error("No error for unknown protocol.")
+	}
+	if err := was.SetWsProtocol("test", dapps.WS_PROTOCOL_JSONRPC); err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	other, _, err := dialWs(srv, "esrpc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+	waitForSessions(t, was, 2)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc":"2.0","method":"hello","id":1},{"jsonrpc":"2.0","method":"nope","id":2}]`))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := `[{"jsonrpc":"2.0","result":"hello","id":1},{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":2}]`
+	if !jsonEqual(string(msg), want) {
+		t.Errorf("Expected: %s, Got: %s\n", want, string(msg))
+	}
+
+	// Notifications only go to JSON-RPC sessions of the same dapp.
+	if num := was.BroadcastNotification("test", "tick", json.RawMessage(`[1]`)); num != 1 {
+		t.Errorf("Wrong number of receivers. Expected: 1, Got: %d\n", num)
+	}
+	if num := was.BroadcastNotification("esrpc", "tick", json.RawMessage(`[1]`)); num != 0 {
+		t.Errorf("Notification was sent to an ESRPC session.")
+	}
+	id := was.sessions.forDapp("test")[0].SessionId()
+	if was.Notify("esrpc", id, "tick", nil) {
+		t.Error("Notification was sent to a session of another dapp.")
+	}
+	if !was.Notify("test", id, "tock", nil) {
+		t.Error("Notification was not sent.")
+	}
+	for _, want := range []string{`{"jsonrpc":"2.0","method":"tick","params":[1]}`, `{"jsonrpc":"2.0","method":"tock"}`} {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !jsonEqual(string(msg), want) {
+			t.Errorf("Expected: %s, Got: %s\n", want, string(msg))
+		}
+	}
+}
+
+// Messages are traced as children of the traceparent of the handshake.
+func TestWsJsonRpcTracing(t *testing.T) {
+	if err := tracing.Configure(&tracing.Config{File: "traces.json", SampleRate: 1}, t.TempDir()); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer tracing.Shutdown()
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}, callSpans: make(chan *tracing.Span, 1)}
+	rt.rpcMethods = map[string]func(string) string{
+		"hello": func(params string) string { return `{"result":"hello"}` },
+	}
+	was := NewWsAPIServer(newFakeRuntimeManager(rt), nil, 10, 0, nil)
+	was.SetWsProtocol("test", dapps.WS_PROTOCOL_JSONRPC)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + WS_BASE + "test"
+	conn, _, err := websocket.DefaultDialer.Dial(u, http.Header{"Traceparent": {traceparent}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"hello","id":1}`))
+	span := <-rt.callSpans
+	if span == nil || span.Name() != "rpc hello" {
+		t.Fatalf("The method was not called in its span: %v\n", span)
+	}
+	if id := span.Context().TraceId.String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Wrong trace: %s\n", id)
+	}
+}
@@ -0,0 +1,144 @@
+// This file contains the metrics of the web server, and the /metrics
+// endpoint. Requests to the dapp http and web file routes are counted and
+// timed as they happen. Websocket sessions, throttled requests and module
+// states are read when the metrics are scraped.
+//
+// The endpoint needs an admin token (read scope), like the admin api.
+package server
+
+import (
+	"bufio"
+	"github.com/eris-ltd/decerver/metrics"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const METRICS_PATH = "/metrics"
+
+var (
+	httpRequests = metrics.NewCounterVec("decerver_http_requests_total",
+		"Requests to the http and web file routes of dapps, by dapp, route and status code.", "dapp", "route", "code")
+	httpDuration = metrics.NewHistogramVec("decerver_http_request_duration_seconds",
+		"Time taken to answer requests to the http and web file routes of dapps.", nil, "dapp", "route")
+)
+
+// Route names, used as the 'route' label.
+const (
+	ROUTE_HTTP   = "http"
+	ROUTE_STATIC = "static"
+)
+
+// Count and time the requests to a route. It must come before any
+// middleware that may answer the request, so that those responses are
+// counted as well.
+func metered(route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sr := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(sr, r)
+			if sr.status == 0 {
+				sr.status = 200
+			}
+			dappId := dappIdOf(r)
+			httpRequests.With(dappId, route, strconv.Itoa(sr.status)).Inc()
+			httpDuration.With(dappId, route).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// Remembers the status code of a response. Flushing and hijacking are
+// passed through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = 200
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sr.ResponseWriter).Hijack()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Forget the request metrics of a dapp.
+func deleteDappMetrics(dappId string) {
+	httpRequests.DeleteMatching("dapp", dappId)
+	httpDuration.DeleteMatching("dapp", dappId)
+}
+
+// The metrics that are read from the server when they are scraped.
+func (ws *WebServer) newMetricsRegistry() *metrics.Registry {
+	reg := metrics.NewRegistry()
+	reg.NewCollector("decerver_ws_sessions", "Open websocket sessions, by dapp.", metrics.GAUGE, func() []*metrics.Sample {
+		counts := make(map[string]int)
+		for _, ss := range ws.was.sessions.all() {
+			counts[ss.caller]++
+		}
+		samples := make([]*metrics.Sample, 0, len(counts))
+		for dappId, num := range counts {
+			samples = append(samples, &metrics.Sample{LabelValues: []string{dappId}, Value: float64(num)})
+		}
+		return sortSamples(samples)
+	}, "dapp")
+	reg.NewCollector("decerver_throttled_total", "Requests and websocket messages refused by the rate limits, by dapp.", metrics.COUNTER, func() []*metrics.Sample {
+		samples := make([]*metrics.Sample, 0)
+		ws.was.limits.throttled.Range(func(key, _ interface{}) bool {
+			dappId := key.(string)
+			stats := ws.was.limits.stats(dappId)
+			samples = append(samples, &metrics.Sample{LabelValues: []string{dappId, "http"}, Value: float64(stats.HttpRequests)},
+				&metrics.Sample{LabelValues: []string{dappId, "ws"}, Value: float64(stats.WsMessages)})
+			return true
+		})
+		return sortSamples(samples)
+	}, "dapp", "kind")
+	reg.NewCollector("decerver_module_state", "The state of each module (1 for the current state).", metrics.GAUGE, func() []*metrics.Sample {
+		samples := make([]*metrics.Sample, 0)
+		mm := ws.dc.ModuleManager()
+		if mm == nil {
+			return samples
+		}
+		for _, status := range mm.Status() {
+			samples = append(samples, &metrics.Sample{LabelValues: []string{status.Name, status.State}, Value: 1})
+		}
+		return sortSamples(samples)
+	}, "module", "state")
+	return reg
+}
+
+func sortSamples(samples []*metrics.Sample) []*metrics.Sample {
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].LabelValues, samples[j].LabelValues
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return samples
+}
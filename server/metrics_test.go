@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/modules"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMeteredRoutes(t *testing.T) {
+	router := NewRouter(http.NotFoundHandler())
+	g := NewRouteGroup("metered")
+	g.HandlePrefix(HTTP_BASE+"metered", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			http.Error(w, "Failed", 500)
+			return
+		}
+		// Flushing must still work through the recorder.
+		w.Write([]byte("ok"))
+		w.(http.Flusher).Flush()
+	}, metered(ROUTE_HTTP), allowMethods("GET"))
+	g.HandlePrefix("/metered", func(w http.ResponseWriter, r *http.Request) {}, metered(ROUTE_STATIC))
+	router.Add(g)
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/http/metered/a"},
+		{"GET", "/http/metered/b"},
+		{"GET", "/http/metered/a?fail=1"},
+		// Answered by middleware that comes after.
+		{"POST", "/http/metered/a"},
+		{"GET", "/metered/index.html"},
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+	defer deleteDappMetrics("metered")
+
+	tests := []struct {
+		route string
+		code  string
+		num   float64
+	}{
+		{ROUTE_HTTP, "200", 2},
+		{ROUTE_HTTP, "500", 1},
+		{ROUTE_HTTP, "405", 1},
+		{ROUTE_STATIC, "200", 1},
+	}
+	for _, test := range tests {
+		if num := httpRequests.With("metered", test.route, test.code).Value(); num != test.num {
+			t.Errorf("%s %s: Wrong count. Expected: %v, Got: %v\n", test.route, test.code, test.num, num)
+		}
+	}
+	if num := httpDuration.With("metered", ROUTE_HTTP).Count(); num != 4 {
+		t.Errorf("Wrong number of timed requests: %d\n", num)
+	}
+
+	deleteDappMetrics("metered")
+	if num := httpRequests.With("metered", ROUTE_HTTP, "200").Value(); num != 0 {
+		t.Error("Metrics of the dapp were not deleted.")
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}}
+	was := NewWsAPIServer(newFakeRuntimeManager(rt), nil, 10, 0, nil)
+	was.SetRateLimits("test", &dapps.RateLimits{HttpRate: 0.01, HttpBurst: 1})
+	was.limits.allow("test", rateHttp, "1.1.1.1")
+	was.limits.allow("test", rateHttp, "1.1.1.1")
+	srv := newWsTestServer(was)
+	defer srv.Close()
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	waitForSessions(t, was, 1)
+
+	ws := &WebServer{was: was}
+	ws.dc = &fakeDecerver{mm: &fakeModuleManager{status: []*modules.ModuleStatus{
+		{Name: "ipfs", State: modules.MODULE_RUNNING},
+		{Name: "monk", State: modules.MODULE_FAILED},
+	}}}
+	buf := &bytes.Buffer{}
+	ws.newMetricsRegistry().WriteText(buf)
+	for _, line := range []string{
+		`decerver_ws_sessions{dapp="test"} 1`,
+		`decerver_throttled_total{dapp="test",kind="http"} 1`,
+		`decerver_throttled_total{dapp="test",kind="ws"} 0`,
+		`decerver_module_state{module="ipfs",state="running"} 1`,
+		`decerver_module_state{module="monk",state="failed"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Missing: %s\n", line)
+		}
+	}
+}
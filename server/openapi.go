@@ -0,0 +1,241 @@
+// This file generates the OpenAPI (3.0) document of the v2 admin api from
+// its route table. Schemas are made from the Go types of the request and
+// response data, using their json tags.
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+
+// The version of the api itself.
+const API_V2_VERSION = "2.0.0"
+
+type jsonObject map[string]interface{}
+
+type openApiBuilder struct {
+	// Named struct types are put in the components, by name.
+	schemas map[string]jsonObject
+	types   map[string]reflect.Type
+}
+
+func openApiSpec(routes []*apiRoute) []byte {
+	b := &openApiBuilder{make(map[string]jsonObject), make(map[string]reflect.Type)}
+	paths := make(jsonObject)
+	for _, route := range routes {
+		p := API_V2_BASE + route.path
+		item, ok := paths[p].(jsonObject)
+		if !ok {
+			item = make(jsonObject)
+			paths[p] = item
+		}
+		item[strings.ToLower(route.method)] = b.operation(route)
+	}
+	paths[API_V2_BASE+"/openapi.json"] = jsonObject{
+		"get": jsonObject{
+			"summary":     "Get this document.",
+			"operationId": "getOpenApi",
+			"responses": jsonObject{
+				"200": jsonObject{"description": "The OpenAPI document.", "content": jsonObject{"application/json": jsonObject{"schema": jsonObject{"type": "object"}}}},
+			},
+		},
+	}
+
+	b.schemas["ApiMeta"] = b.structSchema(reflect.TypeOf(ApiMeta{}))
+	b.schemas["ApiError"] = b.structSchema(reflect.TypeOf(ApiErrorResponse{}))
+	components := jsonObject{
+		"schemas": b.schemas,
+		"responses": jsonObject{
+			"Error": jsonObject{
+				"description": "An error.",
+				"content":     jsonObject{"application/json": jsonObject{"schema": ref("ApiError")}},
+			},
+		},
+		"securitySchemes": jsonObject{
+			"bearer": jsonObject{"type": "http", "scheme": "bearer", "description": "A read-only or read-write admin token."},
+			"session": jsonObject{"type": "apiKey", "in": "cookie", "name": ADMIN_SESSION_COOKIE,
+				"description": "A session from /admin/login. Requests that change anything must also have the " + ADMIN_CSRF_HEADER + " header."},
+		},
+	}
+	spec := jsonObject{
+		"openapi": OPENAPI_VERSION,
+		"info": jsonObject{
+			"title":   "decerver admin api",
+			"version": API_V2_VERSION,
+		},
+		"paths":      paths,
+		"components": components,
+		"security":   []jsonObject{{"bearer": []string{}}, {"session": []string{}}},
+	}
+	bts, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		panic("Failed to generate the api document: " + err.Error())
+	}
+	return bts
+}
+
+func (b *openApiBuilder) operation(route *apiRoute) jsonObject {
+	scope := SCOPE_READ
+	if !safeMethod(route.method) {
+		scope = SCOPE_WRITE
+	}
+	op := jsonObject{
+		"summary":     route.summary,
+		"description": "Requires the " + scope + " scope.",
+		"operationId": operationId(route),
+	}
+	params := make([]jsonObject, 0)
+	for _, seg := range route.segments {
+		if strings.HasPrefix(seg, "{") {
+			params = append(params, jsonObject{"name": seg[1 : len(seg)-1], "in": "path", "required": true, "schema": jsonObject{"type": "string"}})
+		}
+	}
+	if route.list {
+		params = append(params,
+			jsonObject{"name": "offset", "in": "query", "schema": jsonObject{"type": "integer", "minimum": 0, "default": 0}},
+			jsonObject{"name": "limit", "in": "query", "schema": jsonObject{"type": "integer", "minimum": 1, "maximum": API_MAX_LIMIT, "default": API_DEFAULT_LIMIT}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if route.request != nil {
+		op["requestBody"] = jsonObject{
+			"required": true,
+			"content":  jsonObject{"application/json": jsonObject{"schema": b.schema(reflect.TypeOf(route.request))}},
+		}
+	}
+	data := jsonObject{}
+	if route.response != nil {
+		data = b.schema(reflect.TypeOf(route.response))
+	}
+	envelope := jsonObject{"type": "object", "properties": jsonObject{"data": data}, "required": []string{"data"}}
+	if route.list {
+		envelope["properties"].(jsonObject)["meta"] = ref("ApiMeta")
+	}
+	op["responses"] = jsonObject{
+		"200":     jsonObject{"description": "OK", "content": jsonObject{"application/json": jsonObject{"schema": envelope}}},
+		"default": jsonObject{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+// E.g. "GET /dapps/{id}/permissions" becomes "getDappsPermissions". Lists
+// are "list" instead of "get", so that "GET /dapps" is not "GET /dapps/{id}".
+func operationId(route *apiRoute) string {
+	id := strings.ToLower(route.method)
+	if route.list {
+		id = "list"
+	}
+	for _, seg := range route.segments {
+		if strings.HasPrefix(seg, "{") {
+			continue
+		}
+		id += strings.ToUpper(seg[:1]) + seg[1:]
+	}
+	return id
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (b *openApiBuilder) schema(t reflect.Type) jsonObject {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		// Any json value.
+		return jsonObject{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return jsonObject{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return jsonObject{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "format": "byte"}
+		}
+		return jsonObject{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := b.schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			// Set it first, in case the type refers to itself.
+			b.schemas[name] = jsonObject{}
+			b.schemas[name] = b.structSchema(t)
+		}
+		return ref(name)
+	}
+	// Interfaces can be anything.
+	return jsonObject{}
+}
+
+// Types with the same name in different packages are told apart by the
+// package name.
+func (b *openApiBuilder) schemaName(t reflect.Type) string {
+	name := t.Name()
+	if other, ok := b.types[name]; ok && other != t {
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	b.types[name] = t
+	return name
+}
+
+func (b *openApiBuilder) structSchema(t reflect.Type) jsonObject {
+	props := make(jsonObject)
+	b.addFields(t, props)
+	return jsonObject{"type": "object", "properties": props}
+}
+
+func (b *openApiBuilder) addFields(t reflect.Type, props jsonObject) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(ft, props)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+	}
+}
+
+func ref(name string) jsonObject {
+	return jsonObject{"$ref": "#/components/schemas/" + name}
+}
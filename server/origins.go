@@ -0,0 +1,280 @@
+// This file contains the origin policies of dapps. Browsers send an Origin
+// header with cross-origin requests (and websocket handshakes), and those
+// are only accepted from origins that the dapp has allowed in its package
+// file. Pages served by the decerver itself are always allowed.
+//
+// A page on another site can reach the decerver under the name of that
+// site through DNS rebinding, which would make it the same origin. To stop
+// that, requests are only accepted for the names of the decerver.
+package server
+
+import (
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The methods that cross-origin requests may use.
+const corsAllowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+
+// How long browsers may cache preflight responses (in seconds), if the
+// dapp does not say.
+const defaultCorsMaxAge = 600
+
+// Request headers that are always allowed.
+var corsSimpleHeaders = map[string]bool{
+	"accept":           true,
+	"accept-language":  true,
+	"content-language": true,
+	"content-type":     true,
+}
+
+type originPolicies struct {
+	mutex    *sync.Mutex
+	policies map[string]*dapps.OriginPolicy
+}
+
+func newOriginPolicies() *originPolicies {
+	op := &originPolicies{}
+	op.mutex = &sync.Mutex{}
+	op.policies = make(map[string]*dapps.OriginPolicy)
+	return op
+}
+
+// Set the policy of a dapp. nil means same-origin only.
+func (op *originPolicies) set(dappId string, policy *dapps.OriginPolicy) error {
+	if policy != nil {
+		if err := validateOriginPolicy(policy); err != nil {
+			return err
+		}
+	}
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if policy == nil {
+		delete(op.policies, dappId)
+	} else {
+		op.policies[dappId] = policy
+	}
+	return nil
+}
+
+func (op *originPolicies) get(dappId string) *dapps.OriginPolicy {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	return op.policies[dappId]
+}
+
+// Check the origin of a request. Requests without an Origin header are not
+// from browser pages on other sites.
+func (op *originPolicies) allowed(dappId string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || isSameOrigin(r, origin) || originAllowed(op.get(dappId), origin)
+}
+
+// Check the origin of a http request, and add the CORS headers. Preflight
+// requests are answered here. Returns true if the response has been written.
+func (op *originPolicies) handleCors(dappId string, w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || isSameOrigin(r, origin) {
+		return false
+	}
+	policy := op.get(dappId)
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !originAllowed(policy, origin) {
+		writeForbidden(w, "Origin not allowed.")
+		return true
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if policy.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != "OPTIONS" || method == "" {
+		return false
+	}
+	if !strings.Contains(", "+corsAllowedMethods+", ", ", "+method+", ") {
+		writeForbidden(w, "Method not allowed: "+method)
+		return true
+	}
+	reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+	for _, header := range strings.Split(reqHeaders, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !corsSimpleHeaders[header] && !containsFold(policy.Headers, header) {
+			writeForbidden(w, "Header not allowed: "+header)
+			return true
+		}
+	}
+	h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	if reqHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	maxAge := policy.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultCorsMaxAge
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	w.WriteHeader(204)
+	return true
+}
+
+// Check the origin of requests that are routed to a dapp (see handleCors).
+func (op *originPolicies) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if op.handleCors(dappIdOf(r), w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validateOriginPolicy(policy *dapps.OriginPolicy) error {
+	for _, origin := range policy.Allowed {
+		if origin == "*" {
+			if policy.Credentials {
+				return fmt.Errorf("Credentials can not be allowed for all origins ('*').")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil ||
+			strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("Invalid origin: '%s'. Origins must be like 'https://example.com' or 'https://*.example.com'.", origin)
+		}
+	}
+	for _, header := range policy.Headers {
+		if header == "" || strings.ContainsAny(header, " ,:\r\n") {
+			return fmt.Errorf("Invalid header name: '%s'", header)
+		}
+	}
+	if policy.MaxAge < 0 {
+		return fmt.Errorf("Max age can not be negative.")
+	}
+	return nil
+}
+
+// Check if a policy allows an origin. A nil policy allows none.
+func originAllowed(policy *dapps.OriginPolicy, origin string) bool {
+	if policy == nil {
+		return false
+	}
+	u, err := url.Parse(origin)
+	// Opaque origins ("null") are never allowed.
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, allowed := range policy.Allowed {
+		if allowed == "*" {
+			return true
+		}
+		au, err := url.Parse(allowed)
+		if err != nil || au.Scheme != u.Scheme {
+			continue
+		}
+		if strings.HasPrefix(au.Host, "*.") {
+			suffix := strings.ToLower(au.Host[1:])
+			host := strings.ToLower(u.Host)
+			if len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if strings.EqualFold(au.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if an origin is the decerver itself. The Host header has been
+// checked against the names of the decerver (see knownHosts).
+func isSameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme, port := "http", "80"
+	if r.TLS != nil {
+		scheme, port = "https", "443"
+	}
+	return u.Scheme == scheme && normalizeHost(u.Host, port) == normalizeHost(r.Host, port)
+}
+
+// The names (host:port) that the decerver is reached by.
+type knownHosts struct {
+	hosts map[string]bool
+}
+
+// The names are the hostname from the config, and the extra server names.
+// If the decerver listens on a loopback or unspecified address, it is
+// reached through 'localhost' and the loopback addresses. Names without a
+// port gets the port of the decerver.
+func newKnownHosts(hostname string, port int, names []string) *knownHosts {
+	kh := &knownHosts{}
+	kh.hosts = make(map[string]bool)
+	portStr := strconv.Itoa(port)
+	ip := net.ParseIP(strings.Trim(hostname, "[]"))
+	if hostname == "" || hostname == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+		for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+			kh.hosts[normalizeHost(h, portStr)] = true
+		}
+	}
+	if ip == nil || !ip.IsUnspecified() {
+		kh.hosts[normalizeHost(hostname, portStr)] = true
+	}
+	for _, name := range names {
+		kh.hosts[normalizeHost(name, portStr)] = true
+	}
+	return kh
+}
+
+// Check the Host header of a request.
+func (kh *knownHosts) known(r *http.Request) bool {
+	port := "80"
+	if r.TLS != nil {
+		port = "443"
+	}
+	return kh.hosts[normalizeHost(r.Host, port)]
+}
+
+// Refuse requests for other hosts (with a 421).
+func (kh *knownHosts) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !kh.known(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(421)
+			fmt.Fprint(w, "Unknown host: "+r.Host)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lower case host:port. The default port is added if there is none.
+func normalizeHost(host, defaultPort string) string {
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		h, p = strings.Trim(host, "[]"), defaultPort
+	}
+	return strings.ToLower(net.JoinHostPort(h, p))
+}
+
+func containsFold(list []string, s string) bool {
+	for _, str := range list {
+		if strings.EqualFold(str, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeForbidden(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(403)
+	fmt.Fprint(w, msg)
+}
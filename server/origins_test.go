@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	policy := &dapps.OriginPolicy{Allowed: []string{"https://example.com", "http://localhost:8080", "https://*.example.org"}}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://a.example.org", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		if originAllowed(policy, test.origin) != test.allowed {
+			t.Errorf("%s: Expected allowed to be %v\n", test.origin, test.allowed)
+		}
+	}
+	if originAllowed(nil, "https://example.com") {
+		t.Error("A nil policy allowed an origin.")
+	}
+	if !originAllowed(&dapps.OriginPolicy{Allowed: []string{"*"}}, "https://anything.com") {
+		t.Error("'*' did not allow an origin.")
+	}
+	if originAllowed(&dapps.OriginPolicy{Allowed: []string{"*"}}, "null") {
+		t.Error("'*' allowed the null origin.")
+	}
+}
+
+func TestValidateOriginPolicy(t *testing.T) {
+	tests := []struct {
+		policy *dapps.OriginPolicy
+		valid  bool
+	}{
+		{&dapps.OriginPolicy{Allowed: []string{"https://example.com", "https://*.example.com", "*"}}, true},
+		{&dapps.OriginPolicy{Allowed: []string{"https://example.com"}, Credentials: true}, true},
+		{&dapps.OriginPolicy{Allowed: []string{"*"}, Credentials: true}, false},
+		{&dapps.OriginPolicy{Allowed: []string{"example.com"}}, false},
+		{&dapps.OriginPolicy{Allowed: []string{"ftp://example.com"}}, false},
+		{&dapps.OriginPolicy{Allowed: []string{"https://example.com/path"}}, false},
+		{&dapps.OriginPolicy{Allowed: []string{"https://a.*.example.com"}}, false},
+		{&dapps.OriginPolicy{Headers: []string{"X-Good"}}, true},
+		{&dapps.OriginPolicy{Headers: []string{"X-Bad, X-Worse"}}, false},
+		{&dapps.OriginPolicy{MaxAge: -1}, false},
+	}
+	for i, test := range tests {
+		err := validateOriginPolicy(test.policy)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: Expected valid to be %v, got error: %v\n", i, test.valid, err)
+		}
+	}
+}
+
+func TestHttpCors(t *testing.T) {
+	origins := newOriginPolicies()
+	err := origins.set("test", &dapps.OriginPolicy{
+		Allowed: []string{"https://good.com"},
+		Headers: []string{"X-Custom"},
+		MaxAge:  60,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := newHttpTestRouter(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}}, origins)
+	defer srv.Close()
+
+	tests := []struct {
+		method      string
+		headers     map[string]string
+		status      int
+		allowOrigin string
+	}{
+		{"GET", nil, 200, ""},
+		{"GET", map[string]string{"Origin": srv.URL}, 200, ""},
+		// The scheme is part of the origin.
+		{"GET", map[string]string{"Origin": "https" + strings.TrimPrefix(srv.URL, "http")}, 403, ""},
+		{"GET", map[string]string{"Origin": "https://evil.com"}, 403, ""},
+		{"POST", map[string]string{"Origin": "https://evil.com"}, 403, ""},
+		{"GET", map[string]string{"Origin": "https://good.com"}, 200, "https://good.com"},
+		// Preflight requests.
+		{"OPTIONS", map[string]string{"Origin": "https://good.com", "Access-Control-Request-Method": "PUT"}, 204, "https://good.com"},
+		{"OPTIONS", map[string]string{"Origin": "https://good.com", "Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "content-type, x-custom"}, 204, "https://good.com"},
+		{"OPTIONS", map[string]string{"Origin": "https://good.com", "Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "x-other"}, 403, "https://good.com"},
+		{"OPTIONS", map[string]string{"Origin": "https://good.com", "Access-Control-Request-Method": "CONNECT"}, 403, "https://good.com"},
+		{"OPTIONS", map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "PUT"}, 403, ""},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, srv.URL+HTTP_BASE+"test/path", nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%d: Wrong status. Expected: %d, Got: %d\n", i, test.status, resp.StatusCode)
+		}
+		if ao := resp.Header.Get("Access-Control-Allow-Origin"); ao != test.allowOrigin {
+			t.Errorf("%d: Wrong Access-Control-Allow-Origin. Expected: '%s', Got: '%s'\n", i, test.allowOrigin, ao)
+		}
+		if resp.StatusCode == 204 && resp.Header.Get("Access-Control-Max-Age") != "60" {
+			t.Errorf("%d: Wrong Access-Control-Max-Age: %s\n", i, resp.Header.Get("Access-Control-Max-Age"))
+		}
+	}
+}
+
+func TestWsOrigin(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + WS_BASE + "test"
+
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("Origin", origin)
+		return websocket.DefaultDialer.Dial(u, header)
+	}
+
+	_, resp, err := dial("https://evil.com")
+	if err == nil || resp == nil || resp.StatusCode != 403 {
+		t.Errorf("Connection from another origin was not refused: %v\n", err)
+	}
+	if err := was.SetOriginPolicy("test", &dapps.OriginPolicy{Allowed: []string{"https://good.com"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, origin := range []string{srv.URL, "https://good.com"} {
+		conn, _, err := dial(origin)
+		if err != nil {
+			t.Errorf("%s: %s\n", origin, err.Error())
+			continue
+		}
+		conn.Close()
+	}
+	if _, _, err := dial("https://evil.com"); err == nil {
+		t.Error("Connection from another origin was accepted.")
+	}
+	if err := was.SetOriginPolicy("test", &dapps.OriginPolicy{Allowed: []string{"*"}, Credentials: true}); err == nil {
+		t.Error("Invalid policy was accepted.")
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	tests := []struct {
+		hostname string
+		names    []string
+		host     string
+		tls      bool
+		known    bool
+	}{
+		{"localhost", nil, "localhost:3000", false, true},
+		{"localhost", nil, "LOCALHOST:3000", false, true},
+		{"localhost", nil, "127.0.0.1:3000", false, true},
+		{"localhost", nil, "[::1]:3000", false, true},
+		{"localhost", nil, "localhost:3001", false, false},
+		{"localhost", nil, "localhost", false, false},
+		// A rebound name of another site.
+		{"localhost", nil, "evil.test:3000", false, false},
+		{"0.0.0.0", nil, "localhost:3000", false, true},
+		{"0.0.0.0", nil, "0.0.0.0:3000", false, false},
+		{"0.0.0.0", []string{"mybox.lan"}, "mybox.lan:3000", false, true},
+		{"decerver.example.com", nil, "decerver.example.com:3000", false, true},
+		{"decerver.example.com", nil, "localhost:3000", false, false},
+		{"decerver.example.com", []string{"proxy.example.com:443"}, "proxy.example.com", true, true},
+		{"decerver.example.com", []string{"proxy.example.com:443"}, "proxy.example.com", false, false},
+	}
+	for i, test := range tests {
+		kh := newKnownHosts(test.hostname, 3000, test.names)
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if kh.known(r) != test.known {
+			t.Errorf("%d: %s (%s): Expected known: %v\n", i, test.host, test.hostname, test.known)
+		}
+	}
+
+	// Requests for other hosts are refused, which keeps pages that reach
+	// the decerver through DNS rebinding out, since they can only send
+	// their own name.
+	handler := newKnownHosts("localhost", 3000, nil).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	for host, status := range map[string]int{"localhost:3000": 200, "evil.test:3000": 421} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/http/test/", nil)
+		r.Host = host
+		r.Header.Set("Origin", "http://"+host)
+		handler.ServeHTTP(rec, r)
+		if rec.Code != status {
+			t.Errorf("%s: Expected: %d, Got: %d\n", host, status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// This file contains the rate limits of dapps. Each client (ip address) of
+// a dapp gets a token bucket for http requests, and one for websocket
+// messages. A request takes a token, and the tokens are refilled at the
+// rate of the dapp, up to the burst. Requests that find the bucket empty
+// are refused (http gets a 429), so that a single client can not keep the
+// runtime of a dapp busy.
+//
+// Web files are not rate limited, since they are not served by the runtime.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Error code for websocket messages that were refused. It is in the range
+// that JSON-RPC 2.0 reserves for server errors.
+const E_RATE_LIMITED = -32029
+
+// How often buckets that are full (and so are the same as no bucket) are
+// removed.
+const rateLimitSweepPeriod = time.Minute
+
+// The kinds of buckets.
+const (
+	rateHttp = iota
+	rateWs
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	dappId string
+	kind   int
+	client string
+}
+
+// The rates and bursts of a dapp, by kind.
+type dappRates struct {
+	rate  [2]float64
+	burst [2]float64
+}
+
+type rateLimiter struct {
+	// Guards rates, buckets and lastSweep.
+	mutex     *sync.Mutex
+	rates     map[string]*dappRates
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+	// The number of refused requests and messages, by dapp. Counted
+	// atomically.
+	throttled *sync.Map
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	rl := &rateLimiter{}
+	rl.mutex = &sync.Mutex{}
+	rl.rates = make(map[string]*dappRates)
+	rl.buckets = make(map[bucketKey]*tokenBucket)
+	rl.throttled = &sync.Map{}
+	rl.now = time.Now
+	rl.lastSweep = rl.now()
+	return rl
+}
+
+func validateRateLimits(limits *dapps.RateLimits) error {
+	if limits.HttpRate < 0 || limits.HttpBurst < 0 || limits.WsMessageRate < 0 || limits.WsMessageBurst < 0 {
+		return fmt.Errorf("Rate limits can not be negative.")
+	}
+	return nil
+}
+
+// Set the limits of a dapp. nil means no limits. The buckets of its
+// clients are reset.
+func (rl *rateLimiter) set(dappId string, limits *dapps.RateLimits) error {
+	var rates *dappRates
+	if limits != nil {
+		if err := validateRateLimits(limits); err != nil {
+			return err
+		}
+		rates = &dappRates{}
+		rates.rate[rateHttp], rates.burst[rateHttp] = limits.HttpRate, burstOf(limits.HttpRate, limits.HttpBurst)
+		rates.rate[rateWs], rates.burst[rateWs] = limits.WsMessageRate, burstOf(limits.WsMessageRate, limits.WsMessageBurst)
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rates == nil || (rates.rate[rateHttp] == 0 && rates.rate[rateWs] == 0) {
+		delete(rl.rates, dappId)
+	} else {
+		rl.rates[dappId] = rates
+	}
+	for key := range rl.buckets {
+		if key.dappId == dappId {
+			delete(rl.buckets, key)
+		}
+	}
+	return nil
+}
+
+func burstOf(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// Take a token from the bucket of a client. If there is none, it returns
+// false and how long it takes until there is.
+func (rl *rateLimiter) allow(dappId string, kind int, client string) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rates, ok := rl.rates[dappId]
+	if !ok || rates.rate[kind] == 0 {
+		return true, 0
+	}
+	rate, burst := rates.rate[kind], rates.burst[kind]
+	now := rl.now()
+	if now.Sub(rl.lastSweep) > rateLimitSweepPeriod {
+		rl.sweep(now)
+	}
+
+	key := bucketKey{dappId, kind, client}
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{burst, now}
+		rl.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+		bucket.last = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	rl.count(dappId, kind)
+	wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// Remove the buckets that would be full by now. Not thread safe.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range rl.buckets {
+		rates, ok := rl.rates[key.dappId]
+		if !ok || bucket.tokens+now.Sub(bucket.last).Seconds()*rates.rate[key.kind] >= rates.burst[key.kind] {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+func (rl *rateLimiter) count(dappId string, kind int) {
+	counts, _ := rl.throttled.LoadOrStore(dappId, &[2]uint64{})
+	atomic.AddUint64(&counts.(*[2]uint64)[kind], 1)
+}
+
+// The number of requests and messages to a dapp that has been refused.
+func (rl *rateLimiter) stats(dappId string) *dapps.ThrottleStats {
+	stats := &dapps.ThrottleStats{}
+	if counts, ok := rl.throttled.Load(dappId); ok {
+		stats.HttpRequests = atomic.LoadUint64(&counts.(*[2]uint64)[rateHttp])
+		stats.WsMessages = atomic.LoadUint64(&counts.(*[2]uint64)[rateWs])
+	}
+	return stats
+}
+
+// Rate limit the http requests to a dapp. Refused requests get a 429.
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := rl.allow(dappIdOf(r), rateHttp, remoteIp(r.RemoteAddr))
+		if !ok {
+			writeTooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	w.WriteHeader(429)
+	fmt.Fprint(w, "Too many requests")
+}
+
+// Check the rate limit of the client before a message is handled. If it is
+// reached, the client gets an error response instead (in the protocol of
+// the session), and the message is dropped.
+func (ss *Session) allowMessage(msg []byte) bool {
+	ok, wait := ss.server.limits.allow(ss.caller, rateWs, remoteIp(ss.remoteAddr))
+	if ok {
+		return true
+	}
+	data, _ := json.Marshal(map[string]int{"retry_after": retryAfterSeconds(wait)})
+	rpcErr := &RpcError{Code: E_RATE_LIMITED, Message: "Too many messages.", Data: data}
+	if ss.protocol == dapps.WS_PROTOCOL_JSONRPC {
+		// Requests get the error, notifications nothing.
+		resp := processRpc(msg, func(string, json.RawMessage) (json.RawMessage, *RpcError) {
+			return nil, rpcErr
+		})
+		if resp != nil {
+			ss.wsConn.WriteJsonMsg(resp)
+		}
+		return false
+	}
+	ss.wsConn.WriteJsonMsg(esrpcError(msg, rpcErr))
+	return false
+}
+
+// An ESRPC error response to a message. The id and method are copied from
+// the message if it can be parsed.
+func esrpcError(msg []byte, rpcErr *RpcError) []byte {
+	req := &struct {
+		Method string
+		Id     json.RawMessage
+	}{}
+	json.Unmarshal(msg, req)
+	return esrpcMessage(req.Method, req.Id, nil, rpcErr)
+}
+
+// An ESRPC message from the server. A missing id or result is an empty
+// string, as in the responses that dapps create.
+func esrpcMessage(method string, id, result json.RawMessage, rpcErr *RpcError) []byte {
+	if len(id) == 0 {
+		id = json.RawMessage(`""`)
+	}
+	if len(result) == 0 {
+		result = json.RawMessage(`""`)
+	}
+	var errObj *esrpcErrorObj
+	if rpcErr != nil {
+		errObj = &esrpcErrorObj{rpcErr.Code, rpcErr.Message, rpcErr.Data}
+	}
+	resp, _ := json.Marshal(&struct {
+		Protocol string
+		Method   string
+		Result   json.RawMessage
+		Time     string
+		Id       json.RawMessage
+		Error    *esrpcErrorObj
+	}{"ESRPC", method, result, "", id, errObj})
+	return resp
+}
+
+type esrpcErrorObj struct {
+	Code    int
+	Message string
+	Data    json.RawMessage
+}
+
+// Retry-After is in whole seconds, so it is rounded up.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// The ip address of a client, without the port.
+func remoteIp(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A rate limiter with a clock that only moves when told to.
+func newTestRateLimiter() (*rateLimiter, *time.Time) {
+	rl := newRateLimiter()
+	now := time.Unix(1000, 0)
+	rl.now = func() time.Time { return now }
+	rl.lastSweep = now
+	return rl, &now
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, now := newTestRateLimiter()
+	if err := rl.set("test", &dapps.RateLimits{HttpRate: -1}); err == nil {
+		t.Error("No error for negative rate.")
+	}
+	if err := rl.set("test", &dapps.RateLimits{HttpRate: 2, HttpBurst: 3}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The burst is allowed right away, then the bucket is empty.
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("test", rateHttp, "1.1.1.1"); !ok {
+			t.Fatalf("Request %d was refused.\n", i)
+		}
+	}
+	ok, wait := rl.allow("test", rateHttp, "1.1.1.1")
+	if ok {
+		t.Fatal("Request was allowed with an empty bucket.")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Wrong wait. Expected: 500ms, Got: %s\n", wait)
+	}
+
+	// Other clients, kinds and dapps have their own buckets (websocket
+	// messages and the other dapp have no limits).
+	for _, key := range []bucketKey{{"test", rateHttp, "2.2.2.2"}, {"test", rateWs, "1.1.1.1"}, {"other", rateHttp, "1.1.1.1"}} {
+		if ok, _ := rl.allow(key.dappId, key.kind, key.client); !ok {
+			t.Errorf("%v: Request was refused.\n", key)
+		}
+	}
+
+	// Tokens are refilled at the rate.
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.allow("test", rateHttp, "1.1.1.1"); !ok {
+		t.Error("Bucket was not refilled.")
+	}
+	if ok, _ := rl.allow("test", rateHttp, "1.1.1.1"); ok {
+		t.Error("Bucket was refilled too much.")
+	}
+
+	stats := rl.stats("test")
+	if stats.HttpRequests != 2 || stats.WsMessages != 0 {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+
+	// Full buckets are swept.
+	*now = now.Add(2 * rateLimitSweepPeriod)
+	rl.allow("test", rateHttp, "3.3.3.3")
+	if len(rl.buckets) != 1 {
+		t.Errorf("Full buckets were not swept: %d\n", len(rl.buckets))
+	}
+
+	// Removing the limits lets everything through.
+	rl.set("test", nil)
+	for i := 0; i < 10; i++ {
+		if ok, _ := rl.allow("test", rateHttp, "1.1.1.1"); !ok {
+			t.Fatal("Request was refused without limits.")
+		}
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+		want  float64
+	}{
+		{0.5, 0, 1},
+		{2.5, 0, 3},
+		{10, 4, 4},
+	}
+	for _, test := range tests {
+		if got := burstOf(test.rate, test.burst); got != test.want {
+			t.Errorf("%v/%d: Expected: %v, Got: %v\n", test.rate, test.burst, test.want, got)
+		}
+	}
+}
+
+func TestHttpRateLimit(t *testing.T) {
+	rl, _ := newTestRateLimiter()
+	rl.set("test", &dapps.RateLimits{HttpRate: 0.25, HttpBurst: 1})
+	router := NewRouter(namedHandler("fallback"))
+	g := NewRouteGroup("test")
+	g.HandlePrefix(HTTP_BASE+"test", namedHandler("http"), rl.middleware)
+	router.Add(g)
+
+	tests := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"1.1.1.1:1000", 200},
+		// The port does not matter.
+		{"1.1.1.1:1001", 429},
+		{"2.2.2.2:1000", 200},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", HTTP_BASE+"test/a", nil)
+		r.RemoteAddr = test.remoteAddr
+		router.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: Wrong status. Expected: %d, Got: %d\n", test.remoteAddr, test.status, w.Code)
+		}
+		if test.status == 429 && w.Header().Get("Retry-After") != "4" {
+			t.Errorf("Wrong Retry-After: %s\n", w.Header().Get("Retry-After"))
+		}
+	}
+	if stats := rl.stats("test"); stats.HttpRequests != 1 {
+		t.Errorf("Wrong number of throttled requests: %d\n", stats.HttpRequests)
+	}
+}
+
+func TestWsRateLimit(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}, echo: true}
+	rm := newFakeRuntimeManager(rt)
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	if err := was.SetRateLimits("test", &dapps.RateLimits{WsMessageRate: 0.01, WsMessageBurst: 2}); err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := newWsTestServer(was)
+	defer srv.Close()
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	waitForSessions(t, was, 1)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"Protocol":"EWSMP1","Method":"hello","Id":"7"}`))
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp := &struct {
+		Protocol string
+		Method   string
+		Id       string
+		Error    *RpcError
+	}{}
+	if err := json.Unmarshal(msg, resp); err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.Error == nil || resp.Error.Code != E_RATE_LIMITED || resp.Method != "hello" || resp.Id != "7" {
+		t.Errorf("Wrong error response: %s\n", string(msg))
+	}
+	if !jsonEqual(string(resp.Error.Data), `{"retry_after":100}`) {
+		t.Errorf("Wrong error data: %s\n", string(resp.Error.Data))
+	}
+	if stats := was.limits.stats("test"); stats.WsMessages != 1 {
+		t.Errorf("Wrong number of throttled messages: %d\n", stats.WsMessages)
+	}
+}
+
+func TestWsRateLimitJsonRpc(t *testing.T) {
+	rt := &fakeRuntime{id: "test", quotas: &scripting.Quotas{}}
+	was := NewWsAPIServer(newFakeRuntimeManager(rt), nil, 10, 0, nil)
+	was.SetWsProtocol("test", dapps.WS_PROTOCOL_JSONRPC)
+	was.SetRateLimits("test", &dapps.RateLimits{WsMessageRate: 0.01, WsMessageBurst: 1})
+	srv := newWsTestServer(was)
+	defer srv.Close()
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	waitForSessions(t, was, 1)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"nope","id":1}`))
+	}
+	conn.ReadMessage()
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := `{"jsonrpc":"2.0","error":{"code":-32029,"message":"Too many messages.","data":{"retry_after":100}},"id":1}`
+	if !jsonEqual(string(msg), want) {
+		t.Errorf("Expected: %s, Got: %s\n", want, string(msg))
+	}
+}
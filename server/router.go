@@ -0,0 +1,210 @@
+// This file contains the router of the dapp endpoints. Each dapp has a group
+// of routes, which is added when the dapp is registered, and removed (or
+// replaced) as a whole. The id of the dapp comes from the group that a
+// request matched, and is put in the request context.
+//
+// Requests that do not match a dapp route go to the fallback handler.
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Middleware wraps a handler, e.g. to check a request before it is passed
+// on.
+type Middleware func(http.Handler) http.Handler
+
+type routerContextKey int
+
+const dappIdKey routerContextKey = 0
+
+// Get the id of the dapp that a request was routed to. Returns the empty
+// string if it was not routed to a dapp.
+func dappIdOf(r *http.Request) string {
+	dappId, _ := r.Context().Value(dappIdKey).(string)
+	return dappId
+}
+
+type groupRoute struct {
+	path string
+	// Prefix routes match paths under path as well.
+	prefix     bool
+	handler    http.Handler
+	middleware []Middleware
+}
+
+// The routes of a dapp.
+type RouteGroup struct {
+	dappId     string
+	routes     []*groupRoute
+	middleware []Middleware
+}
+
+func NewRouteGroup(dappId string) *RouteGroup {
+	return &RouteGroup{dappId: dappId}
+}
+
+// Add middleware for all the routes of the group. It runs before the
+// middleware of the routes, in the order it is added.
+func (g *RouteGroup) Use(middleware ...Middleware) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+// Route a path to a handler.
+func (g *RouteGroup) Handle(path string, handler http.HandlerFunc, middleware ...Middleware) {
+	g.routes = append(g.routes, &groupRoute{path, false, handler, middleware})
+}
+
+// Route a path, and all paths under it, to a handler.
+func (g *RouteGroup) HandlePrefix(path string, handler http.HandlerFunc, middleware ...Middleware) {
+	g.routes = append(g.routes, &groupRoute{strings.TrimSuffix(path, "/"), true, handler, middleware})
+}
+
+// A route of a group, with the middleware applied.
+type routerEntry struct {
+	dappId  string
+	handler http.Handler
+}
+
+type Router struct {
+	mutex    *sync.RWMutex
+	groups   map[string]*RouteGroup
+	exact    map[string]*routerEntry
+	prefixes map[string]*routerEntry
+	fallback http.Handler
+}
+
+func NewRouter(fallback http.Handler) *Router {
+	router := &Router{}
+	router.mutex = &sync.RWMutex{}
+	router.groups = make(map[string]*RouteGroup)
+	router.exact = make(map[string]*routerEntry)
+	router.prefixes = make(map[string]*routerEntry)
+	router.fallback = fallback
+	return router
+}
+
+// Add a group of routes. If the dapp already has a group it is replaced.
+// Nothing is changed if a path is used by the group of another dapp.
+func (router *Router) Add(g *RouteGroup) error {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	for _, route := range g.routes {
+		table := router.exact
+		if route.prefix {
+			table = router.prefixes
+		}
+		if other, ok := table[route.path]; ok && other.dappId != g.dappId {
+			return fmt.Errorf("Path '%s' of dapp '%s' is already used by dapp '%s'.", route.path, g.dappId, other.dappId)
+		}
+	}
+	router.remove(g.dappId)
+	for _, route := range g.routes {
+		entry := &routerEntry{g.dappId, groupHandler(g, route)}
+		if route.prefix {
+			router.prefixes[route.path] = entry
+		} else {
+			router.exact[route.path] = entry
+		}
+	}
+	router.groups[g.dappId] = g
+	return nil
+}
+
+// Remove the routes of a dapp. Returns false if it has none.
+func (router *Router) Remove(dappId string) bool {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	return router.remove(dappId)
+}
+
+func (router *Router) remove(dappId string) bool {
+	g, ok := router.groups[dappId]
+	if !ok {
+		return false
+	}
+	for _, route := range g.routes {
+		if route.prefix {
+			delete(router.prefixes, route.path)
+		} else {
+			delete(router.exact, route.path)
+		}
+	}
+	delete(router.groups, dappId)
+	return true
+}
+
+// The ids of the dapps that have routes, sorted.
+func (router *Router) DappIds() []string {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	ids := make([]string, 0, len(router.groups))
+	for id := range router.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := router.match(r.URL.Path)
+	if entry == nil {
+		router.fallback.ServeHTTP(w, r)
+		return
+	}
+	ctx := context.WithValue(r.Context(), dappIdKey, entry.dappId)
+	entry.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Exact routes come first, then the longest prefix.
+func (router *Router) match(p string) *routerEntry {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	if entry, ok := router.exact[p]; ok {
+		return entry
+	}
+	for {
+		if entry, ok := router.prefixes[p]; ok {
+			return entry
+		}
+		i := strings.LastIndex(p, "/")
+		if i <= 0 {
+			return nil
+		}
+		p = p[:i]
+	}
+}
+
+// Refuse requests that do not use one of the methods.
+func allowMethods(methods ...string) Middleware {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, method := range methods {
+				if r.Method == method {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", 405)
+		})
+	}
+}
+
+// Wrap the handler of a route in the middleware of the group and route.
+func groupHandler(g *RouteGroup, route *groupRoute) http.Handler {
+	handler := route.handler
+	for i := len(route.middleware) - 1; i >= 0; i-- {
+		handler = route.middleware[i](handler)
+	}
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		handler = g.middleware[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Writes the name of the handler and the dapp id of the request.
+func namedHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Trace", name)
+		w.Write([]byte(name + " " + dappIdOf(r)))
+	}
+}
+
+// Adds its name to the trace header, before the handler runs.
+func traceMiddleware(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func routeTo(router *Router, p string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = p
+	router.ServeHTTP(w, r)
+	return w.Body.String()
+}
+
+func testRouteGroup(dappId string) *RouteGroup {
+	g := NewRouteGroup(dappId)
+	g.HandlePrefix(HTTP_BASE+dappId, namedHandler("http"))
+	g.Handle(WS_BASE+dappId, namedHandler("ws"))
+	g.HandlePrefix("/"+dappId, namedHandler("static"))
+	return g
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter(namedHandler("fallback"))
+	for _, id := range []string{"test", "test2"} {
+		if err := router.Add(testRouteGroup(id)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/http/test/", "http test"},
+		{"/http/test/a/b", "http test"},
+		{"/http/test", "http test"},
+		{"/http/test2/a", "http test2"},
+		{"/http/test3/a", "fallback "},
+		{"/http/", "fallback "},
+		{"/ws/test", "ws test"},
+		{"/ws/test/more", "fallback "},
+		{"/ws/tes", "fallback "},
+		{"/test", "static test"},
+		{"/test/index.html", "static test"},
+		{"/test2/", "static test2"},
+		{"/test3", "fallback "},
+		{"/admin/ready", "fallback "},
+		{"/", "fallback "},
+		{"*", "fallback "},
+		{"", "fallback "},
+	}
+	for _, test := range tests {
+		if got := routeTo(router, test.path); got != test.expected {
+			t.Errorf("%s: Expected: '%s', Got: '%s'\n", test.path, test.expected, got)
+		}
+	}
+
+	if ids := strings.Join(router.DappIds(), ","); ids != "test,test2" {
+		t.Errorf("Wrong dapp ids: %s\n", ids)
+	}
+
+	// Removing a dapp removes all its routes, and no others.
+	if !router.Remove("test") {
+		t.Error("Dapp had no routes.")
+	}
+	if router.Remove("test") {
+		t.Error("Dapp was removed twice.")
+	}
+	for _, p := range []string{"/http/test/a", "/ws/test", "/test/index.html"} {
+		if got := routeTo(router, p); got != "fallback " {
+			t.Errorf("%s: Removed route is still used: %s\n", p, got)
+		}
+	}
+	if got := routeTo(router, "/ws/test2"); got != "ws test2" {
+		t.Errorf("Route of other dapp was removed: %s\n", got)
+	}
+}
+
+func TestRouterReplace(t *testing.T) {
+	router := NewRouter(namedHandler("fallback"))
+	router.Add(testRouteGroup("test"))
+
+	// The new group replaces the old one, and routes that it does not have
+	// are removed.
+	g := NewRouteGroup("test")
+	g.Handle(WS_BASE+"test", namedHandler("new ws"))
+	if err := router.Add(g); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := routeTo(router, "/ws/test"); got != "new ws test" {
+		t.Errorf("Route was not replaced: %s\n", got)
+	}
+	if got := routeTo(router, "/http/test/a"); got != "fallback " {
+		t.Errorf("Old route is still used: %s\n", got)
+	}
+
+	// A group that uses the paths of another dapp is refused, and the old
+	// routes are kept.
+	other := NewRouteGroup("other")
+	other.Handle(WS_BASE+"other", namedHandler("ws"))
+	other.Handle(WS_BASE+"test", namedHandler("ws"))
+	if err := router.Add(other); err == nil {
+		t.Error("Group with conflicting path was added.")
+	}
+	if got := routeTo(router, "/ws/other"); got != "fallback " {
+		t.Errorf("Refused group was partly added: %s\n", got)
+	}
+	if got := routeTo(router, "/ws/test"); got != "new ws test" {
+		t.Errorf("Route of other dapp was changed: %s\n", got)
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	router := NewRouter(namedHandler("fallback"))
+	g := NewRouteGroup("test")
+	g.Use(traceMiddleware("group1"), traceMiddleware("group2"))
+	g.Handle("/a", namedHandler("a"), traceMiddleware("route1"), traceMiddleware("route2"))
+	g.Handle("/b", namedHandler("b"))
+	router.Add(g)
+
+	tests := []struct {
+		path  string
+		trace string
+	}{
+		{"/a", "group1,group2,route1,route2,a"},
+		{"/b", "group1,group2,b"},
+		{"/c", "fallback"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if trace := strings.Join(w.Header()["X-Trace"], ","); trace != test.trace {
+			t.Errorf("%s: Expected: %s, Got: %s\n", test.path, test.trace, trace)
+		}
+	}
+
+	g = NewRouteGroup("test")
+	g.Handle("/a", namedHandler("a"), allowMethods("GET", "HEAD"))
+	router.Add(g)
+	for method, status := range map[string]int{"GET": 200, "HEAD": 200, "POST": 405} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/a", nil))
+		if w.Code != status {
+			t.Errorf("%s: Wrong status. Expected: %d, Got: %d\n", method, status, w.Code)
+		}
+		if status == 405 && w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("Wrong Allow header: %s\n", w.Header().Get("Allow"))
+		}
+	}
+
+	// Middleware that answers the request stops it.
+	stop := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(403)
+		})
+	}
+	g = NewRouteGroup("test")
+	g.Handle("/a", namedHandler("a"), stop)
+	router.Add(g)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/a", nil))
+	if w.Code != 403 || w.Body.Len() != 0 {
+		t.Errorf("Handler was called after the middleware answered: %d %s\n", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"github.com/eris-ltd/decerver/tracing"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A runtime that does nothing. Methods that are not overridden panics.
+type fakeRuntime struct {
+	scripting.Runtime
+	id     string
+	quotas *scripting.Quotas
+	// Return incoming websocket messages as the response.
+	echo bool
+	// Rpc methods, by name. They return what network.callRpcMethod would.
+	rpcMethods map[string]func(params string) string
+	caps       scripting.Capabilities
+	// Makes network.deleteWsSession hang until the channel is closed.
+	hangOnDelete chan struct{}
+	// Handles incoming http requests instead of the default response.
+	httpHandler func(req *HttpReqProxy, body *HttpBodyJs, resp *HttpResponseJs) string
+	// Gets the span that each call is made in, if set.
+	callSpans chan *tracing.Span
+}
+
+func (fr *fakeRuntime) Capabilities() scripting.Capabilities {
+	return fr.caps
+}
+
+func (fr *fakeRuntime) Id() string {
+	return fr.id
+}
+
+func (fr *fakeRuntime) Quotas() *scripting.Quotas {
+	return fr.quotas
+}
+
+func (fr *fakeRuntime) BindScriptObject(name string, val interface{}) error {
+	return nil
+}
+
+func (fr *fakeRuntime) AddScript(script string) error {
+	return nil
+}
+
+func (fr *fakeRuntime) CallFuncOnObjContext(ctx context.Context, objName, funcName string, param ...interface{}) (interface{}, error) {
+	if fr.callSpans != nil {
+		fr.callSpans <- tracing.SpanFromContext(ctx)
+	}
+	return fr.CallFuncOnObj(objName, funcName, param...)
+}
+
+func (fr *fakeRuntime) CallFuncOnObj(objName, funcName string, param ...interface{}) (interface{}, error) {
+	if fr.echo && funcName == "incomingWsMsg" {
+		return param[1], nil
+	}
+	if funcName == "deleteWsSession" && fr.hangOnDelete != nil {
+		<-fr.hangOnDelete
+	}
+	if funcName == "handleIncomingHttp" && fr.httpHandler != nil {
+		req := &HttpReqProxy{}
+		json.Unmarshal([]byte(param[0].(string)), req)
+		return fr.httpHandler(req, param[1].(*HttpBodyJs), param[2].(*HttpResponseJs)), nil
+	}
+	if funcName == "handleIncomingHttp" {
+		return `{"status":200,"header":{},"body":"ok"}`, nil
+	}
+	if funcName == "callRpcMethod" {
+		if method, ok := fr.rpcMethods[param[1].(string)]; ok {
+			return method(param[2].(string)), nil
+		}
+		return `{"error":{"code":-32601,"message":"Method not found"}}`, nil
+	}
+	return nil, nil
+}
+
+type fakeRuntimeManager struct {
+	scripting.RuntimeManager
+	runtimes map[string]scripting.Runtime
+}
+
+func newFakeRuntimeManager(rts ...*fakeRuntime) *fakeRuntimeManager {
+	frm := &fakeRuntimeManager{}
+	frm.runtimes = make(map[string]scripting.Runtime)
+	for _, rt := range rts {
+		frm.runtimes[rt.id] = rt
+	}
+	return frm
+}
+
+func (frm *fakeRuntimeManager) GetRuntime(name string) scripting.Runtime {
+	return frm.runtimes[name]
+}
+
+func (frm *fakeRuntimeManager) RegisterApiObjectFactory(name string, factory func(scripting.Runtime) interface{}) {
+}
+
+// Starts a test server with the websocket handler on WS_BASE, for the
+// dapps that has runtimes.
+func newWsTestServer(was *WsAPIServer) *httptest.Server {
+	router := NewRouter(http.NotFoundHandler())
+	for id := range was.rm.(*fakeRuntimeManager).runtimes {
+		g := NewRouteGroup(id)
+		g.Handle(WS_BASE+id, was.handleWs)
+		router.Add(g)
+	}
+	return httptest.NewServer(router)
+}
+
+func dialWs(srv *httptest.Server, dappId string) (*websocket.Conn, *http.Response, error) {
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + WS_BASE + dappId
+	return websocket.DefaultDialer.Dial(u, nil)
+}
+
+// Dials until the connection is accepted, since closed sessions are
+// released asynchronously.
+func dialWsRetry(t *testing.T, srv *httptest.Server, dappId string) *websocket.Conn {
+	for i := 0; i < 50; i++ {
+		conn, _, err := dialWs(srv, dappId)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Connection was never accepted.")
+	return nil
+}
+
+func expectUnavailable(t *testing.T, resp *http.Response, err error) {
+	if err == nil {
+		t.Fatal("Connection was accepted, but should have been refused.")
+	}
+	if resp == nil {
+		t.Fatalf("No response: %s\n", err.Error())
+	}
+	if resp.StatusCode != 503 {
+		t.Errorf("Wrong status code. Expected: 503, Got: %d\n", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("No Retry-After header.")
+	}
+}
+
+func TestWsMaxClients(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 3, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conns := make([]*websocket.Conn, 0)
+	for i := 0; i < 3; i++ {
+		conn, _, err := dialWs(srv, "test")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conns = append(conns, conn)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, resp, err := dialWs(srv, "test")
+		expectUnavailable(t, resp, err)
+	}
+
+	// Closing a connection should make room for a new one.
+	conns[0].Close()
+	conns[0] = dialWsRetry(t, srv, "test")
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func TestWsMaxClientsPerIp(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 10, 2, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialWs(srv, "test")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+	}
+	_, resp, err := dialWs(srv, "test")
+	expectUnavailable(t, resp, err)
+}
+
+func TestWsDappSessionQuota(t *testing.T) {
+	rm := newFakeRuntimeManager(
+		&fakeRuntime{id: "limited", quotas: &scripting.Quotas{MaxWsSessions: 1}},
+		&fakeRuntime{id: "other", quotas: &scripting.Quotas{}},
+	)
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "limited")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	_, resp, err := dialWs(srv, "limited")
+	expectUnavailable(t, resp, err)
+
+	// Other dapps are not affected.
+	conn2, _, err := dialWs(srv, "other")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn2.Close()
+}
+
+// Waits until the server has the given number of sessions.
+func waitForSessions(t *testing.T, was *WsAPIServer, num int) {
+	for i := 0; i < 100; i++ {
+		if len(was.Sessions()) == num {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Wrong number of sessions. Expected: %d, Got: %d\n", num, len(was.Sessions()))
+}
+
+// The id of a session is not given to a new connection until the dapp has
+// deleted the session.
+func TestWsSessionIdReuse(t *testing.T) {
+	hang := make(chan struct{})
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, hangOnDelete: hang})
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	waitForSessions(t, was, 1)
+	oldId := was.Sessions()[0].Id
+	conn.Close()
+
+	conn2, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn2.Close()
+	// The old session is still being deleted.
+	waitForSessions(t, was, 2)
+	ids := map[uint32]bool{}
+	for _, info := range was.Sessions() {
+		ids[info.Id] = true
+	}
+	if len(ids) != 2 || !ids[oldId] {
+		t.Errorf("The id of a session that was being deleted was reused: %v\n", ids)
+	}
+	close(hang)
+	waitForSessions(t, was, 1)
+}
+
+func TestWsSessionRegistry(t *testing.T) {
+	rm := newFakeRuntimeManager(
+		&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, echo: true},
+		&fakeRuntime{id: "other", quotas: &scripting.Quotas{}},
+	)
+	was := NewWsAPIServer(rm, nil, 20, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conns := make([]*websocket.Conn, 10)
+	wg := &sync.WaitGroup{}
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, _, err := dialWs(srv, "test")
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			conns[i] = conn
+			for j := 0; j < 5; j++ {
+				conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("msg %d", j)))
+				if _, _, err := conn.ReadMessage(); err != nil {
+					t.Error(err.Error())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	other, _, err := dialWs(srv, "other")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+
+	infos := was.Sessions()
+	if len(infos) != 11 {
+		t.Fatalf("Wrong number of sessions. Expected: 11, Got: %d\n", len(infos))
+	}
+	for i, info := range infos {
+		if i > 0 && info.Id <= infos[i-1].Id {
+			t.Error("Sessions are not sorted by id.")
+		}
+		if info.State != "open" {
+			t.Errorf("Wrong state. Expected: open, Got: %s\n", info.State)
+		}
+		if info.RemoteAddr == "" {
+			t.Error("No remote address.")
+		}
+		if info.DappId == "other" {
+			continue
+		}
+		if info.MsgsIn != 5 || info.MsgsOut != 5 || info.BytesIn != 25 || info.BytesOut != 25 {
+			t.Errorf("Wrong counters: %d/%d msgs, %d/%d bytes\n", info.MsgsIn, info.MsgsOut, info.BytesIn, info.BytesOut)
+		}
+	}
+	if num := was.DappSessionCount("test"); num != 10 {
+		t.Errorf("Wrong session count. Expected: 10, Got: %d\n", num)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitForSessions(t, was, 1)
+	if was.CurrentActiveConnections() != 1 {
+		t.Errorf("Connections were not released. Expected: 1, Got: %d\n", was.CurrentActiveConnections())
+	}
+}
+
+func TestWsBroadcast(t *testing.T) {
+	rm := newFakeRuntimeManager(
+		&fakeRuntime{id: "test", quotas: &scripting.Quotas{}},
+		&fakeRuntime{id: "other", quotas: &scripting.Quotas{}},
+	)
+	was := NewWsAPIServer(rm, nil, 20, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	const numConns = 5
+	const numSenders = 4
+	const numMsgs = 25
+
+	conns := make([]*websocket.Conn, numConns)
+	for i := range conns {
+		conn, _, err := dialWs(srv, "test")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	other, _, err := dialWs(srv, "other")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+	waitForSessions(t, was, numConns+1)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numSenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numMsgs; j++ {
+				if num := was.Broadcast("test", []byte("hello")); num != numConns {
+					t.Errorf("Wrong number of receivers. Expected: %d, Got: %d\n", numConns, num)
+				}
+			}
+		}()
+	}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for j := 0; j < numSenders*numMsgs; j++ {
+				if _, msg, err := conn.ReadMessage(); err != nil {
+					t.Error(err.Error())
+					return
+				} else if string(msg) != "hello" {
+					t.Errorf("Wrong message: %s\n", string(msg))
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	// Sessions of other dapps should not get anything.
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := other.ReadMessage(); err == nil {
+		t.Errorf("Other dapp got a message: %s\n", string(msg))
+	}
+}
+
+func TestWsSessionCloseConcurrent(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 20, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	waitForSessions(t, was, 1)
+	ss := was.Session(was.Sessions()[0].Id)
+
+	// Write, broadcast and close at the same time. Nothing should block
+	// or panic, and close should only run once.
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ss.wsConn.WriteJsonMsg([]byte("msg"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				was.Broadcast("test", []byte("msg"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			ss.Close()
+			if ss.State() != SESSION_CLOSED {
+				t.Error("Session is not closed after Close returned.")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(was.Sessions()) != 0 {
+		t.Error("Session was not removed.")
+	}
+	if was.CurrentActiveConnections() != 0 {
+		t.Error("Connection was not released.")
+	}
+	if num := was.Broadcast("test", []byte("msg")); num != 0 {
+		t.Errorf("Broadcast to closed session. Expected: 0, Got: %d\n", num)
+	}
+
+	// The client should get a close frame.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("Expected a normal close, got: %s\n", err.Error())
+		}
+		break
+	}
+}
+
+func TestWsSettings(t *testing.T) {
+	ws := newWsSettings(nil)
+	if ws.pingPeriod != pingPeriod || ws.downWait != downWait || ws.maxMessageSize != maxMessageSize {
+		t.Error("Nil config should give the defaults.")
+	}
+	ws = newWsSettings(&decerver.WsConfig{PingPeriod: 5000, PongWait: 2000})
+	if ws.pingPeriod >= ws.downWait {
+		t.Errorf("Ping period was not adjusted: %v (pong wait: %v)\n", ws.pingPeriod, ws.downWait)
+	}
+	ws = newWsSettings(&decerver.WsConfig{MaxMessageSize: 1000})
+	if limit := ws.messageLimit(&scripting.Quotas{MaxWsMessageBytes: 100}); limit != 100 {
+		t.Errorf("Wrong limit. Expected: 100, Got: %d\n", limit)
+	}
+	// Quotas can not raise the limit.
+	if limit := ws.messageLimit(&scripting.Quotas{MaxWsMessageBytes: 5000}); limit != 1000 {
+		t.Errorf("Wrong limit. Expected: 1000, Got: %d\n", limit)
+	}
+}
+
+func TestWsKeepalive(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	was := NewWsAPIServer(rm, nil, 10, 0, &decerver.WsConfig{PingPeriod: 50, PongWait: 200})
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	// This client reads, so it answers the pings.
+	alive, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer alive.Close()
+	pings := make(chan bool, 100)
+	alive.SetPingHandler(func(data string) error {
+		pings <- true
+		return alive.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// This one never reads, so it never answers.
+	dead, _, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer dead.Close()
+	waitForSessions(t, was, 2)
+
+	time.Sleep(500 * time.Millisecond)
+	waitForSessions(t, was, 1)
+	if len(pings) < 3 {
+		t.Errorf("Too few pings. Expected at least 3, Got: %d\n", len(pings))
+	}
+}
+
+func TestWsMessageLimit(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{MaxWsMessageBytes: 16}, echo: true})
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conn, resp, err := dialWs(srv, "test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if size := resp.Header.Get("X-Max-Message-Size"); size != "16" {
+		t.Errorf("Wrong X-Max-Message-Size. Expected: 16, Got: %s\n", size)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("small"))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "small" {
+		t.Fatalf("Small message was not echoed: %v\n", err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100)))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected the connection to be closed (message too big), got: %v\n", err)
+	}
+	waitForSessions(t, was, 0)
+}
+
+func TestWsCompression(t *testing.T) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}, echo: true})
+	was := NewWsAPIServer(rm, nil, 10, 0, &decerver.WsConfig{Compression: true})
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + WS_BASE + "test"
+	conn, resp, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("Compression was not negotiated: '%s'\n", ext)
+	}
+
+	msg := strings.Repeat("compress me ", 100)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != msg {
+		t.Errorf("Message was not echoed: %v\n", err)
+	}
+}
+
+func TestWsShutdown(t *testing.T) {
+	hang := make(chan struct{})
+	rm := newFakeRuntimeManager(
+		&fakeRuntime{id: "test", quotas: &scripting.Quotas{}},
+		&fakeRuntime{id: "stuck", quotas: &scripting.Quotas{}, hangOnDelete: hang},
+	)
+	was := NewWsAPIServer(rm, nil, 10, 0, nil)
+	srv := newWsTestServer(was)
+	defer srv.Close()
+
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conn, _, err := dialWs(srv, "test")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	waitForSessions(t, was, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if num := was.Shutdown(ctx); num != 0 {
+		t.Errorf("%d sessions did not close.\n", num)
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("Expected a normal close, got: %v\n", err)
+		}
+	}
+	_, resp, err := dialWs(srv, "test")
+	expectUnavailable(t, resp, err)
+
+	// Sessions that do not close in time are reported.
+	was.Open()
+	conn, _, err := dialWs(srv, "stuck")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	waitForSessions(t, was, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if num := was.Shutdown(ctx); num != 1 {
+		t.Errorf("Wrong number of sessions left. Expected: 1, Got: %d\n", num)
+	}
+	close(hang)
+	waitForSessions(t, was, 0)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// The states a websocket session goes through. A session is open until
+// Close is called. It is closing while the writer is being stopped and
+// the connection torn down, and closed when it has been removed from the
+// server and the runtime.
+const (
+	SESSION_OPEN int32 = iota
+	SESSION_CLOSING
+	SESSION_CLOSED
+)
+
+func sessionStateName(state int32) string {
+	switch state {
+	case SESSION_OPEN:
+		return "open"
+	case SESSION_CLOSING:
+		return "closing"
+	case SESSION_CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// The live websocket sessions, by id. It is safe for concurrent use.
+type sessionRegistry struct {
+	mutex    *sync.RWMutex
+	sessions map[uint32]*Session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	sr := &sessionRegistry{}
+	sr.mutex = &sync.RWMutex{}
+	sr.sessions = make(map[uint32]*Session)
+	return sr
+}
+
+func (sr *sessionRegistry) add(ss *Session) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.sessions[ss.SessionId()] = ss
+}
+
+func (sr *sessionRegistry) remove(id uint32) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	delete(sr.sessions, id)
+}
+
+func (sr *sessionRegistry) get(id uint32) *Session {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	return sr.sessions[id]
+}
+
+// Get the sessions of a dapp, sorted by id.
+func (sr *sessionRegistry) forDapp(dappId string) []*Session {
+	sr.mutex.RLock()
+	sss := make([]*Session, 0)
+	for _, ss := range sr.sessions {
+		if ss.caller == dappId {
+			sss = append(sss, ss)
+		}
+	}
+	sr.mutex.RUnlock()
+	sortSessions(sss)
+	return sss
+}
+
+// Get all sessions, sorted by id.
+func (sr *sessionRegistry) all() []*Session {
+	sr.mutex.RLock()
+	sss := make([]*Session, 0, len(sr.sessions))
+	for _, ss := range sr.sessions {
+		sss = append(sss, ss)
+	}
+	sr.mutex.RUnlock()
+	sortSessions(sss)
+	return sss
+}
+
+type sessionsById []*Session
+
+func (s sessionsById) Len() int           { return len(s) }
+func (s sessionsById) Less(i, j int) bool { return s[i].SessionId() < s[j].SessionId() }
+func (s sessionsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sortSessions(sss []*Session) {
+	sort.Sort(sessionsById(sss))
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a test server with the sse handler for the dapp 'test'.
+func newSseTestServer() (*SseAPIServer, *httptest.Server) {
+	rm := newFakeRuntimeManager(&fakeRuntime{id: "test", quotas: &scripting.Quotas{}})
+	sas := NewSseAPIServer(rm, NewWsAPIServer(rm, nil, 10, 0, nil))
+	router := NewRouter(http.NotFoundHandler())
+	g := NewRouteGroup("test")
+	g.Handle(SSE_BASE+"test", sas.handleSse)
+	router.Add(g)
+	return sas, httptest.NewServer(router)
+}
+
+type sseTestStream struct {
+	resp *http.Response
+	br   *bufio.Reader
+}
+
+// Open an event stream. Reads time out, so tests can not hang.
+func openSse(t *testing.T, srv *httptest.Server, query, lastId string) *sseTestStream {
+	req, _ := http.NewRequest("GET", srv.URL+SSE_BASE+"test"+query, nil)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Wrong response: %d, %s\n", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &sseTestStream{resp, bufio.NewReader(resp.Body)}
+}
+
+func (sts *sseTestStream) close() {
+	sts.resp.Body.Close()
+}
+
+// Read the next event, or comment. Fields are returned as "name: value"
+// lines, and comments as ": comment".
+func (sts *sseTestStream) next(t *testing.T) string {
+	lines := make([]string, 0)
+	for {
+		line, err := sts.br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v\n", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Wait until the stream of the dapp has n clients.
+func waitForSseClients(t *testing.T, sas *SseAPIServer, n int) {
+	st := sas.stream("test")
+	for i := 0; i < 100; i++ {
+		st.mutex.Lock()
+		num := len(st.clients)
+		st.mutex.Unlock()
+		if num == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d sse clients.\n", n)
+}
+
+func TestSseReplay(t *testing.T) {
+	sas, srv := newSseTestServer()
+	defer srv.Close()
+	// The first events do not fit in the buffer.
+	for i := 1; i <= sseBufferSize+44; i++ {
+		sas.Publish("test", "", fmt.Sprint(i))
+	}
+
+	tests := []struct {
+		query  string
+		lastId string
+		first  int
+	}{
+		{"", "290", 291},
+		{"?lastEventId=295", "", 296},
+		// The header is used over the query parameter.
+		{"?lastEventId=295", "298", 299},
+		{"", "1", 45},
+		// New clients get the whole buffer.
+		{"", "", 45},
+	}
+	for _, test := range tests {
+		sts := openSse(t, srv, test.query, test.lastId)
+		for i := test.first; i <= sseBufferSize+44; i++ {
+			want := fmt.Sprintf("id: %d\ndata: %d", i, i)
+			if got := sts.next(t); got != want {
+				t.Fatalf("%s%s: Expected: %q, Got: %q\n", test.query, test.lastId, want, got)
+			}
+		}
+		sts.close()
+	}
+
+	// Events that are published later are sent as well.
+	sts := openSse(t, srv, "", "300")
+	defer sts.close()
+	waitForSseClients(t, sas, 1)
+	sas.Publish("test", "", "new")
+	if got := sts.next(t); got != "id: 301\ndata: new" {
+		t.Errorf("Wrong event: %q\n", got)
+	}
+}
+
+func TestSseChannels(t *testing.T) {
+	sas, srv := newSseTestServer()
+	defer srv.Close()
+	sas.Publish("test", "a", "1")
+	sas.Publish("test", "c", "2")
+
+	sts := openSse(t, srv, "?channel=a&channel=b", "0")
+	defer sts.close()
+	waitForSseClients(t, sas, 1)
+	sas.Publish("test", "", "3")
+	sas.Publish("test", "b", "4")
+	sas.Publish("test", "c", "5")
+	sas.Publish("test", "a", "6")
+	// Other dapps have streams of their own.
+	sas.Publish("other", "a", "7")
+	sas.Publish("test", "b", "8")
+
+	for _, want := range []string{
+		"id: 1\nevent: a\ndata: 1",
+		"id: 4\nevent: b\ndata: 4",
+		"id: 6\nevent: a\ndata: 6",
+		"id: 7\nevent: b\ndata: 8",
+	} {
+		if got := sts.next(t); got != want {
+			t.Errorf("Expected: %q, Got: %q\n", want, got)
+		}
+	}
+}
+
+func TestSseHeartbeat(t *testing.T) {
+	sas, srv := newSseTestServer()
+	defer srv.Close()
+	sas.heartbeatPeriod = 20 * time.Millisecond
+
+	sts := openSse(t, srv, "", "")
+	defer sts.close()
+	for i := 0; i < 2; i++ {
+		if got := sts.next(t); got != ": heartbeat" {
+			t.Errorf("Expected a heartbeat, Got: %q\n", got)
+		}
+	}
+}
+
+// A response writer that blocks in the first write after release is set,
+// until release is closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(bts []byte) (int, error) {
+	select {
+	case bw.entered <- struct{}{}:
+		<-bw.release
+	default:
+	}
+	return bw.ResponseRecorder.Write(bts)
+}
+
+func TestSseSlowClient(t *testing.T) {
+	// The handler is called directly, with a writer that can be stalled.
+	sas, srv := newSseTestServer()
+	defer srv.Close()
+	bw := &blockingWriter{httptest.NewRecorder(), make(chan struct{}, 1), make(chan struct{})}
+	r := httptest.NewRequest("GET", SSE_BASE+"test", nil)
+	r = r.WithContext(context.WithValue(r.Context(), dappIdKey, "test"))
+	done := make(chan struct{})
+	go func() {
+		sas.handleSse(bw, r)
+		close(done)
+	}()
+	waitForSseClients(t, sas, 1)
+
+	// The handler is stuck writing the first event, so the queue fills up,
+	// and the client is dropped on the event after that.
+	sas.Publish("test", "", "first")
+	<-bw.entered
+	for i := 0; i < sseClientQueueSize+1; i++ {
+		sas.Publish("test", "", "more")
+	}
+	waitForSseClients(t, sas, 0)
+	close(bw.release)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The slow client was not disconnected.")
+	}
+	// The events that were queued are still written.
+	if n := strings.Count(bw.Body.String(), "id: "); n != sseClientQueueSize+1 {
+		t.Errorf("Wrong number of events written: %d\n", n)
+	}
+	sas.was.mutex.Lock()
+	defer sas.was.mutex.Unlock()
+	if n := len(sas.was.slots); n != 0 {
+		t.Errorf("The stream was not released: %d\n", n)
+	}
+}
+
+func TestWriteSseEvent(t *testing.T) {
+	tests := []struct {
+		evt  sseEvent
+		want string
+	}{
+		{sseEvent{1, "", "hello"}, "id: 1\ndata: hello\n\n"},
+		{sseEvent{2, "news", "a\nb"}, "id: 2\nevent: news\ndata: a\ndata: b\n\n"},
+		{sseEvent{3, "ne\r\nws", ""}, "id: 3\nevent: news\ndata: \n\n"},
+		// Carriage returns end lines too, and must not end up in a field.
+		{sseEvent{4, "", "a\r\nb\rc\n"}, "id: 4\ndata: a\ndata: b\ndata: c\ndata: \n\n"},
+		{sseEvent{5, "", "\r\rid: 9"}, "id: 5\ndata: \ndata: \ndata: id: 9\n\n"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		if err := writeSseEvent(rec, &test.evt); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%d: Expected: %q, Got: %q\n", test.evt.id, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// This file contains the handler for the web files of dapps. Each dapp is
+// served from its own directory under /<dappId>/, and only from its public
+// directory. The package file, the models (backend javascript) and
+// dot-files are never served.
+package server
+
+import (
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How long browsers may cache files other than html (in seconds), if the
+// dapp does not say.
+const DEFAULT_STATIC_MAX_AGE = 3600
+
+// Precompressed files that are served instead of the file itself, if the
+// client accepts the encoding. In order of preference.
+var staticEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Dapps can not use these ids, since their files would hide the api.
+var reservedStaticIds = []string{"admin", "api", strings.Trim(METRICS_PATH, "/"), strings.Trim(HTTP_BASE, "/"), strings.Trim(WS_BASE, "/"), strings.Trim(SSE_BASE, "/")}
+
+type staticDapp struct {
+	// The dapp directory, and the directory the files are served from.
+	// Symlinks are resolved.
+	root   string
+	public string
+	config *dapps.StaticConfig
+}
+
+type staticFiles struct {
+	mutex *sync.Mutex
+	dapps map[string]*staticDapp
+}
+
+func newStaticFiles() *staticFiles {
+	sf := &staticFiles{}
+	sf.mutex = &sync.Mutex{}
+	sf.dapps = make(map[string]*staticDapp)
+	return sf
+}
+
+func (sf *staticFiles) set(dappId, dir string, config *dapps.StaticConfig) error {
+	for _, id := range reservedStaticIds {
+		if strings.EqualFold(dappId, id) {
+			return fmt.Errorf("Dapp id is reserved: %s", dappId)
+		}
+	}
+	if config == nil {
+		config = &dapps.StaticConfig{}
+	}
+	if filepath.IsAbs(config.Dir) {
+		return fmt.Errorf("Static dir must be relative to the dapp directory: %s", config.Dir)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	public, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(config.Dir)))
+	if err != nil {
+		return err
+	}
+	if !isWithin(root, public) {
+		return fmt.Errorf("Static dir must be inside the dapp directory: %s", config.Dir)
+	}
+	if fi, err := os.Stat(public); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("Static dir is not a directory: %s", config.Dir)
+	}
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	sf.dapps[dappId] = &staticDapp{root, public, config}
+	return nil
+}
+
+func (sf *staticFiles) remove(dappId string) {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	delete(sf.dapps, dappId)
+}
+
+func (sf *staticFiles) get(dappId string) *staticDapp {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return sf.dapps[dappId]
+}
+
+// Serve a file. The path is /<dappId>/<file>.
+func (sf *staticFiles) handle(w http.ResponseWriter, r *http.Request) {
+	dappId := dappIdOf(r)
+	sd := sf.get(dappId)
+	if sd == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/"+dappId)
+	if name == "" {
+		// Relative links in index.html only work with the trailing slash.
+		redirectSlash(w, r)
+		return
+	}
+	sd.serve(w, r, name[1:])
+}
+
+func (sd *staticDapp) serve(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	upath := path.Clean("/" + name)
+	file := filepath.Join(sd.public, filepath.FromSlash(upath))
+	f, fi, err := sd.open(file)
+	if err == nil && fi.IsDir() {
+		f.Close()
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirectSlash(w, r)
+			return
+		}
+		file = filepath.Join(file, dapps.INDEX_FILE_NAME)
+		f, fi, err = sd.open(file)
+	}
+	if err != nil && sd.config.SpaFallback && path.Ext(upath) == "" {
+		file = filepath.Join(sd.public, dapps.INDEX_FILE_NAME)
+		f, fi, err = sd.open(file)
+	}
+	if err != nil || fi.IsDir() {
+		if err == nil {
+			f.Close()
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	h := w.Header()
+	ctype := mime.TypeByExtension(filepath.Ext(file))
+	h.Set("Vary", "Accept-Encoding")
+	for _, enc := range staticEncodings {
+		if !acceptsEncoding(r, enc.name) {
+			continue
+		}
+		cf, cfi, err := sd.open(file + enc.ext)
+		if err != nil {
+			continue
+		}
+		if cfi.IsDir() {
+			cf.Close()
+			continue
+		}
+		f.Close()
+		f, fi = cf, cfi
+		h.Set("Content-Encoding", enc.name)
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		break
+	}
+	if ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+	// The etag changes when the file does. Encoded files has their own.
+	etag := strconv.FormatInt(fi.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(fi.Size(), 36)
+	if enc := h.Get("Content-Encoding"); enc != "" {
+		etag += "-" + enc
+	}
+	h.Set("Etag", `"`+etag+`"`)
+	h.Set("Cache-Control", sd.cacheControl(file))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// Open a file if it can be served. Files that are hidden, or outside of the
+// public directory (through symlinks), does not exist.
+func (sd *staticDapp) open(file string) (*os.File, os.FileInfo, error) {
+	if sd.hidden(file) {
+		return nil, nil, os.ErrNotExist
+	}
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isWithin(sd.public, real) || sd.hidden(real) {
+		return nil, nil, os.ErrNotExist
+	}
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// The package file, the models folder and dot-files are never served.
+func (sd *staticDapp) hidden(file string) bool {
+	rel, err := filepath.Rel(sd.root, file)
+	if err != nil {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == dapps.PACKAGE_FILE_NAME || rel == dapps.MODELS_FOLDER_NAME || strings.HasPrefix(rel, dapps.MODELS_FOLDER_NAME+"/") {
+		return true
+	}
+	// The public directory itself may be a dot-directory.
+	rel, err = filepath.Rel(sd.public, file)
+	if err != nil {
+		return true
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// Html files (the pages) are always revalidated, so that new versions of a
+// dapp are picked up. Other files are cached.
+func (sd *staticDapp) cacheControl(file string) string {
+	maxAge := sd.config.MaxAge
+	if maxAge == 0 {
+		maxAge = DEFAULT_STATIC_MAX_AGE
+	}
+	ext := strings.ToLower(filepath.Ext(file))
+	if maxAge < 0 || ext == ".html" || ext == ".htm" {
+		return "no-cache"
+	}
+	return "public, max-age=" + strconv.Itoa(maxAge)
+}
+
+// Check if a file is in a directory (or is the directory).
+func isWithin(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// Check if the Accept-Encoding header of a request allows an encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		name := strings.TrimSpace(params[0])
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func redirectSlash(w http.ResponseWriter, r *http.Request) {
+	u := r.URL.Path + "/"
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, u, 301)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a dapp directory with the given files (relative paths).
+func newStaticTestDapp(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return dir
+}
+
+func TestStaticFiles(t *testing.T) {
+	dir := newStaticTestDapp(t, map[string]string{
+		"package.json":          `{"id":"test"}`,
+		"index.html":            "root index",
+		"models/backend.js":     "secret",
+		"models/config.json":    "{}",
+		"public/index.html":     "index",
+		"public/app.js":         "app",
+		"public/app.js.gz":      "gzipped",
+		"public/app.js.br":      "brotli",
+		"public/style.css":      "css",
+		"public/sub/index.html": "sub index",
+		"public/.env":           "secret",
+	})
+	if err := os.Symlink(filepath.Join(dir, "models", "backend.js"), filepath.Join(dir, "public", "link.js")); err != nil {
+		t.Fatal(err.Error())
+	}
+	sf := newStaticFiles()
+	if err := sf.set("test", dir, &dapps.StaticConfig{Dir: "public", SpaFallback: true, MaxAge: 60}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := sf.set("other", dir, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	router := NewRouter(http.NotFoundHandler())
+	for _, id := range []string{"test", "other"} {
+		g := NewRouteGroup(id)
+		g.HandlePrefix("/"+id, sf.handle)
+		router.Add(g)
+	}
+	tests := []struct {
+		path     string
+		encoding string
+		status   int
+		body     string
+		cache    string
+	}{
+		{"/test/", "", 200, "index", "no-cache"},
+		{"/test/app.js", "", 200, "app", "public, max-age=60"},
+		{"/test/app.js", "gzip", 200, "gzipped", "public, max-age=60"},
+		{"/test/app.js", "gzip, br", 200, "brotli", "public, max-age=60"},
+		{"/test/app.js", "br;q=0, gzip", 200, "gzipped", "public, max-age=60"},
+		{"/test/style.css", "gzip", 200, "css", "public, max-age=60"},
+		{"/test/sub/", "", 200, "sub index", "no-cache"},
+		{"/test/sub", "", 301, "", ""},
+		{"/test", "", 301, "", ""},
+		// Single-page app routes get the index, missing assets do not.
+		{"/test/some/route", "", 200, "index", "no-cache"},
+		{"/test/missing.js", "", 404, "", ""},
+		{"/test/.env", "", 404, "", ""},
+		{"/test/link.js", "", 404, "", ""},
+		{"/test/../models/backend.js", "", 404, "", ""},
+		{"/unknown/index.html", "", 404, "", ""},
+		// Without a public directory, the backend is still hidden.
+		{"/other/index.html", "", 200, "root index", "no-cache"},
+		{"/other/public/app.js", "", 200, "app", "public, max-age=3600"},
+		{"/other/package.json", "", 404, "", ""},
+		{"/other/models/backend.js", "", 404, "", ""},
+		{"/other/models/", "", 404, "", ""},
+		{"/other/route", "", 404, "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = test.path
+		if test.encoding != "" {
+			r.Header.Set("Accept-Encoding", test.encoding)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: Wrong status. Expected: %d, Got: %d\n", test.path, test.status, w.Code)
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("%s (%s): Wrong body: %s\n", test.path, test.encoding, w.Body.String())
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.cache {
+			t.Errorf("%s: Wrong Cache-Control: %s\n", test.path, cc)
+		}
+	}
+
+	// Encoded files keep the type of the file, and has their own etag.
+	r := httptest.NewRequest("GET", "/test/app.js", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	plainTag := w.Header().Get("Etag")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Wrong encoding headers: %v\n", w.Header())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/javascript; charset=utf-8" && ct != "application/javascript" {
+		t.Errorf("Wrong content type: %s\n", ct)
+	}
+	if etag := w.Header().Get("Etag"); etag == "" || etag == plainTag {
+		t.Errorf("Encoded file has the same etag as the plain file: %s\n", etag)
+	}
+
+	// Unchanged files are not sent again.
+	r = httptest.NewRequest("GET", "/test/app.js", nil)
+	r.Header.Set("If-None-Match", plainTag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected a 304, got: %d\n", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/test/app.js", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != 405 {
+		t.Errorf("Expected a 405, got: %d\n", w.Code)
+	}
+}
+
+func TestStaticFilesConfig(t *testing.T) {
+	dir := newStaticTestDapp(t, map[string]string{"index.html": "", "file": ""})
+	tests := []struct {
+		id     string
+		config *dapps.StaticConfig
+		ok     bool
+	}{
+		{"test", nil, true},
+		{"admin", nil, false},
+		{"http", nil, false},
+		{"api", nil, false},
+		{"test", &dapps.StaticConfig{Dir: "../"}, false},
+		{"test", &dapps.StaticConfig{Dir: "/etc"}, false},
+		{"test", &dapps.StaticConfig{Dir: "missing"}, false},
+		{"test", &dapps.StaticConfig{Dir: "file"}, false},
+	}
+	for i, test := range tests {
+		err := newStaticFiles().set(test.id, dir, test.config)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: Expected ok: %t, Got: %v\n", i, test.ok, err)
+		}
+	}
+}
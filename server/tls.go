@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/files"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The files in the system directory that the generated certificate is
+// stored in.
+const (
+	TLS_CERT_FILE_NAME = "tls_cert.pem"
+	TLS_KEY_FILE_NAME  = "tls_key.pem"
+)
+
+// How long generated certificates are valid.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// Create the tls config for the web server.
+func loadTlsConfig(cfg *decerver.TlsConfig, fio files.FileIO, host string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("Both the tls certificate and key file must be set.")
+		}
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		cert, err = selfSignedCert(fio, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{}
+	tc.MinVersion = tls.VersionTLS12
+	tc.Certificates = []tls.Certificate{cert}
+	if cfg.ClientCaFile != "" {
+		pemData, err := ioutil.ReadFile(cfg.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("No certificates found in: %s", cfg.ClientCaFile)
+		}
+		tc.ClientCAs = pool
+		// Only the admin routes require a certificate, so they are not
+		// required during the handshake. Those that are given are verified.
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// Load the self-signed certificate from the system directory. It is
+// generated if it does not exist, or has expired.
+func selfSignedCert(fio files.FileIO, host string) (tls.Certificate, error) {
+	certPath := path.Join(fio.System(), TLS_CERT_FILE_NAME)
+	keyPath := path.Join(fio.System(), TLS_KEY_FILE_NAME)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Now().Before(leaf.NotAfter) {
+			return cert, nil
+		}
+		logger.Println("Self-signed certificate has expired. Generating a new one.")
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, fmt.Errorf("Failed to load self-signed certificate: %s", err.Error())
+	}
+
+	certPem, keyPem, err := generateCert(host)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := fio.WriteFile(fio.System(), TLS_KEY_FILE_NAME, keyPem); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := fio.WriteFile(fio.System(), TLS_CERT_FILE_NAME, certPem); err != nil {
+		return tls.Certificate{}, err
+	}
+	logger.Println("Generated self-signed certificate: " + certPath)
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+// Generate a self-signed certificate for the host (and localhost).
+// Returns the certificate and key, PEM encoded.
+func generateCert(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{}
+	tmpl.SerialNumber = serial
+	tmpl.Subject = pkix.Name{Organization: []string{"decerver"}, CommonName: host}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(selfSignedValidity)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	tmpl.BasicConstraintsValid = true
+	for _, h := range []string{host, "localhost", "127.0.0.1", "::1"} {
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPem, keyPem, nil
+}
+
+// Wraps the handler so that requests to the admin routes must have a
+// verified client certificate.
+func requireClientCert(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			writeAuthError(w, r, 403, "A client certificate is required.")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// The admin routes, version 2 of the admin api, and the metrics. The path
+// is not cleaned, so that it is the same path that the routes match.
+func isAdminPath(p string) bool {
+	return p == "/admin" || strings.HasPrefix(p, "/admin/") || isApiV2Path(p) || p == METRICS_PATH
+}
+
+// Listen on a unix socket. A stale socket file (from a decerver that did
+// not shut down properly) is removed first. The socket is made accessible
+// to the owner only.
+func listenUnix(socketPath string) (net.Listener, error) {
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Not a socket: %s", socketPath)
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Socket is in use: %s", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
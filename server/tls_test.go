@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/files"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// A FileIO with only a root and a system directory.
+type fakeFileIO struct {
+	files.FileIO
+	root   string
+	system string
+}
+
+func (ffio *fakeFileIO) Root() string {
+	return ffio.root
+}
+
+func (ffio *fakeFileIO) System() string {
+	return ffio.system
+}
+
+func (ffio *fakeFileIO) MarshalJsonToFile(directory, name string, object interface{}) error {
+	bts, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return ffio.WriteFile(directory, name, bts)
+}
+
+func (ffio *fakeFileIO) UnmarshalJsonFromFile(directory, name string, object interface{}) error {
+	bts, err := ioutil.ReadFile(path.Join(directory, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bts, object)
+}
+
+func (ffio *fakeFileIO) WriteFile(directory, name string, data []byte) error {
+	return ioutil.WriteFile(path.Join(directory, name), data, 0600)
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	fio := &fakeFileIO{system: t.TempDir()}
+	tc, err := loadTlsConfig(&decerver.TlsConfig{}, fio, "example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := leaf.VerifyHostname("example.com"); err != nil {
+		t.Error(err.Error())
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err.Error())
+	}
+	fi, err := os.Stat(path.Join(fio.system, TLS_KEY_FILE_NAME))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong key file mode: %v\n", fi.Mode())
+	}
+
+	// The stored certificate should be used the second time.
+	tc2, err := loadTlsConfig(&decerver.TlsConfig{}, fio, "example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(tc.Certificates[0].Certificate[0], tc2.Certificates[0].Certificate[0]) {
+		t.Error("A new certificate was generated.")
+	}
+
+	if _, err := loadTlsConfig(&decerver.TlsConfig{CertFile: "cert.pem"}, fio, "example.com"); err == nil {
+		t.Error("No error when the key file is missing.")
+	}
+}
+
+// Creates a certificate. If parent is nil, it is a self-signed CA.
+func testCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertAdmin(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := testCert(t, nil, nil)
+	_, _, clientCert := testCert(t, ca, caKey)
+	_, _, otherCert := testCert(t, nil, nil)
+	caFile := path.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+
+	tc, err := loadTlsConfig(&decerver.TlsConfig{ClientCaFile: caFile}, &fakeFileIO{system: dir}, "localhost")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reached := make(chan string, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- r.URL.Path
+		w.WriteHeader(200)
+	})
+	srv := httptest.NewUnstartedServer(canonicalPath(requireClientCert(handler)))
+	srv.TLS = tc
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+	}
+	tests := []struct {
+		client *http.Client
+		path   string
+		status int
+	}{
+		{client(), "/http/test/", 200},
+		{client(), "/admin/ready", 403},
+		{client(), "/admin/../admin/ready", 403},
+		{client(clientCert), "/admin/ready", 200},
+	}
+	for _, test := range tests {
+		resp, err := test.client.Get(srv.URL + test.path)
+		if err != nil {
+			t.Errorf("%s: %s\n", test.path, err.Error())
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: Wrong status. Expected: %d, Got: %d\n", test.path, test.status, resp.StatusCode)
+		}
+	}
+
+	// Paths that are not canonical never reach the handler. They used to
+	// get past the check, and match the admin routes.
+	for len(reached) > 0 {
+		<-reached
+	}
+	dial := func() (net.Conn, error) {
+		return tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	}
+	rawTests := []struct {
+		method   string
+		path     string
+		status   int
+		location string
+	}{
+		{"GET", "/admin/switch/../../evil", 301, "/evil"},
+		{"GET", "/admin/modules/..%2f..%2fmonk?a=b", 301, "/monk?a=b"},
+		{"POST", "/admin/modules/../../monk", 400, ""},
+		{"POST", "/admin//modules/monk", 400, ""},
+		{"POST", "/admin/modules/monk", 403, ""},
+	}
+	for _, test := range rawTests {
+		resp := doRawRequest(t, dial, test.method, test.path, nil)
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s %s: Expected: %d %s, Got: %d %s\n", test.method, test.path, test.status, test.location, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	if len(reached) > 0 {
+		t.Errorf("Request for %s reached the handler.\n", <-reached)
+	}
+
+	// Certificates from other CAs are rejected in the handshake.
+	if resp, err := client(otherCert).Get(srv.URL + "/admin/ready"); err == nil {
+		resp.Body.Close()
+		t.Error("Certificate from an unknown CA was accepted.")
+	}
+}
+
+// Send a request with the path exactly as it is given (clients clean
+// it), and read the response.
+func doRawRequest(t *testing.T, dial func() (net.Conn, error), method, p string, headers map[string]string) *http.Response {
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	req := method + " " + p + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 0\r\n"
+	for k, v := range headers {
+		req += k + ": " + v + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]string{
+		"":                 "/",
+		"/":                "/",
+		"/http/dapp/":      "/http/dapp/",
+		"/admin/./ready":   "/admin/ready",
+		"/admin/x/../../a": "/a",
+		"//admin":          "/admin",
+		"/a/b/..//":        "/a/",
+		"/..":              "/",
+	}
+	for p, want := range tests {
+		if cp := cleanPath(p); cp != want {
+			t.Errorf("%s: Expected: %s, Got: %s\n", p, want, cp)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "decerver.sock")
+
+	// A stale socket is removed.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong socket mode: %v\n", fi.Mode())
+	}
+
+	// A socket that is in use is not.
+	if _, err := listenUnix(socketPath); err == nil {
+		t.Error("Listened on a socket that is in use.")
+	}
+}
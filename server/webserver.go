@@ -1,38 +1,67 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/eris-ltd/decerver/interfaces/logging"
 	"github.com/eris-ltd/decerver/interfaces/decerver"
 	"github.com/eris-ltd/decerver/interfaces/dapps"
+	"github.com/eris-ltd/decerver/interfaces/network"
+	"github.com/eris-ltd/decerver/metrics"
 	"github.com/go-martini/martini"
-	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 const DEFAULT_PORT = 3000  // For communicating with dapps (the atom browser).
+const DEFAULT_MAX_CLIENTS = 10
 // const DECERVER_PORT = 3100 // For communication with the atom client back-end.
 
 const HTTP_BASE = "/http/"
 const WS_BASE = "/ws/"
+const SSE_BASE = "/sse/"
 
-var logger *log.Logger = logging.NewLogger("Webserver")
+var logger *logging.Logger = logging.NewLogger("Webserver")
 
 type WebServer struct {
 	webServer      *martini.ClassicMartini
+	// Routes the dapp endpoints. Other requests go to webServer.
+	router         *Router
 	maxConnections uint32
 	host		   string
 	port           int
 	dc       	   decerver.Decerver
 	was            *WsAPIServer
 	has            *HttpAPIServer
+	sas            *SseAPIServer
 	das            *DecerverAPIServer
+	static         *staticFiles
 	dm             dapps.DappManager
+	auth           *adminAuth
+	// Metrics that are read from the server when they are scraped.
+	metricsRegistry *metrics.Registry
+	// The running http servers (tcp, and unix socket if enabled). Guarded
+	// by mutex.
+	httpServers    []*http.Server
+	mutex          *sync.Mutex
+	routesOnce     *sync.Once
 }
 
 func NewWebServer(dc decerver.Decerver) *WebServer {
 	ws := &WebServer{}
-	
-	ws.maxConnections = uint32(dc.Config().MaxClients)
+	ws.mutex = &sync.Mutex{}
+	ws.routesOnce = &sync.Once{}
+
+	maxClients := dc.Config().MaxClients
+	if maxClients <= 0 {
+		maxClients = DEFAULT_MAX_CLIENTS
+	}
+	ws.maxConnections = uint32(maxClients)
 	port := dc.Config().Port
 	if port <= 0 {
 		port = DEFAULT_PORT
@@ -41,51 +70,297 @@ func NewWebServer(dc decerver.Decerver) *WebServer {
 	ws.host = dc.Config().Hostname
 	ws.dc = dc
 	rm := dc.RuntimeManager()
-	ws.was = NewWsAPIServer(rm, ws.maxConnections)
+	ws.was = NewWsAPIServer(rm, dc.EventProcessor(), ws.maxConnections, dc.Config().MaxClientsPerIp, dc.Config().Websocket)
 	ws.has = NewHttpAPIServer(rm)
+	ws.sas = NewSseAPIServer(rm, ws.was)
+	ws.static = newStaticFiles()
+	ws.metricsRegistry = ws.newMetricsRegistry()
 
 	ws.webServer = martini.Classic()
 	// TODO remember to change to martini.Prod
 	martini.Env = martini.Dev
+	ws.router = NewRouter(ws.webServer)
 
 	return ws
 }
 
-func (ws *WebServer) RegisterDapp(dappId string) {
-	logger.Println("Adding routes for: " + dappId + " path http: " + HTTP_BASE+dappId + "/(.*)")
-	ws.webServer.Any(HTTP_BASE+dappId + "/(.*)", ws.has.handleHttp)
-	ws.webServer.Get(WS_BASE+dappId, ws.was.handleWs)
+// Add the routes of a dapp. If it already has routes, they are replaced.
+func (ws *WebServer) RegisterDapp(dappId string) error {
+	logger.Println("Adding routes for: " + dappId + " path http: " + HTTP_BASE+dappId + "/")
+	return ws.router.Add(ws.dappRoutes(dappId))
+}
+
+// Remove the routes of a dapp, and forget its settings.
+func (ws *WebServer) UnregisterDapp(dappId string) {
+	if ws.router.Remove(dappId) {
+		logger.Println("Removed routes for: " + dappId)
+	}
+	ws.static.remove(dappId)
+	ws.was.SetOriginPolicy(dappId, nil)
+	ws.was.SetWsProtocol(dappId, "")
+	ws.was.SetRateLimits(dappId, nil)
+	deleteDappMetrics(dappId)
+}
+
+func (ws *WebServer) dappRoutes(dappId string) *RouteGroup {
+	// Requests from other sites are refused unless the dapp allows them.
+	// Preflight requests are answered without calling the dapp. Websockets
+	// check the origin themselves. Requests that go to the runtime are rate
+	// limited (websocket messages are limited by the session). Requests
+	// that are answered by the server are metered too.
+	cors := ws.was.origins.middleware
+	limit := ws.was.limits.middleware
+	get := allowMethods("GET")
+
+	g := NewRouteGroup(dappId)
+	g.HandlePrefix(HTTP_BASE+dappId, ws.has.handleHttp, metered(ROUTE_HTTP), cors, limit)
+	g.Handle(WS_BASE+dappId, ws.was.handleWs, get)
+	g.Handle(SSE_BASE+dappId, ws.sas.handleSse, get, cors, limit)
+	g.HandlePrefix("/"+dappId, ws.static.handle, metered(ROUTE_STATIC))
+	return g
+}
+
+func (ws *WebServer) SessionCount(dappId string) int {
+	return ws.was.DappSessionCount(dappId)
+}
+
+func (ws *WebServer) Sessions() []*network.SessionInfo {
+	return ws.was.Sessions()
+}
+
+func (ws *WebServer) SetWsProtocol(dappId, protocol string) error {
+	return ws.was.SetWsProtocol(dappId, protocol)
+}
+
+func (ws *WebServer) SetOriginPolicy(dappId string, policy *dapps.OriginPolicy) error {
+	return ws.was.SetOriginPolicy(dappId, policy)
+}
+
+func (ws *WebServer) SetRateLimits(dappId string, limits *dapps.RateLimits) error {
+	return ws.was.SetRateLimits(dappId, limits)
+}
+
+func (ws *WebServer) Throttled(dappId string) *dapps.ThrottleStats {
+	return ws.was.limits.stats(dappId)
+}
+
+func (ws *WebServer) SetStaticFiles(dappId, dir string, config *dapps.StaticConfig) error {
+	return ws.static.set(dappId, dir, config)
 }
 
 func (ws *WebServer) AddDappManager(dm dapps.DappManager) {
 	ws.dm = dm
 }
 
+// Start the server. It can be started again after it has been shut down.
 func (ws *WebServer) Start() error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if len(ws.httpServers) != 0 {
+		return fmt.Errorf("Server is already running.")
+	}
+	ws.routesOnce.Do(ws.addRoutes)
+	cfg := ws.dc.Config()
+	if ws.auth == nil {
+		auth, err := newAdminAuth(ws.dc.FileIO())
+		if err != nil {
+			return err
+		}
+		ws.auth = auth
+	}
+	handler := ws.auth.wrap(ws.router)
+
+	addr := ws.host + ":" + fmt.Sprintf("%d", ws.port)
+	// Requests over tcp must be for one of our names (see origins.go).
+	hosts := newKnownHosts(ws.host, ws.port, cfg.ServerNames)
+	srv := &http.Server{Handler: hosts.middleware(canonicalPath(handler))}
+	scheme := "http"
+	if cfg.Tls != nil {
+		tlsConfig, err := loadTlsConfig(cfg.Tls, ws.dc.FileIO(), ws.host)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		if tlsConfig.ClientCAs != nil {
+			srv.Handler = hosts.middleware(canonicalPath(requireClientCert(handler)))
+		}
+		scheme = "https"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if srv.TLSConfig != nil {
+		listener = tls.NewListener(listener, srv.TLSConfig)
+	}
+	servers := []*http.Server{srv}
+	listeners := []net.Listener{listener}
+	urls := []string{scheme + "://" + addr}
+
+	// Local tools use the unix socket. Access is controlled by the file
+	// permissions, so no client certificate is needed (admin tokens are).
+	if cfg.UnixSocket != "" {
+		unixListener, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		servers = append(servers, &http.Server{Handler: canonicalPath(handler)})
+		listeners = append(listeners, unixListener)
+		urls = append(urls, "unix:"+cfg.UnixSocket)
+	}
+
+	ws.was.Open()
+	ws.sas.Open()
+	ws.httpServers = servers
+	for i, srv := range servers {
+		go func(srv *http.Server, listener net.Listener, url string) {
+			logger.Println("Listening on " + url)
+			err := srv.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				logger.Printf("Server on %s stopped: %s\n", url, err.Error())
+			}
+		}(srv, listeners[i], urls[i])
+	}
+	return nil
+}
+
+// Requests must use the canonical form of their path, so that the admin
+// checks see the same path as the routes. This is the outermost handler.
+// GET and HEAD requests for paths with '.', '..' or empty segments are
+// redirected to the canonical path, other requests are refused.
+func canonicalPath(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cp := cleanPath(r.URL.Path)
+		if cp == r.URL.Path {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			u := *r.URL
+			u.Path = cp
+			u.RawPath = ""
+			http.Redirect(w, r, u.RequestURI(), 301)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprint(w, "The request path is not canonical: use "+cp)
+	})
+}
+
+// Clean a request path. A trailing slash is kept.
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cp := path.Clean(p)
+	if cp != "/" && strings.HasSuffix(p, "/") {
+		cp += "/"
+	}
+	return cp
+}
+
+// Shut the server down. The listeners are closed right away, websocket
+// sessions are sent a close frame, and event streams are ended. Other
+// requests are given until the timeout to finish, after which their
+// connections are closed.
+func (ws *WebServer) Shutdown(timeout time.Duration) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	servers := ws.httpServers
+	if len(servers) == 0 {
+		return nil
+	}
+	ws.httpServers = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// This closes the listeners, and then waits for the requests.
+	drained := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
+			drained <- err
+		}(srv)
+	}
+
+	failed := make([]string, 0)
+	if num := ws.was.Shutdown(ctx); num > 0 {
+		failed = append(failed, fmt.Sprintf("%d websocket session(s) did not close", num))
+	}
+	ws.sas.Shutdown()
+
+	for range servers {
+		if err := <-drained; err != nil {
+			failed = append(failed, "http requests did not finish ("+err.Error()+")")
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Server did not shut down cleanly: %s.", strings.Join(failed, ", "))
+	}
+	logger.Println("Server shut down.")
+	return nil
+}
 
-	ws.webServer.Use(martini.Static(ws.dc.FileIO().Dapps()))
+func (ws *WebServer) addRoutes() {
 
 	das := NewDecerverAPIServer(ws.dc, ws.dm)
 
+	// Admin api, version 2
+	api := NewApiV2Server(ws.dc, ws.dm)
+	ws.webServer.Any(API_V2_BASE+"/(.*)", api.ServeHTTP)
+
+	// Metrics
+	ws.webServer.Get(METRICS_PATH, metrics.Handler(metrics.Default, ws.metricsRegistry).ServeHTTP)
+
+	// Dashboard
+	ws.webServer.Get(DASHBOARD_PATH, das.handleDashboard)
+	ws.webServer.Get(DASHBOARD_PATH+"/(.*)", das.handleDashboard)
+
+	// The old admin routes. They are kept for now, but new clients should
+	// use the v2 api.
+
 	// Decerver ready
-	ws.webServer.Get("/admin/ready", das.handleReadyGET)
+	ws.webServer.Get("/admin/ready", deprecated(API_V2_BASE+"/status", das.handleReadyGET))
 
 	// Decerver configuration
-	ws.webServer.Get("/admin/decerver", das.handleDecerverGET)
-	ws.webServer.Post("/admin/decerver", das.handleDecerverPOST)
+	ws.webServer.Get("/admin/decerver", deprecated(API_V2_BASE+"/config", das.handleDecerverGET))
+	ws.webServer.Post("/admin/decerver", deprecated(API_V2_BASE+"/config", das.handleDecerverPOST))
+
+	// Dapps and runtimes
+	ws.webServer.Get("/admin/dapps", deprecated(API_V2_BASE+"/dapps", das.handleDappsGET))
+	ws.webServer.Get("/admin/runtimes", deprecated(API_V2_BASE+"/runtimes", das.handleRuntimesGET))
+
+	// Modules and their state. This must come before the config routes.
+	ws.webServer.Get("/admin/modules", deprecated(API_V2_BASE+"/modules", das.handleModulesGET))
 
 	// Module configuration
-	ws.webServer.Get("/admin/modules/(.*)", das.handleModuleGET)
-	ws.webServer.Post("/admin/modules/(.*)", das.handleModulePOST)
+	ws.webServer.Get("/admin/modules/(.*)", deprecated(API_V2_BASE+"/modules/%s/config", das.handleModuleGET))
+	ws.webServer.Post("/admin/modules/(.*)", deprecated(API_V2_BASE+"/modules/%s/config", das.handleModulePOST))
 
 	// Decerver configuration
-	ws.webServer.Get("/admin/switch/(.*)", das.handleDappSwitch)
-
-	// TODO Close down properly. Removed that third party stuff since 
-	// it was a mess.
-	go func() {
-		ws.webServer.RunOnAddr(ws.host + ":" + fmt.Sprintf("%d", ws.port))
-	}()
-	
-	return nil
+	ws.webServer.Get("/admin/switch/(.*)", deprecated(API_V2_BASE+"/dapps/%s/runtime", das.handleDappSwitch))
+
+	// Dapp permissions
+	ws.webServer.Get("/admin/permissions/(.*)", deprecated(API_V2_BASE+"/dapps/%s/permissions", das.handlePermissionsGET))
+	ws.webServer.Post("/admin/permissions/(.*)", deprecated(API_V2_BASE+"/dapps/%s/permissions", das.handlePermissionsPOST))
+
+	// Dapp quotas
+	ws.webServer.Get("/admin/quotas/(.*)", deprecated(API_V2_BASE+"/dapps/%s/quotas", das.handleQuotasGET))
+
+	// Websocket sessions
+	ws.webServer.Get("/admin/sessions", deprecated(API_V2_BASE+"/sessions", das.handleSessionsGET))
+
+	// Event traffic (debug mode only)
+	ws.webServer.Get("/admin/traffic", deprecated(API_V2_BASE+"/traffic", das.handleTrafficGET))
+
+	// Runtime profiling
+	ws.webServer.Get("/admin/profile/(.*)", deprecated(API_V2_BASE+"/runtimes/%s/profile", das.handleProfileGET))
+	ws.webServer.Post("/admin/profile/(.*)", deprecated(API_V2_BASE+"/runtimes/%s/profile/dumps", das.handleProfilePOST))
+	ws.webServer.Delete("/admin/profile/(.*)", deprecated(API_V2_BASE+"/runtimes/%s/profile", das.handleProfileDELETE))
 }
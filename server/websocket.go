@@ -4,11 +4,15 @@
 package server
 
 import (
+	"github.com/eris-ltd/decerver/interfaces/decerver"
+	"github.com/eris-ltd/decerver/interfaces/scripting"
 	"github.com/gorilla/websocket"
 	"io/ioutil"
+	"net/http"
 	"time"
 )
 
+// Defaults for the websocket settings in the decerver config.
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -23,10 +27,61 @@ const (
 	maxMessageSize = 8192
 )
 
-// TODO need to look over this and maxMessageSize
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  8192,
-	WriteBufferSize: 8192,
+// The websocket settings that are used by the server.
+type wsSettings struct {
+	writeWait      time.Duration
+	downWait       time.Duration
+	pingPeriod     time.Duration
+	maxMessageSize int64
+	compression    bool
+}
+
+// Get the settings from the config. Missing values gets the defaults. If
+// the ping period is not shorter then the time we wait for the 'down'
+// message, it is adjusted so that live connections are not dropped.
+func newWsSettings(cfg *decerver.WsConfig) *wsSettings {
+	ws := &wsSettings{writeWait, downWait, pingPeriod, maxMessageSize, false}
+	if cfg == nil {
+		return ws
+	}
+	if cfg.WriteWait > 0 {
+		ws.writeWait = time.Duration(cfg.WriteWait) * time.Millisecond
+	}
+	if cfg.PongWait > 0 {
+		ws.downWait = time.Duration(cfg.PongWait) * time.Millisecond
+		ws.pingPeriod = (ws.downWait * 9) / 10
+	}
+	if cfg.PingPeriod > 0 {
+		ws.pingPeriod = time.Duration(cfg.PingPeriod) * time.Millisecond
+	}
+	if ws.pingPeriod >= ws.downWait {
+		logger.Printf("Websocket ping period (%v) must be less then the pong wait (%v). Adjusting.\n", ws.pingPeriod, ws.downWait)
+		ws.pingPeriod = (ws.downWait * 9) / 10
+	}
+	if cfg.MaxMessageSize > 0 {
+		ws.maxMessageSize = cfg.MaxMessageSize
+	}
+	ws.compression = cfg.Compression
+	return ws
+}
+
+// The largest message a client may send to a dapp. It is the servers limit,
+// unless the dapp has a lower quota.
+func (ws *wsSettings) messageLimit(quotas *scripting.Quotas) int64 {
+	if quotas != nil && quotas.MaxWsMessageBytes > 0 && quotas.MaxWsMessageBytes < ws.maxMessageSize {
+		return quotas.MaxWsMessageBytes
+	}
+	return ws.maxMessageSize
+}
+
+func (ws *wsSettings) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    8192,
+		WriteBufferSize:   8192,
+		EnableCompression: ws.compression,
+		// Origins are checked in handleWs, before admission.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
 }
 
 // Base message type we pass to writer. Text, Bro and close.
@@ -55,11 +110,24 @@ func GetCloseMessage() *Message {
 }
 
 type WsConn struct {
-	sessionId         uint32
-	conn              *websocket.Conn
-	writeMsgChannel   chan *Message
-	writeCloseChannel chan *Message
-	// writeBroChannel   chan *Message
+	sessionId       uint32
+	conn            *websocket.Conn
+	writeMsgChannel chan *Message
+	// Closed when the session starts closing. Stops the writer, and
+	// unblocks anyone waiting to queue a message.
+	closing chan struct{}
+	// Closed when the writer has returned.
+	writerDone chan struct{}
+}
+
+func newWsConn(conn *websocket.Conn) *WsConn {
+	wc := &WsConn{}
+	wc.conn = conn
+	// TODO buffering...
+	wc.writeMsgChannel = make(chan *Message, 256)
+	wc.closing = make(chan struct{})
+	wc.writerDone = make(chan struct{})
+	return wc
 }
 
 func (wc *WsConn) SessionId() uint32 {
@@ -70,67 +138,115 @@ func (wc *WsConn) Connection() *websocket.Conn {
 	return wc.conn
 }
 
+// Queue a message. Blocks until there is room in the queue, or the
+// connection is closing (in which case the message is dropped).
 func (wc *WsConn) WriteJsonMsg(msg []byte) {
-	wc.writeMsgChannel <- &Message{Data: msg, Type: websocket.TextMessage}
+	select {
+	case wc.writeMsgChannel <- &Message{Data: msg, Type: websocket.TextMessage}:
+	case <-wc.closing:
+	}
 }
 
-func (wc *WsConn) WriteCloseMsg() {
-	wc.writeCloseChannel <- &Message{Data: nil, Type: websocket.CloseMessage}
+// Queue a message without blocking. Returns false if the message was
+// dropped, because the queue is full or the connection is closing.
+func (wc *WsConn) tryWriteJsonMsg(msg []byte) bool {
+	select {
+	case <-wc.closing:
+		return false
+	default:
+	}
+	select {
+	case wc.writeMsgChannel <- &Message{Data: msg, Type: websocket.TextMessage}:
+		return true
+	default:
+		return false
+	}
 }
 
-// Handle the reader
+// Handle the reader. The read deadline is pushed forward every time
+// something arrives from the peer (pongs included), so a connection that
+// has been silent for longer then the down wait is considered dead.
 func reader(ss *Session) {
 	conn := ss.wsConn.conn
+	settings := ss.server.settings
 
-	conn.SetReadLimit(maxMessageSize)
-	// TODO add for hosted. No need for 'bro -> down' packets when only on localhost...
-	//wsc.conn.SetReadDeadline(time.Now().Add(downWait))
-	conn.SetReadDeadline(time.Time{})
-	//wsc.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(downWait)); return nil })
+	conn.SetReadLimit(ss.messageLimit)
+	conn.SetReadDeadline(time.Now().Add(settings.downWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(settings.downWait))
+		return nil
+	})
 
-	// TODO add back the reader timeout?
 	for {
 
 		mType, message, err := conn.NextReader()
 
 		if err != nil {
-			ss.wsConn.writeCloseChannel <- GetCloseMessage()
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Printf("Websocket read failed (session: %d): %s\n", ss.SessionId(), err.Error())
+			}
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(settings.downWait))
 
 		if mType == websocket.TextMessage {
-			rpcReq, _ := ioutil.ReadAll(message)
-			ss.handleRequest(string(rpcReq))
+			rpcReq, err := ioutil.ReadAll(message)
+			if err != nil {
+				// Most likely the message was too large. The connection
+				// can not be used after that.
+				logger.Printf("Websocket read failed (session: %d): %s\n", ss.SessionId(), err.Error())
+				return
+			}
+			ss.countIn(len(rpcReq))
+			if ss.allowMessage(rpcReq) {
+				ss.handleRequest(string(rpcReq))
+			}
 		} else if mType == websocket.CloseMessage {
 			return
 		}
 
+		if ss.State() != SESSION_OPEN {
+			return
+		}
 	}
 }
 
-// Handle the writer
+// Handle the writer. It is the only goroutine that writes to the
+// connection. It sends a ping ('bro') every ping period. When the session
+// starts closing it sends a close frame and returns.
 func writer(ss *Session) {
-	conn := ss.wsConn.conn
+	wc := ss.wsConn
+	conn := wc.conn
+	settings := ss.server.settings
+	ticker := time.NewTicker(settings.pingPeriod)
+	defer func() {
+		ticker.Stop()
+		close(wc.writerDone)
+	}()
 	for {
-		message, ok := <-ss.wsConn.writeMsgChannel
-
-		if !ok {
-			conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		}
-
-		if message.Data == nil {
-			return
-		}
-
-		if message.Type == websocket.CloseMessage {
-			conn.WriteMessage(websocket.CloseMessage, []byte{})
+		select {
+		case message := <-wc.writeMsgChannel:
+			conn.SetWriteDeadline(time.Now().Add(settings.writeWait))
+			if err := conn.WriteMessage(message.Type, message.Data); err != nil {
+				// The connection is broken. Close must run in another
+				// goroutine, since it waits for the writer.
+				go ss.Close()
+				return
+			}
+			if message.Type == websocket.TextMessage {
+				ss.countOut(len(message.Data))
+			}
+		case <-ticker.C:
+			bro := GetBroMessage()
+			conn.SetWriteDeadline(time.Now().Add(settings.writeWait))
+			if err := conn.WriteMessage(bro.Type, bro.Data); err != nil {
+				go ss.Close()
+				return
+			}
+		case <-wc.closing:
+			conn.SetWriteDeadline(time.Now().Add(settings.writeWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			return
 		}
-
-		if err := conn.WriteMessage(websocket.TextMessage, message.Data); err != nil {
-			return
-		}
-
 	}
 }
@@ -0,0 +1,409 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/eris-ltd/decerver/interfaces/logging"
+	"github.com/eris-ltd/decerver/metrics"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger *logging.Logger = logging.NewLogger("Tracing")
+
+var (
+	spansExported = metrics.NewCounterVec("decerver_trace_spans_exported_total",
+		"Spans that have been exported.").With()
+	spansDropped = metrics.NewCounterVec("decerver_trace_spans_dropped_total",
+		"Spans that were dropped because the export queue was full, or the export failed.").With()
+)
+
+const (
+	// Spans are exported in batches of this size, or when they have
+	// waited for the flush period.
+	BATCH_SIZE   = 512
+	FLUSH_PERIOD = 5 * time.Second
+	// Spans that are ended when the queue is full are dropped.
+	QUEUE_SIZE = 4096
+	// The trace file is rotated when it reaches this size. Only the newest
+	// rotated files are kept.
+	TRACE_FILE_MAX_SIZE    = 50 * 1024 * 1024
+	TRACE_FILE_MAX_BACKUPS = 3
+	// The path that spans are posted to on collectors.
+	OTLP_TRACES_PATH = "/v1/traces"
+
+	DEFAULT_SERVICE_NAME = "decerver"
+)
+
+// Tracing settings. Tracing is off unless there is a file or an endpoint
+// to export to.
+type Config struct {
+	// Spans are written to this file as OTLP json, one export request per
+	// line (the format of the OpenTelemetry collector's file exporter). A
+	// relative path is in the log directory.
+	File string `json:"file"`
+	// An OTLP/HTTP collector, e.g. "http://localhost:4318". Spans are
+	// posted (as json) to its /v1/traces path.
+	Endpoint string `json:"endpoint"`
+	// The fraction (0 to 1) of new traces that are recorded. Requests with
+	// a traceparent header follow the sampling decision in it.
+	SampleRate float64 `json:"sample_rate"`
+	// The service name of the spans. The default is "decerver".
+	ServiceName string `json:"service_name"`
+}
+
+type exporter interface {
+	// Export a json encoded OTLP export request.
+	export(req []byte) error
+	close() error
+}
+
+type fileExporter struct {
+	file *logging.RotatingFile
+}
+
+func (fe *fileExporter) export(req []byte) error {
+	_, err := fe.file.Write(append(req, '\n'))
+	return err
+}
+
+func (fe *fileExporter) close() error {
+	return fe.file.Close()
+}
+
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (he *httpExporter) export(req []byte) error {
+	resp, err := he.client.Post(he.url, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector responded with status %d.", resp.StatusCode)
+	}
+	return nil
+}
+
+func (he *httpExporter) close() error {
+	he.client.CloseIdleConnections()
+	return nil
+}
+
+type tracer struct {
+	service    string
+	sampleRate float64
+	exporters  []exporter
+	queue      chan *Span
+	// Closed to stop the export loop, which closes done when it has
+	// exported the remaining spans.
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	tracerMutex = &sync.RWMutex{}
+	active      *tracer
+)
+
+func activeTracer() *tracer {
+	tracerMutex.RLock()
+	defer tracerMutex.RUnlock()
+	return active
+}
+
+func (t *tracer) sample() bool {
+	return t.sampleRate >= 1 || (t.sampleRate > 0 && rand.Float64() < t.sampleRate)
+}
+
+// Never blocks. The queue is not closed when the tracer stops, so spans
+// that end after that are dropped once it is full.
+func (t *tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		spansDropped.Inc()
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(FLUSH_PERIOD)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, BATCH_SIZE)
+	flush := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = make([]*Span, 0, BATCH_SIZE)
+		}
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			// Only this loop receives from the queue.
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+				if len(batch) >= BATCH_SIZE {
+					flush()
+				}
+			}
+			flush()
+			close(t.done)
+			return
+		}
+	}
+}
+
+func (t *tracer) export(spans []*Span) {
+	req, err := json.Marshal(newOtlpRequest(t.service, spans))
+	if err != nil {
+		logger.Error("Failed to encode spans.", "error", err.Error())
+		spansDropped.Add(float64(len(spans)))
+		return
+	}
+	failed := false
+	for _, e := range t.exporters {
+		if err := e.export(req); err != nil {
+			logger.Warn("Failed to export spans.", "spans", len(spans), "error", err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		spansDropped.Add(float64(len(spans)))
+	} else {
+		spansExported.Add(float64(len(spans)))
+	}
+}
+
+// Apply the config. The new tracer is set up before the previous one (if
+// any) is shut down, so that a bad config leaves the current one running.
+// Dir is the log directory, which relative trace file paths are in.
+func Configure(cfg *Config, dir string) error {
+	if cfg == nil || (cfg.File == "" && cfg.Endpoint == "") {
+		return Shutdown()
+	}
+	t, err := newTracer(cfg, dir)
+	if err != nil {
+		return err
+	}
+	go t.run()
+
+	tracerMutex.Lock()
+	prev := active
+	active = t
+	tracerMutex.Unlock()
+	logger.Info("Tracing started.", "file", cfg.File, "endpoint", cfg.Endpoint, "sample_rate", cfg.SampleRate)
+	return prev.shutdown()
+}
+
+// Check the config, and create a tracer with its exporters. It is not
+// running yet.
+func newTracer(cfg *Config, dir string) (*tracer, error) {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("The sample rate must be between 0 and 1: %v", cfg.SampleRate)
+	}
+	t := &tracer{}
+	t.service = cfg.ServiceName
+	if t.service == "" {
+		t.service = DEFAULT_SERVICE_NAME
+	}
+	t.sampleRate = cfg.SampleRate
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid collector endpoint: %s", cfg.Endpoint)
+		}
+		if !strings.HasSuffix(u.Path, OTLP_TRACES_PATH) {
+			u.Path = strings.TrimSuffix(u.Path, "/") + OTLP_TRACES_PATH
+		}
+		t.exporters = append(t.exporters, &httpExporter{u.String(), &http.Client{Timeout: 10 * time.Second}})
+	}
+	// The file is opened last, so there is nothing to close if the config
+	// is bad.
+	if cfg.File != "" {
+		file := cfg.File
+		if !filepath.IsAbs(file) {
+			if dir == "" {
+				return nil, fmt.Errorf("Trace file '%s' is relative, but there is no log directory.", file)
+			}
+			file = filepath.Join(dir, file)
+		}
+		rf, err := logging.OpenRotatingFile(file, TRACE_FILE_MAX_SIZE, 0, TRACE_FILE_MAX_BACKUPS)
+		if err != nil {
+			return nil, err
+		}
+		t.exporters = append(t.exporters, &fileExporter{rf})
+	}
+	t.queue = make(chan *Span, QUEUE_SIZE)
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	return t, nil
+}
+
+// Stop tracing. The spans that have ended are exported first. Spans that
+// end after this are dropped.
+func Shutdown() error {
+	tracerMutex.Lock()
+	t := active
+	active = nil
+	tracerMutex.Unlock()
+	return t.shutdown()
+}
+
+// Stop the tracer and close its exporters. It must not be active. Does
+// nothing if t is nil.
+func (t *tracer) shutdown() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.done
+	errs := make([]string, 0)
+	for _, e := range t.exporters {
+		if err := e.close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to close exporters: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// The OTLP json encoding (ExportTraceServiceRequest). Ids are hex strings,
+// and 64 bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   *otlpResource     `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope *otlpScope  `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newOtlpRequest(service string, spans []*Span) *otlpRequest {
+	ss := &otlpScopeSpans{Scope: &otlpScope{Name: DEFAULT_SERVICE_NAME}}
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, newOtlpSpan(s))
+	}
+	rs := &otlpResourceSpans{ScopeSpans: []*otlpScopeSpans{ss}}
+	rs.Resource = &otlpResource{[]*otlpKeyValue{{"service.name", otlpValue(service)}}}
+	return &otlpRequest{[]*otlpResourceSpans{rs}}
+}
+
+// The span must have ended.
+func newOtlpSpan(s *Span) *otlpSpan {
+	ospan := &otlpSpan{}
+	ospan.TraceId = s.sc.TraceId.String()
+	ospan.SpanId = s.sc.SpanId.String()
+	if s.parent.IsValid() {
+		ospan.ParentSpanId = s.parent.String()
+	}
+	ospan.Name = s.name
+	ospan.Kind = s.kind
+	ospan.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+	ospan.EndTimeUnixNano = strconv.FormatInt(s.end.UnixNano(), 10)
+	for _, a := range s.attrs {
+		ospan.Attributes = append(ospan.Attributes, &otlpKeyValue{a.key, otlpValue(a.value)})
+	}
+	ospan.Status = &otlpStatus{s.status, s.message}
+	return ospan
+}
+
+func otlpValue(v interface{}) *otlpAnyValue {
+	av := &otlpAnyValue{}
+	var i int64
+	switch val := v.(type) {
+	case string:
+		av.StringValue = &val
+		return av
+	case bool:
+		av.BoolValue = &val
+		return av
+	case float64:
+		av.DoubleValue = &val
+		return av
+	case float32:
+		f := float64(val)
+		av.DoubleValue = &f
+		return av
+	case int:
+		i = int64(val)
+	case int32:
+		i = int64(val)
+	case int64:
+		i = val
+	case uint32:
+		i = int64(val)
+	case uint16:
+		i = int64(val)
+	default:
+		str := fmt.Sprint(v)
+		av.StringValue = &str
+		return av
+	}
+	str := strconv.FormatInt(i, 10)
+	av.IntValue = &str
+	return av
+}
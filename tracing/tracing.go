@@ -0,0 +1,309 @@
+// Package tracing records spans for requests as they pass through the web
+// server, the runtimes and the modules, so that it is possible to see
+// where the time of a slow request went. Spans are exported in the
+// OpenTelemetry (OTLP) json format, to a file and/or a collector.
+//
+// The trace context is passed along in a context.Context, and between
+// processes in the W3C 'traceparent' header. When tracing is off, Start
+// returns nil spans. All Span methods can be called on nil.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The header that carries the trace context.
+const TRACEPARENT_HEADER = "traceparent"
+
+type TraceId [16]byte
+
+type SpanId [8]byte
+
+func (id TraceId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceId) IsValid() bool {
+	return id != TraceId{}
+}
+
+func (id SpanId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanId) IsValid() bool {
+	return id != SpanId{}
+}
+
+func newTraceId() TraceId {
+	var id TraceId
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanId() SpanId {
+	var id SpanId
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// The part of a span that is passed on to child spans, and to other
+// processes.
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	// Whether the trace is recorded.
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId.IsValid() && sc.SpanId.IsValid()
+}
+
+// Format the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceId.String() + "-" + sc.SpanId.String() + "-" + flags
+}
+
+// Parse a traceparent header value (version-traceid-spanid-flags).
+// Versions later then 00 are accepted, as long as they start with those
+// fields.
+func ParseTraceparent(s string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("Malformed traceparent: %s", s)
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return sc, fmt.Errorf("Unsupported traceparent version: %s", s)
+	}
+	if strings.ToLower(s) != s {
+		return sc, fmt.Errorf("Traceparent must be lower case: %s", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	_, errT := hex.Decode(sc.TraceId[:], []byte(parts[1]))
+	_, errS := hex.Decode(sc.SpanId[:], []byte(parts[2]))
+	if err != nil || errT != nil || errS != nil || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("Invalid traceparent: %s", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Get the trace context from the traceparent header of a request. It is
+// invalid (the zero value) if there is none, or it is malformed.
+func Extract(h http.Header) SpanContext {
+	sc, err := ParseTraceparent(h.Get(TRACEPARENT_HEADER))
+	if err != nil {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// Set the traceparent header of a request, if the span context is valid.
+func Inject(h http.Header, sc SpanContext) {
+	if sc.IsValid() {
+		h.Set(TRACEPARENT_HEADER, sc.Traceparent())
+	}
+}
+
+// The kinds of spans, with their OTLP values.
+type SpanKind int
+
+const (
+	KIND_INTERNAL SpanKind = 1
+	KIND_SERVER   SpanKind = 2
+	KIND_CLIENT   SpanKind = 3
+)
+
+// Span status codes (OTLP values).
+const (
+	STATUS_UNSET = 0
+	STATUS_OK    = 1
+	STATUS_ERROR = 2
+)
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// A timed operation. Spans that are not sampled are only used to pass
+// the trace context on.
+type Span struct {
+	tracer *tracer
+	mutex  *sync.Mutex
+	name   string
+	kind   SpanKind
+	sc     SpanContext
+	parent SpanId
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	status int
+	// The status message.
+	message string
+	ended   bool
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) Name() string {
+	if s == nil {
+		return ""
+	}
+	return s.name
+}
+
+// Is the span recorded?
+func (s *Span) Recording() bool {
+	return s != nil && s.sc.Sampled
+}
+
+// Set an attribute. Values should be strings, numbers or booleans; other
+// values are formatted with fmt.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.Recording() {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended {
+		return
+	}
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// Mark the span as failed.
+func (s *Span) SetError(msg string) {
+	if !s.Recording() {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.ended {
+		s.status = STATUS_ERROR
+		s.message = msg
+	}
+}
+
+// End the span. It is exported if it is recorded. Calls after the first
+// do nothing.
+func (s *Span) End() {
+	if !s.Recording() {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = now()
+	s.mutex.Unlock()
+	s.tracer.enqueue(s)
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// Get the current span. It is nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// Add the span context of a remote parent (from a traceparent header).
+// Spans that are started from the returned context without a local
+// parent become its children. Invalid span contexts are ignored.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// Start a span. It is a child of the span in the context, or of the
+// remote parent if there is no span. Otherwise it starts a new trace,
+// which is sampled according to the sample rate. Returns a context with
+// the new span in it, and a nil span if tracing is off.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := activeTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if ps := SpanFromContext(ctx); ps != nil {
+		parent = ps.sc
+	} else if rsc, ok := ctx.Value(remoteKey).(SpanContext); ok {
+		parent = rsc
+	}
+	s := &Span{}
+	s.tracer = t
+	s.mutex = &sync.Mutex{}
+	s.name = name
+	s.kind = kind
+	s.sc.SpanId = newSpanId()
+	if parent.IsValid() {
+		s.sc.TraceId = parent.TraceId
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanId
+	} else {
+		s.sc.TraceId = newTraceId()
+		s.sc.Sampled = t.sample()
+	}
+	s.start = now()
+	return ContextWithSpan(ctx, s), s
+}
+
+// Start a child span of a span. Returns nil if the parent is nil.
+func StartChild(parent *Span, name string, kind SpanKind) *Span {
+	if parent == nil {
+		return nil
+	}
+	_, s := Start(ContextWithSpan(context.Background(), parent), name, kind)
+	return s
+}
+
+// Is tracing on?
+func Enabled() bool {
+	return activeTracer() != nil
+}
+
+// Replaced in tests.
+var now = time.Now
@@ -0,0 +1,351 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The parts of the OTLP json that the tests look at.
+type testSpan struct {
+	TraceId           string `json:"traceId"`
+	SpanId            string `json:"spanId"`
+	ParentSpanId      string `json:"parentSpanId"`
+	Name              string `json:"name"`
+	Kind              int    `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	Attributes        []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type testRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string            `json:"key"`
+				Value map[string]string `json:"value"`
+			} `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []*testSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func (tr *testRequest) spans() []*testSpan {
+	spans := make([]*testSpan, 0)
+	for _, rs := range tr.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			spans = append(spans, ss.Spans...)
+		}
+	}
+	return spans
+}
+
+func readSpanFile(t *testing.T, p string) map[string]*testSpan {
+	bts, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	spans := make(map[string]*testSpan)
+	for _, line := range strings.Split(strings.TrimSpace(string(bts)), "\n") {
+		if line == "" {
+			continue
+		}
+		tr := &testRequest{}
+		if err := json.Unmarshal([]byte(line), tr); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, s := range tr.spans() {
+			spans[s.Name] = s
+		}
+	}
+	return spans
+}
+
+func TestTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		// Later versions may add fields.
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		sc, err := ParseTraceparent(test.header)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Expected ok: %v, Got: %v\n", test.header, test.ok, err)
+			continue
+		}
+		if test.ok && sc.Sampled != test.sampled {
+			t.Errorf("%s: Wrong sampled flag.\n", test.header)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Traceparent", tests[0].header)
+	sc := Extract(h)
+	out := http.Header{}
+	Inject(out, sc)
+	if out.Get(TRACEPARENT_HEADER) != tests[0].header {
+		t.Errorf("Wrong injected header: %s\n", out.Get(TRACEPARENT_HEADER))
+	}
+	Inject(out, SpanContext{})
+	if out.Get(TRACEPARENT_HEADER) != tests[0].header {
+		t.Error("Invalid span context was injected.")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if err := Configure(&Config{SampleRate: 1}, t.TempDir()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if Enabled() {
+		t.Fatal("Tracing is on without an exporter.")
+	}
+	ctx, span := Start(context.Background(), "test", KIND_SERVER)
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Error("Got a span when tracing is off.")
+	}
+	// Nil spans can be used.
+	span.SetAttribute("a", 1)
+	span.SetError("error")
+	span.End()
+	if StartChild(span, "child", KIND_INTERNAL) != nil {
+		t.Error("Got a child of a nil span.")
+	}
+}
+
+func TestFileExport(t *testing.T) {
+	dir := t.TempDir()
+	if err := Configure(&Config{File: "traces.json", SampleRate: 1, ServiceName: "test"}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Shutdown()
+	start := time.Unix(1000, 5)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := Start(ContextWithRemote(context.Background(), remote), "server", KIND_SERVER)
+	server.SetAttribute("str", "a")
+	server.SetAttribute("int", 3)
+	server.SetAttribute("bool", true)
+	server.SetAttribute("float", 1.5)
+	server.SetAttribute("int", 4)
+	_, child := Start(ctx, "child", KIND_INTERNAL)
+	child.SetError("failed")
+	child.End()
+	grandchild := StartChild(child, "grandchild", KIND_CLIENT)
+	grandchild.End()
+	server.End()
+	// Ended spans can not be changed.
+	server.SetAttribute("late", 1)
+	server.End()
+	// A new trace.
+	_, root := Start(context.Background(), "root", KIND_SERVER)
+	root.End()
+
+	if err := Shutdown(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if Enabled() {
+		t.Error("Tracing is on after shutdown.")
+	}
+	spans := readSpanFile(t, filepath.Join(dir, "traces.json"))
+	if len(spans) != 4 {
+		t.Fatalf("Wrong number of spans: %d\n", len(spans))
+	}
+	s := spans["server"]
+	if s.TraceId != remote.TraceId.String() || s.ParentSpanId != remote.SpanId.String() || s.Kind != int(KIND_SERVER) {
+		t.Errorf("Server span is not a child of the remote parent: %+v\n", s)
+	}
+	if s.StartTimeUnixNano != "1000000000005" {
+		t.Errorf("Wrong start time: %s\n", s.StartTimeUnixNano)
+	}
+	attrs := make(map[string]interface{})
+	for _, a := range s.Attributes {
+		for _, v := range a.Value {
+			attrs[a.Key] = v
+		}
+	}
+	want := map[string]interface{}{"str": "a", "int": "4", "bool": true, "float": 1.5}
+	if len(attrs) != len(want) {
+		t.Errorf("Wrong attributes: %v\n", attrs)
+	}
+	for k, v := range want {
+		if attrs[k] != v {
+			t.Errorf("Attribute %s: Expected: %v, Got: %v\n", k, v, attrs[k])
+		}
+	}
+	if c := spans["child"]; c.ParentSpanId != s.SpanId || c.TraceId != s.TraceId || c.Status.Code != STATUS_ERROR || c.Status.Message != "failed" {
+		t.Errorf("Wrong child span: %+v\n", c)
+	}
+	if gc := spans["grandchild"]; gc.ParentSpanId != spans["child"].SpanId || gc.Kind != int(KIND_CLIENT) {
+		t.Errorf("Wrong grandchild span: %+v\n", gc)
+	}
+	if r := spans["root"]; r.TraceId == s.TraceId || r.ParentSpanId != "" {
+		t.Errorf("Wrong root span: %+v\n", r)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	dir := t.TempDir()
+	if err := Configure(&Config{File: "traces.json", SampleRate: 0}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Shutdown()
+	ctx, root := Start(context.Background(), "unsampled", KIND_SERVER)
+	if root == nil || root.Recording() || !root.Context().IsValid() {
+		t.Fatal("Unsampled span should carry a valid context, but not be recorded.")
+	}
+	// Children follow the decision.
+	_, child := Start(ctx, "unsampled child", KIND_INTERNAL)
+	if child.Recording() || child.Context().TraceId != root.Context().TraceId {
+		t.Error("Child of an unsampled span is recorded.")
+	}
+	child.End()
+	root.End()
+	// As do the children of remote parents.
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, sampled := Start(ContextWithRemote(context.Background(), remote), "sampled", KIND_SERVER)
+	sampled.End()
+	Shutdown()
+
+	spans := readSpanFile(t, filepath.Join(dir, "traces.json"))
+	if len(spans) != 1 || spans["sampled"] == nil {
+		t.Errorf("Wrong spans were exported: %v\n", spans)
+	}
+}
+
+func TestCollectorExport(t *testing.T) {
+	requests := make(chan *testRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != OTLP_TRACES_PATH || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(400)
+			return
+		}
+		bts, _ := ioutil.ReadAll(r.Body)
+		tr := &testRequest{}
+		if err := json.Unmarshal(bts, tr); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		requests <- tr
+	}))
+	defer srv.Close()
+
+	if err := Configure(&Config{Endpoint: srv.URL, SampleRate: 1}, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, span := Start(context.Background(), "posted", KIND_SERVER)
+	span.End()
+	if err := Shutdown(); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case tr := <-requests:
+		if spans := tr.spans(); len(spans) != 1 || spans[0].Name != "posted" {
+			t.Errorf("Wrong spans: %v\n", spans)
+		}
+		res := tr.ResourceSpans[0].Resource.Attributes
+		if len(res) != 1 || res[0].Key != "service.name" || res[0].Value["stringValue"] != DEFAULT_SERVICE_NAME {
+			t.Errorf("Wrong resource: %v\n", res)
+		}
+	default:
+		t.Error("Nothing was posted to the collector.")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Shutdown()
+	tests := []struct {
+		cfg *Config
+		dir string
+		ok  bool
+	}{
+		{nil, "", true},
+		{&Config{File: "t.json", SampleRate: 2}, t.TempDir(), false},
+		{&Config{File: "t.json"}, "", false},
+		{&Config{Endpoint: "localhost:4318"}, "", false},
+		{&Config{Endpoint: "ftp://localhost"}, "", false},
+		{&Config{Endpoint: "http://localhost:4318/v1/traces"}, "", true},
+	}
+	for i, test := range tests {
+		if err := Configure(test.cfg, test.dir); (err == nil) != test.ok {
+			t.Errorf("%d: Expected ok: %v, Got: %v\n", i, test.ok, err)
+		}
+	}
+	if !Enabled() {
+		t.Error("Tracing is not on.")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	defer Shutdown()
+	dir := t.TempDir()
+	if err := Configure(&Config{File: "first.json", SampleRate: 1}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, s := Start(context.Background(), "first", KIND_INTERNAL)
+	s.End()
+
+	// A bad config is refused, and the tracer that is running is kept.
+	bad := []*Config{
+		{File: "second.json", SampleRate: 2},
+		{Endpoint: "ftp://localhost", SampleRate: 1},
+		{File: filepath.Join("first.json", "nope.json"), SampleRate: 1},
+	}
+	for i, cfg := range bad {
+		if err := Configure(cfg, dir); err == nil {
+			t.Errorf("%d: Bad config was accepted.\n", i)
+		}
+		if !Enabled() {
+			t.Fatalf("%d: Tracing was turned off by a bad config.\n", i)
+		}
+	}
+	_, s = Start(context.Background(), "kept", KIND_INTERNAL)
+	s.End()
+
+	// A good config replaces the tracer, and the old one is shut down
+	// after it has exported its spans.
+	if err := Configure(&Config{File: "second.json", SampleRate: 1}, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	spans := readSpanFile(t, filepath.Join(dir, "first.json"))
+	if len(spans) != 2 || spans["first"] == nil || spans["kept"] == nil {
+		t.Errorf("Wrong spans from the first tracer: %v\n", spans)
+	}
+	_, s = Start(context.Background(), "second", KIND_INTERNAL)
+	s.End()
+	if err := Shutdown(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if spans := readSpanFile(t, filepath.Join(dir, "second.json")); len(spans) != 1 || spans["second"] == nil {
+		t.Errorf("Wrong spans from the second tracer: %v\n", spans)
+	}
+}
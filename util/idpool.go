@@ -1,17 +1,24 @@
 package util
 
-// Simple id pool. Lets you get and release ids.
+// Simple id pool. Lets you get and release ids. It is safe to use
+// from multiple goroutines.
 import (
 	"container/list"
+	"errors"
+	"sync"
 )
 
+var ErrNoIds = errors.New("No ids available.")
+
 type IdPool struct {
-	ids *list.List
+	mutex *sync.Mutex
+	ids   *list.List
 }
 
 // Keeps a pool of integers.
 func NewIdPool(totNum uint32) *IdPool {
 	idPool := &IdPool{}
+	idPool.mutex = &sync.Mutex{}
 	idPool.init(totNum)
 	return idPool
 }
@@ -24,13 +31,28 @@ func (idp *IdPool) init(totNum uint32) {
 	}
 }
 
-func (idp *IdPool) GetId() uint32 {
+// Get an id. Returns ErrNoIds if they are all in use.
+func (idp *IdPool) GetId() (uint32, error) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
 	val := idp.ids.Front()
+	if val == nil {
+		return 0, ErrNoIds
+	}
 	idp.ids.Remove(val)
 	num, _ := val.Value.(uint32)
-	return num
+	return num, nil
 }
 
 func (idp *IdPool) ReleaseId(id uint32) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
 	idp.ids.PushBack(id)
 }
+
+// The number of ids that are available.
+func (idp *IdPool) Available() int {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	return idp.ids.Len()
+}
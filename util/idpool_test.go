@@ -0,0 +1,50 @@
+package util
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIdPool(t *testing.T) {
+	idp := NewIdPool(3)
+	got := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		id, err := idp.GetId()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if id == 0 || got[id] {
+			t.Errorf("Bad id: %d\n", id)
+		}
+		got[id] = true
+	}
+	if _, err := idp.GetId(); err != ErrNoIds {
+		t.Errorf("Expected ErrNoIds from empty pool, got: %v\n", err)
+	}
+	idp.ReleaseId(2)
+	if id, err := idp.GetId(); err != nil || id != 2 {
+		t.Errorf("Expected to get released id 2, got: %d (%v)\n", id, err)
+	}
+}
+
+func TestIdPoolConcurrent(t *testing.T) {
+	idp := NewIdPool(100)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id, err := idp.GetId()
+				if err != nil {
+					continue
+				}
+				idp.ReleaseId(id)
+			}
+		}()
+	}
+	wg.Wait()
+	if idp.Available() != 100 {
+		t.Errorf("Ids lost. Expected 100 available, got: %d\n", idp.Available())
+	}
+}